@@ -0,0 +1,117 @@
+// Command rdbdump saves the contents of a running miniredis (or Redis) server to an RDB file
+// that redis-server can load. It fetches the snapshot with SYNC, like redis-cli --rdb.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6379", "address of the server to dump")
+	output := flag.String("out", "dump.rdb", "path of the RDB file to write")
+	timeout := flag.Duration("timeout", time.Minute, "time allowed for the whole transfer")
+	flag.Parse()
+
+	size, err := dump(*addr, *output, *timeout)
+	if err != nil {
+		log.Fatalf("Dump failed: %v", err)
+	}
+	log.Printf("Wrote %d bytes to %s", size, *output)
+}
+
+func dump(addr string, output string, timeout time.Duration) (int64, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// rdb-only asks for the snapshot alone, without registering as a replica receiving the writes that follow
+	if _, err := conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$8\r\nrdb-only\r\n$1\r\n1\r\n*1\r\n$4\r\nSYNC\r\n")); err != nil {
+		return 0, fmt.Errorf("sending SYNC: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	// Servers predating rdb-only reply with an error, the snapshot still comes first then
+	if _, err := reader.ReadString('\n'); err != nil {
+		return 0, fmt.Errorf("reading REPLCONF reply: %w", err)
+	}
+	size, err := readPayloadLength(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	// Written next to the output and renamed once complete, so a failed transfer never leaves a partial dump
+	tmp, err := os.CreateTemp(filepath.Dir(output), "rdbdump-*.rdb")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.CopyN(tmp, reader, size); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("receiving payload: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := checkSignature(tmp.Name()); err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), output)
+}
+
+// Reads the "$<length>" line announcing the payload. Masters may send empty lines as keepalives
+// while the snapshot is being generated
+func readPayloadLength(reader *bufio.Reader) (int64, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("reading SYNC reply: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			continue
+		case line[0] == '-':
+			return 0, fmt.Errorf("server replied with an error: %s", line[1:])
+		case line[0] != '$':
+			return 0, fmt.Errorf("unexpected SYNC reply %q", line)
+		case strings.HasPrefix(line, "$EOF:"):
+			return 0, fmt.Errorf("diskless payloads are not supported, set repl-diskless-sync to no")
+		}
+
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid payload length %q", line)
+		}
+		return size, nil
+	}
+}
+
+func checkSignature(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 5)
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != "REDIS" {
+		return fmt.Errorf("payload is not an RDB file")
+	}
+	return nil
+}
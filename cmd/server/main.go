@@ -1,18 +1,42 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	_ "net/http/pprof"
+	"os"
+	"path/filepath"
 
 	"github.com/mrtonbrian/miniredis/internal/miniredis"
 )
 
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [/path/to/redis.conf] [--<directive> <value> ...]\n\n", name)
+	fmt.Fprintf(os.Stderr, "Directives are those of redis.conf, and given on the command line they override the file:\n")
+	fmt.Fprintf(os.Stderr, "  %s --port 7000\n", name)
+	fmt.Fprintf(os.Stderr, "  %s /etc/redis/redis.conf --replicaof 127.0.0.1 6379 --save 60 1000\n", name)
+}
+
 func main() {
-	addr := "0.0.0.0:6379"
+	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+		usage()
+		return
+	}
+
+	cfg, err := miniredis.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		usage()
+		os.Exit(1)
+	}
+	miniredis.SetConfig(cfg)
+
+	addr := cfg.ListenAddr()
 	log.Printf("Starting server on %s\n", addr)
 
-	err := miniredis.StartServer(addr)
+	// Returns once shut down by SHUTDOWN, SIGINT or SIGTERM
+	err = miniredis.StartServer(addr)
 	if err != nil {
-		log.Printf("Server Error: %v\n", err)
+		log.Fatalf("Server Error: %v\n", err)
 	}
 }
@@ -0,0 +1,793 @@
+package miniredis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// appendfsync policies
+const (
+	AOF_FSYNC_ALWAYS   = "always"
+	AOF_FSYNC_EVERYSEC = "everysec"
+	AOF_FSYNC_NO       = "no"
+)
+
+// Delay before retrying a failed automatic AOF rewrite
+const AOF_REWRITE_RETRY_DELAY = 5 * time.Second
+
+// State of the append only file. Write commands are encoded into buffer as they are
+// executed, and the buffer is written to the current incremental file before their replies are sent
+type aofState struct {
+	mutex sync.Mutex
+	// Files making up the AOF, nil while it is disabled
+	manifest *aofManifest
+	// Incremental file receiving new writes
+	file   *os.File
+	buffer []byte
+	// Database selected by the commands of the incremental file, -1 until one is selected. Each file is
+	// loaded by a new client, so every file selects a database before its first command
+	selectedDb int
+	// Whether data was written to file since the last fsync
+	fsyncPending bool
+	lastFsync    time.Time
+	// Replication offsets of the last command added to buffer, written to file, and fsynced (for WAITAOF)
+	bufferedOffset int64
+	writtenOffset  int64
+	fsyncedOffset  int64
+
+	// Size of all the AOF files, and that size right after the last rewrite (for auto-aof-rewrite-percentage)
+	currentSize     int64
+	rewriteBaseSize int64
+
+	rewriteInProgress bool
+	lastRewriteErr    error
+	lastRewriteTry    time.Time
+}
+
+var aof = &aofState{}
+
+// Serializes the execution and logging of write commands, so that the AOF and the replicas
+// get them in the same order they were applied to the keyspace. While nothing consumes the
+// writes, commands only share it and writes to different keys run in parallel
+var propagationMutex sync.RWMutex
+
+// Whether write commands are logged to the AOF or streamed to replicas, and so must hold
+// propagationMutex for writing. Only changes with propagationMutex held for writing
+var propagating atomic.Bool
+
+// Whether executed write commands are currently logged
+func aofEnabled() bool {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	return aof.file != nil
+}
+
+// Whether there is an AOF to load, in either the multi-part or the single file layout
+func aofExists() bool {
+	for _, path := range []string{aofManifestPath(), aofLegacyPath()} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the AOF for writing, appending to its last incremental file. Without a manifest, the
+// AOF directory is created from the single file AOF if there is one, and otherwise from the current
+// store contents, so data loaded from an RDB file isn't missing from it
+func openAppendOnlyFile() error {
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		return fmt.Errorf("creating the AOF directory: %w", err)
+	}
+
+	manifest, err := loadAOFManifest()
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		if manifest, err = createAOFManifest(); err != nil {
+			return err
+		}
+	}
+
+	newIncr := len(manifest.incrs) == 0
+	if newIncr {
+		manifest.incrs = append(manifest.incrs, manifest.nextIncrFile())
+	}
+
+	incr := manifest.incrs[len(manifest.incrs)-1]
+	file, err := os.OpenFile(filepath.Join(aofDirPath(), incr.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening append only file: %w", err)
+	}
+
+	if newIncr {
+		if err := persistAOFManifest(manifest); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := deleteAOFHistory(manifest); err != nil {
+		log.Printf("Error deleting old AOF files: %v", err)
+	}
+
+	size, err := aofFilesSize(manifest)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	aof.manifest = manifest
+	aof.file = file
+	aof.selectedDb = -1
+	propagating.Store(true)
+	aof.lastFsync = time.Now()
+	aof.currentSize = size
+	aof.rewriteBaseSize = size
+	return nil
+}
+
+// Creates the manifest of a new AOF directory, with a base file holding either the
+// single file AOF or a snapshot of the store
+func createAOFManifest() (*aofManifest, error) {
+	manifest := &aofManifest{}
+
+	if _, err := os.Stat(aofLegacyPath()); err == nil {
+		base := manifest.nextBaseFile(false)
+		if err := os.Rename(aofLegacyPath(), filepath.Join(aofDirPath(), base.name)); err != nil {
+			return nil, fmt.Errorf("moving %s to the AOF directory: %w", aofLegacyPath(), err)
+		}
+		manifest.base = &base
+		log.Printf("Successfully migrated the old-style AOF file %s into the AOF directory", aofLegacyPath())
+	} else {
+		base := manifest.nextBaseFile(config().AofUseRDBPreamble)
+		propagationMutex.Lock()
+		snapshot := databases.snapshot()
+		propagationMutex.Unlock()
+		if err := writeAOFBase(base, snapshot); err != nil {
+			return nil, err
+		}
+		manifest.base = &base
+	}
+
+	if err := persistAOFManifest(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Writes snapshot to a new base file, as an RDB or as the commands recreating it.
+// The data goes to a temporary file that is renamed into place once complete
+func writeAOFBase(base aofFileInfo, snapshot []map[string]MiniRedisObject) error {
+	tmp, err := os.CreateTemp(aofDirPath(), fmt.Sprintf("temp-rewriteaof-%d-*.aof", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	// No-op once the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	now := serverClock.now()
+	if strings.HasSuffix(base.name, ".rdb") {
+		err = writeRDB(tmp, snapshot, now)
+	} else {
+		var commands []byte
+		if commands, err = catSnapshotCommands(nil, snapshot, now); err == nil {
+			_, err = tmp.Write(commands)
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing AOF base: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing AOF base: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing AOF base: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(aofDirPath(), base.name)); err != nil {
+		return fmt.Errorf("renaming AOF base: %w", err)
+	}
+	return nil
+}
+
+func aofFilesSize(manifest *aofManifest) (int64, error) {
+	var size int64
+	for _, info := range manifest.files() {
+		stat, err := os.Stat(filepath.Join(aofDirPath(), info.name))
+		if err != nil {
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
+// Flushes and fsyncs pending data, then stops logging write commands
+func closeAppendOnlyFile() error {
+	if err := flushAppendOnlyFile(); err != nil {
+		return err
+	}
+
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.file == nil {
+		return nil
+	}
+	err := aof.fsyncLocked()
+	if closeErr := aof.file.Close(); err == nil {
+		err = closeErr
+	}
+	aof.file = nil
+	aof.manifest = nil
+	aof.buffer = nil
+	propagating.Store(replicationBacklogCreated())
+	return err
+}
+
+// Appends a command executed against database db to the AOF buffer, preceded by a SELECT when the file
+// was on another database. offset is the replication offset reached with the command
+func feedAppendOnlyFile(db int, args [][]byte, offset int64) {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.file == nil {
+		return
+	}
+	if db != aof.selectedDb {
+		aof.buffer = catCommand(aof.buffer, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(db))})
+		aof.selectedDb = db
+	}
+	aof.buffer = catCommand(aof.buffer, args)
+	aof.bufferedOffset = offset
+}
+
+// Writes the AOF buffer to file and fsyncs it, whatever the appendfsync policy
+func fsyncAppendOnlyFile() error {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if err := aof.writeBufferLocked(); err != nil {
+		return err
+	}
+	if aof.fsyncPending {
+		return aof.fsyncLocked()
+	}
+	return nil
+}
+
+// Writes the AOF buffer to file. With appendfsync always the data is also fsynced,
+// so it is on disk before the replies of the commands are sent
+func flushAppendOnlyFile() error {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if err := aof.writeBufferLocked(); err != nil {
+		return err
+	}
+	if aof.fsyncPending && config().AppendFsync == AOF_FSYNC_ALWAYS {
+		return aof.fsyncLocked()
+	}
+	return nil
+}
+
+func (a *aofState) writeBufferLocked() error {
+	if a.file == nil || len(a.buffer) == 0 {
+		return nil
+	}
+
+	written, err := a.file.Write(a.buffer)
+	a.currentSize += int64(written)
+	// Whatever couldn't be written stays in the buffer for the next attempt
+	a.buffer = a.buffer[:copy(a.buffer, a.buffer[written:])]
+	if written > 0 {
+		a.fsyncPending = true
+	}
+	if len(a.buffer) == 0 {
+		a.writtenOffset = a.bufferedOffset
+	}
+	if err != nil {
+		return fmt.Errorf("writing append only file: %w", err)
+	}
+	return nil
+}
+
+func (a *aofState) fsyncLocked() error {
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("fsyncing append only file: %w", err)
+	}
+	a.fsyncPending = false
+	a.lastFsync = time.Now()
+	a.fsyncedOffset = a.writtenOffset
+	ackNotifier.notify()
+	return nil
+}
+
+// Replication offset up to which writes are fsynced to the AOF, or -1 while it is disabled
+func aofFsyncedOffset() int64 {
+	// Holding the propagation lock, every write counted in the replication offset also reached the AOF buffer
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.file == nil {
+		return -1
+	}
+	// Nothing waiting for an fsync: whatever followed the last fsynced write (pings, reads) needs none
+	if len(aof.buffer) == 0 && !aof.fsyncPending {
+		return replicationOffset()
+	}
+	return aof.fsyncedOffset
+}
+
+// Called by the server cron: with appendfsync everysec, fsyncs written data once per second
+func fsyncAppendOnlyFileEverysec(now time.Time) {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.file == nil || config().AppendFsync != AOF_FSYNC_EVERYSEC {
+		return
+	}
+	if !aof.fsyncPending || now.Sub(aof.lastFsync) < time.Second {
+		return
+	}
+	if err := aof.fsyncLocked(); err != nil {
+		log.Printf("Error fsyncing the append only file: %v", err)
+	}
+}
+
+// Switches writes to a new incremental file, which is added to the manifest
+func (a *aofState) rotateIncrLocked() error {
+	if err := a.writeBufferLocked(); err != nil {
+		return err
+	}
+
+	manifest := a.manifest.clone()
+	incr := manifest.nextIncrFile()
+	manifest.incrs = append(manifest.incrs, incr)
+
+	path := filepath.Join(aofDirPath(), incr.name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("creating incremental AOF file: %w", err)
+	}
+	if err := persistAOFManifest(manifest); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := a.fsyncLocked(); err != nil {
+		log.Printf("Error fsyncing the previous incremental AOF file: %v", err)
+	}
+	a.file.Close()
+
+	a.file = file
+	a.selectedDb = -1
+	a.manifest = manifest
+	return nil
+}
+
+func handleBgrewriteaof(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("BGREWRITEAOF command takes no arguments")
+	}
+
+	if err := startAOFRewrite(); err != nil {
+		return nil, err
+	}
+	return &SimpleStringReply{data: "Background append only file rewriting started"}, nil
+}
+
+// Starts a rewrite: new writes go to a fresh incremental file while a goroutine writes a snapshot
+// of the store as the new base. Once the base is complete, the manifest drops the previous base and
+// incremental files. A crash at any point leaves the manifest listing a complete set of files
+func startAOFRewrite() error {
+	// With writes blocked, each of them is either in the snapshot or in the new incremental file
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.rewriteInProgress {
+		return fmt.Errorf("Background append only file rewriting already in progress")
+	}
+	aof.lastRewriteTry = time.Now()
+
+	// Sequence number of the first incremental file to keep after the rewrite, 0 to drop all of them
+	var keepIncrSeq int64
+	var manifest *aofManifest
+	if aof.file != nil {
+		if err := aof.rotateIncrLocked(); err != nil {
+			aof.lastRewriteErr = err
+			return fmt.Errorf("Can't start background AOF rewrite: %w", err)
+		}
+		manifest = aof.manifest.clone()
+		keepIncrSeq = manifest.incrSeq
+	} else {
+		// Disabled AOF: only a base file is written
+		if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+			return fmt.Errorf("creating the AOF directory: %w", err)
+		}
+		existing, err := loadAOFManifest()
+		if err != nil {
+			return err
+		}
+		manifest = existing
+		if manifest == nil {
+			manifest = &aofManifest{}
+		}
+	}
+
+	snapshot := databases.snapshot()
+	aof.rewriteInProgress = true
+
+	go func() {
+		err := rewriteAppendOnlyFile(manifest, keepIncrSeq, snapshot)
+		if err != nil {
+			log.Printf("Background AOF rewrite error: %v", err)
+		} else {
+			log.Printf("Background AOF rewrite finished successfully")
+		}
+
+		aof.mutex.Lock()
+		defer aof.mutex.Unlock()
+		aof.rewriteInProgress = false
+		aof.lastRewriteErr = err
+	}()
+
+	return nil
+}
+
+// Writes snapshot as a new base file and installs it in the manifest. The previous base and
+// the incremental files before keepIncrSeq become history and are deleted
+func rewriteAppendOnlyFile(manifest *aofManifest, keepIncrSeq int64, snapshot []map[string]MiniRedisObject) error {
+	base := manifest.nextBaseFile(config().AofUseRDBPreamble)
+	if err := writeAOFBase(base, snapshot); err != nil {
+		return err
+	}
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	// The live manifest may have changed since the rewrite started
+	current := manifest
+	if aof.manifest != nil {
+		current = aof.manifest
+	}
+
+	updated := current.clone()
+	updated.history = append(updated.history, current.files()...)
+	updated.base = &base
+	updated.baseSeq = base.seq
+	updated.incrs = nil
+	for _, incr := range current.incrs {
+		if keepIncrSeq > 0 && incr.seq >= keepIncrSeq {
+			updated.incrs = append(updated.incrs, incr)
+		}
+	}
+	kept := make(map[string]bool)
+	for _, info := range updated.files() {
+		kept[info.name] = true
+	}
+	updated.history = slices.DeleteFunc(updated.history, func(info aofFileInfo) bool { return kept[info.name] })
+
+	if err := persistAOFManifest(updated); err != nil {
+		os.Remove(filepath.Join(aofDirPath(), base.name))
+		return err
+	}
+	if err := deleteAOFHistory(updated); err != nil {
+		log.Printf("Error deleting old AOF files: %v", err)
+	}
+
+	if aof.manifest != nil {
+		aof.manifest = updated
+		size, err := aofFilesSize(updated)
+		if err != nil {
+			return err
+		}
+		// Data buffered but not written yet isn't in the files
+		aof.currentSize = size
+		aof.rewriteBaseSize = size
+	}
+	return nil
+}
+
+// Called by the server cron: starts a rewrite once the AOF grew by auto-aof-rewrite-percentage
+// since the last rewrite, and is larger than auto-aof-rewrite-min-size
+func checkAOFRewrite(now time.Time) {
+	cfg := config()
+	aof.mutex.Lock()
+	shouldRewrite := aof.file != nil && !aof.rewriteInProgress && cfg.AutoAofRewritePercentage > 0 &&
+		aof.currentSize > cfg.AutoAofRewriteMinSize &&
+		(aof.lastRewriteErr == nil || now.Sub(aof.lastRewriteTry) > AOF_REWRITE_RETRY_DELAY)
+
+	var growth int64
+	if shouldRewrite {
+		base := max(aof.rewriteBaseSize, 1)
+		growth = aof.currentSize*100/base - 100
+		shouldRewrite = growth >= cfg.AutoAofRewritePercentage
+	}
+	aof.mutex.Unlock()
+
+	if shouldRewrite {
+		log.Printf("Starting automatic rewriting of AOF on %d%% growth", growth)
+		if err := startAOFRewrite(); err != nil {
+			log.Printf("Can't start automatic AOF rewrite: %v", err)
+		}
+	}
+}
+
+func aofInfo() []infoField {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	rewriteStatus := "ok"
+	if aof.lastRewriteErr != nil {
+		rewriteStatus = "err"
+	}
+
+	fields := []infoField{
+		{"aof_enabled", formatBool(aof.file != nil)},
+		{"aof_rewrite_in_progress", formatBool(aof.rewriteInProgress)},
+		{"aof_last_bgrewrite_status", rewriteStatus},
+	}
+	if aof.file != nil {
+		fields = append(fields,
+			infoField{"aof_current_size", strconv.FormatInt(aof.currentSize, 10)},
+			infoField{"aof_base_size", strconv.FormatInt(aof.rewriteBaseSize, 10)},
+		)
+	}
+	return fields
+}
+
+// Encodes a command as a RESP multibulk request and appends it to buf
+func catCommand(buf []byte, args [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// Appends the commands recreating snapshot to buf: a SELECT before the keys of each database, then a SET per
+// string key, with the expiry as an absolute PXAT, and a RESTORE with an absolute TTL for aggregates, which have
+// no other write command recreating them
+func catSnapshotCommands(buf []byte, snapshot []map[string]MiniRedisObject, now time.Time) ([]byte, error) {
+	for db, entries := range snapshot {
+		if len(entries) == 0 {
+			continue
+		}
+		buf = catCommand(buf, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(db))})
+		var err error
+		if buf, err = catDatabaseCommands(buf, entries, now); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func catDatabaseCommands(buf []byte, entries map[string]MiniRedisObject, now time.Time) ([]byte, error) {
+	for key, obj := range entries {
+		if obj.isExpired(now) {
+			continue
+		}
+
+		var value []byte
+		switch data := obj.data.(type) {
+		case *StringData:
+			value = data.data
+		case *IntegerData:
+			value = []byte(strconv.FormatInt(data.data, 10))
+		default:
+			payload, err := createDumpPayload(obj.data)
+			if err != nil {
+				return nil, err
+			}
+			var expireMillis int64
+			if !obj.expiry.IsZero() {
+				expireMillis = obj.expiry.UnixMilli()
+			}
+			buf = catCommand(buf, [][]byte{[]byte("RESTORE"), []byte(key), []byte(strconv.FormatInt(expireMillis, 10)), payload, []byte("ABSTTL"), []byte("REPLACE")})
+			continue
+		}
+
+		if obj.expiry.IsZero() {
+			buf = catCommand(buf, [][]byte{[]byte("SET"), []byte(key), value})
+		} else {
+			expireMillis := []byte(strconv.FormatInt(obj.expiry.UnixMilli(), 10))
+			buf = catCommand(buf, [][]byte{[]byte("SET"), []byte(key), value, []byte("PXAT"), expireMillis})
+		}
+	}
+	return buf, nil
+}
+
+// Reads a single multibulk request from r, returning its arguments and size in bytes.
+// Returns io.EOF when r ends cleanly before a request, and io.ErrUnexpectedEOF when it ends in the middle of one
+func readMultibulk(r *bufio.Reader) ([][]byte, int64, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	size := int64(len(line))
+	if len(line) < 4 || line[0] != '*' || line[len(line)-2] != '\r' {
+		return nil, 0, fmt.Errorf("expected multibulk header, got %q", line)
+	}
+
+	count, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || count < 1 {
+		return nil, 0, fmt.Errorf("invalid multibulk length %q", line)
+	}
+
+	args := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		size += int64(len(line))
+
+		if len(line) < 4 || line[0] != '$' || line[len(line)-2] != '\r' {
+			return nil, 0, fmt.Errorf("expected bulk header, got %q", line)
+		}
+
+		length, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil || length < 0 {
+			return nil, 0, fmt.Errorf("invalid bulk length %q", line)
+		}
+
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		size += int64(length + 2)
+
+		args = append(args, arg[:length])
+	}
+
+	return args, size, nil
+}
+
+// Loads the AOF into the store: the files listed in the manifest in order, or the single file
+// AOF when there is no manifest yet
+func loadAppendOnlyFile() error {
+	manifest, err := loadAOFManifest()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var paths []string
+	if manifest == nil {
+		if _, err := os.Stat(aofLegacyPath()); err != nil {
+			return nil
+		}
+		paths = []string{aofLegacyPath()}
+	} else {
+		for _, info := range manifest.files() {
+			paths = append(paths, filepath.Join(aofDirPath(), info.name))
+		}
+	}
+
+	loaded := 0
+	for i, path := range paths {
+		n, err := loadAOFFile(path, i == len(paths)-1)
+		if err != nil {
+			return err
+		}
+		loaded += n
+	}
+
+	log.Printf("DB loaded from append only file: %d commands in %.3f seconds", loaded, time.Since(start).Seconds())
+	return nil
+}
+
+// Replays a single AOF file, which may start with an RDB preamble. When it is the last file, a
+// request cut short at the end (crash in the middle of a write) is dropped and the file truncated
+// to the last complete command. Returns the number of commands replayed
+func loadAOFFile(path string, last bool) (int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	loader := newClient(NewRESPWriter(io.Discard, RESP_WRITER_INITIAL_BUF_SIZE))
+	reader := bufio.NewReader(file)
+
+	var validSize int64
+	if magic, _ := reader.Peek(5); string(magic) == "REDIS" {
+		// readRDB reuses reader instead of wrapping it, so the commands after the preamble aren't skipped
+		err := readRDB(reader, loader.now(), func(db int, key string, obj MiniRedisObject) {
+			database(db).Set(&key, &obj)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("loading the RDB preamble of %s: %w", path, err)
+		}
+
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		validSize = offset - int64(reader.Buffered())
+	}
+
+	loaded := 0
+	for {
+		args, size, err := readMultibulk(reader)
+		if err == io.EOF {
+			break
+		}
+
+		if err == io.ErrUnexpectedEOF && last {
+			log.Printf("!!! Warning: short read while loading the AOF file %s !!!", path)
+			log.Printf("AOF loaded anyway, truncating it to %d bytes (last valid command)", validSize)
+			if err := file.Truncate(validSize); err != nil {
+				return 0, fmt.Errorf("truncating %s: %w", path, err)
+			}
+			break
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("bad file format reading the append only file %s at offset %d: %w", path, validSize, err)
+		}
+
+		if err := replayCommand(loader, args); err != nil {
+			return 0, fmt.Errorf("replaying the append only file %s at offset %d: %w", path, validSize, err)
+		}
+
+		validSize += size
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// Executes a command read from the AOF
+func replayCommand(c *client, args [][]byte) error {
+	requestArgs := make([]RESPData, len(args))
+	for i, arg := range args {
+		requestArgs[i] = &RESPBulkString{data: arg, owned: true}
+	}
+
+	cmd, err := ParseCommand(&RESPArray{data: requestArgs})
+	if err != nil {
+		return err
+	}
+
+	if _, err := dispatchCommand(c, &cmd); err != nil {
+		return fmt.Errorf("%s: %w", commandTable[cmd.Type].name, err)
+	}
+	return nil
+}
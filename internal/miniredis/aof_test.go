@@ -0,0 +1,576 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Enables the AOF in a temporary directory for the duration of the test. Returns the path of the incremental file
+func useTempAppendOnlyFile(t *testing.T) string {
+	useTempDataDir(t)
+	updateConfig(t, func(c *Config) { c.AppendOnly = true })
+	if err := openAppendOnlyFile(); err != nil {
+		t.Fatalf("openAppendOnlyFile() error: %v", err)
+	}
+	t.Cleanup(func() {
+		waitForAOFRewrite(t)
+		closeAppendOnlyFile()
+	})
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	return aof.file.Name()
+}
+
+// Waits for the running AOF rewrite to finish and returns its error
+func waitForAOFRewrite(t *testing.T) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		aof.mutex.Lock()
+		inProgress := aof.rewriteInProgress
+		lastErr := aof.lastRewriteErr
+		aof.mutex.Unlock()
+
+		if !inProgress {
+			return lastErr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("AOF rewrite did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Reads the commands of an AOF file without an RDB preamble
+func readAOFCommands(t *testing.T, path string) [][]string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading AOF: %v", err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(content))
+	var commands [][]string
+	for {
+		args, _, err := readMultibulk(reader)
+		if err == io.EOF {
+			return commands
+		}
+		if err != nil {
+			t.Fatalf("readMultibulk() error: %v", err)
+		}
+		command := make([]string, len(args))
+		for i, arg := range args {
+			command[i] = string(arg)
+		}
+		commands = append(commands, command)
+	}
+}
+
+func TestCatCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args [][]byte
+		want string
+	}{
+		{
+			name: "single argument",
+			args: [][]byte{[]byte("PING")},
+			want: "*1\r\n$4\r\nPING\r\n",
+		},
+		{
+			name: "binary and empty arguments",
+			args: [][]byte{[]byte("SET"), []byte("a\r\nb"), {}},
+			want: "*3\r\n$3\r\nSET\r\n$4\r\na\r\nb\r\n$0\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(catCommand(nil, tt.args)); got != tt.want {
+				t.Errorf("catCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatSnapshotCommands(t *testing.T) {
+	now := time.Now()
+	expiry := now.Add(time.Hour).Truncate(time.Millisecond)
+	snapshot := []map[string]MiniRedisObject{2: {
+		"list": {data: &ListData{data: [][]byte{[]byte("a"), []byte("b")}}, expiry: expiry},
+	}}
+
+	buf, err := catSnapshotCommands(nil, snapshot, now)
+	if err != nil {
+		t.Fatalf("catSnapshotCommands() error: %v", err)
+	}
+	reader := bufio.NewReader(bytes.NewReader(buf))
+
+	// Keys follow the SELECT of their database, empty databases are skipped
+	args, _, err := readMultibulk(reader)
+	if err != nil {
+		t.Fatalf("readMultibulk() error: %v", err)
+	}
+	if len(args) != 2 || string(args[0]) != "SELECT" || string(args[1]) != "2" {
+		t.Fatalf("command = %q, want SELECT 2", args)
+	}
+
+	args, _, err = readMultibulk(reader)
+	if err != nil {
+		t.Fatalf("readMultibulk() error: %v", err)
+	}
+
+	// Aggregates are recreated with RESTORE, with an absolute expiry
+	if len(args) != 6 || string(args[0]) != "RESTORE" || string(args[1]) != "list" {
+		t.Fatalf("command = %q, want RESTORE list", args)
+	}
+	if got, want := string(args[2]), strconv.FormatInt(expiry.UnixMilli(), 10); got != want {
+		t.Errorf("TTL = %s, want %s", got, want)
+	}
+	if string(args[4]) != "ABSTTL" || string(args[5]) != "REPLACE" {
+		t.Errorf("options = %q, want ABSTTL REPLACE", args[4:])
+	}
+	if data, err := decodeDumpPayload(args[3]); err != nil {
+		t.Errorf("decodeDumpPayload() error: %v", err)
+	} else if list, ok := data.(*ListData); !ok || len(list.data) != 2 {
+		t.Errorf("restored value = %#v, want the list", data)
+	}
+}
+
+func TestReadMultibulk(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantArgs []string
+		wantSize int64
+		wantErr  error
+		badInput bool
+	}{
+		{
+			name:     "complete request",
+			input:    "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n",
+			wantArgs: []string{"DEL", "k"},
+			wantSize: 20,
+		},
+		{
+			name:    "clean end of file",
+			input:   "",
+			wantErr: io.EOF,
+		},
+		{
+			name:    "truncated header",
+			input:   "*2\r",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "truncated argument",
+			input:   "*2\r\n$3\r\nDEL\r\n$1\r\n",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:     "garbage",
+			input:    "hello\r\n",
+			badInput: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, size, err := readMultibulk(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.badInput {
+				if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+					t.Fatalf("readMultibulk() error = %v, want a format error", err)
+				}
+				return
+			}
+			if err != tt.wantErr {
+				t.Fatalf("readMultibulk() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if size != tt.wantSize {
+				t.Errorf("readMultibulk() size = %d, want %d", size, tt.wantSize)
+			}
+			if len(args) != len(tt.wantArgs) {
+				t.Fatalf("readMultibulk() = %q, want %q", args, tt.wantArgs)
+			}
+			for i := range args {
+				if string(args[i]) != tt.wantArgs[i] {
+					t.Errorf("readMultibulk() arg %d = %q, want %q", i, args[i], tt.wantArgs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAppendOnlyFileLogsWrites(t *testing.T) {
+	path := useTempAppendOnlyFile(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$8\r\naof_key1\r\n$2\r\nv1\r\n",
+		"*2\r\n$3\r\nGET\r\n$8\r\naof_key1\r\n",
+		"*5\r\n$3\r\nSET\r\n$8\r\naof_key2\r\n$2\r\nv2\r\n$2\r\nEX\r\n$3\r\n100\r\n",
+		"*3\r\n$6\r\nEXPIRE\r\n$8\r\naof_key1\r\n$3\r\n100\r\n",
+		// Doesn't change anything, so it isn't logged
+		"*2\r\n$3\r\nDEL\r\n$11\r\naof_missing\r\n",
+	})
+
+	commands := readAOFCommands(t, path)
+	if len(commands) != 4 {
+		t.Fatalf("expected 4 logged commands, got %q", commands)
+	}
+
+	// The file starts by selecting the database of the first write
+	if strings.Join(commands[0], " ") != "SELECT 0" {
+		t.Errorf("unexpected first command %q", commands[0])
+	}
+	commands = commands[1:]
+
+	if strings.Join(commands[0], " ") != "SET aof_key1 v1" {
+		t.Errorf("unexpected first command %q", commands[0])
+	}
+
+	// Relative expiries are logged as absolute unix times
+	checkAbsoluteExpiry := func(command []string, wantName string, wantLen int) {
+		t.Helper()
+		if command[0] != wantName || len(command) != wantLen {
+			t.Errorf("unexpected command %q", command)
+			return
+		}
+		millis, err := strconv.ParseInt(command[len(command)-1], 10, 64)
+		if err != nil {
+			t.Errorf("expiry %q is not an integer", command[len(command)-1])
+			return
+		}
+		if remaining := time.Until(time.UnixMilli(millis)); remaining < 99*time.Second || remaining > 100*time.Second {
+			t.Errorf("expiry %q is %v from now, want about 100s", command[len(command)-1], remaining)
+		}
+	}
+	checkAbsoluteExpiry(commands[1], "SET", 5)
+	if commands[1][3] != "PXAT" {
+		t.Errorf("expected SET EX to be logged with PXAT, got %q", commands[1])
+	}
+	checkAbsoluteExpiry(commands[2], "PEXPIREAT", 3)
+}
+
+func TestAppendOnlyFileLogsExpiredKeys(t *testing.T) {
+	path := useTempAppendOnlyFile(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	expired := MiniRedisObject{data: &StringData{data: []byte("v")}, expiry: time.Now().Add(-time.Second)}
+	for _, key := range []string{"aof_expired1", "aof_expired2"} {
+		database(0).Set(&key, &expired)
+		defer database(0).Delete(&key)
+	}
+
+	// Found expired by a read and by a write that then changes nothing
+	dialAndSend(t, addr, []string{
+		"*2\r\n$3\r\nGET\r\n$12\r\naof_expired1\r\n",
+		"*3\r\n$6\r\nEXPIRE\r\n$12\r\naof_expired2\r\n$3\r\n100\r\n",
+	})
+
+	commands := readAOFCommands(t, path)
+	var logged []string
+	for _, command := range commands {
+		logged = append(logged, strings.Join(command, " "))
+	}
+	if want := []string{"SELECT 0", "DEL aof_expired1", "DEL aof_expired2"}; !slices.Equal(logged, want) {
+		t.Errorf("logged %q, want %q", logged, want)
+	}
+}
+
+func TestLoadAppendOnlyFile(t *testing.T) {
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10)
+	valid := "*3\r\n$3\r\nSET\r\n$9\r\nload_key1\r\n$2\r\nv1\r\n" +
+		"*3\r\n$3\r\nSET\r\n$9\r\nload_key2\r\n$2\r\nv2\r\n" +
+		"*3\r\n$9\r\nPEXPIREAT\r\n$9\r\nload_key2\r\n$" + strconv.Itoa(len(expired)) + "\r\n" + expired + "\r\n"
+
+	tests := []struct {
+		name     string
+		content  string
+		wantErr  bool
+		wantSize int
+	}{
+		{
+			name:     "complete file",
+			content:  valid,
+			wantSize: len(valid),
+		},
+		{
+			name:     "truncated tail is dropped",
+			content:  valid + "*3\r\n$3\r\nSET\r\n$9\r\nload_key3\r\n$2\r\nv",
+			wantSize: len(valid),
+		},
+		{
+			name:    "garbage in the middle",
+			content: "*3\r\n$3\r\nSET\r\n$9\r\nload_key1\r\n$2\r\nv1\r\nGARBAGE\r\n" + valid,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useTempDataDir(t)
+			path := filepath.Join(dir, config().AppendFilename)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("writing AOF: %v", err)
+			}
+			for _, key := range []string{"load_key1", "load_key2", "load_key3"} {
+				database(0).Delete(&key)
+			}
+
+			err := loadAppendOnlyFile()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadAppendOnlyFile() expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadAppendOnlyFile() error: %v", err)
+			}
+
+			if obj, ok := lookupKey(database(0), "load_key1", time.Now()); !ok || string(obj.data.(*StringData).data) != "v1" {
+				t.Errorf("load_key1 not restored")
+			}
+			if _, ok := lookupKey(database(0), "load_key2", time.Now()); ok {
+				t.Errorf("load_key2 should have expired")
+			}
+			if _, ok := lookupKey(database(0), "load_key3", time.Now()); ok {
+				t.Errorf("load_key3 comes from the truncated command and should not exist")
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("stat AOF: %v", err)
+			}
+			if info.Size() != int64(tt.wantSize) {
+				t.Errorf("AOF size = %d, want %d", info.Size(), tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestOpenAppendOnlyFileWritesExistingKeys(t *testing.T) {
+	dir := useTempDataDir(t)
+	key := "aof_existing"
+	database(0).Set(&key, &MiniRedisObject{data: &StringData{data: []byte("before")}})
+	defer database(0).Delete(&key)
+
+	if err := openAppendOnlyFile(); err != nil {
+		t.Fatalf("openAppendOnlyFile() error: %v", err)
+	}
+	if err := closeAppendOnlyFile(); err != nil {
+		t.Fatalf("closeAppendOnlyFile() error: %v", err)
+	}
+
+	database(0).Delete(&key)
+	if err := loadAppendOnlyFile(); err != nil {
+		t.Fatalf("loadAppendOnlyFile() error: %v", err)
+	}
+
+	if obj, ok := lookupKey(database(0), key, time.Now()); !ok || string(obj.data.(*StringData).data) != "before" {
+		t.Errorf("key written before the AOF was enabled is missing from %s", dir)
+	}
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	firstIncr := useTempAppendOnlyFile(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$12\r\nrewrite_key1\r\n$2\r\nv1\r\n",
+		"*3\r\n$3\r\nSET\r\n$12\r\nrewrite_key1\r\n$2\r\nv2\r\n",
+		"*3\r\n$3\r\nSET\r\n$12\r\nrewrite_key2\r\n$2\r\nv1\r\n",
+	})
+
+	replies := dialAndSend(t, addr, []string{"*1\r\n$12\r\nBGREWRITEAOF\r\n"})
+	if len(replies) != 1 || replies[0] != "+Background append only file rewriting started" {
+		t.Fatalf("unexpected BGREWRITEAOF reply %q", replies)
+	}
+	if err := waitForAOFRewrite(t); err != nil {
+		t.Fatalf("AOF rewrite failed: %v", err)
+	}
+
+	// Writes after the rewrite go to the new incremental file
+	dialAndSend(t, addr, []string{"*2\r\n$3\r\nDEL\r\n$12\r\nrewrite_key2\r\n"})
+
+	manifest, err := loadAOFManifest()
+	if err != nil || manifest == nil {
+		t.Fatalf("loadAOFManifest() = %v, %v", manifest, err)
+	}
+	if manifest.base.name != "appendonly.aof.2.base.rdb" || len(manifest.incrs) != 1 || manifest.incrs[0].name != "appendonly.aof.2.incr.aof" {
+		t.Fatalf("unexpected manifest after the rewrite:\n%s", manifest.encode())
+	}
+	if len(manifest.history) != 0 {
+		t.Errorf("history files left in the manifest:\n%s", manifest.encode())
+	}
+
+	for _, old := range []string{firstIncr, filepath.Join(aofDirPath(), "appendonly.aof.1.base.rdb")} {
+		if _, err := os.Stat(old); !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted after the rewrite", old)
+		}
+	}
+
+	// Each incremental file selects its database before the first command
+	commands := readAOFCommands(t, filepath.Join(aofDirPath(), manifest.incrs[0].name))
+	if len(commands) != 2 || strings.Join(commands[0], " ") != "SELECT 0" || strings.Join(commands[1], " ") != "DEL rewrite_key2" {
+		t.Errorf("unexpected commands in the new incremental file %q", commands)
+	}
+
+	if err := closeAppendOnlyFile(); err != nil {
+		t.Fatalf("closeAppendOnlyFile() error: %v", err)
+	}
+	for _, key := range []string{"rewrite_key1", "rewrite_key2"} {
+		database(0).Delete(&key)
+	}
+	if err := loadAppendOnlyFile(); err != nil {
+		t.Fatalf("loadAppendOnlyFile() error: %v", err)
+	}
+
+	if obj, ok := lookupKey(database(0), "rewrite_key1", time.Now()); !ok || string(obj.data.(*StringData).data) != "v2" {
+		t.Errorf("rewrite_key1 not restored from the base file")
+	}
+	if _, ok := lookupKey(database(0), "rewrite_key2", time.Now()); ok {
+		t.Errorf("rewrite_key2 was deleted after the rewrite and should not exist")
+	}
+}
+
+func TestLoadMultiPartAppendOnlyFile(t *testing.T) {
+	useTempDataDir(t)
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Base written with commands only, followed by an incremental file with an RDB preamble
+	// and one with a truncated tail, as left by a crash after a rewrite rotated the incremental file
+	key := "multipart_key1"
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, []map[string]MiniRedisObject{{key: {data: &StringData{data: []byte("from_rdb")}}}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"appendonly.aof.1.base.aof": "*3\r\n$3\r\nSET\r\n$14\r\nmultipart_key2\r\n$4\r\nbase\r\n",
+		"appendonly.aof.1.incr.aof": rdb.String() + "*3\r\n$3\r\nSET\r\n$14\r\nmultipart_key3\r\n$5\r\nincr1\r\n",
+		"appendonly.aof.2.incr.aof": "*3\r\n$3\r\nSET\r\n$14\r\nmultipart_key2\r\n$5\r\nincr2\r\n*2\r\n$3\r\nDEL\r\n$1",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(aofDirPath(), name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := "file appendonly.aof.1.base.aof seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+	if err := os.WriteFile(aofManifestPath(), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"multipart_key1", "multipart_key2", "multipart_key3"} {
+		database(0).Delete(&key)
+	}
+	if err := loadAppendOnlyFile(); err != nil {
+		t.Fatalf("loadAppendOnlyFile() error: %v", err)
+	}
+
+	want := map[string]string{"multipart_key1": "from_rdb", "multipart_key2": "incr2", "multipart_key3": "incr1"}
+	for key, value := range want {
+		if obj, ok := lookupKey(database(0), key, time.Now()); !ok || string(obj.data.(*StringData).data) != value {
+			t.Errorf("%s not restored to %q", key, value)
+		}
+	}
+
+	// Only the last file may be truncated
+	if err := os.WriteFile(filepath.Join(aofDirPath(), "appendonly.aof.1.incr.aof"), []byte("*3\r\n$3\r\nSET\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadAppendOnlyFile(); err == nil {
+		t.Errorf("expected an error loading a truncated file that isn't the last one")
+	}
+}
+
+func TestLegacyAppendOnlyFileUpgrade(t *testing.T) {
+	dir := useTempDataDir(t)
+	legacy := "*3\r\n$3\r\nSET\r\n$10\r\nlegacy_key\r\n$5\r\nvalue\r\n"
+	if err := os.WriteFile(filepath.Join(dir, config().AppendFilename), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := openAppendOnlyFile(); err != nil {
+		t.Fatalf("openAppendOnlyFile() error: %v", err)
+	}
+	defer closeAppendOnlyFile()
+
+	if _, err := os.Stat(filepath.Join(dir, config().AppendFilename)); !os.IsNotExist(err) {
+		t.Errorf("the single file AOF should have been moved into the AOF directory")
+	}
+
+	manifest, err := loadAOFManifest()
+	if err != nil || manifest == nil {
+		t.Fatalf("loadAOFManifest() = %v, %v", manifest, err)
+	}
+	if manifest.base.name != "appendonly.aof.1.base.aof" || len(manifest.incrs) != 1 {
+		t.Fatalf("unexpected manifest after the upgrade:\n%s", manifest.encode())
+	}
+
+	content, err := os.ReadFile(filepath.Join(aofDirPath(), manifest.base.name))
+	if err != nil || string(content) != legacy {
+		t.Errorf("base file = %q, %v, want the single file AOF", content, err)
+	}
+}
+
+func TestAutoAOFRewrite(t *testing.T) {
+	useTempAppendOnlyFile(t)
+	updateConfig(t, func(c *Config) {
+		c.AutoAofRewritePercentage = 100
+		c.AutoAofRewriteMinSize = 1
+	})
+
+	aof.mutex.Lock()
+	baseSize := aof.rewriteBaseSize
+	aof.mutex.Unlock()
+
+	now := time.Now()
+	checkAOFRewrite(now)
+	if err := waitForAOFRewrite(t); err != nil {
+		t.Fatalf("AOF rewrite failed: %v", err)
+	}
+	if manifest, _ := loadAOFManifest(); manifest.baseSeq != 1 {
+		t.Fatalf("rewrite started before the AOF grew")
+	}
+
+	// Grow the AOF past twice its size after the last rewrite
+	key := "auto_rewrite_key"
+	value := bytes.Repeat([]byte("x"), int(baseSize)+1)
+	feedAppendOnlyFile(0, [][]byte{[]byte("SET"), []byte(key), value}, 0)
+	if err := flushAppendOnlyFile(); err != nil {
+		t.Fatalf("flushAppendOnlyFile() error: %v", err)
+	}
+
+	checkAOFRewrite(now)
+	if err := waitForAOFRewrite(t); err != nil {
+		t.Fatalf("AOF rewrite failed: %v", err)
+	}
+	if manifest, _ := loadAOFManifest(); manifest.baseSeq != 2 {
+		t.Errorf("expected an automatic rewrite once the AOF doubled in size")
+	}
+}
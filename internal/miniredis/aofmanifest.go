@@ -0,0 +1,242 @@
+package miniredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Types of the files listed in the AOF manifest
+const (
+	AOF_FILE_TYPE_BASE = 'b'
+	// Files made obsolete by a rewrite, deleted as soon as possible
+	AOF_FILE_TYPE_HIST = 'h'
+	AOF_FILE_TYPE_INCR = 'i'
+)
+
+type aofFileInfo struct {
+	name     string
+	seq      int64
+	fileType byte
+}
+
+// The set of files making up the AOF, in the Redis 7 multi-part layout: a base file holding a
+// snapshot (RDB or RESP commands) followed by the incremental files with the commands executed since.
+// The manifest is the only file replaced atomically, so whatever it lists is always loadable
+type aofManifest struct {
+	base    *aofFileInfo
+	incrs   []aofFileInfo
+	history []aofFileInfo
+	// Last sequence numbers handed out for base and incremental files
+	baseSeq int64
+	incrSeq int64
+}
+
+func aofDirPath() string {
+	cfg := config()
+	return filepath.Join(cfg.Dir, cfg.AppendDirname)
+}
+
+func aofManifestPath() string {
+	cfg := config()
+	return filepath.Join(cfg.Dir, cfg.AppendDirname, cfg.AppendFilename+".manifest")
+}
+
+// Path of a single file AOF, as written before the multi-part layout
+func aofLegacyPath() string {
+	cfg := config()
+	return filepath.Join(cfg.Dir, cfg.AppendFilename)
+}
+
+func (m *aofManifest) clone() *aofManifest {
+	c := *m
+	if m.base != nil {
+		base := *m.base
+		c.base = &base
+	}
+	c.incrs = append([]aofFileInfo(nil), m.incrs...)
+	c.history = append([]aofFileInfo(nil), m.history...)
+	return &c
+}
+
+func (m *aofManifest) nextBaseFile(rdb bool) aofFileInfo {
+	m.baseSeq++
+	extension := "aof"
+	if rdb {
+		extension = "rdb"
+	}
+	return aofFileInfo{
+		name:     fmt.Sprintf("%s.%d.base.%s", config().AppendFilename, m.baseSeq, extension),
+		seq:      m.baseSeq,
+		fileType: AOF_FILE_TYPE_BASE,
+	}
+}
+
+func (m *aofManifest) nextIncrFile() aofFileInfo {
+	m.incrSeq++
+	return aofFileInfo{
+		name:     fmt.Sprintf("%s.%d.incr.aof", config().AppendFilename, m.incrSeq),
+		seq:      m.incrSeq,
+		fileType: AOF_FILE_TYPE_INCR,
+	}
+}
+
+// Files to load, in order
+func (m *aofManifest) files() []aofFileInfo {
+	var files []aofFileInfo
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// Encodes the manifest as lines of "file <name> seq <seq> type <type>"
+func (m *aofManifest) encode() []byte {
+	var buf []byte
+	for _, list := range [][]aofFileInfo{m.history, m.files()} {
+		for _, info := range list {
+			buf = fmt.Appendf(buf, "file %s seq %d type %c\n", info.name, info.seq, info.fileType)
+		}
+	}
+	return buf
+}
+
+func parseAOFManifest(r io.Reader) (*aofManifest, error) {
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %q", lineNumber, line)
+		}
+
+		var info aofFileInfo
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil || seq < 1 {
+					return nil, fmt.Errorf("invalid sequence number on AOF manifest line %d", lineNumber)
+				}
+				info.seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, fmt.Errorf("invalid file type on AOF manifest line %d", lineNumber)
+				}
+				info.fileType = fields[i+1][0]
+			}
+		}
+
+		// Names are joined to the AOF directory, so they must not point outside of it
+		if info.name == "" || info.seq == 0 || strings.ContainsAny(info.name, "/\\") {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %q", lineNumber, line)
+		}
+
+		switch info.fileType {
+		case AOF_FILE_TYPE_BASE:
+			if m.base != nil {
+				return nil, fmt.Errorf("found duplicate base file information in the AOF manifest")
+			}
+			m.base = &info
+			m.baseSeq = info.seq
+		case AOF_FILE_TYPE_HIST:
+			m.history = append(m.history, info)
+		case AOF_FILE_TYPE_INCR:
+			if info.seq <= m.incrSeq {
+				return nil, fmt.Errorf("found a non-monotonic sequence number in the AOF manifest")
+			}
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = info.seq
+		default:
+			return nil, fmt.Errorf("unknown AOF file type on AOF manifest line %d", lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, fmt.Errorf("found an empty AOF manifest")
+	}
+	return m, nil
+}
+
+// Reads the manifest from the AOF directory. Returns nil without error when there is none
+func loadAOFManifest() (*aofManifest, error) {
+	file, err := os.Open(aofManifestPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	m, err := parseAOFManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", aofManifestPath(), err)
+	}
+	return m, nil
+}
+
+// Atomically replaces the manifest on disk with m
+func persistAOFManifest(m *aofManifest) error {
+	tmp, err := os.CreateTemp(aofDirPath(), "temp-manifest-*")
+	if err != nil {
+		return fmt.Errorf("creating temp manifest: %w", err)
+	}
+	// No-op once the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(m.encode()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing manifest: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing manifest: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), aofManifestPath()); err != nil {
+		return fmt.Errorf("renaming manifest: %w", err)
+	}
+	return fsyncDir(aofDirPath())
+}
+
+// Deletes the files of a previous rewrite, then drops them from the manifest
+func deleteAOFHistory(m *aofManifest) error {
+	if len(m.history) == 0 {
+		return nil
+	}
+	for _, info := range m.history {
+		if err := os.Remove(filepath.Join(aofDirPath(), info.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("deleting history file %s: %w", info.name, err)
+		}
+	}
+	m.history = nil
+	return persistAOFManifest(m)
+}
+
+// Makes renames in dir durable
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
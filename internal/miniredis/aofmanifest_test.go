@@ -0,0 +1,122 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAOFManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantErr   bool
+		wantBase  string
+		wantIncrs []string
+		wantHist  int
+	}{
+		{
+			name: "base and incremental files",
+			input: "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+				"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+				"file appendonly.aof.4.incr.aof seq 4 type i\n",
+			wantBase:  "appendonly.aof.2.base.rdb",
+			wantIncrs: []string{"appendonly.aof.3.incr.aof", "appendonly.aof.4.incr.aof"},
+		},
+		{
+			name: "history files and fields in any order",
+			input: "file appendonly.aof.1.base.rdb seq 1 type h\n" +
+				"type b seq 2 file appendonly.aof.2.base.rdb\n" +
+				"\n" +
+				"file appendonly.aof.2.incr.aof seq 2 type i\n",
+			wantBase:  "appendonly.aof.2.base.rdb",
+			wantIncrs: []string{"appendonly.aof.2.incr.aof"},
+			wantHist:  1,
+		},
+		{
+			name:    "empty manifest",
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name: "duplicate base",
+			input: "file a.1.base.rdb seq 1 type b\n" +
+				"file a.2.base.rdb seq 2 type b\n",
+			wantErr: true,
+		},
+		{
+			name: "non-monotonic incremental files",
+			input: "file a.2.incr.aof seq 2 type i\n" +
+				"file a.1.incr.aof seq 1 type i\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			input:   "file a.1.incr.aof seq 1 type x\n",
+			wantErr: true,
+		},
+		{
+			name:    "path outside of the directory",
+			input:   "file ../a.1.incr.aof seq 1 type i\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing sequence",
+			input:   "file a.1.incr.aof type i\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseAOFManifest(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAOFManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if m.base == nil || m.base.name != tt.wantBase {
+				t.Errorf("base = %v, want %q", m.base, tt.wantBase)
+			}
+			if len(m.incrs) != len(tt.wantIncrs) {
+				t.Fatalf("incrs = %v, want %q", m.incrs, tt.wantIncrs)
+			}
+			for i, incr := range m.incrs {
+				if incr.name != tt.wantIncrs[i] {
+					t.Errorf("incr %d = %q, want %q", i, incr.name, tt.wantIncrs[i])
+				}
+			}
+			if len(m.history) != tt.wantHist {
+				t.Errorf("history = %v, want %d files", m.history, tt.wantHist)
+			}
+
+			// Encoding and parsing again gives the same manifest
+			again, err := parseAOFManifest(strings.NewReader(string(m.encode())))
+			if err != nil {
+				t.Fatalf("parsing the encoded manifest: %v", err)
+			}
+			if string(again.encode()) != string(m.encode()) {
+				t.Errorf("round trip changed the manifest:\n%s\nvs\n%s", again.encode(), m.encode())
+			}
+		})
+	}
+}
+
+func TestAOFManifestSequences(t *testing.T) {
+	useTempDataDir(t)
+	m := &aofManifest{baseSeq: 1, incrSeq: 4}
+
+	if base := m.nextBaseFile(true); base.name != "appendonly.aof.2.base.rdb" || base.fileType != AOF_FILE_TYPE_BASE {
+		t.Errorf("nextBaseFile(true) = %+v", base)
+	}
+	if base := m.nextBaseFile(false); base.name != "appendonly.aof.3.base.aof" {
+		t.Errorf("nextBaseFile(false) = %+v", base)
+	}
+	if incr := m.nextIncrFile(); incr.name != "appendonly.aof.5.incr.aof" || incr.seq != 5 || incr.fileType != AOF_FILE_TYPE_INCR {
+		t.Errorf("nextIncrFile() = %+v", incr)
+	}
+}
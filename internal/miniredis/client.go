@@ -0,0 +1,147 @@
+package miniredis
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Per-connection state shared by the handlers
+type client struct {
+	id     int64
+	name   string
+	conn   net.Conn
+	writer *RESPWriter
+	// Embedded server the client is connected to, nil for the server started with StartServer
+	server *Server
+	// Clock of the server the client is connected to
+	clock *clock
+	// Database selected with SELECT
+	db int
+	// Close the connection once the pending replies are sent
+	closeAfterReply bool
+	// Set while the client is served by an epoll event loop, which holds the databases when it owns them
+	servedByLoop bool
+
+	// Changes made to the keyspace by the command being executed. Write commands that
+	// didn't change anything (SET NX on an existing key, DEL of missing keys) aren't propagated
+	dirty int64
+	// When set, the command being executed is propagated as these arguments instead of the
+	// ones the client sent, e.g. with relative expiries turned into absolute ones
+	propagateArgs [][]byte
+	// Keys the command being executed deleted because they expired, propagated as DELs
+	expiredKeys []string
+	// Replication offset reached with the last write of the client, which WAIT and WAITAOF wait for
+	woff int64
+
+	// Set by ASKING for the next command, see clusterRedirect
+	asking bool
+
+	// Set on the client applying the stream received from our master, whose writes are always accepted
+	master bool
+	// Replication settings sent with REPLCONF before PSYNC or SYNC
+	replListeningPort int
+	rdbOnly           bool
+	// Set once the client became a replica, after which the connection is served by serveReplica
+	replica *replica
+}
+
+var nextClientID atomic.Int64
+
+func newClient(writer *RESPWriter) *client {
+	return &client{
+		id:     nextClientID.Add(1),
+		writer: writer,
+		clock:  serverClock,
+	}
+}
+
+// Databases of the server the client is connected to
+func (c *client) databases() *databaseSet {
+	if c.server != nil {
+		return c.server.databases
+	}
+	return databases
+}
+
+// Current time of the server the client is connected to, which tests can move (see clock).
+// Expiries are checked against it
+func (c *client) now() time.Time {
+	return c.clock.now()
+}
+
+// Whether the command being executed holds the databases of the server started with StartServer, which
+// it does when an event loop owns them unless it is a blocking command (see executeCommands)
+func (c *client) holdsKeyspace() bool {
+	return c.server == nil && keyspaceOwner.owned.Load()
+}
+
+// Keys of the database selected by the client
+func (c *client) keyspace() *ShardedMap[MiniRedisObject] {
+	return c.databases().get(c.db)
+}
+
+// Protocol version negotiated by the client (RESP2 until HELLO 3 is sent)
+func (c *client) protocol() int {
+	return c.writer.protocol
+}
+
+// Looks up key in the selected database for a command reading it, which counts in the keyspace
+// hits and misses of INFO
+func (c *client) lookupKeyRead(key string) (MiniRedisObject, bool) {
+	db, now := c.keyspace(), c.now()
+	obj, exists := db.Get(&key)
+	if exists && obj.isExpired(now) {
+		obj, exists = MiniRedisObject{}, false
+		if c.deleteExpired(db, key, now) && c.server == nil {
+			stats.expiredKeys.Add(1)
+		}
+	}
+	if c.server == nil {
+		if exists {
+			stats.keyspaceHits.Add(1)
+		} else {
+			stats.keyspaceMisses.Add(1)
+		}
+	}
+	return obj, exists
+}
+
+// Deletes key, which a command reading it found expired at now, and reports whether it did. Reads
+// don't hold propagationMutex, so it is taken for the DEL to be propagated in order with the writes.
+// Keys stay while a shutdown pauses the writes, like Redis doesn't expire keys during a pause
+func (c *client) deleteExpired(db *ShardedMap[MiniRedisObject], key string, now time.Time) bool {
+	if c.server != nil {
+		return deleteIfExpired(db, key, now)
+	}
+
+	shared, resume, stopping := lockPropagation(false)
+	defer unlockPropagation(shared)
+	if resume != nil || stopping {
+		return false
+	}
+	deleted := deleteIfExpired(db, key, now)
+	if deleted && !shared {
+		propagateExpired(c, []string{key})
+	}
+	return deleted
+}
+
+// Records key, which the write command being executed found expired and so deleted
+func (c *client) addExpired(key string) {
+	if c.server == nil {
+		stats.expiredKeys.Add(1)
+		c.expiredKeys = append(c.expiredKeys, key)
+	}
+}
+
+// Records changes made by the command being executed
+func (c *client) addDirty(changes int64) {
+	c.dirty += changes
+	addDirty(changes)
+}
+
+// Propagates the command being executed as args (command name included)
+func (c *client) rewritePropagated(args ...[]byte) {
+	c.propagateArgs = args
+}
@@ -0,0 +1,48 @@
+package miniredis
+
+import (
+	"sync"
+	"time"
+)
+
+// Time the expiries of a server are checked against: the system time moved forward by offset,
+// or fixedTime once set. Tests move it with FastForward and SetTime instead of sleeping
+type clock struct {
+	mutex     sync.Mutex
+	offset    time.Duration
+	fixedTime time.Time
+}
+
+// Clock of the server started with StartServer
+var serverClock = &clock{}
+
+func (c *clock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.fixedTime.IsZero() {
+		return c.fixedTime
+	}
+	return time.Now().Add(c.offset)
+}
+
+// Moves the clock forward by d
+func (c *clock) fastForward(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.fixedTime.IsZero() {
+		c.offset += d
+	} else {
+		c.fixedTime = c.fixedTime.Add(d)
+	}
+}
+
+// Stops the clock at t, after which it only moves with fastForward. The zero time makes it follow
+// the system time again
+func (c *clock) setTime(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.fixedTime = t
+	if t.IsZero() {
+		c.offset = 0
+	}
+}
@@ -0,0 +1,759 @@
+package miniredis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of hash slots the keyspace of a cluster is divided into
+const CLUSTER_SLOTS = 16384
+
+// Offset between the client port and the cluster bus port when cluster-port isn't set
+const CLUSTER_PORT_INCR = 10000
+
+// A node of the cluster, as known by this instance
+type clusterNode struct {
+	// 40 characters hexadecimal ID, random for a node that didn't complete its handshake yet
+	id      string
+	ip      string
+	port    int
+	busPort int
+	myself  bool
+	// Met with CLUSTER MEET or learned from gossip, but it didn't answer a ping yet
+	handshake bool
+	// No pong received within cluster-node-timeout
+	pfail bool
+	// Version of the slots the node claims: claims with a greater epoch win
+	configEpoch uint64
+
+	created      time.Time
+	pingSent     time.Time
+	pongReceived time.Time
+	// Outgoing bus connection, nil while disconnected
+	link       *clusterLink
+	connecting bool
+}
+
+// Cluster configuration of this node. Slot ownership comes from the nodes' own claims, spread by
+// the gossip bus (see clusterbus.go), with configEpoch settling conflicting claims
+type clusterState struct {
+	mutex        sync.RWMutex
+	myself       *clusterNode
+	currentEpoch uint64
+	nodes        map[string]*clusterNode
+	slots        [CLUSTER_SLOTS]*clusterNode
+	// Number of non nil entries in slots. The cluster is up once every slot is assigned
+	assigned int
+	// Slots moving to or from another node, see handleClusterSetSlot
+	migratingTo   [CLUSTER_SLOTS]*clusterNode
+	importingFrom [CLUSTER_SLOTS]*clusterNode
+	keys          *slotIndex
+	// The configuration changed and cluster-config-file needs to be rewritten
+	todoSave bool
+
+	listener net.Listener
+	inbound  map[*clusterLink]struct{}
+	// Set by stopCluster, after which no link is opened
+	closed bool
+}
+
+// Set by initCluster when cluster mode is enabled
+var cluster *clusterState
+
+// Slot of a key: the CRC16 of the key, or of the part between the first { and the next } when it isn't
+// empty (hash tag), so related keys can be put in the same slot
+func keyHashSlot(key []byte) int {
+	start := bytes.IndexByte(key, '{')
+	if start >= 0 {
+		if length := bytes.IndexByte(key[start+1:], '}'); length > 0 {
+			key = key[start+1 : start+1+length]
+		}
+	}
+	return int(crc16(key) & (CLUSTER_SLOTS - 1))
+}
+
+// Loads the cluster configuration from cluster-config-file, or creates a new node when it doesn't
+// exist. port is the client port of this instance
+func initCluster(port int) error {
+	cs := &clusterState{nodes: map[string]*clusterNode{}, inbound: map[*clusterLink]struct{}{}, keys: &slotIndex{}}
+	if err := cs.loadConfig(); err != nil {
+		return fmt.Errorf("loading the cluster configuration: %w", err)
+	}
+	if cs.myself == nil {
+		cs.myself = &clusterNode{id: newReplicationID(), myself: true, created: time.Now()}
+		cs.nodes[cs.myself.id] = cs.myself
+		log.Printf("No cluster configuration found, I'm %s", cs.myself.id)
+	}
+
+	cs.myself.port = port
+	cs.myself.busPort = config().ClusterPort
+	if cs.myself.busPort == 0 {
+		cs.myself.busPort = port + CLUSTER_PORT_INCR
+	}
+	if err := cs.saveConfigLocked(); err != nil {
+		return fmt.Errorf("saving the cluster configuration: %w", err)
+	}
+
+	database(0).Watch(cs.keys.update)
+	cluster = cs
+	return nil
+}
+
+// Changes the owner of a slot, nil to unassign it
+func (cs *clusterState) setSlotLocked(slot int, node *clusterNode) {
+	if cs.slots[slot] == nil && node != nil {
+		cs.assigned++
+	} else if cs.slots[slot] != nil && node == nil {
+		cs.assigned--
+	}
+	cs.slots[slot] = node
+	cs.todoSave = true
+}
+
+func (cs *clusterState) stateOKLocked() bool {
+	return cs.assigned == CLUSTER_SLOTS
+}
+
+// Checks that this node serves the keys of a command, returning the error to reply with otherwise:
+// CROSSSLOT when they are in different slots, MOVED when another node serves them, ASK or TRYAGAIN
+// while their slot is being migrated, or CLUSTERDOWN
+func clusterRedirect(c *client, cmd *RESPCommand) error {
+	// The flag set by ASKING only applies to the next command
+	asking := c.asking || commandTable[cmd.Type].flags&cmdAsking != 0
+	if cmd.Type != ASKING {
+		c.asking = false
+	}
+
+	keys := commandKeys(cmd)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return newRedisError(ErrPrefixCrossSlot, "Keys in request don't hash to the same slot")
+		}
+	}
+
+	cluster.mutex.RLock()
+	defer cluster.mutex.RUnlock()
+
+	if !cluster.stateOKLocked() {
+		return newRedisError(ErrPrefixClusterDown, "The cluster is down")
+	}
+	owner := cluster.slots[slot]
+	if owner == nil {
+		return newRedisError(ErrPrefixClusterDown, "Hash slot not served")
+	}
+	migrating := owner == cluster.myself && cluster.migratingTo[slot] != nil
+	importing := cluster.importingFrom[slot] != nil
+	if !migrating && !importing {
+		if owner != cluster.myself {
+			return newRedisError(ErrPrefixMoved, "%d %s:%d", slot, owner.ip, owner.port)
+		}
+		return nil
+	}
+
+	// MIGRATE moves the keys of the slot, whichever are still here
+	if cmd.Type == MIGRATE {
+		return nil
+	}
+	// Expired keys are left for the command to delete, which propagates the deletion
+	missing := 0
+	now := c.now()
+	for _, key := range keys {
+		name := string(key)
+		if obj, ok := c.keyspace().Get(&name); !ok || obj.isExpired(now) {
+			missing++
+		}
+	}
+	if migrating && missing > 0 {
+		// Keys already moved, or new keys, are served by the target
+		target := cluster.migratingTo[slot]
+		return newRedisError(ErrPrefixAsk, "%d %s:%d", slot, target.ip, target.port)
+	}
+	if importing && asking {
+		// Some keys are still on the source: the command can't run on either node for now
+		if len(keys) > 1 && missing > 0 {
+			return newRedisError(ErrPrefixTryAgain, "Multiple keys request during rehashing of slot")
+		}
+		return nil
+	}
+	if owner != cluster.myself {
+		return newRedisError(ErrPrefixMoved, "%d %s:%d", slot, owner.ip, owner.port)
+	}
+	return nil
+}
+
+var errClusterDisabled = fmt.Errorf("This instance has cluster support disabled")
+var errInvalidSlot = fmt.Errorf("Invalid or out of range slot")
+
+func parseSlot(arg *RESPData) (int, error) {
+	slot, err := ExtractInt64(arg)
+	if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return 0, errInvalidSlot
+	}
+	return int(slot), nil
+}
+
+// CLUSTER <subcommand> [<arg> ...]
+func handleCluster(args []RESPData) (MiniRedisData, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("CLUSTER command requires a subcommand")
+	}
+	if !config().ClusterEnabled || cluster == nil {
+		return nil, errClusterDisabled
+	}
+
+	subcommand, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid subcommand: %w", err)
+	}
+	args = args[1:]
+
+	switch strings.ToUpper(subcommand) {
+	case "INFO":
+		return &StringData{data: []byte(cluster.info())}, nil
+	case "MYID":
+		cluster.mutex.RLock()
+		defer cluster.mutex.RUnlock()
+		return &StringData{data: []byte(cluster.myself.id)}, nil
+	case "NODES":
+		cluster.mutex.RLock()
+		defer cluster.mutex.RUnlock()
+		return &VerbatimStringReply{format: "txt", data: []byte(cluster.nodesDescriptionLocked(false))}, nil
+	case "SLOTS":
+		return cluster.slotsReply(), nil
+	case "SHARDS":
+		return cluster.shardsReply(), nil
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("CLUSTER KEYSLOT requires exactly 1 argument")
+		}
+		key, err := ExtractByteSlice(&args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		return &IntegerData{data: int64(keyHashSlot(key))}, nil
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("CLUSTER COUNTKEYSINSLOT requires exactly 1 argument")
+		}
+		slot, err := parseSlot(&args[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid slot")
+		}
+		return &IntegerData{data: int64(cluster.keys.count(slot))}, nil
+	case "GETKEYSINSLOT":
+		return handleClusterGetKeysInSlot(args)
+	case "MEET":
+		return handleClusterMeet(args)
+	case "ADDSLOTS", "DELSLOTS", "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		return handleClusterSlots(args, strings.ToUpper(subcommand))
+	case "SETSLOT":
+		return handleClusterSetSlot(args)
+	case "SET-CONFIG-EPOCH":
+		return handleClusterSetConfigEpoch(args)
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try CLUSTER HELP.", subcommand)
+	}
+}
+
+// CLUSTER GETKEYSINSLOT slot count
+func handleClusterGetKeysInSlot(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("CLUSTER GETKEYSINSLOT requires exactly 2 arguments")
+	}
+	slot, err := parseSlot(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid slot")
+	}
+	count, err := ExtractInt64(&args[1])
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Invalid number of keys")
+	}
+
+	keys := cluster.keys.keysInSlot(slot, int(count))
+	reply := make([]MiniRedisData, len(keys))
+	for i, key := range keys {
+		reply[i] = &StringData{data: []byte(key)}
+	}
+	return &ArrayReply{data: reply}, nil
+}
+
+// CLUSTER MEET ip port [cluster-bus-port]: starts a handshake with another node, after which
+// the two nodes gossip about the rest of the cluster
+func handleClusterMeet(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("CLUSTER MEET requires 2 or 3 arguments")
+	}
+	ip, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip: %w", err)
+	}
+	portArg, _ := ExtractString(&args[1])
+	port, err := ExtractInt64(&args[1])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid base port specified: %s", portArg)
+	}
+	busPort := port + CLUSTER_PORT_INCR
+	if len(args) == 3 {
+		busPortArg, _ := ExtractString(&args[2])
+		busPort, err = ExtractInt64(&args[2])
+		if err != nil || busPort < 0 || busPort > 65535 {
+			return nil, fmt.Errorf("Invalid bus port specified: %s", busPortArg)
+		}
+	}
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("Invalid node address specified: %s:%s", ip, portArg)
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	cluster.startHandshakeLocked(ip, int(port), int(busPort))
+	return okReply, nil
+}
+
+// CLUSTER ADDSLOTS slot [slot ...] and DELSLOTS, or ADDSLOTSRANGE start end [start end ...] and
+// DELSLOTSRANGE. Nothing changes unless every slot is valid
+func handleClusterSlots(args []RESPData, subcommand string) (MiniRedisData, error) {
+	add := strings.HasPrefix(subcommand, "ADD")
+	ranges := strings.HasSuffix(subcommand, "RANGE")
+	if len(args) == 0 || (ranges && len(args)%2 != 0) {
+		return nil, fmt.Errorf("wrong number of arguments for CLUSTER %s", subcommand)
+	}
+
+	var slots []int
+	for i := 0; i < len(args); i++ {
+		start, err := parseSlot(&args[i])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if ranges {
+			i++
+			if end, err = parseSlot(&args[i]); err != nil {
+				return nil, err
+			}
+			if start > end {
+				return nil, fmt.Errorf("start slot number %d is greater than end slot number %d", start, end)
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if seen[slot] {
+			return nil, fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+		if add && cluster.slots[slot] != nil {
+			return nil, fmt.Errorf("Slot %d is already busy", slot)
+		}
+		if !add && cluster.slots[slot] == nil {
+			return nil, fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+	}
+
+	owner := cluster.myself
+	if !add {
+		owner = nil
+	}
+	for _, slot := range slots {
+		cluster.setSlotLocked(slot, owner)
+	}
+	cluster.saveConfigOrLogLocked()
+	return okReply, nil
+}
+
+// CLUSTER SET-CONFIG-EPOCH epoch: gives a new cluster distinct epochs, so slot claims never collide
+func handleClusterSetConfigEpoch(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("CLUSTER SET-CONFIG-EPOCH requires exactly 1 argument")
+	}
+	epoch, err := ExtractInt64(&args[0])
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if epoch < 0 {
+		return nil, fmt.Errorf("Invalid config epoch specified: %d", epoch)
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	if len(cluster.nodes) > 1 {
+		return nil, fmt.Errorf("The user can assign a config epoch only when the node does not know any other node.")
+	}
+	if cluster.myself.configEpoch != 0 {
+		return nil, fmt.Errorf("Node config epoch is already non-zero")
+	}
+	cluster.myself.configEpoch = uint64(epoch)
+	cluster.currentEpoch = max(cluster.currentEpoch, uint64(epoch))
+	cluster.saveConfigOrLogLocked()
+	return okReply, nil
+}
+
+func (cs *clusterState) info() string {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	state := "fail"
+	if cs.stateOKLocked() {
+		state = "ok"
+	}
+	var pfail int
+	size := map[*clusterNode]bool{}
+	for _, node := range cs.slots {
+		if node == nil {
+			continue
+		}
+		size[node] = true
+		if node.pfail {
+			pfail++
+		}
+	}
+
+	fields := []infoField{
+		{name: "cluster_state", value: state},
+		{name: "cluster_slots_assigned", value: strconv.Itoa(cs.assigned)},
+		{name: "cluster_slots_ok", value: strconv.Itoa(cs.assigned - pfail)},
+		{name: "cluster_slots_pfail", value: strconv.Itoa(pfail)},
+		{name: "cluster_slots_fail", value: "0"},
+		{name: "cluster_known_nodes", value: strconv.Itoa(len(cs.nodes))},
+		{name: "cluster_size", value: strconv.Itoa(len(size))},
+		{name: "cluster_current_epoch", value: strconv.FormatUint(cs.currentEpoch, 10)},
+		{name: "cluster_my_epoch", value: strconv.FormatUint(cs.myself.configEpoch, 10)},
+	}
+	var builder strings.Builder
+	for _, field := range fields {
+		fmt.Fprintf(&builder, "%s:%s\r\n", field.name, field.value)
+	}
+	return builder.String()
+}
+
+// Mode reported by HELLO
+func serverMode() string {
+	if config().ClusterEnabled {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+func clusterInfo(*client) []infoField {
+	return []infoField{{name: "cluster_enabled", value: formatBool(config().ClusterEnabled)}}
+}
+
+// Contiguous slots served by the same node
+type slotRange struct {
+	start, end int
+	node       *clusterNode
+}
+
+func (cs *clusterState) slotRangesLocked() []slotRange {
+	var ranges []slotRange
+	for slot, node := range cs.slots {
+		if node == nil {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].node == node && ranges[n-1].end == slot-1 {
+			ranges[n-1].end = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{start: slot, end: slot, node: node})
+	}
+	return ranges
+}
+
+// Nodes sorted by ID, for stable CLUSTER NODES and SHARDS replies
+func (cs *clusterState) sortedNodesLocked() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cs.nodes))
+	for _, node := range cs.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+func (n *clusterNode) flags() string {
+	var flags []string
+	if n.myself {
+		flags = append(flags, "myself")
+	}
+	if !n.handshake {
+		flags = append(flags, "master")
+	}
+	if n.pfail {
+		flags = append(flags, "fail?")
+	}
+	if n.handshake {
+		flags = append(flags, "handshake")
+	}
+	return strings.Join(flags, ",")
+}
+
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// One line per node, in the format of CLUSTER NODES and of cluster-config-file:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func (cs *clusterState) nodesDescriptionLocked(forConfig bool) string {
+	slots := map[*clusterNode][]string{}
+	for _, r := range cs.slotRangesLocked() {
+		description := strconv.Itoa(r.start)
+		if r.end != r.start {
+			description += "-" + strconv.Itoa(r.end)
+		}
+		slots[r.node] = append(slots[r.node], description)
+	}
+
+	var builder strings.Builder
+	for _, node := range cs.sortedNodesLocked() {
+		if forConfig && node.handshake {
+			continue
+		}
+		linkState := "disconnected"
+		if node.myself || node.link != nil {
+			linkState = "connected"
+		}
+		fmt.Fprintf(&builder, "%s %s:%d@%d %s - %d %d %d %s", node.id, node.ip, node.port, node.busPort, node.flags(),
+			unixMillis(node.pingSent), unixMillis(node.pongReceived), node.configEpoch, linkState)
+		for _, description := range slots[node] {
+			builder.WriteString(" " + description)
+		}
+		if node.myself {
+			for _, description := range cs.migrationsDescriptionLocked() {
+				builder.WriteString(" " + description)
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// CLUSTER SLOTS: [start, end, [ip, port, id, metadata]] for each range of slots
+func (cs *clusterState) slotsReply() MiniRedisData {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	var reply []MiniRedisData
+	for _, r := range cs.slotRangesLocked() {
+		reply = append(reply, &ArrayReply{data: []MiniRedisData{
+			&IntegerData{data: int64(r.start)},
+			&IntegerData{data: int64(r.end)},
+			&ArrayReply{data: []MiniRedisData{
+				&StringData{data: []byte(r.node.ip)},
+				&IntegerData{data: int64(r.node.port)},
+				&StringData{data: []byte(r.node.id)},
+				&MapReply{data: []MiniRedisData{}},
+			}},
+		}})
+	}
+	return &ArrayReply{data: reply}
+}
+
+// CLUSTER SHARDS: the slot ranges and nodes of each shard. Every node is a master of its own shard
+func (cs *clusterState) shardsReply() MiniRedisData {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	ranges := map[*clusterNode][]MiniRedisData{}
+	for _, r := range cs.slotRangesLocked() {
+		ranges[r.node] = append(ranges[r.node], &IntegerData{data: int64(r.start)}, &IntegerData{data: int64(r.end)})
+	}
+
+	var reply []MiniRedisData
+	for _, node := range cs.sortedNodesLocked() {
+		if node.handshake {
+			continue
+		}
+		health := "online"
+		if node.pfail {
+			health = "fail"
+		}
+		reply = append(reply, &MapReply{data: []MiniRedisData{
+			&StringData{data: []byte("slots")}, &ArrayReply{data: ranges[node]},
+			&StringData{data: []byte("nodes")}, &ArrayReply{data: []MiniRedisData{&MapReply{data: []MiniRedisData{
+				&StringData{data: []byte("id")}, &StringData{data: []byte(node.id)},
+				&StringData{data: []byte("port")}, &IntegerData{data: int64(node.port)},
+				&StringData{data: []byte("ip")}, &StringData{data: []byte(node.ip)},
+				&StringData{data: []byte("endpoint")}, &StringData{data: []byte(node.ip)},
+				&StringData{data: []byte("role")}, &StringData{data: []byte("master")},
+				&StringData{data: []byte("replication-offset")}, &IntegerData{data: 0},
+				&StringData{data: []byte("health")}, &StringData{data: []byte(health)},
+			}}}},
+		}})
+	}
+	return &ArrayReply{data: reply}
+}
+
+func clusterConfigPath() string {
+	cfg := config()
+	if filepath.IsAbs(cfg.ClusterConfigFile) {
+		return cfg.ClusterConfigFile
+	}
+	return filepath.Join(cfg.Dir, cfg.ClusterConfigFile)
+}
+
+// Writes the nodes, their slots and the current epoch to cluster-config-file, through a temporary
+// file renamed over the old one
+func (cs *clusterState) saveConfigLocked() error {
+	content := cs.nodesDescriptionLocked(true) + fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", cs.currentEpoch)
+
+	path := clusterConfigPath()
+	tmp, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf("temp-%d-*.conf", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	cs.todoSave = false
+	return nil
+}
+
+func (cs *clusterState) saveConfigOrLogLocked() {
+	if err := cs.saveConfigLocked(); err != nil {
+		log.Printf("Error saving the cluster configuration: %v", err)
+	}
+}
+
+// Reads cluster-config-file, as written by saveConfigLocked. A missing file leaves the state empty
+func (cs *clusterState) loadConfig() error {
+	file, err := os.Open(clusterConfigPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Migrations name nodes that may come later in the file
+	var migrations []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					cs.currentEpoch, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("unrecoverable error: corrupted cluster config file %q", scanner.Text())
+		}
+
+		node, err := parseNodeLine(fields)
+		if err != nil {
+			return err
+		}
+		cs.nodes[node.id] = node
+		if node.myself {
+			cs.myself = node
+		}
+		for _, description := range fields[8:] {
+			if strings.HasPrefix(description, "[") {
+				migrations = append(migrations, description)
+				continue
+			}
+			startArg, endArg, isRange := strings.Cut(description, "-")
+			if !isRange {
+				endArg = startArg
+			}
+			start, err1 := strconv.Atoi(startArg)
+			end, err2 := strconv.Atoi(endArg)
+			if err1 != nil || err2 != nil || start < 0 || end >= CLUSTER_SLOTS || start > end {
+				return fmt.Errorf("invalid slot range %q", description)
+			}
+			for slot := start; slot <= end; slot++ {
+				cs.setSlotLocked(slot, node)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(cs.nodes) > 0 && cs.myself == nil {
+		return fmt.Errorf("myself node not found in the cluster config file")
+	}
+
+	for _, description := range migrations {
+		slot, importing, nodeID, err := parseMigration(description)
+		if err != nil {
+			return err
+		}
+		node := cs.nodes[nodeID]
+		if node == nil {
+			return fmt.Errorf("migration %q names an unknown node", description)
+		}
+		if importing {
+			cs.importingFrom[slot] = node
+		} else {
+			cs.migratingTo[slot] = node
+		}
+	}
+	return nil
+}
+
+func parseNodeLine(fields []string) (*clusterNode, error) {
+	address, busPortArg, ok := strings.Cut(fields[1], "@")
+	// Redis appends the hostname after the bus port
+	busPortArg, _, _ = strings.Cut(busPortArg, ",")
+	ip, portArg, err := net.SplitHostPort(address)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("invalid node address %q", fields[1])
+	}
+	port, err1 := strconv.Atoi(portArg)
+	busPort, err2 := strconv.Atoi(busPortArg)
+	configEpoch, err3 := strconv.ParseUint(fields[6], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("invalid node line %q", strings.Join(fields, " "))
+	}
+
+	node := &clusterNode{id: fields[0], ip: ip, port: port, busPort: busPort, configEpoch: configEpoch, created: time.Now()}
+	for _, flag := range strings.Split(fields[2], ",") {
+		if flag == "myself" {
+			node.myself = true
+		}
+	}
+	return node, nil
+}
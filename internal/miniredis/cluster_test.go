@@ -0,0 +1,405 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Enables cluster mode with a new node whose bus listens on a random port, for the duration of the test
+func useClusterMode(t *testing.T) {
+	useTempDataDir(t)
+	updateConfig(t, func(c *Config) {
+		c.ClusterEnabled = true
+		c.ClusterNodeTimeout = 2 * time.Second
+	})
+	if err := initCluster(6379); err != nil {
+		t.Fatalf("initCluster() error: %v", err)
+	}
+	if err := startClusterBus("127.0.0.1:0"); err != nil {
+		t.Fatalf("startClusterBus() error: %v", err)
+	}
+	t.Cleanup(stopCluster)
+}
+
+// Sends a command with respClient and checks the error it replies with
+func expectCallError(t *testing.T, client *respClient, want string, args ...string) {
+	t.Helper()
+	request := make([][]byte, len(args))
+	for i, arg := range args {
+		request[i] = []byte(arg)
+	}
+	if _, err := client.call(request...); err == nil || err.Error() != want {
+		t.Errorf("%s error = %v, want %q", strings.Join(args, " "), err, want)
+	}
+}
+
+// Waits for cond to hold on the cluster state
+func waitForCluster(t *testing.T, what string, cond func(cs *clusterState) bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cluster.mutex.RLock()
+		ok := cond(cluster)
+		cluster.mutex.RUnlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{key: "123456789", want: 0x31c3},
+		{key: "somekey", want: 11058},
+		{key: "foo", want: 12182},
+		{key: "foo{hash_tag}", want: 2515},
+		// Only the part between the braces is hashed
+		{key: "{foo}bar", want: 12182},
+		{key: "x{foo}y{z}", want: 12182},
+		// Empty hash tags hash the whole key
+		{key: "foo{}{bar}", want: int(crc16([]byte("foo{}{bar}")) & 0x3fff)},
+		{key: "foo{{bar}}zap", want: int(crc16([]byte("{bar")) & 0x3fff)},
+		{key: "foo{bar", want: int(crc16([]byte("foo{bar")) & 0x3fff)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := keyHashSlot([]byte(tt.key)); got != tt.want {
+				t.Errorf("keyHashSlot(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterDisabled(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	lines := dialAndSend(t, addr, []string{"*2\r\n$7\r\nCLUSTER\r\n$4\r\nINFO\r\n"})
+	if len(lines) != 1 || lines[0] != "-ERR This instance has cluster support disabled" {
+		t.Errorf("CLUSTER INFO = %q, want the cluster support disabled error", lines)
+	}
+}
+
+func TestClusterRedirection(t *testing.T) {
+	useClusterMode(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	keys := []string{"bar", "{bar}2"}
+	for _, key := range keys {
+		key := key
+		defer database(0).Delete(&key)
+	}
+
+	client, err := dialRESP(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer client.Close()
+
+	expectError := func(want string, args ...string) {
+		t.Helper()
+		expectCallError(t, client, want, args...)
+	}
+
+	expectError("CLUSTERDOWN The cluster is down", "GET", "bar")
+	callCommand(t, client, "CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+	expectError("ERR Slot 5 is already busy", "CLUSTER", "ADDSLOTS", "5")
+	expectError("ERR Invalid or out of range slot", "CLUSTER", "ADDSLOTS", "16384")
+
+	// Slot 12182 ("foo") belongs to another node
+	cluster.mutex.Lock()
+	other := &clusterNode{id: strings.Repeat("f", 40), ip: "127.0.0.1", port: 7001, busPort: 17001, configEpoch: 1}
+	cluster.nodes[other.id] = other
+	cluster.setSlotLocked(12182, other)
+	cluster.mutex.Unlock()
+
+	expectError("MOVED 12182 127.0.0.1:7001", "GET", "foo")
+	expectError("MOVED 12182 127.0.0.1:7001", "SET", "{foo}bar", "v")
+	expectError("CROSSSLOT Keys in request don't hash to the same slot", "DEL", "bar", "foo")
+
+	callCommand(t, client, "SET", "bar", "v")
+	callCommand(t, client, "SET", "{bar}2", "v")
+	if reply, ok := callCommand(t, client, "DEL", "bar", "{bar}2").(*RESPInteger); !ok || reply.data != 2 {
+		t.Errorf("DEL of keys in the same slot = %#v, want 2", reply)
+	}
+	callCommand(t, client, "SET", "bar", "v")
+
+	integerTests := []struct {
+		args []string
+		want int64
+	}{
+		{args: []string{"CLUSTER", "KEYSLOT", "bar"}, want: 5061},
+		{args: []string{"CLUSTER", "COUNTKEYSINSLOT", "5061"}, want: 1},
+		{args: []string{"CLUSTER", "COUNTKEYSINSLOT", "12182"}, want: 0},
+	}
+	for _, tt := range integerTests {
+		if reply, ok := callCommand(t, client, tt.args...).(*RESPInteger); !ok || reply.data != tt.want {
+			t.Errorf("%s = %#v, want %d", strings.Join(tt.args, " "), reply, tt.want)
+		}
+	}
+
+	if reply, ok := callCommand(t, client, "CLUSTER", "GETKEYSINSLOT", "5061", "10").(*RESPArray); !ok || len(reply.data) != 1 {
+		t.Errorf("CLUSTER GETKEYSINSLOT 5061 10 = %#v, want [bar]", reply)
+	}
+
+	info, ok := callCommand(t, client, "CLUSTER", "INFO").(*RESPBulkString)
+	if !ok || !strings.Contains(string(info.data), "cluster_state:ok\r\n") || !strings.Contains(string(info.data), "cluster_known_nodes:2\r\n") {
+		t.Errorf("CLUSTER INFO = %#v, want cluster_state:ok and 2 known nodes", info)
+	}
+
+	slots, ok := callCommand(t, client, "CLUSTER", "SLOTS").(*RESPArray)
+	if !ok || len(slots.data) != 3 {
+		t.Fatalf("CLUSTER SLOTS = %#v, want 3 ranges", slots)
+	}
+	if r, ok := slots.data[1].(*RESPArray); !ok || r.data[0].(*RESPInteger).data != 12182 || r.data[1].(*RESPInteger).data != 12182 {
+		t.Errorf("second CLUSTER SLOTS range = %#v, want 12182-12182", slots.data[1])
+	}
+
+	nodes, ok := callCommand(t, client, "CLUSTER", "NODES").(*RESPBulkString)
+	if !ok {
+		t.Fatalf("CLUSTER NODES = %#v, want a bulk string", nodes)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(nodes.data)), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == other.id:
+			if fields[2] != "master" || strings.Join(fields[8:], " ") != "12182" {
+				t.Errorf("CLUSTER NODES line %q, want a master serving 12182", line)
+			}
+		case fields[2] == "myself,master":
+			if strings.Join(fields[8:], " ") != "0-12181 12183-16383" {
+				t.Errorf("CLUSTER NODES line %q, want myself serving 0-12181 12183-16383", line)
+			}
+		default:
+			t.Errorf("unexpected CLUSTER NODES line %q", line)
+		}
+	}
+
+	// The configuration survives a restart
+	cluster.mutex.Lock()
+	myID := cluster.myself.id
+	cluster.saveConfigOrLogLocked()
+	cluster.mutex.Unlock()
+	stopCluster()
+	if err := initCluster(6379); err != nil {
+		t.Fatalf("initCluster() error: %v", err)
+	}
+	cluster.mutex.RLock()
+	defer cluster.mutex.RUnlock()
+	if cluster.myself.id != myID || cluster.slots[12182] == nil || cluster.slots[12182].id != other.id || !cluster.stateOKLocked() {
+		t.Errorf("reloaded cluster configuration lost nodes or slots")
+	}
+}
+
+// Sends a cluster bus message and reads the reply
+func exchangeBusMessage(t *testing.T, conn net.Conn, reader *bufio.Reader, m *clusterMessage) *clusterMessage {
+	t.Helper()
+	if _, err := conn.Write(m.encode()); err != nil {
+		t.Fatalf("writing bus message: %v", err)
+	}
+	args, _, err := readMultibulk(reader)
+	if err != nil {
+		t.Fatalf("reading bus message: %v", err)
+	}
+	reply, err := decodeClusterMessage(args)
+	if err != nil {
+		t.Fatalf("decodeClusterMessage() error: %v", err)
+	}
+	return reply
+}
+
+func TestClusterBus(t *testing.T) {
+	useClusterMode(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	cluster.mutex.RLock()
+	myID := cluster.myself.id
+	busAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(cluster.myself.busPort))
+	cluster.mutex.RUnlock()
+
+	// A node met with CLUSTER MEET: it gets a MEET on connection, and its PONG completes the handshake
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer peer.Close()
+	peerBusPort := peer.Addr().(*net.TCPAddr).Port
+	peerID := strings.Repeat("a", 40)
+
+	lines := dialAndSend(t, addr, []string{
+		"*5\r\n$7\r\nCLUSTER\r\n$4\r\nMEET\r\n$9\r\n127.0.0.1\r\n$4\r\n7002\r\n$" +
+			strconv.Itoa(len(strconv.Itoa(peerBusPort))) + "\r\n" + strconv.Itoa(peerBusPort) + "\r\n",
+	})
+	if len(lines) != 1 || lines[0] != "+OK" {
+		t.Fatalf("CLUSTER MEET = %q, want +OK", lines)
+	}
+
+	conn, err := peer.Accept()
+	if err != nil {
+		t.Fatalf("accepting the bus connection: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	args, _, err := readMultibulk(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("reading MEET: %v", err)
+	}
+	meet, err := decodeClusterMessage(args)
+	if err != nil || meet.kind != clusterMsgMeet || meet.sender != myID {
+		t.Fatalf("first bus message = %+v, %v, want a MEET from %s", meet, err, myID)
+	}
+
+	pong := &clusterMessage{kind: clusterMsgPong, sender: peerID, ip: "127.0.0.1", port: 7002, busPort: peerBusPort,
+		currentEpoch: 1, configEpoch: 1, slots: make([]byte, CLUSTER_SLOTS/8)}
+	pong.slots[0] = 0xff // slots 0-7
+	if _, err := conn.Write(pong.encode()); err != nil {
+		t.Fatalf("writing PONG: %v", err)
+	}
+	waitForCluster(t, "the handshake to complete", func(cs *clusterState) bool {
+		node := cs.nodes[peerID]
+		return node != nil && !node.handshake && cs.slots[7] == node && cs.currentEpoch == 1
+	})
+
+	// A node joining on its own with a MEET gets a PONG, with gossip about the node met above
+	inbound, err := net.Dial("tcp", busAddr)
+	if err != nil {
+		t.Fatalf("dialing the bus: %v", err)
+	}
+	defer inbound.Close()
+	inbound.SetDeadline(time.Now().Add(2 * time.Second))
+	joinerID := strings.Repeat("b", 40)
+	reply := exchangeBusMessage(t, inbound, bufio.NewReader(inbound), &clusterMessage{kind: clusterMsgMeet, sender: joinerID,
+		port: 7003, busPort: 17003, slots: make([]byte, CLUSTER_SLOTS/8)})
+	if reply.kind != clusterMsgPong || reply.sender != myID {
+		t.Errorf("reply to MEET = %+v, want a PONG from %s", reply, myID)
+	}
+	if len(reply.gossip) != 1 || reply.gossip[0].id != peerID || reply.gossip[0].busPort != peerBusPort {
+		t.Errorf("gossip = %+v, want the node %s", reply.gossip, peerID)
+	}
+	waitForCluster(t, "the joining node", func(cs *clusterState) bool {
+		node := cs.nodes[joinerID]
+		return node != nil && node.ip == "127.0.0.1" && node.port == 7003 && cs.myself.ip == "127.0.0.1"
+	})
+}
+
+func TestClusterSlotMigration(t *testing.T) {
+	useClusterMode(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	keys := []string{"{m}1", "{m}2", "{i}1"}
+	for _, key := range keys {
+		key := key
+		defer database(0).Delete(&key)
+	}
+
+	client, err := dialRESP(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer client.Close()
+
+	targetAddr, received := startMigrateTarget(t, "")
+	targetHost, targetPortArg, _ := net.SplitHostPort(targetAddr)
+	targetPort, _ := strconv.Atoi(targetPortArg)
+
+	callCommand(t, client, "CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+	cluster.mutex.Lock()
+	myID := cluster.myself.id
+	target := &clusterNode{id: strings.Repeat("1", 40), ip: targetHost, port: targetPort}
+	source := &clusterNode{id: strings.Repeat("2", 40), ip: "127.0.0.1", port: 7010}
+	cluster.nodes[target.id] = target
+	cluster.nodes[source.id] = source
+	// Slot of "{i}" is owned by source, to be imported
+	importSlot := keyHashSlot([]byte("i"))
+	cluster.setSlotLocked(importSlot, source)
+	cluster.mutex.Unlock()
+
+	slotCount := func(slot int) int64 {
+		t.Helper()
+		reply, ok := callCommand(t, client, "CLUSTER", "COUNTKEYSINSLOT", strconv.Itoa(slot)).(*RESPInteger)
+		if !ok {
+			t.Fatalf("CLUSTER COUNTKEYSINSLOT reply = %#v, want an integer", reply)
+		}
+		return reply.data
+	}
+
+	// Migrating: keys still here are served, the others are redirected to the target with ASK
+	slot := keyHashSlot([]byte("m"))
+	slotArg := strconv.Itoa(slot)
+	callCommand(t, client, "SET", "{m}1", "v1")
+	callCommand(t, client, "SET", "{m}2", "v2")
+	expectCallError(t, client, "ERR I don't know about node "+strings.Repeat("9", 40), "CLUSTER", "SETSLOT", slotArg, "MIGRATING", strings.Repeat("9", 40))
+	callCommand(t, client, "CLUSTER", "SETSLOT", slotArg, "MIGRATING", target.id)
+
+	nodes := callCommand(t, client, "CLUSTER", "NODES").(*RESPBulkString)
+	if want := "[" + slotArg + "->-" + target.id + "]"; !strings.Contains(string(nodes.data), want) {
+		t.Errorf("CLUSTER NODES = %q, want it to contain %s", nodes.data, want)
+	}
+
+	callCommand(t, client, "GET", "{m}1")
+	ask := "ASK " + slotArg + " " + targetAddr
+	expectCallError(t, client, ask, "GET", "{m}missing")
+	expectCallError(t, client, ask, "DEL", "{m}1", "{m}missing")
+	if got := slotCount(slot); got != 2 {
+		t.Errorf("keys in the migrating slot = %d, want 2", got)
+	}
+	if reply := callCommand(t, client, "CLUSTER", "GETKEYSINSLOT", slotArg, "10").(*RESPArray); len(reply.data) != 2 {
+		t.Errorf("CLUSTER GETKEYSINSLOT = %#v, want 2 keys", reply.data)
+	}
+
+	expectCallError(t, client, "ERR Can't assign hashslot "+slotArg+" to a different node while I still hold keys for this hash slot.",
+		"CLUSTER", "SETSLOT", slotArg, "NODE", target.id)
+	callCommand(t, client, "MIGRATE", targetHost, targetPortArg, "", "0", "1000", "KEYS", "{m}1", "{m}2")
+	for i := 0; i < 2; i++ {
+		if args := <-received; string(args[0]) != "RESTORE-ASKING" {
+			t.Errorf("command sent by MIGRATE = %q, want RESTORE-ASKING", args[0])
+		}
+	}
+	if got := slotCount(slot); got != 0 {
+		t.Errorf("keys in the migrated slot = %d, want 0", got)
+	}
+	expectCallError(t, client, ask, "GET", "{m}1")
+
+	callCommand(t, client, "CLUSTER", "SETSLOT", slotArg, "NODE", target.id)
+	expectCallError(t, client, "MOVED "+slotArg+" "+targetAddr, "GET", "{m}1")
+
+	// Importing: only commands sent after ASKING are served until the slot is assigned to this node
+	importArg := strconv.Itoa(importSlot)
+	expectCallError(t, client, "ERR I'm already the owner of hash slot 0", "CLUSTER", "SETSLOT", "0", "IMPORTING", source.id)
+	callCommand(t, client, "CLUSTER", "SETSLOT", importArg, "IMPORTING", source.id)
+	moved := "MOVED " + importArg + " 127.0.0.1:7010"
+	expectCallError(t, client, moved, "SET", "{i}1", "v")
+	callCommand(t, client, "ASKING")
+	callCommand(t, client, "SET", "{i}1", "v")
+	expectCallError(t, client, moved, "GET", "{i}1")
+	callCommand(t, client, "ASKING")
+	expectCallError(t, client, "TRYAGAIN Multiple keys request during rehashing of slot", "DEL", "{i}1", "{i}2")
+
+	callCommand(t, client, "CLUSTER", "SETSLOT", importArg, "NODE", myID)
+	if reply := callCommand(t, client, "GET", "{i}1").(*RESPBulkString); string(reply.data) != "v" {
+		t.Errorf("GET of an imported key = %q, want v", reply.data)
+	}
+	cluster.mutex.RLock()
+	defer cluster.mutex.RUnlock()
+	if cluster.myself.configEpoch == 0 || cluster.importingFrom[importSlot] != nil {
+		t.Errorf("importing the slot didn't bump the config epoch or clear the import")
+	}
+}
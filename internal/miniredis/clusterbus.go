@@ -0,0 +1,502 @@
+package miniredis
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Interval between the pings sent to each node on the cluster bus
+const CLUSTER_PING_INTERVAL = time.Second
+
+// Message types of the cluster bus. Nodes answer PING and MEET with a PONG, and a MEET from an
+// unknown node makes it part of the cluster
+const (
+	clusterMsgPing = "PING"
+	clusterMsgPong = "PONG"
+	clusterMsgMeet = "MEET"
+)
+
+// A message of the cluster bus, sent as a multibulk request:
+// <type> <id> <ip> <port> <bus port> <current epoch> <config epoch> <slots bitmap> [<id> <ip> <port> <bus port> ...]
+// The sender describes itself and the slots it claims, followed by gossip about the other nodes it knows
+type clusterMessage struct {
+	kind         string
+	sender       string
+	ip           string
+	port         int
+	busPort      int
+	currentEpoch uint64
+	configEpoch  uint64
+	// Bit n (bit n%8 of byte n/8) is set when the sender serves slot n
+	slots  []byte
+	gossip []clusterGossip
+}
+
+type clusterGossip struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+}
+
+const clusterMessageHeaderArgs = 8
+
+func (m *clusterMessage) encode() []byte {
+	args := [][]byte{
+		[]byte(m.kind), []byte(m.sender), []byte(m.ip),
+		[]byte(strconv.Itoa(m.port)), []byte(strconv.Itoa(m.busPort)),
+		[]byte(strconv.FormatUint(m.currentEpoch, 10)), []byte(strconv.FormatUint(m.configEpoch, 10)),
+		m.slots,
+	}
+	for _, g := range m.gossip {
+		args = append(args, []byte(g.id), []byte(g.ip), []byte(strconv.Itoa(g.port)), []byte(strconv.Itoa(g.busPort)))
+	}
+	return catCommand(nil, args)
+}
+
+func decodeClusterMessage(args [][]byte) (*clusterMessage, error) {
+	if len(args) < clusterMessageHeaderArgs || (len(args)-clusterMessageHeaderArgs)%4 != 0 {
+		return nil, fmt.Errorf("invalid cluster bus message with %d arguments", len(args))
+	}
+
+	var err error
+	parseInt := func(arg []byte) int {
+		n, parseErr := strconv.Atoi(string(arg))
+		if parseErr != nil {
+			err = parseErr
+		}
+		return n
+	}
+	parseUint := func(arg []byte) uint64 {
+		n, parseErr := strconv.ParseUint(string(arg), 10, 64)
+		if parseErr != nil {
+			err = parseErr
+		}
+		return n
+	}
+
+	m := &clusterMessage{
+		kind:         string(args[0]),
+		sender:       string(args[1]),
+		ip:           string(args[2]),
+		port:         parseInt(args[3]),
+		busPort:      parseInt(args[4]),
+		currentEpoch: parseUint(args[5]),
+		configEpoch:  parseUint(args[6]),
+		slots:        args[7],
+	}
+	for i := clusterMessageHeaderArgs; i < len(args); i += 4 {
+		m.gossip = append(m.gossip, clusterGossip{
+			id:      string(args[i]),
+			ip:      string(args[i+1]),
+			port:    parseInt(args[i+2]),
+			busPort: parseInt(args[i+3]),
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster bus message: %w", err)
+	}
+	if len(m.slots) != CLUSTER_SLOTS/8 {
+		return nil, fmt.Errorf("invalid slots bitmap of %d bytes", len(m.slots))
+	}
+	return m, nil
+}
+
+// A connection of the cluster bus. Outgoing links are opened by this node to send pings and read
+// the pongs, incoming links are opened by other nodes
+type clusterLink struct {
+	conn net.Conn
+	// Node the link was opened to, nil for incoming links
+	node *clusterNode
+	// Serializes writes
+	mutex sync.Mutex
+}
+
+func (l *clusterLink) send(m *clusterMessage) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.conn.SetWriteDeadline(time.Now().Add(config().ClusterNodeTimeout))
+	_, err := l.conn.Write(m.encode())
+	return err
+}
+
+// Starts accepting connections from the other nodes on addr
+func startClusterBus(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on the cluster bus port: %w", err)
+	}
+
+	cs := cluster
+	cs.mutex.Lock()
+	cs.listener = listener
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+		cs.myself.busPort = tcpAddr.Port
+	}
+	cs.mutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			link := &clusterLink{conn: conn}
+			cs.mutex.Lock()
+			if cs.closed {
+				cs.mutex.Unlock()
+				conn.Close()
+				return
+			}
+			cs.inbound[link] = struct{}{}
+			cs.mutex.Unlock()
+			go cs.serveLink(link)
+		}
+	}()
+	return nil
+}
+
+// Closes the cluster bus and its links, and leaves cluster mode
+func stopCluster() {
+	cs := cluster
+	if cs == nil {
+		return
+	}
+
+	cs.mutex.Lock()
+	cs.closed = true
+	if cs.listener != nil {
+		cs.listener.Close()
+	}
+	for link := range cs.inbound {
+		link.conn.Close()
+	}
+	for _, node := range cs.nodes {
+		if node.link != nil {
+			node.link.conn.Close()
+		}
+	}
+	cs.mutex.Unlock()
+
+	database(0).Watch(nil)
+	cluster = nil
+}
+
+// Describes this node to another one, with gossip about the nodes it knows
+func (cs *clusterState) buildMessageLocked(kind string, to *clusterNode) *clusterMessage {
+	m := &clusterMessage{
+		kind:         kind,
+		sender:       cs.myself.id,
+		ip:           cs.myself.ip,
+		port:         cs.myself.port,
+		busPort:      cs.myself.busPort,
+		currentEpoch: cs.currentEpoch,
+		configEpoch:  cs.myself.configEpoch,
+		slots:        make([]byte, CLUSTER_SLOTS/8),
+	}
+	for slot, owner := range cs.slots {
+		if owner == cs.myself {
+			m.slots[slot/8] |= 1 << (slot % 8)
+		}
+	}
+
+	// Clusters run by miniredis are small, so every node is part of the gossip
+	for _, node := range cs.nodes {
+		if node.myself || node.handshake || node == to || node.ip == "" {
+			continue
+		}
+		m.gossip = append(m.gossip, clusterGossip{id: node.id, ip: node.ip, port: node.port, busPort: node.busPort})
+	}
+	return m
+}
+
+// Adds a node with a temporary ID, which is replaced by its real one when it answers the MEET
+// sent on connection. Nothing happens if a node at that address is already known
+func (cs *clusterState) startHandshakeLocked(ip string, port int, busPort int) {
+	for _, node := range cs.nodes {
+		if node.ip == ip && node.port == port && node.busPort == busPort {
+			return
+		}
+	}
+
+	node := &clusterNode{id: newReplicationID(), ip: ip, port: port, busPort: busPort, handshake: true, created: time.Now()}
+	cs.nodes[node.id] = node
+	node.connecting = true
+	go cs.connect(node)
+}
+
+func (cs *clusterState) deleteNodeLocked(node *clusterNode) {
+	for slot, owner := range cs.slots {
+		if owner == node {
+			cs.setSlotLocked(slot, nil)
+		}
+		if cs.migratingTo[slot] == node {
+			cs.migratingTo[slot] = nil
+		}
+		if cs.importingFrom[slot] == node {
+			cs.importingFrom[slot] = nil
+		}
+	}
+	if node.link != nil {
+		node.link.conn.Close()
+		node.link = nil
+	}
+	delete(cs.nodes, node.id)
+	cs.todoSave = true
+}
+
+// Opens the outgoing link to a node, then reads the replies to the pings sent on it
+func (cs *clusterState) connect(node *clusterNode) {
+	cs.mutex.Lock()
+	// A node that can't be reached counts as not answering pings
+	if node.pingSent.IsZero() {
+		node.pingSent = time.Now()
+	}
+	address := net.JoinHostPort(node.ip, strconv.Itoa(node.busPort))
+	cs.mutex.Unlock()
+
+	conn, err := net.DialTimeout("tcp", address, config().ClusterNodeTimeout)
+
+	cs.mutex.Lock()
+	node.connecting = false
+	if err != nil {
+		cs.mutex.Unlock()
+		return
+	}
+	if cs.closed || cs.nodes[node.id] != node {
+		cs.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	link := &clusterLink{conn: conn, node: node}
+	node.link = link
+	kind := clusterMsgPing
+	if node.handshake {
+		kind = clusterMsgMeet
+	}
+	m := cs.buildMessageLocked(kind, node)
+	cs.mutex.Unlock()
+
+	if err := link.send(m); err != nil {
+		cs.closeLink(link)
+		return
+	}
+	cs.serveLink(link)
+}
+
+// Reads and processes the messages of a link until it fails
+func (cs *clusterState) serveLink(link *clusterLink) {
+	defer cs.closeLink(link)
+
+	reader := bufio.NewReader(link.conn)
+	for {
+		args, _, err := readMultibulk(reader)
+		if err != nil {
+			return
+		}
+		m, err := decodeClusterMessage(args)
+		if err != nil {
+			log.Printf("Closing cluster bus link: %v", err)
+			return
+		}
+
+		if reply := cs.processMessage(link, m); reply != nil {
+			if err := link.send(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (cs *clusterState) closeLink(link *clusterLink) {
+	link.conn.Close()
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.inbound, link)
+	if link.node != nil && link.node.link == link {
+		link.node.link = nil
+	}
+}
+
+// Updates the cluster state with a message, returning the reply to send on the link if any
+func (cs *clusterState) processMessage(link *clusterLink, m *clusterMessage) *clusterMessage {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	now := time.Now()
+	inbound := link.node == nil
+	if m.currentEpoch > cs.currentEpoch {
+		cs.currentEpoch = m.currentEpoch
+		cs.todoSave = true
+	}
+
+	sender := cs.nodes[m.sender]
+	if sender != nil && sender.handshake {
+		sender = nil
+	}
+
+	// The address other nodes use to reach us is our address as seen by the cluster
+	if inbound && cs.myself.ip == "" {
+		if local, ok := link.conn.LocalAddr().(*net.TCPAddr); ok {
+			cs.myself.ip = local.IP.String()
+			cs.todoSave = true
+		}
+	}
+
+	if inbound && m.kind == clusterMsgMeet && sender == nil && m.sender != cs.myself.id {
+		ip := m.ip
+		if remote, ok := link.conn.RemoteAddr().(*net.TCPAddr); ok && ip == "" {
+			ip = remote.IP.String()
+		}
+		sender = &clusterNode{id: m.sender, ip: ip, port: m.port, busPort: m.busPort, configEpoch: m.configEpoch, created: now}
+		cs.nodes[sender.id] = sender
+		cs.todoSave = true
+		log.Printf("Cluster node %s joined from %s:%d", sender.id, ip, m.port)
+	}
+
+	if !inbound && link.node.handshake && m.kind == clusterMsgPong {
+		node := link.node
+		if m.sender == cs.myself.id || cs.nodes[m.sender] != nil {
+			// Met ourselves or a node known under another address
+			cs.deleteNodeLocked(node)
+			return nil
+		}
+		delete(cs.nodes, node.id)
+		node.id = m.sender
+		node.handshake = false
+		cs.nodes[node.id] = node
+		cs.todoSave = true
+		sender = node
+	}
+
+	if sender == nil {
+		// Unknown nodes are answered, but only a MEET makes them part of the cluster
+		if inbound && (m.kind == clusterMsgPing || m.kind == clusterMsgMeet) {
+			return cs.buildMessageLocked(clusterMsgPong, nil)
+		}
+		return nil
+	}
+
+	if !inbound && m.kind == clusterMsgPong {
+		sender.pongReceived = now
+		sender.pingSent = time.Time{}
+		sender.pfail = false
+	}
+	if m.configEpoch > sender.configEpoch {
+		sender.configEpoch = m.configEpoch
+		cs.todoSave = true
+	}
+	cs.updateSlotsLocked(sender, m.slots)
+	cs.handleConfigEpochCollisionLocked(sender)
+
+	for _, g := range m.gossip {
+		if g.id != cs.myself.id && cs.nodes[g.id] == nil && g.ip != "" {
+			cs.startHandshakeLocked(g.ip, g.port, g.busPort)
+		}
+	}
+
+	if inbound && (m.kind == clusterMsgPing || m.kind == clusterMsgMeet) {
+		return cs.buildMessageLocked(clusterMsgPong, sender)
+	}
+	return nil
+}
+
+// Gives the slots a node claims to it, unless their owner has a greater config epoch. Slots being
+// imported are left alone: the import ends with CLUSTER SETSLOT NODE
+func (cs *clusterState) updateSlotsLocked(sender *clusterNode, claimed []byte) {
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if claimed[slot/8]&(1<<(slot%8)) == 0 || cs.importingFrom[slot] != nil {
+			continue
+		}
+		owner := cs.slots[slot]
+		if owner == sender {
+			continue
+		}
+		if owner == nil || owner.configEpoch < sender.configEpoch {
+			cs.setSlotLocked(slot, sender)
+			// The target of a migration took the slot over
+			if cs.migratingTo[slot] == sender {
+				cs.migratingTo[slot] = nil
+			}
+		}
+	}
+}
+
+// Two nodes with the same config epoch couldn't settle conflicting slot claims. As in Redis, the
+// node with the smaller ID takes a new epoch, so every node ends up with a distinct one
+func (cs *clusterState) handleConfigEpochCollisionLocked(sender *clusterNode) {
+	if sender.configEpoch != cs.myself.configEpoch || sender.id <= cs.myself.id {
+		return
+	}
+	cs.currentEpoch++
+	cs.myself.configEpoch = cs.currentEpoch
+	cs.todoSave = true
+	log.Printf("WARNING: configEpoch collision with node %s, configEpoch set to %d", sender.id, cs.myself.configEpoch)
+}
+
+// Periodic cluster work, run by serverCron: reconnects links, pings the nodes, flags the ones that
+// don't answer and saves the configuration when it changed
+func clusterCron(now time.Time) {
+	cs := cluster
+	if cs == nil {
+		return
+	}
+
+	type ping struct {
+		link    *clusterLink
+		message *clusterMessage
+	}
+	var pings []ping
+
+	cs.mutex.Lock()
+	handshakeTimeout := max(config().ClusterNodeTimeout, time.Second)
+	for _, node := range cs.nodes {
+		if node.myself {
+			continue
+		}
+		if node.handshake && now.Sub(node.created) > handshakeTimeout {
+			cs.deleteNodeLocked(node)
+			continue
+		}
+
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > config().ClusterNodeTimeout && !node.pfail {
+			log.Printf("*** NODE %s possibly failing", node.id)
+			node.pfail = true
+		}
+
+		if node.link == nil {
+			if !node.connecting {
+				node.connecting = true
+				go cs.connect(node)
+			}
+			continue
+		}
+		// The link may be stuck: reconnect, keeping the time of the unanswered ping
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > config().ClusterNodeTimeout/2 {
+			node.link.conn.Close()
+			node.link = nil
+			continue
+		}
+		if node.pingSent.IsZero() && now.Sub(node.pongReceived) >= CLUSTER_PING_INTERVAL {
+			node.pingSent = now
+			pings = append(pings, ping{link: node.link, message: cs.buildMessageLocked(clusterMsgPing, node)})
+		}
+	}
+	if cs.todoSave {
+		cs.saveConfigOrLogLocked()
+	}
+	cs.mutex.Unlock()
+
+	for _, p := range pings {
+		if err := p.link.send(p.message); err != nil {
+			cs.closeLink(p.link)
+		}
+	}
+}
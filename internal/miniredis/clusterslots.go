@@ -0,0 +1,198 @@
+package miniredis
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keys of each hash slot. In cluster mode it watches the store, so the keys of a slot can be listed
+// and shipped to another node without scanning the whole keyspace
+type slotIndex struct {
+	mutex sync.Mutex
+	keys  [CLUSTER_SLOTS]map[string]struct{}
+}
+
+// Called by the store for every key added or removed
+func (ix *slotIndex) update(key string, added bool) {
+	slot := keyHashSlot([]byte(key))
+
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	if !added {
+		delete(ix.keys[slot], key)
+		return
+	}
+	if ix.keys[slot] == nil {
+		ix.keys[slot] = map[string]struct{}{}
+	}
+	ix.keys[slot][key] = struct{}{}
+}
+
+func (ix *slotIndex) count(slot int) int {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	return len(ix.keys[slot])
+}
+
+// Keys of a slot, sorted, at most count of them unless count is negative
+func (ix *slotIndex) keysInSlot(slot int, count int) []string {
+	ix.mutex.Lock()
+	keys := make([]string, 0, len(ix.keys[slot]))
+	for key := range ix.keys[slot] {
+		keys = append(keys, key)
+	}
+	ix.mutex.Unlock()
+
+	sort.Strings(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// ASKING: the next command of the connection may use a slot this node is importing
+func handleAsking(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("ASKING command takes no arguments")
+	}
+	if !config().ClusterEnabled {
+		return nil, errClusterDisabled
+	}
+	c.asking = true
+	return okReply, nil
+}
+
+// Takes a new config epoch without agreement from the other nodes, unless this node already has the
+// greatest one, so its claim on a slot it just imported wins over the previous owner's
+func (cs *clusterState) bumpConfigEpochLocked() {
+	var maxEpoch uint64
+	for _, node := range cs.nodes {
+		maxEpoch = max(maxEpoch, node.configEpoch)
+	}
+	if cs.myself.configEpoch != 0 && cs.myself.configEpoch == maxEpoch {
+		return
+	}
+	cs.currentEpoch++
+	cs.myself.configEpoch = cs.currentEpoch
+	log.Printf("configEpoch set to %d after importing slot", cs.myself.configEpoch)
+}
+
+// CLUSTER SETSLOT slot IMPORTING node-id | MIGRATING node-id | NODE node-id | STABLE.
+// A slot moves from a source to a target node as follows: the target is set IMPORTING from the
+// source and the source MIGRATING to the target, the keys are moved with MIGRATE, and both are told
+// the new owner with NODE. Meanwhile the source answers ASK for the keys it no longer has, and the
+// target serves them to clients that sent ASKING
+func handleClusterSetSlot(args []RESPData) (MiniRedisData, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("CLUSTER SETSLOT requires at least 2 arguments")
+	}
+	slot, err := parseSlot(&args[0])
+	if err != nil {
+		return nil, err
+	}
+	action, err := ExtractString(&args[1])
+	if err != nil {
+		return nil, errSyntax
+	}
+	action = strings.ToUpper(action)
+
+	var nodeID string
+	if action == "STABLE" {
+		if len(args) != 2 {
+			return nil, errSyntax
+		}
+	} else {
+		if len(args) != 3 {
+			return nil, errSyntax
+		}
+		if nodeID, err = ExtractString(&args[2]); err != nil {
+			return nil, errSyntax
+		}
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	node := cluster.nodes[nodeID]
+	if action != "STABLE" && (node == nil || node.handshake) {
+		return nil, fmt.Errorf("I don't know about node %s", nodeID)
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cluster.slots[slot] != cluster.myself {
+			return nil, fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		if node == cluster.myself {
+			return nil, fmt.Errorf("Target node is not a different node")
+		}
+		cluster.migratingTo[slot] = node
+	case "IMPORTING":
+		if cluster.slots[slot] == cluster.myself {
+			return nil, fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		if node == cluster.myself {
+			return nil, fmt.Errorf("Source node is not a different node")
+		}
+		cluster.importingFrom[slot] = node
+	case "STABLE":
+		cluster.migratingTo[slot] = nil
+		cluster.importingFrom[slot] = nil
+	case "NODE":
+		keys := cluster.keys.count(slot)
+		if cluster.slots[slot] == cluster.myself && node != cluster.myself && keys > 0 {
+			return nil, fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		// Once the source gave its last key away, the migration is over for it
+		if keys == 0 {
+			cluster.migratingTo[slot] = nil
+		}
+		// The target takes the slot with a new epoch, which the other nodes learn through gossip
+		if node == cluster.myself && cluster.importingFrom[slot] != nil {
+			cluster.importingFrom[slot] = nil
+			cluster.bumpConfigEpochLocked()
+		}
+		cluster.setSlotLocked(slot, node)
+	default:
+		return nil, fmt.Errorf("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+
+	cluster.saveConfigOrLogLocked()
+	return okReply, nil
+}
+
+// Migration states of this node, as written after its slots in CLUSTER NODES:
+// [slot->-target] for slots being migrated and [slot-<-source] for slots being imported
+func (cs *clusterState) migrationsDescriptionLocked() []string {
+	var descriptions []string
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if node := cs.migratingTo[slot]; node != nil {
+			descriptions = append(descriptions, fmt.Sprintf("[%d->-%s]", slot, node.id))
+		}
+		if node := cs.importingFrom[slot]; node != nil {
+			descriptions = append(descriptions, fmt.Sprintf("[%d-<-%s]", slot, node.id))
+		}
+	}
+	return descriptions
+}
+
+// Parses a migration state written by migrationsDescriptionLocked
+func parseMigration(description string) (slot int, importing bool, nodeID string, err error) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(description, "["), "]")
+	slotArg, nodeID, migrating := strings.Cut(inner, "->-")
+	if !migrating {
+		var ok bool
+		if slotArg, nodeID, ok = strings.Cut(inner, "-<-"); !ok {
+			return 0, false, "", fmt.Errorf("invalid migration %q", description)
+		}
+		importing = true
+	}
+	if slot, err = strconv.Atoi(slotArg); err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return 0, false, "", fmt.Errorf("invalid migration %q", description)
+	}
+	return slot, importing, nodeID, nil
+}
@@ -0,0 +1,128 @@
+package miniredis
+
+import (
+	"strings"
+)
+
+type commandFlags uint32
+
+const (
+	// The command may modify the keyspace
+	cmdWrite commandFlags = 1 << iota
+	// The command only reads from the keyspace
+	cmdReadonly
+	// Server administration command (persistence, configuration, ...)
+	cmdAdmin
+	// Acts as if ASKING was sent before it, for commands sent by MIGRATE to a node importing the slot
+	cmdAsking
+	// Write command that runs while no other write is executing, even those that could run in parallel
+	cmdExclusive
+	// May keep the client waiting (for replicas, ...) or take over its connection, so it can't
+	// run on an event loop thread, see eventloop_linux.go
+	cmdBlocking
+)
+
+// Static information about a command
+type commandSpec struct {
+	name  string
+	flags commandFlags
+	// Positions of the key arguments, as in the Redis command table: the first and last key
+	// (negative counts from the end) and the step between keys, with the command name at position 0.
+	// firstKey is 0 for commands without keys
+	firstKey, lastKey, keyStep int
+	// Finds the keys of commands whose key positions depend on their options, instead of firstKey
+	getKeys func(args []RESPData) []int
+}
+
+var commandTable = map[RESPCommandType]commandSpec{
+	SET:          {name: "set", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	GET:          {name: "get", flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	ECHO:         {name: "echo"},
+	HELLO:        {name: "hello"},
+	PING:         {name: "ping"},
+	SAVE:         {name: "save", flags: cmdAdmin},
+	BGSAVE:       {name: "bgsave", flags: cmdAdmin},
+	LASTSAVE:     {name: "lastsave"},
+	INFO:         {name: "info"},
+	DEL:          {name: "del", flags: cmdWrite, firstKey: 1, lastKey: -1, keyStep: 1},
+	EXPIRE:       {name: "expire", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	PEXPIRE:      {name: "pexpire", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	EXPIREAT:     {name: "expireat", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	PEXPIREAT:    {name: "pexpireat", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	TTL:          {name: "ttl", flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	PTTL:         {name: "pttl", flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	PERSIST:      {name: "persist", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	BGREWRITEAOF: {name: "bgrewriteaof", flags: cmdAdmin},
+	SYNC:         {name: "sync", flags: cmdAdmin | cmdBlocking},
+	REPLCONF:     {name: "replconf", flags: cmdAdmin},
+	DUMP:         {name: "dump", flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	RESTORE:      {name: "restore", flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	MIGRATE:      {name: "migrate", flags: cmdWrite | cmdExclusive, getKeys: migrateKeys},
+	PSYNC:        {name: "psync", flags: cmdAdmin | cmdBlocking},
+	REPLICAOF:    {name: "replicaof", flags: cmdAdmin},
+	SLAVEOF:      {name: "slaveof", flags: cmdAdmin},
+	ROLE:         {name: "role"},
+	WAIT:         {name: "wait", flags: cmdBlocking},
+	WAITAOF:      {name: "waitaof", flags: cmdBlocking},
+	CLUSTER:      {name: "cluster", flags: cmdAdmin},
+	ASKING:       {name: "asking"},
+	// RESTORE sent by MIGRATE in cluster mode
+	RESTORE_ASKING: {name: "restore-asking", flags: cmdWrite | cmdAsking, firstKey: 1, lastKey: 1, keyStep: 1},
+	SELECT:         {name: "select"},
+	// MOVE locks keys of two databases and SWAPDB exchanges databases other writes may be using, so they run alone
+	MOVE:   {name: "move", flags: cmdWrite | cmdExclusive, firstKey: 1, lastKey: 1, keyStep: 1},
+	SWAPDB: {name: "swapdb", flags: cmdWrite | cmdExclusive},
+	DBSIZE: {name: "dbsize", flags: cmdReadonly},
+	// Waits for lagging replicas
+	SHUTDOWN: {name: "shutdown", flags: cmdAdmin | cmdBlocking},
+	CONFIG:   {name: "config", flags: cmdAdmin},
+	HGETALL:  {name: "hgetall", flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	ZSCORE:   {name: "zscore", flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+}
+
+// Command types indexed by their upper case name, used by ParseCommand
+var commandsByName = func() map[string]RESPCommandType {
+	byName := make(map[string]RESPCommandType, len(commandTable))
+	for commandType, spec := range commandTable {
+		byName[strings.ToUpper(spec.name)] = commandType
+	}
+	return byName
+}()
+
+// Key arguments of a command, used to route it to the cluster node serving them
+func commandKeys(cmd *RESPCommand) [][]byte {
+	spec := commandTable[cmd.Type]
+	var positions []int
+	if spec.getKeys != nil {
+		positions = spec.getKeys(cmd.Args)
+	} else if spec.firstKey > 0 {
+		// Positions count the command name, which isn't part of Args
+		last := spec.lastKey
+		if last < 0 {
+			last += len(cmd.Args) + 1
+		}
+		for i := spec.firstKey; i <= last && i <= len(cmd.Args); i += spec.keyStep {
+			positions = append(positions, i-1)
+		}
+	}
+
+	keys := make([][]byte, 0, len(positions))
+	for _, i := range positions {
+		if key, err := ExtractByteSlice(&cmd.Args[i]); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (t RESPCommandType) isWrite() bool {
+	return commandTable[t].flags&cmdWrite != 0
+}
+
+func (t RESPCommandType) isExclusive() bool {
+	return commandTable[t].flags&cmdExclusive != 0
+}
+
+func (t RESPCommandType) isBlocking() bool {
+	return commandTable[t].flags&cmdBlocking != 0
+}
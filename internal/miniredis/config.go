@@ -0,0 +1,191 @@
+package miniredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot automatically once at least Changes writes happened in the last Seconds (save <seconds> <changes>)
+type SaveRule struct {
+	Seconds time.Duration
+	Changes int64
+}
+
+// Server settings. Field names follow the matching redis.conf directives, see configParams
+type Config struct {
+	// Absolute path of the redis.conf file the settings were loaded from, which CONFIG REWRITE
+	// updates. Empty when started without one
+	ConfigFile string
+	// Port accepting client connections, 0 for any free port (port)
+	Port int
+	// Addresses accepting client connections (bind). Only the first one is listened on
+	Bind string
+	// Largest bulk string accepted in a request (proto-max-bulk-len)
+	ProtoMaxBulkLen int64
+	// Largest number of arguments accepted in a single multibulk request
+	MaxMultibulkLen int64
+	// Largest amount of unparsed data buffered for a client before it gets disconnected (client-query-buffer-limit)
+	ClientQueryBufferLimit int64
+	// Directory holding the persistence files (dir)
+	Dir string
+	// Name of the RDB file inside Dir (dbfilename)
+	DBFilename string
+	// Automatic snapshot rules (save). Empty disables automatic snapshots
+	SaveRules []SaveRule
+	// Refuse writes while the last background save failed (stop-writes-on-bgsave-error)
+	StopWritesOnBgsaveError bool
+	// Log every write command to an append only file (appendonly)
+	AppendOnly bool
+	// Name of the append only file inside Dir (appendfilename)
+	AppendFilename string
+	// When the append only file is fsynced: always, everysec or no (appendfsync)
+	AppendFsync string
+	// Directory inside Dir holding the base and incremental AOF files and their manifest (appenddirname)
+	AppendDirname string
+	// Write the base file of a rewritten AOF as an RDB rather than as commands (aof-use-rdb-preamble)
+	AofUseRDBPreamble bool
+	// Rewrite the AOF once it grew by this percentage since the last rewrite, 0 to disable (auto-aof-rewrite-percentage)
+	AutoAofRewritePercentage int64
+	// Smallest AOF size for an automatic rewrite (auto-aof-rewrite-min-size)
+	AutoAofRewriteMinSize int64
+	// Master to replicate from at startup as "<host> <port>", empty for a master (replicaof)
+	ReplicaOf string
+	// Reject writes from clients while replicating (replica-read-only)
+	ReplicaReadOnly bool
+	// Size of the replication backlog kept for partial resynchronizations (repl-backlog-size)
+	ReplBacklogSize int64
+	// Interval between the pings a master sends to its replicas (repl-ping-replica-period)
+	ReplPingReplicaPeriod time.Duration
+	// Time without data or acknowledgements after which a replication link is dropped (repl-timeout)
+	ReplTimeout time.Duration
+	// Run as a Redis Cluster node (cluster-enabled)
+	ClusterEnabled bool
+	// File inside Dir where the node saves the cluster configuration (cluster-config-file)
+	ClusterConfigFile string
+	// Port of the cluster bus, 0 for the client port + 10000 (cluster-port)
+	ClusterPort int
+	// Time without a reply to a ping after which a node is flagged as failing (cluster-node-timeout)
+	ClusterNodeTimeout time.Duration
+	// Number of logical databases, selected with SELECT (databases)
+	Databases int
+	// Longest time a shutdown waits for lagging replicas, then for clients to finish the commands they sent (shutdown-timeout)
+	ShutdownTimeout time.Duration
+	// How connections are served: a goroutine each, or epoll or io_uring event loops (miniredis only)
+	IOModel string
+	// Number of event loop threads executing commands with the epoll and io_uring I/O models (miniredis only)
+	EventLoopThreads int
+	// Port of the HTTP server exposing Prometheus metrics and pprof profiles, 0 to disable it (miniredis only)
+	AdminPort int
+	// Address the admin HTTP server listens on (miniredis only)
+	AdminBind string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:                   6379,
+		Bind:                   "* -::*",
+		ProtoMaxBulkLen:        512 * 1024 * 1024,  // 512mb
+		MaxMultibulkLen:        1024 * 1024,        // 1M arguments
+		ClientQueryBufferLimit: 1024 * 1024 * 1024, // 1gb
+		Dir:                    ".",
+		DBFilename:             "dump.rdb",
+		SaveRules: []SaveRule{
+			{Seconds: 3600 * time.Second, Changes: 1},
+			{Seconds: 300 * time.Second, Changes: 100},
+			{Seconds: 60 * time.Second, Changes: 10000},
+		},
+		StopWritesOnBgsaveError:  true,
+		AppendOnly:               false,
+		AppendFilename:           "appendonly.aof",
+		AppendFsync:              AOF_FSYNC_EVERYSEC,
+		AppendDirname:            "appendonlydir",
+		AofUseRDBPreamble:        true,
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 * 1024 * 1024, // 64mb
+		ReplicaReadOnly:          true,
+		ReplBacklogSize:          1024 * 1024, // 1mb
+		ReplPingReplicaPeriod:    10 * time.Second,
+		ReplTimeout:              60 * time.Second,
+		ClusterConfigFile:        "nodes.conf",
+		ClusterNodeTimeout:       15 * time.Second,
+		Databases:                16,
+		ShutdownTimeout:          10 * time.Second,
+		IOModel:                  IO_MODEL_GOROUTINES,
+		EventLoopThreads:         1,
+		AdminBind:                "127.0.0.1",
+	}
+}
+
+// Configuration of the server. SetConfig and CONFIG SET replace it as a whole instead of changing
+// its fields, so that it can be read without a lock
+var currentConfig = func() *atomic.Pointer[Config] {
+	var p atomic.Pointer[Config]
+	defaults := DefaultConfig()
+	p.Store(&defaults)
+	return &p
+}()
+
+// The current configuration, which must not be modified. Parameters read together should come
+// from the same call, as CONFIG SET may replace the configuration in between
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// Address StartServer should listen on: the first address of bind and the port. "*" stands for
+// every IPv4 interface, and the "-" marking optional addresses is dropped
+func (c *Config) ListenAddr() string {
+	host := "0.0.0.0"
+	if fields := strings.Fields(c.Bind); len(fields) > 0 && fields[0] != "*" {
+		host = strings.TrimPrefix(fields[0], "-")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Port))
+}
+
+// Address of the admin HTTP server
+func (c *Config) adminAddr() string {
+	return net.JoinHostPort(c.AdminBind, strconv.Itoa(c.AdminPort))
+}
+
+// Replaces the server configuration. Meant to be called before StartServer
+func SetConfig(c Config) {
+	currentConfig.Store(&c)
+	if c.Databases != databaseCount() {
+		databases.reset(c.Databases)
+	}
+}
+
+// Parses save rules written as in redis.conf: "<seconds> <changes> [<seconds> <changes> ...]".
+// An empty string disables automatic snapshots
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters %q", s)
+	}
+
+	rules := []SaveRule{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		rules = append(rules, SaveRule{Seconds: time.Duration(seconds) * time.Second, Changes: changes})
+	}
+	return rules, nil
+}
+
+// Formats save rules as ParseSaveRules reads them
+func formatSaveRules(rules []SaveRule) string {
+	fields := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		fields = append(fields, strconv.FormatInt(int64(rule.Seconds/time.Second), 10), strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
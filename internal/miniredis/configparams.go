@@ -0,0 +1,711 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type configParamFlags int
+
+const (
+	// Only set at startup: CONFIG SET refuses to change it
+	configImmutable configParamFlags = 1 << iota
+	// The value is made of all the arguments of the directive, as in "save 3600 1 300 100"
+	configMultiArg
+	// Repeated directives add to the value instead of replacing it, as "save" lines do
+	configAppend
+)
+
+// A redis.conf directive, stored in a field of Config
+type configParam struct {
+	name string
+	// Former name still accepted (slaveof, ...)
+	alias string
+	flags configParamFlags
+	// Formats the value as CONFIG GET shows it
+	get func(c *Config) string
+	// Parses and validates value into c
+	set func(c *Config, value string) error
+	// Makes the running server follow a change made by CONFIG SET, old being the configuration before it
+	apply func(old *Config) error
+}
+
+func (p configParam) immutable() configParam {
+	p.flags |= configImmutable
+	return p
+}
+
+func (p configParam) withAlias(alias string) configParam {
+	p.alias = alias
+	return p
+}
+
+func (p configParam) onApply(apply func(old *Config) error) configParam {
+	p.apply = apply
+	return p
+}
+
+// Directives understood in redis.conf, on the command line and by CONFIG
+var configParams = []configParam{
+	intParam("port", func(c *Config) *int { return &c.Port }, 0, 65535).immutable(),
+	{
+		name:  "bind",
+		flags: configImmutable | configMultiArg,
+		get:   func(c *Config) string { return c.Bind },
+		set: func(c *Config, value string) error {
+			if value == "" {
+				return fmt.Errorf("argument must be at least one address")
+			}
+			c.Bind = value
+			return nil
+		},
+	},
+	memoryParam("proto-max-bulk-len", func(c *Config) *int64 { return &c.ProtoMaxBulkLen }, 1024*1024, math.MaxInt64),
+	intParam("max-multibulk-len", func(c *Config) *int64 { return &c.MaxMultibulkLen }, 1, math.MaxInt64),
+	memoryParam("client-query-buffer-limit", func(c *Config) *int64 { return &c.ClientQueryBufferLimit }, 1024*1024, math.MaxInt64),
+	stringParam("dir", func(c *Config) *string { return &c.Dir }, func(value string) error {
+		info, err := os.Stat(value)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", value)
+		}
+		return nil
+	}).onApply(applyDir),
+	stringParam("dbfilename", func(c *Config) *string { return &c.DBFilename }, validateFilename),
+	{
+		name:  "save",
+		flags: configMultiArg | configAppend,
+		get:   func(c *Config) string { return formatSaveRules(c.SaveRules) },
+		set: func(c *Config, value string) error {
+			rules, err := ParseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			c.SaveRules = rules
+			return nil
+		},
+	},
+	boolParam("stop-writes-on-bgsave-error", func(c *Config) *bool { return &c.StopWritesOnBgsaveError }),
+	boolParam("appendonly", func(c *Config) *bool { return &c.AppendOnly }).onApply(applyAppendOnly),
+	stringParam("appendfilename", func(c *Config) *string { return &c.AppendFilename }, validateFilename).immutable(),
+	enumParam("appendfsync", func(c *Config) *string { return &c.AppendFsync }, AOF_FSYNC_ALWAYS, AOF_FSYNC_EVERYSEC, AOF_FSYNC_NO),
+	stringParam("appenddirname", func(c *Config) *string { return &c.AppendDirname }, validateFilename).immutable(),
+	boolParam("aof-use-rdb-preamble", func(c *Config) *bool { return &c.AofUseRDBPreamble }),
+	intParam("auto-aof-rewrite-percentage", func(c *Config) *int64 { return &c.AutoAofRewritePercentage }, 0, math.MaxInt32),
+	memoryParam("auto-aof-rewrite-min-size", func(c *Config) *int64 { return &c.AutoAofRewriteMinSize }, 0, math.MaxInt64),
+	{
+		// Changed at runtime with REPLICAOF
+		name:  "replicaof",
+		alias: "slaveof",
+		flags: configImmutable | configMultiArg,
+		get:   func(c *Config) string { return c.ReplicaOf },
+		set: func(c *Config, value string) error {
+			if value != "" {
+				if _, _, err := parseReplicaOf(value); err != nil {
+					return err
+				}
+			}
+			c.ReplicaOf = value
+			return nil
+		},
+	},
+	boolParam("replica-read-only", func(c *Config) *bool { return &c.ReplicaReadOnly }).withAlias("slave-read-only"),
+	memoryParam("repl-backlog-size", func(c *Config) *int64 { return &c.ReplBacklogSize }, 1, math.MaxInt64).onApply(func(*Config) error {
+		resizeReplicationBacklog()
+		return nil
+	}),
+	durationParam("repl-ping-replica-period", func(c *Config) *time.Duration { return &c.ReplPingReplicaPeriod }, time.Second, 1, math.MaxInt32).withAlias("repl-ping-slave-period"),
+	durationParam("repl-timeout", func(c *Config) *time.Duration { return &c.ReplTimeout }, time.Second, 1, math.MaxInt32),
+	boolParam("cluster-enabled", func(c *Config) *bool { return &c.ClusterEnabled }).immutable(),
+	stringParam("cluster-config-file", func(c *Config) *string { return &c.ClusterConfigFile }, nil).immutable(),
+	intParam("cluster-port", func(c *Config) *int { return &c.ClusterPort }, 0, 65535).immutable(),
+	durationParam("cluster-node-timeout", func(c *Config) *time.Duration { return &c.ClusterNodeTimeout }, time.Millisecond, 1, math.MaxInt64),
+	intParam("databases", func(c *Config) *int { return &c.Databases }, 1, math.MaxInt32).immutable(),
+	durationParam("shutdown-timeout", func(c *Config) *time.Duration { return &c.ShutdownTimeout }, time.Second, 0, math.MaxInt32),
+	enumParam("io-model", func(c *Config) *string { return &c.IOModel }, IO_MODEL_GOROUTINES, IO_MODEL_EPOLL, IO_MODEL_IO_URING).immutable(),
+	intParam("event-loop-threads", func(c *Config) *int { return &c.EventLoopThreads }, 1, 1024).immutable(),
+	intParam("admin-port", func(c *Config) *int { return &c.AdminPort }, 0, 65535).immutable(),
+	stringParam("admin-bind", func(c *Config) *string { return &c.AdminBind }, nil).immutable(),
+}
+
+// Parameters indexed by their name and alias
+var configParamsByName = func() map[string]*configParam {
+	byName := make(map[string]*configParam, 2*len(configParams))
+	for i := range configParams {
+		p := &configParams[i]
+		byName[p.name] = p
+		if p.alias != "" {
+			byName[p.alias] = p
+		}
+	}
+	return byName
+}()
+
+func boolParam(name string, field func(c *Config) *bool) configParam {
+	return configParam{
+		name: name,
+		get: func(c *Config) string {
+			if *field(c) {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(c *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				*field(c) = true
+			case "no":
+				*field(c) = false
+			default:
+				return fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+func intParam[T int | int64](name string, field func(c *Config) *T, lower, upper int64) configParam {
+	return configParam{
+		name: name,
+		get:  func(c *Config) string { return strconv.FormatInt(int64(*field(c)), 10) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < lower || n > upper {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+			}
+			*field(c) = T(n)
+			return nil
+		},
+	}
+}
+
+// Sizes in bytes, written with an optional unit: 1k is 1000 bytes, 1kb is 1024 bytes (see parseMemory)
+func memoryParam(name string, field func(c *Config) *int64, lower, upper int64) configParam {
+	return configParam{
+		name: name,
+		get:  func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+		set: func(c *Config, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < lower || n > upper {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+// Durations written as a number of units, seconds or milliseconds like their Redis counterparts
+func durationParam(name string, field func(c *Config) *time.Duration, unit time.Duration, lower, upper int64) configParam {
+	return configParam{
+		name: name,
+		get:  func(c *Config) string { return strconv.FormatInt(int64(*field(c)/unit), 10) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < lower || n > upper || n > math.MaxInt64/int64(unit) {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, min(upper, math.MaxInt64/int64(unit)))
+			}
+			*field(c) = time.Duration(n) * unit
+			return nil
+		},
+	}
+}
+
+func enumParam(name string, field func(c *Config) *string, values ...string) configParam {
+	return configParam{
+		name: name,
+		get:  func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			value = strings.ToLower(value)
+			if !slices.Contains(values, value) {
+				return fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(values, ", "))
+			}
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+// validate may be nil when any string is accepted
+func stringParam(name string, field func(c *Config) *string, validate func(value string) error) configParam {
+	return configParam{
+		name: name,
+		get:  func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			if validate != nil {
+				if err := validate(value); err != nil {
+					return err
+				}
+			}
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+// Files named by the configuration live in dir
+func validateFilename(value string) error {
+	if value == "" || strings.ContainsAny(value, `/\`) {
+		return fmt.Errorf("%q must be a file name, not a path", value)
+	}
+	return nil
+}
+
+// Parses a size in bytes as Redis does: a number followed by an optional unit among
+// k, kb, m, mb, g and gb (case insensitive). k is 1000 bytes while kb is 1024 bytes
+func parseMemory(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	digits := strings.TrimRight(lower, "kmgb")
+	multiplier := int64(1)
+	switch lower[len(digits):] {
+	case "":
+	case "b":
+	case "k":
+		multiplier = 1000
+	case "kb":
+		multiplier = 1024
+	case "m":
+		multiplier = 1000 * 1000
+	case "mb":
+		multiplier = 1024 * 1024
+	case "g":
+		multiplier = 1000 * 1000 * 1000
+	case "gb":
+		multiplier = 1024 * 1024 * 1024
+	default:
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
+
+// Builds the configuration from command line arguments the way redis-server takes them: the path of a
+// redis.conf file, if any, followed by directives written as "--<name> <value> ...", which come after
+// those of the file and so override them
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+	seen := map[*configParam]bool{}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return cfg, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading the configuration file: %w", err)
+		}
+		// Unlike the command line, redis.conf files may hold directives meant for a real Redis
+		if err := parseConfigText(&cfg, string(data), path, false, seen); err != nil {
+			return cfg, err
+		}
+		cfg.ConfigFile = path
+		args = args[1:]
+	}
+
+	var overrides strings.Builder
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			if overrides.Len() > 0 {
+				overrides.WriteByte('\n')
+			}
+			overrides.WriteString(arg[2:])
+		case overrides.Len() == 0:
+			return cfg, fmt.Errorf("expected an option starting with --, got %q", arg)
+		default:
+			overrides.WriteString(" " + quoteConfigArg(arg))
+		}
+	}
+	if err := parseConfigText(&cfg, overrides.String(), "command line", true, seen); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Applies the directives of text, in redis.conf format, to c. Unsupported directives are skipped with a
+// warning unless strict is set. seen holds the parameters already set, so that repeated "save" lines add up
+func parseConfigText(c *Config, text string, source string, strict bool, seen map[*configParam]bool) error {
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args, err := splitConfigLine(line)
+		if err == nil && len(args) > 0 {
+			err = setConfigDirective(c, args, seen)
+		}
+		var unsupported *unsupportedDirectiveError
+		if errors.As(err, &unsupported) && !strict {
+			log.Printf("Ignoring unsupported directive '%s' (%s, line %d)", unsupported.name, source, i+1)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s, line %d: '%s': %w", source, i+1, line, err)
+		}
+	}
+	return nil
+}
+
+type unsupportedDirectiveError struct {
+	name string
+}
+
+func (e *unsupportedDirectiveError) Error() string {
+	return fmt.Sprintf("Bad directive or wrong number of arguments for '%s'", e.name)
+}
+
+// Sets the parameter named by args[0] to the value made of the other arguments
+func setConfigDirective(c *Config, args []string, seen map[*configParam]bool) error {
+	p := configParamsByName[strings.ToLower(args[0])]
+	if p == nil {
+		return &unsupportedDirectiveError{name: args[0]}
+	}
+	if len(args) < 2 || (len(args) > 2 && p.flags&configMultiArg == 0) {
+		return fmt.Errorf("wrong number of arguments")
+	}
+
+	value := strings.Join(args[1:], " ")
+	if p.flags&configAppend != 0 && seen[p] && value != "" {
+		if current := p.get(c); current != "" {
+			value = current + " " + value
+		}
+	}
+	seen[p] = true
+	return p.set(c, value)
+}
+
+// Splits a redis.conf line into arguments, quoted as in inline commands
+func splitConfigLine(line string) ([]string, error) {
+	parsed, err := splitInlineArgs([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, len(parsed))
+	for i := range parsed {
+		if args[i], err = ExtractString(&parsed[i]); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// Quotes an argument of a redis.conf line when it can't be written as is
+func quoteConfigArg(arg string) string {
+	plain := arg != ""
+	for i := 0; i < len(arg) && plain; i++ {
+		plain = arg[i] > ' ' && arg[i] < 0x7f && arg[i] != '"' && arg[i] != '\'' && arg[i] != '\\'
+	}
+	if plain {
+		return arg
+	}
+
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch ch := arg[i]; ch {
+		case '\\', '"':
+			builder.WriteByte('\\')
+			builder.WriteByte(ch)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\r':
+			builder.WriteString(`\r`)
+		case '\t':
+			builder.WriteString(`\t`)
+		default:
+			if ch < ' ' || ch >= 0x7f {
+				fmt.Fprintf(&builder, `\x%02x`, ch)
+			} else {
+				builder.WriteByte(ch)
+			}
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+// The redis.conf line setting p to its value in c
+func configLine(p *configParam, c *Config) string {
+	value := p.get(c)
+	if p.flags&configMultiArg != 0 && value != "" {
+		return p.name + " " + value
+	}
+	return p.name + " " + quoteConfigArg(value)
+}
+
+// Serializes CONFIG SET and CONFIG REWRITE
+var configMutex sync.Mutex
+
+// CONFIG GET | SET | REWRITE | RESETSTAT
+func handleConfig(args []RESPData) (MiniRedisData, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("CONFIG command requires a subcommand")
+	}
+
+	subcommand, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid subcommand: %w", err)
+	}
+	args = args[1:]
+
+	switch strings.ToUpper(subcommand) {
+	case "GET":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("CONFIG GET requires at least 1 argument")
+		}
+		return handleConfigGet(args)
+	case "SET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return nil, fmt.Errorf("CONFIG SET requires parameter and value pairs")
+		}
+		return handleConfigSet(args)
+	case "REWRITE":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("CONFIG REWRITE takes no arguments")
+		}
+		return handleConfigRewrite()
+	case "RESETSTAT":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("CONFIG RESETSTAT takes no arguments")
+		}
+		resetStats()
+		return okReply, nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try CONFIG HELP.", subcommand)
+	}
+}
+
+// CONFIG GET pattern [pattern ...]: the parameters whose name or alias matches one of the glob-style patterns
+func handleConfigGet(args []RESPData) (MiniRedisData, error) {
+	patterns := make([]string, len(args))
+	for i := range args {
+		pattern, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		patterns[i] = strings.ToLower(pattern)
+	}
+
+	cfg := config()
+	entries := []MiniRedisData{}
+	for i := range configParams {
+		p := &configParams[i]
+		for _, name := range []string{p.name, p.alias} {
+			if name == "" {
+				continue
+			}
+			if slices.ContainsFunc(patterns, func(pattern string) bool {
+				matched, _ := path.Match(pattern, name)
+				return matched
+			}) {
+				entries = append(entries, &StringData{data: []byte(name)}, &StringData{data: []byte(p.get(cfg))})
+			}
+		}
+	}
+	return &MapReply{data: entries}, nil
+}
+
+func configSetError(name string, err error) error {
+	return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %w", name, err)
+}
+
+// CONFIG SET parameter value [parameter value ...]: every value is validated before any is set, and
+// a change the server fails to apply reverts them all
+func handleConfigSet(args []RESPData) (MiniRedisData, error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	old := config()
+	updated := *old
+	changed := []*configParam{}
+	for i := 0; i < len(args); i += 2 {
+		name, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter: %w", err)
+		}
+		value, err := ExtractString(&args[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+
+		p := configParamsByName[strings.ToLower(name)]
+		if p == nil {
+			return nil, fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+		}
+		if slices.Contains(changed, p) {
+			return nil, configSetError(name, fmt.Errorf("duplicate parameter"))
+		}
+		if p.flags&configImmutable != 0 {
+			return nil, configSetError(name, fmt.Errorf("can't set immutable config"))
+		}
+		if err := p.set(&updated, value); err != nil {
+			return nil, configSetError(name, err)
+		}
+		changed = append(changed, p)
+	}
+
+	currentConfig.Store(&updated)
+	for i, p := range changed {
+		if p.apply == nil {
+			continue
+		}
+		if err := p.apply(old); err != nil {
+			currentConfig.Store(old)
+			for _, applied := range changed[:i] {
+				if applied.apply != nil {
+					applied.apply(&updated)
+				}
+			}
+			return nil, configSetError(p.name, err)
+		}
+	}
+	return okReply, nil
+}
+
+// Files of the AOF are open in dir
+func applyDir(old *Config) error {
+	if config().Dir != old.Dir && aofEnabled() {
+		return fmt.Errorf("can't change dir while appendonly is enabled")
+	}
+	return nil
+}
+
+// Starts or stops logging writes. The existing AOF files may miss the writes made while it was
+// disabled, so they are rewritten from the current keyspace
+func applyAppendOnly(old *Config) error {
+	appendOnly := config().AppendOnly
+	if appendOnly == old.AppendOnly {
+		return nil
+	}
+	if !appendOnly {
+		return closeAppendOnlyFile()
+	}
+
+	if err := openAppendOnlyFile(); err != nil {
+		return err
+	}
+	if err := startAOFRewrite(); err != nil {
+		closeAppendOnlyFile()
+		return err
+	}
+	return nil
+}
+
+// Precedes the parameters CONFIG REWRITE appends to the file, as in Redis
+const configRewriteSignature = "# Generated by CONFIG REWRITE"
+
+func handleConfigRewrite() (MiniRedisData, error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	cfg := config()
+	if cfg.ConfigFile == "" {
+		return nil, fmt.Errorf("The server is running without a config file")
+	}
+	if err := rewriteConfigFile(cfg.ConfigFile, cfg); err != nil {
+		log.Printf("CONFIG REWRITE failed: %v", err)
+		return nil, fmt.Errorf("Rewriting config file: %w", err)
+	}
+	log.Printf("CONFIG REWRITE executed with success.")
+	return okReply, nil
+}
+
+// Updates the redis.conf file at path to hold the configuration c. Comments, blank lines and unsupported
+// directives are kept. The first line setting a parameter is replaced with its current value, and its other
+// lines are removed. Parameters the file didn't set are appended when they aren't at their default value
+func rewriteConfigFile(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	lines := []string{}
+	written := map[*configParam]bool{}
+	hasSignature := false
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			trimmed := strings.TrimSpace(line)
+			hasSignature = hasSignature || trimmed == configRewriteSignature
+			var p *configParam
+			if trimmed != "" && trimmed[0] != '#' {
+				if args, err := splitConfigLine(trimmed); err == nil && len(args) > 0 {
+					p = configParamsByName[strings.ToLower(args[0])]
+				}
+			}
+			if p == nil {
+				lines = append(lines, line)
+			} else if !written[p] {
+				lines = append(lines, configLine(p, c))
+				written[p] = true
+			}
+		}
+	}
+
+	defaults := DefaultConfig()
+	generated := []string{}
+	for i := range configParams {
+		p := &configParams[i]
+		if !written[p] && p.get(c) != p.get(&defaults) {
+			generated = append(generated, configLine(p, c))
+		}
+	}
+	if len(generated) > 0 && !hasSignature {
+		lines = append(lines, configRewriteSignature)
+	}
+	lines = append(lines, generated...)
+	content := strings.Join(lines, "\n") + "\n"
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf("temp-%d-*.conf", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
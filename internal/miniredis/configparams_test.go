@@ -0,0 +1,249 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"100", 100, true},
+		{"1k", 1000, true},
+		{"1kb", 1024, true},
+		{"64MB", 64 * 1024 * 1024, true},
+		{"2g", 2000 * 1000 * 1000, true},
+		{"1gb", 1024 * 1024 * 1024, true},
+		{"", 0, false},
+		{"mb", 0, false},
+		{"-1", 0, false},
+		{"1tb", 0, false},
+		{"9223372036854775807kb", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMemory(tt.value)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d (ok: %v)", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `# Comment
+port 7000
+save 900 1
+save 300 10
+slaveof 127.0.0.1 6380
+appendfsync ALWAYS
+repl-backlog-size 2mb
+cluster-node-timeout 5000
+dbfilename "my dump.rdb"
+loglevel notice
+`)
+
+	cfg, err := LoadConfig([]string{path, "--port", "7001", "--save", "60", "100", "--appendonly", "yes", "--admin-port", "9121"})
+	if err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+
+	if cfg.ConfigFile != path {
+		t.Errorf("ConfigFile = %q, want %q", cfg.ConfigFile, path)
+	}
+	if cfg.Port != 7001 {
+		t.Errorf("Port = %d, want the command line override 7001", cfg.Port)
+	}
+	// Repeated save directives add up
+	wantRules := []SaveRule{{900 * time.Second, 1}, {300 * time.Second, 10}, {60 * time.Second, 100}}
+	if !reflect.DeepEqual(cfg.SaveRules, wantRules) {
+		t.Errorf("SaveRules = %v, want %v", cfg.SaveRules, wantRules)
+	}
+	if cfg.ReplicaOf != "127.0.0.1 6380" {
+		t.Errorf("ReplicaOf = %q from the slaveof alias", cfg.ReplicaOf)
+	}
+	if cfg.AppendFsync != AOF_FSYNC_ALWAYS || !cfg.AppendOnly {
+		t.Errorf("AppendFsync = %q, AppendOnly = %v", cfg.AppendFsync, cfg.AppendOnly)
+	}
+	if cfg.ReplBacklogSize != 2*1024*1024 || cfg.ClusterNodeTimeout != 5*time.Second {
+		t.Errorf("ReplBacklogSize = %d, ClusterNodeTimeout = %v", cfg.ReplBacklogSize, cfg.ClusterNodeTimeout)
+	}
+	if cfg.DBFilename != "my dump.rdb" {
+		t.Errorf("DBFilename = %q", cfg.DBFilename)
+	}
+	if cfg.ListenAddr() != "0.0.0.0:7001" {
+		t.Errorf("ListenAddr() = %q", cfg.ListenAddr())
+	}
+	if cfg.adminAddr() != "127.0.0.1:9121" {
+		t.Errorf("adminAddr() = %q", cfg.adminAddr())
+	}
+
+	// save "" clears the rules
+	cfg, err = LoadConfig([]string{path, "--save", ""})
+	if err != nil || len(cfg.SaveRules) != 0 {
+		t.Errorf("save \"\" left rules %v (error: %v)", cfg.SaveRules, err)
+	}
+
+	invalid := [][]string{
+		{"--port", "70000"},
+		{"--appendfsync", "sometimes"},
+		{"--loglevel", "notice"},
+		{"--port"},
+		{"7000"},
+		{path, "--databases", "0"},
+	}
+	for _, args := range invalid {
+		if _, err := LoadConfig(args); err == nil {
+			t.Errorf("LoadConfig(%q) succeeded", args)
+		}
+	}
+}
+
+func TestConfigGetSet(t *testing.T) {
+	useTempDataDir(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	replies := dialAndSend(t, addr, []string{"*3\r\n$6\r\nCONFIG\r\n$3\r\nGET\r\n$13\r\nappend[fo]*ly\r\n"})
+	want := []string{"*2", "$10", "appendonly", "$2", "no"}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("CONFIG GET appendonly: got %q, want %q", replies, want)
+	}
+
+	replies = dialAndSend(t, addr, []string{
+		"*6\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$22\r\nrepl-ping-slave-period\r\n$1\r\n5\r\n$4\r\nsave\r\n$6\r\n60 100\r\n",
+		"*4\r\n$6\r\nCONFIG\r\n$3\r\nGET\r\n$4\r\nsave\r\n$24\r\nrepl-ping-replica-period\r\n",
+	})
+	want = []string{"+OK", "*4", "$4", "save", "$6", "60 100", "$24", "repl-ping-replica-period", "$1", "5"}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("CONFIG SET then GET: got %q, want %q", replies, want)
+	}
+
+	tests := []struct {
+		command string
+		prefix  string
+	}{
+		{"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$9\r\ndatabases\r\n$1\r\n4\r\n", "-ERR CONFIG SET failed (possibly related to argument 'databases') - can't set immutable config"},
+		{"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$7\r\nunknown\r\n$1\r\n4\r\n", "-ERR Unknown option or number of arguments for CONFIG SET - 'unknown'"},
+		{"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$17\r\nrepl-backlog-size\r\n$3\r\nlot\r\n", "-ERR CONFIG SET failed (possibly related to argument 'repl-backlog-size') - argument must be a memory value"},
+		// No change is made when one of the values is invalid
+		{"*6\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$12\r\nrepl-timeout\r\n$2\r\n30\r\n$11\r\nappendfsync\r\n$5\r\nnever\r\n", "-ERR CONFIG SET failed (possibly related to argument 'appendfsync')"},
+		{"*6\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$12\r\nrepl-timeout\r\n$2\r\n30\r\n$12\r\nrepl-timeout\r\n$2\r\n40\r\n", "-ERR CONFIG SET failed (possibly related to argument 'repl-timeout') - duplicate parameter"},
+		{"*2\r\n$6\r\nCONFIG\r\n$7\r\nREWRITE\r\n", "-ERR The server is running without a config file"},
+		{"*2\r\n$6\r\nCONFIG\r\n$9\r\nRESETSTAT\r\n", "+OK"},
+	}
+	for _, tt := range tests {
+		replies := dialAndSend(t, addr, []string{tt.command})
+		if len(replies) != 1 || !strings.HasPrefix(replies[0], tt.prefix) {
+			t.Errorf("%q: expected %q, got %v", tt.command, tt.prefix, replies)
+		}
+	}
+	if config().ReplTimeout != DefaultConfig().ReplTimeout {
+		t.Errorf("repl-timeout changed by a failed CONFIG SET: %v", config().ReplTimeout)
+	}
+}
+
+func TestConfigSetAppendOnly(t *testing.T) {
+	dir := useTempDataDir(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	defer closeAppendOnlyFile()
+
+	key := "config_aof_key"
+	defer database(0).Delete(&key)
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$14\r\nconfig_aof_key\r\n$1\r\n1\r\n",
+		"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$10\r\nappendonly\r\n$3\r\nyes\r\n",
+	})
+	if len(replies) != 3 || replies[2] != "+OK" {
+		t.Fatalf("unexpected replies: %v", replies)
+	}
+	if !aofEnabled() {
+		t.Fatalf("CONFIG SET appendonly yes didn't enable the AOF")
+	}
+	if _, err := os.Stat(filepath.Join(dir, config().AppendDirname)); err != nil {
+		t.Errorf("AOF directory not created: %v", err)
+	}
+
+	replies = dialAndSend(t, addr, []string{"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$3\r\ndir\r\n$4\r\n/tmp\r\n"})
+	if len(replies) != 1 || !strings.Contains(replies[0], "appendonly is enabled") {
+		t.Errorf("CONFIG SET dir with the AOF enabled: %v", replies)
+	}
+
+	replies = dialAndSend(t, addr, []string{"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$10\r\nappendonly\r\n$2\r\nno\r\n"})
+	if len(replies) != 1 || replies[0] != "+OK" || aofEnabled() {
+		t.Errorf("CONFIG SET appendonly no: %v, enabled: %v", replies, aofEnabled())
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	path := writeConfigFile(t, `# Server port
+port 7000
+
+# Snapshots
+save 900 1
+save 300 10
+loglevel notice
+appendfsync everysec
+`)
+	cfg, err := LoadConfig([]string{path, "--repl-timeout", "30"})
+	if err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+	cfg.SaveRules = []SaveRule{{60 * time.Second, 5}}
+	cfg.AppendFsync = AOF_FSYNC_NO
+	cfg.DBFilename = "my dump.rdb"
+
+	if err := rewriteConfigFile(path, &cfg); err != nil {
+		t.Fatalf("rewriteConfigFile() error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the rewritten file: %v", err)
+	}
+	want := `# Server port
+port 7000
+
+# Snapshots
+save 60 5
+loglevel notice
+appendfsync no
+# Generated by CONFIG REWRITE
+dbfilename "my dump.rdb"
+repl-timeout 30
+`
+	if string(data) != want {
+		t.Errorf("rewritten file:\n%s\nwant:\n%s", data, want)
+	}
+
+	// The file loads back to the same configuration, and rewriting it again changes nothing
+	reloaded, err := LoadConfig([]string{path})
+	if err != nil {
+		t.Fatalf("LoadConfig() error on the rewritten file: %v", err)
+	}
+	if !reflect.DeepEqual(reloaded, cfg) {
+		t.Errorf("reloaded configuration %+v, want %+v", reloaded, cfg)
+	}
+	if err := rewriteConfigFile(path, &reloaded); err != nil {
+		t.Fatalf("rewriteConfigFile() error: %v", err)
+	}
+	if again, _ := os.ReadFile(path); string(again) != want {
+		t.Errorf("second rewrite changed the file:\n%s", again)
+	}
+}
@@ -2,6 +2,7 @@ package miniredis
 
 import (
 	"bytes"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -11,6 +12,11 @@ type MiniRedisDataType int16
 const (
 	Scalar MiniRedisDataType = iota
 	List
+	Hash
+	UnorderedSet
+	SortedSet
+	// Reply marks values that only exist as command replies and are never stored
+	Reply
 )
 
 type MiniRedisObject struct {
@@ -18,6 +24,11 @@ type MiniRedisObject struct {
 	expiry time.Time
 }
 
+// Whether the key holding obj has expired at now
+func (obj *MiniRedisObject) isExpired(now time.Time) bool {
+	return !obj.expiry.IsZero() && !now.Before(obj.expiry)
+}
+
 type MiniRedisData interface {
 	Type() MiniRedisDataType
 	Serialize() ([]byte, error)
@@ -46,3 +57,73 @@ func (n *IntegerData) Serialize() ([]byte, error) {
 	buffer.WriteString("\r\n")
 	return buffer.Bytes(), nil
 }
+
+// Aggregate values, currently only created by loading RDB files
+type ListData struct{ data [][]byte }
+type HashData struct{ data map[string][]byte }
+type SetData struct{ data map[string]struct{} }
+type SortedSetData struct{ data map[string]float64 }
+
+func (l *ListData) Type() MiniRedisDataType      { return List }
+func (h *HashData) Type() MiniRedisDataType      { return Hash }
+func (s *SetData) Type() MiniRedisDataType       { return UnorderedSet }
+func (z *SortedSetData) Type() MiniRedisDataType { return SortedSet }
+
+func (l *ListData) Serialize() ([]byte, error)      { return serializeRESP2(l.reply()) }
+func (h *HashData) Serialize() ([]byte, error)      { return serializeRESP2(h.reply()) }
+func (s *SetData) Serialize() ([]byte, error)       { return serializeRESP2(s.reply()) }
+func (z *SortedSetData) Serialize() ([]byte, error) { return serializeRESP2(z.reply()) }
+
+// Values of an aggregate as a reply, like LRANGE, HGETALL, SMEMBERS and ZRANGE WITHSCORES return them
+type aggregateData interface {
+	reply() MiniRedisData
+}
+
+func (l *ListData) reply() MiniRedisData {
+	elements := make([]MiniRedisData, len(l.data))
+	for i, element := range l.data {
+		elements[i] = &StringData{data: element}
+	}
+	return &ArrayReply{data: elements}
+}
+
+func (h *HashData) reply() MiniRedisData {
+	fields := make([]MiniRedisData, 0, 2*len(h.data))
+	for field, value := range h.data {
+		fields = append(fields, &StringData{data: []byte(field)}, &StringData{data: value})
+	}
+	return &MapReply{data: fields}
+}
+
+func (s *SetData) reply() MiniRedisData {
+	members := make([]MiniRedisData, 0, len(s.data))
+	for member := range s.data {
+		members = append(members, &StringData{data: []byte(member)})
+	}
+	return &SetReply{data: members}
+}
+
+func (z *SortedSetData) reply() MiniRedisData {
+	members := z.sortedMembers()
+	elements := make([]MiniRedisData, 0, 2*len(members))
+	for _, member := range members {
+		elements = append(elements, &StringData{data: []byte(member)}, &DoubleReply{data: z.data[member]})
+	}
+	return &ArrayReply{data: elements}
+}
+
+// Members ordered by score, then lexicographically
+func (z *SortedSetData) sortedMembers() []string {
+	members := make([]string, 0, len(z.data))
+	for member := range z.data {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		si, sj := z.data[members[i]], z.data[members[j]]
+		if si != sj {
+			return si < sj
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
@@ -0,0 +1,15 @@
+package miniredis
+
+import (
+	"hash/crc64"
+)
+
+// Redis checksums RDB files and DUMP payloads with the Jones CRC-64 (reflected, no init or xorout).
+// The table takes the polynomial 0xad93d23594c935a9 in reversed bit order
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// Continues a Redis CRC-64 checksum over p. hash/crc64 inverts the checksum before and after
+// the update, so the inversions are undone here
+func crc64Jones(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64JonesTable, p)
+}
@@ -0,0 +1,266 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The logical databases of a server, indexed by number. SWAPDB installs a new list, so every client
+// sees the two databases exchanged at once
+type databaseSet struct {
+	list atomic.Pointer[[]*ShardedMap[MiniRedisObject]]
+	// Whether the databases are accessed without the locks of their shards, see setKeyspaceOwned
+	lockFree bool
+}
+
+// The databases of the server started with StartServer, which are persisted and replicated
+var databases = newDatabaseSet(DefaultConfig().Databases)
+
+var errDBIndexOutOfRange = errors.New("DB index is out of range")
+
+func newDatabaseSet(count int) *databaseSet {
+	s := &databaseSet{}
+	s.reset(count)
+	return s
+}
+
+// Replaces the databases with count empty ones
+func (s *databaseSet) reset(count int) {
+	dbs := make([]*ShardedMap[MiniRedisObject], count)
+	for i := range dbs {
+		dbs[i] = NewShardedMap[MiniRedisObject](KEYSPACE_SHARDS)
+		dbs[i].SetLockFree(s.lockFree)
+	}
+	s.list.Store(&dbs)
+}
+
+// Keys of database id
+func (s *databaseSet) get(id int) *ShardedMap[MiniRedisObject] {
+	return (*s.list.Load())[id]
+}
+
+func (s *databaseSet) count() int {
+	return len(*s.list.Load())
+}
+
+// Copies the contents of every database, indexed by number. Called with propagationMutex held
+// for writing, so the copies are all taken at the same point of the write history
+func (s *databaseSet) snapshot() []map[string]MiniRedisObject {
+	dbs := *s.list.Load()
+	snapshot := make([]map[string]MiniRedisObject, len(dbs))
+	for i, db := range dbs {
+		snapshot[i] = db.Snapshot()
+	}
+	return snapshot
+}
+
+// Replaces the contents of every database with those of snapshot, emptying the databases it has no entry for.
+// Called with propagationMutex held for writing
+func (s *databaseSet) replace(snapshot []map[string]MiniRedisObject) {
+	for i, db := range *s.list.Load() {
+		contents := map[string]MiniRedisObject{}
+		if i < len(snapshot) && snapshot[i] != nil {
+			contents = snapshot[i]
+		}
+		db.Replace(contents)
+	}
+}
+
+// Ownership of the databases of the server started with StartServer. When a single event loop executes
+// the commands (see eventLoopServer), it owns them: it holds mutex while it handles its events, so the
+// shards are accessed without their locks. Whatever accesses the databases outside of the commands of the
+// loop, such as the cron, the clients served from goroutines or the master link, takes mutex first
+var keyspaceOwner struct {
+	mutex sync.Mutex
+	// Set while an event loop owns the databases
+	owned atomic.Bool
+}
+
+// Switches the databases to being owned by a single event loop, or back to the locks of their shards.
+// Called by StartServer before anything else accesses them, and once everything stopped
+func setKeyspaceOwned(owned bool) {
+	keyspaceOwner.mutex.Lock()
+	defer keyspaceOwner.mutex.Unlock()
+
+	databases.lockFree = owned
+	for _, db := range *databases.list.Load() {
+		db.SetLockFree(owned)
+	}
+	keyspaceOwner.owned.Store(owned)
+}
+
+// Takes the databases from the event loop owning them, if any, until releaseKeyspace is called with the
+// returned value. The commands of the loop, and the other commands that aren't blocking, already hold them
+func acquireKeyspace() bool {
+	if !keyspaceOwner.owned.Load() {
+		return false
+	}
+	keyspaceOwner.mutex.Lock()
+	return true
+}
+
+func releaseKeyspace(acquired bool) {
+	if acquired {
+		keyspaceOwner.mutex.Unlock()
+	}
+}
+
+// Takes back the databases released by releaseKeyspace(acquired)
+func reacquireKeyspace(acquired bool) {
+	if acquired {
+		keyspaceOwner.mutex.Lock()
+	}
+}
+
+// Keys of database id of the server started with StartServer
+func database(id int) *ShardedMap[MiniRedisObject] {
+	return databases.get(id)
+}
+
+func databaseCount() int {
+	return databases.count()
+}
+
+// SELECT index: changes the database the following commands of the client run against
+func handleSelect(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("SELECT command requires exactly 1 argument")
+	}
+
+	id, err := ExtractInt64(&args[0])
+	if err != nil {
+		return nil, err
+	}
+	// Cluster nodes only serve database 0, the slot index tracks its keys alone
+	if config().ClusterEnabled && id != 0 {
+		return nil, fmt.Errorf("SELECT is not allowed in cluster mode")
+	}
+	if id < 0 || id >= int64(c.databases().count()) {
+		return nil, errDBIndexOutOfRange
+	}
+
+	c.db = int(id)
+	return okReply, nil
+}
+
+// MOVE key db: moves key from the selected database to db, unless db already holds it
+func handleMove(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("MOVE command requires exactly 2 arguments")
+	}
+	if config().ClusterEnabled {
+		return nil, fmt.Errorf("MOVE is not allowed in cluster mode")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	id, err := ExtractInt64(&args[1])
+	if err != nil || id < 0 || id >= int64(c.databases().count()) {
+		return nil, errDBIndexOutOfRange
+	}
+	dst := int(id)
+	if dst == c.db {
+		return nil, fmt.Errorf("source and destination objects are the same")
+	}
+
+	// No other write runs (see cmdExclusive), so locking the key in both databases can't deadlock
+	now := c.now()
+	moved := false
+	c.keyspace().Compute(&key, func(obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		if !exists || obj.isExpired(now) {
+			return obj, false
+		}
+		c.databases().get(dst).Compute(&key, func(target MiniRedisObject, targetExists bool) (MiniRedisObject, bool) {
+			if targetExists && !target.isExpired(now) {
+				return target, true
+			}
+			moved = true
+			return obj, true
+		})
+		return obj, !moved
+	})
+
+	if !moved {
+		return &IntegerData{data: 0}, nil
+	}
+	c.addDirty(1)
+	return &IntegerData{data: 1}, nil
+}
+
+// SWAPDB index1 index2: exchanges the contents of two databases. Clients keep their selected number,
+// so the ones connected to either database see the data of the other one right away
+func handleSwapdb(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("SWAPDB command requires exactly 2 arguments")
+	}
+	if config().ClusterEnabled {
+		return nil, fmt.Errorf("SWAPDB is not allowed in cluster mode")
+	}
+
+	first, err := ExtractInt64(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid first DB index")
+	}
+	second, err := ExtractInt64(&args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid second DB index")
+	}
+
+	// No other write runs (see cmdExclusive), so none is applied to a database after it was swapped
+	dbs := c.databases()
+	current := *dbs.list.Load()
+	if first < 0 || first >= int64(len(current)) || second < 0 || second >= int64(len(current)) {
+		return nil, errDBIndexOutOfRange
+	}
+	swapped := append([]*ShardedMap[MiniRedisObject](nil), current...)
+	swapped[first], swapped[second] = swapped[second], swapped[first]
+	dbs.list.Store(&swapped)
+
+	c.addDirty(1)
+	return okReply, nil
+}
+
+// DBSIZE: number of keys of the selected database, including expired keys not deleted yet
+func handleDbsize(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("DBSIZE command takes no arguments")
+	}
+	return &IntegerData{data: int64(c.keyspace().Len())}, nil
+}
+
+// Counts the keys of db, and those with an expiry along with the sum of their TTLs in milliseconds
+func countKeys(db *ShardedMap[MiniRedisObject], now time.Time) (keys, expires, totalTTL int64) {
+	db.Range(func(key string, obj MiniRedisObject) {
+		keys++
+		if !obj.expiry.IsZero() {
+			expires++
+			totalTTL += max(obj.expiry.Sub(now).Milliseconds(), 0)
+		}
+	})
+	return keys, expires, totalTTL
+}
+
+// A line per database holding keys, with the number of keys, of keys with an expiry and their average TTL in milliseconds
+func keyspaceInfo(c *client) []infoField {
+	var fields []infoField
+	now := c.now()
+	for i, db := range *c.databases().list.Load() {
+		keys, expires, totalTTL := countKeys(db, now)
+		if keys == 0 {
+			continue
+		}
+
+		var avgTTL int64
+		if expires > 0 {
+			avgTTL = totalTTL / expires
+		}
+		fields = append(fields, infoField{"db" + strconv.Itoa(i), fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d", keys, expires, avgTTL)})
+	}
+	return fields
+}
@@ -0,0 +1,211 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Deletes key from every database when the test ends
+func cleanupKeyInAllDatabases(t *testing.T, key string) {
+	t.Cleanup(func() {
+		for i := 0; i < databaseCount(); i++ {
+			database(i).Delete(&key)
+		}
+	})
+}
+
+func TestSelect(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	cleanupKeyInAllDatabases(t, "select_key")
+
+	client, err := dialRESP(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer client.Close()
+
+	callCommand(t, client, "SELECT", "3")
+	callCommand(t, client, "SET", "select_key", "in 3")
+	if got := callCommand(t, client, "DBSIZE"); !reflect.DeepEqual(got, &RESPInteger{data: 1}) {
+		t.Errorf("DBSIZE in 3 = %#v, want 1", got)
+	}
+
+	// Each connection has its own selected database
+	other, err := dialRESP(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer other.Close()
+	if got := callCommand(t, other, "GET", "select_key"); !reflect.DeepEqual(got, &RESPBulkString{data: nil}) {
+		t.Errorf("GET in 0 = %#v, want nil", got)
+	}
+	callCommand(t, other, "SELECT", "3")
+	if got := callCommand(t, other, "GET", "select_key"); !reflect.DeepEqual(got, &RESPBulkString{data: []byte("in 3")}) {
+		t.Errorf("GET in 3 = %#v, want in 3", got)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SELECT", "16"}, "ERR DB index is out of range"},
+		{[]string{"SELECT", "-1"}, "ERR DB index is out of range"},
+		{[]string{"SELECT", "one"}, "ERR value is not an integer or out of range"},
+	}
+	for _, tt := range tests {
+		expectCallError(t, client, tt.want, tt.args...)
+	}
+	// A failed SELECT keeps the previous database
+	if got := callCommand(t, client, "GET", "select_key"); !reflect.DeepEqual(got, &RESPBulkString{data: []byte("in 3")}) {
+		t.Errorf("GET after failed SELECT = %#v, want in 3", got)
+	}
+}
+
+func TestMove(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	cleanupKeyInAllDatabases(t, "move_key")
+	cleanupKeyInAllDatabases(t, "move_taken")
+
+	client, err := dialRESP(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer client.Close()
+
+	callCommand(t, client, "SET", "move_key", "v", "PX", "100000")
+	callCommand(t, client, "SET", "move_taken", "in 0")
+	callCommand(t, client, "SELECT", "5")
+	callCommand(t, client, "SET", "move_taken", "in 5")
+	callCommand(t, client, "SELECT", "0")
+
+	tests := []struct {
+		args []string
+		want RESPData
+	}{
+		{[]string{"MOVE", "move_key", "5"}, &RESPInteger{data: 1}},
+		{[]string{"MOVE", "move_key", "5"}, &RESPInteger{data: 0}},
+		{[]string{"MOVE", "move_taken", "5"}, &RESPInteger{data: 0}},
+	}
+	for _, tt := range tests {
+		if got := callCommand(t, client, tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+
+	// The key keeps its TTL, and the key already in the destination is left alone
+	obj, ok := lookupKey(database(5), "move_key", time.Now())
+	if !ok || obj.expiry.IsZero() {
+		t.Errorf("moved key = %#v, %v, want a key with an expiry", obj, ok)
+	}
+	if obj, ok := lookupKey(database(0), "move_taken", time.Now()); !ok || string(obj.data.(*StringData).data) != "in 0" {
+		t.Errorf("move_taken was moved although the destination holds it")
+	}
+	if obj, ok := lookupKey(database(5), "move_taken", time.Now()); !ok || string(obj.data.(*StringData).data) != "in 5" {
+		t.Errorf("move_taken in the destination was overwritten")
+	}
+
+	expectCallError(t, client, "ERR source and destination objects are the same", "MOVE", "move_taken", "0")
+	expectCallError(t, client, "ERR DB index is out of range", "MOVE", "move_taken", "16")
+}
+
+func TestSwapdb(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	cleanupKeyInAllDatabases(t, "swap_key")
+
+	first, err := dialRESP(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer first.Close()
+	second, err := dialRESP(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer second.Close()
+
+	callCommand(t, first, "SELECT", "1")
+	callCommand(t, first, "SET", "swap_key", "from 1")
+	callCommand(t, second, "SELECT", "2")
+
+	callCommand(t, second, "SWAPDB", "1", "2")
+	defer callCommand(t, second, "SWAPDB", "1", "2")
+
+	// Both clients keep their database number, and see the other contents right away
+	if got := callCommand(t, second, "GET", "swap_key"); !reflect.DeepEqual(got, &RESPBulkString{data: []byte("from 1")}) {
+		t.Errorf("GET in 2 after SWAPDB = %#v, want from 1", got)
+	}
+	if got := callCommand(t, first, "GET", "swap_key"); !reflect.DeepEqual(got, &RESPBulkString{data: nil}) {
+		t.Errorf("GET in 1 after SWAPDB = %#v, want nil", got)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SWAPDB", "x", "1"}, "ERR invalid first DB index"},
+		{[]string{"SWAPDB", "1", "x"}, "ERR invalid second DB index"},
+		{[]string{"SWAPDB", "1", "16"}, "ERR DB index is out of range"},
+	}
+	for _, tt := range tests {
+		expectCallError(t, first, tt.want, tt.args...)
+	}
+}
+
+func TestKeyspaceInfo(t *testing.T) {
+	cleanupKeyInAllDatabases(t, "info_key")
+	cleanupKeyInAllDatabases(t, "info_volatile")
+
+	key, volatile := "info_key", "info_volatile"
+	database(7).Set(&key, &MiniRedisObject{data: &StringData{data: []byte("v")}})
+	database(7).Set(&volatile, &MiniRedisObject{data: &StringData{data: []byte("v")}, expiry: time.Now().Add(time.Hour)})
+
+	var db7 string
+	for _, field := range keyspaceInfo(newClient(nil)) {
+		if field.name == "db7" {
+			db7 = field.value
+		}
+	}
+	if !strings.HasPrefix(db7, "keys=2,expires=1,avg_ttl=") {
+		t.Errorf("db7 = %q, want keys=2,expires=1,avg_ttl=...", db7)
+	}
+}
+
+func TestAppendOnlyFileSelectsDatabases(t *testing.T) {
+	useTempAppendOnlyFile(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	cleanupKeyInAllDatabases(t, "aof_db_key")
+
+	dialAndSend(t, addr, []string{
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n4\r\n",
+		"*3\r\n$3\r\nSET\r\n$10\r\naof_db_key\r\n$1\r\n4\r\n",
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n",
+		"*3\r\n$3\r\nSET\r\n$10\r\naof_db_key\r\n$1\r\n0\r\n",
+	})
+	if err := closeAppendOnlyFile(); err != nil {
+		t.Fatalf("closeAppendOnlyFile() error: %v", err)
+	}
+
+	key := "aof_db_key"
+	database(0).Delete(&key)
+	database(4).Delete(&key)
+	if err := loadAppendOnlyFile(); err != nil {
+		t.Fatalf("loadAppendOnlyFile() error: %v", err)
+	}
+
+	for _, db := range []int{0, 4} {
+		obj, ok := lookupKey(database(db), key, time.Now())
+		if want := strconv.Itoa(db); !ok || string(obj.data.(*StringData).data) != want {
+			t.Errorf("aof_db_key in %d = %#v, %v, want %s", db, obj, ok, want)
+		}
+	}
+}
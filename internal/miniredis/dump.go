@@ -0,0 +1,455 @@
+package miniredis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Serializes a value the way DUMP does: its RDB type and encoding, followed by the
+// RDB version (2 bytes) and a CRC64 of everything before it (8 bytes), both little endian
+func createDumpPayload(data MiniRedisData) ([]byte, error) {
+	var buffer bytes.Buffer
+	e := newRDBEncoder(&buffer)
+
+	objType, err := rdbObjectType(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.writeByte(objType); err != nil {
+		return nil, err
+	}
+	if err := e.writeObject(data); err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, 2)
+	binary.LittleEndian.PutUint16(footer, RDB_VERSION)
+	if err := e.write(footer); err != nil {
+		return nil, err
+	}
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, e.crc)
+	if _, err := e.writer.Write(checksum); err != nil {
+		return nil, err
+	}
+	if err := e.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+var errBadDumpPayload = fmt.Errorf("DUMP payload version or checksum are wrong")
+
+// Checks the footer of a DUMP payload and decodes the value it holds
+func decodeDumpPayload(payload []byte) (MiniRedisData, error) {
+	if len(payload) < 10 {
+		return nil, errBadDumpPayload
+	}
+
+	footer := payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(footer)
+	if version > RDB_MAX_LOAD_VERSION {
+		return nil, errBadDumpPayload
+	}
+	if crc64Jones(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return nil, errBadDumpPayload
+	}
+
+	body := payload[:len(payload)-10]
+	d := newRDBDecoder(bytes.NewReader(body))
+	objType, err := d.readByte()
+	if err != nil {
+		return nil, fmt.Errorf("Bad data format")
+	}
+	data, err := d.readObject(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Bad data format")
+	}
+	// The value must use the whole payload
+	if _, err := d.readByte(); err == nil {
+		return nil, fmt.Errorf("Bad data format")
+	}
+	return data, nil
+}
+
+func handleDump(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("DUMP command requires exactly 1 argument")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	obj, exists := c.lookupKeyRead(key)
+	if !exists {
+		return &StringData{data: nil}, nil
+	}
+
+	payload, err := createDumpPayload(obj.data)
+	if err != nil {
+		return nil, err
+	}
+	return &StringData{data: payload}, nil
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency].
+// IDLETIME and FREQ are validated but ignored, as keys don't track access times or frequencies.
+// Relative TTLs are propagated as ABSTTL, so replaying the command doesn't extend them
+func handleRestore(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("RESTORE command requires at least 3 arguments")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	ttl, err := ExtractInt64(&args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := ExtractByteSlice(&args[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	var replace, absTTL bool
+	for i := 3; i < len(args); i++ {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, errSyntax
+		}
+
+		switch strings.ToUpper(option) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			i++
+			idle, err := ExtractInt64(&args[i])
+			if err != nil {
+				return nil, err
+			}
+			if idle < 0 {
+				return nil, fmt.Errorf("Invalid IDLETIME value, must be >= 0")
+			}
+		case "FREQ":
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			i++
+			freq, err := ExtractInt64(&args[i])
+			if err != nil {
+				return nil, err
+			}
+			if freq < 0 || freq > 255 {
+				return nil, fmt.Errorf("Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if ttl < 0 {
+		return nil, fmt.Errorf("Invalid TTL value, must be >= 0")
+	}
+
+	data, err := decodeDumpPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.now()
+	var expiry time.Time
+	if ttl > 0 {
+		if absTTL {
+			expiry = time.UnixMilli(ttl)
+		} else {
+			expiry = now.Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+	expired := !expiry.IsZero() && !expiry.After(now)
+
+	busy := false
+	deleted := false
+	c.keyspace().Compute(&key, func(obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		exists = exists && !obj.isExpired(now)
+		if exists && !replace {
+			busy = true
+			return obj, true
+		}
+		// A value arriving already expired only removes the key it replaces
+		if expired {
+			deleted = exists
+			return obj, false
+		}
+		return MiniRedisObject{data: data, expiry: expiry}, true
+	})
+
+	if busy {
+		return nil, newRedisError(ErrPrefixBusyKey, "Target key name already exists.")
+	}
+
+	switch {
+	case expired && deleted:
+		c.addDirty(1)
+		c.rewritePropagated([]byte("DEL"), []byte(key))
+	case !expired:
+		c.addDirty(1)
+		if ttl > 0 && !absTTL {
+			propagated := [][]byte{[]byte("RESTORE"), []byte(key), []byte(strconv.FormatInt(expiry.UnixMilli(), 10)), payload, []byte("ABSTTL")}
+			if replace {
+				propagated = append(propagated, []byte("REPLACE"))
+			}
+			c.rewritePropagated(propagated...)
+		}
+	}
+	return okReply, nil
+}
+
+// Key positions of MIGRATE: the key argument, or everything after KEYS when it is empty
+func migrateKeys(args []RESPData) []int {
+	if len(args) < 5 {
+		return nil
+	}
+	if key, _ := ExtractByteSlice(&args[2]); len(key) > 0 {
+		return []int{2}
+	}
+	for i := 5; i < len(args); i++ {
+		option, _ := ExtractString(&args[i])
+		switch strings.ToUpper(option) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			positions := make([]int, 0, len(args)-i-1)
+			for k := i + 1; k < len(args); k++ {
+				positions = append(positions, k)
+			}
+			return positions
+		}
+	}
+	return nil
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]].
+// The keys are sent to the target with RESTORE and, unless COPY is given, deleted locally once the
+// target accepted them. Writes are blocked for the whole transfer, so no key changes halfway through
+func handleMigrate(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) < 5 {
+		return nil, fmt.Errorf("MIGRATE command requires at least 5 arguments")
+	}
+
+	host, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %w", err)
+	}
+	port, err := ExtractString(&args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	key, err := ExtractString(&args[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	db, err := ExtractInt64(&args[3])
+	if err != nil {
+		return nil, err
+	}
+	timeoutMillis, err := ExtractInt64(&args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	var copyKeys, replace bool
+	var auth [][]byte
+	keys := []string{key}
+	for i := 5; i < len(args); i++ {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, errSyntax
+		}
+
+		switch strings.ToUpper(option) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			password, _ := ExtractByteSlice(&args[i+1])
+			auth = [][]byte{[]byte("AUTH"), password}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, errSyntax
+			}
+			username, _ := ExtractByteSlice(&args[i+1])
+			password, _ := ExtractByteSlice(&args[i+2])
+			auth = [][]byte{[]byte("AUTH"), username, password}
+			i += 2
+		case "KEYS":
+			if key != "" {
+				return nil, fmt.Errorf("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = keys[:0]
+			for _, arg := range args[i+1:] {
+				name, err := ExtractString(&arg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid key: %w", err)
+				}
+				keys = append(keys, name)
+			}
+			i = len(args)
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	// Serialize the keys that exist, with their remaining TTL. Expired keys are skipped without
+	// being deleted, since nothing is propagated before the network I/O
+	type migratedKey struct {
+		name    string
+		data    MiniRedisData
+		ttl     int64
+		payload []byte
+	}
+	var migrated []migratedKey
+	now := c.now()
+	for _, name := range keys {
+		obj, exists := c.keyspace().Get(&name)
+		if !exists || obj.isExpired(now) {
+			continue
+		}
+
+		payload, err := createDumpPayload(obj.data)
+		if err != nil {
+			return nil, err
+		}
+		var ttl int64
+		if !obj.expiry.IsZero() {
+			ttl = max(obj.expiry.Sub(now).Milliseconds(), 1)
+		}
+		migrated = append(migrated, migratedKey{name: name, data: obj.data, ttl: ttl, payload: payload})
+	}
+
+	if len(migrated) == 0 {
+		return &SimpleStringReply{data: "NOKEY"}, nil
+	}
+
+	// Everything is pipelined, then the replies are read in order
+	var commands [][][]byte
+	if auth != nil {
+		commands = append(commands, auth)
+	}
+	if db != 0 {
+		commands = append(commands, [][]byte{[]byte("SELECT"), []byte(strconv.FormatInt(db, 10))})
+	}
+	setupCommands := len(commands)
+	// A cluster node importing the slot only accepts the keys from RESTORE-ASKING
+	restoreCommand := "RESTORE"
+	if config().ClusterEnabled {
+		restoreCommand = "RESTORE-ASKING"
+	}
+	for _, m := range migrated {
+		restore := [][]byte{[]byte(restoreCommand), []byte(m.name), []byte(strconv.FormatInt(m.ttl, 10)), m.payload}
+		if replace {
+			restore = append(restore, []byte("REPLACE"))
+		}
+		commands = append(commands, restore)
+	}
+
+	var pipeline []byte
+	for _, command := range commands {
+		pipeline = catCommand(pipeline, command)
+	}
+
+	// Other clients keep writing while the keys are sent
+	var targetErr error
+	restored := make([]bool, len(migrated))
+	lockErr := unlockedDuring(c, func() {
+		target, err := dialRESP(net.JoinHostPort(host, port), timeout)
+		if err != nil {
+			targetErr = newRedisError(ErrPrefixIOErr, "error or timeout connecting to the client")
+			return
+		}
+		defer target.Close()
+
+		target.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := target.conn.Write(pipeline); err != nil {
+			targetErr = newRedisError(ErrPrefixIOErr, "error or timeout writing to target instance")
+			return
+		}
+
+		for i := range commands {
+			_, err := target.readReply()
+			if err != nil {
+				if _, ok := err.(*remoteError); !ok {
+					targetErr = newRedisError(ErrPrefixIOErr, "error or timeout reading to target instance")
+					return
+				}
+				if targetErr == nil {
+					targetErr = fmt.Errorf("Target instance replied with error: %s", err)
+				}
+				// Nothing was restored if authentication or SELECT failed
+				if i < setupCommands {
+					return
+				}
+				continue
+			}
+			if i >= setupCommands {
+				restored[i-setupCommands] = true
+			}
+		}
+	})
+	if lockErr != nil {
+		return nil, lockErr
+	}
+
+	// Keys written meanwhile keep their new value
+	deleted := [][]byte{[]byte("DEL")}
+	for i, m := range migrated {
+		if !restored[i] || copyKeys {
+			continue
+		}
+		removed := false
+		c.keyspace().Compute(&m.name, func(obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+			removed = exists && obj.data == m.data
+			return obj, exists && !removed
+		})
+		if removed {
+			deleted = append(deleted, []byte(m.name))
+		}
+	}
+
+	if len(deleted) > 1 {
+		c.addDirty(int64(len(deleted) - 1))
+		c.rewritePropagated(deleted...)
+	}
+	if targetErr != nil {
+		return nil, targetErr
+	}
+	return okReply, nil
+}
@@ -0,0 +1,415 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDumpPayloadRoundTrip(t *testing.T) {
+	values := []MiniRedisData{
+		&StringData{data: []byte("hello")},
+		&ListData{data: [][]byte{[]byte("a"), []byte("b"), []byte("c")}},
+		&HashData{data: map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")}},
+		&SetData{data: map[string]struct{}{"x": {}, "y": {}}},
+		&SortedSetData{data: map[string]float64{"m1": 1.5, "m2": -2}},
+	}
+
+	for _, value := range values {
+		payload, err := createDumpPayload(value)
+		if err != nil {
+			t.Fatalf("createDumpPayload(%T) error: %v", value, err)
+		}
+
+		decoded, err := decodeDumpPayload(payload)
+		if err != nil {
+			t.Fatalf("decodeDumpPayload(%T) error: %v", value, err)
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("round trip of %T = %#v, want %#v", value, decoded, value)
+		}
+	}
+}
+
+func TestDecodeDumpPayloadErrors(t *testing.T) {
+	payload, err := createDumpPayload(&StringData{data: []byte("hello")})
+	if err != nil {
+		t.Fatalf("createDumpPayload() error: %v", err)
+	}
+
+	corrupt := append([]byte(nil), payload...)
+	corrupt[2] ^= 0xff
+
+	newerVersion := append([]byte(nil), payload...)
+	newerVersion[len(newerVersion)-10] = RDB_MAX_LOAD_VERSION + 1
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "too short", payload: []byte("short")},
+		{name: "bad checksum", payload: corrupt},
+		{name: "newer version", payload: newerVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeDumpPayload(tt.payload); err != errBadDumpPayload {
+				t.Errorf("decodeDumpPayload() error = %v, want %v", err, errBadDumpPayload)
+			}
+		})
+	}
+}
+
+func TestDumpRestoreCommands(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	conn, err := dialRESP(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer conn.Close()
+
+	call := func(args ...string) (RESPData, error) {
+		t.Helper()
+		byteArgs := make([][]byte, len(args))
+		for i, arg := range args {
+			byteArgs[i] = []byte(arg)
+		}
+		return conn.call(byteArgs...)
+	}
+
+	for _, key := range []string{"dump_src", "dump_dst", "dump_expired", "dump_missing"} {
+		key := key
+		defer database(0).Delete(&key)
+	}
+	srcKey := "dump_src"
+	database(0).Set(&srcKey, &MiniRedisObject{data: &ListData{data: [][]byte{[]byte("a"), []byte("b")}}})
+
+	reply, err := call("DUMP", "dump_src")
+	if err != nil {
+		t.Fatalf("DUMP error: %v", err)
+	}
+	payload, err := ExtractString(&reply)
+	if err != nil {
+		t.Fatalf("DUMP reply %#v is not a bulk string", reply)
+	}
+
+	if reply, err := call("DUMP", "dump_missing"); err != nil || reply.(*RESPBulkString).data != nil {
+		t.Errorf("DUMP of a missing key = %#v, %v", reply, err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "restore", args: []string{"RESTORE", "dump_dst", "0", payload}},
+		{name: "busy key", args: []string{"RESTORE", "dump_dst", "0", payload}, wantErr: "BUSYKEY Target key name already exists."},
+		{name: "replace", args: []string{"RESTORE", "dump_dst", "100000", payload, "REPLACE", "IDLETIME", "10", "FREQ", "5"}},
+		{name: "negative ttl", args: []string{"RESTORE", "dump_missing", "-1", payload}, wantErr: "ERR Invalid TTL value, must be >= 0"},
+		{name: "invalid freq", args: []string{"RESTORE", "dump_missing", "0", payload, "FREQ", "256"}, wantErr: "ERR Invalid FREQ value, must be >= 0 and <= 255"},
+		{name: "unknown option", args: []string{"RESTORE", "dump_missing", "0", payload, "NOPE"}, wantErr: "ERR syntax error"},
+		{name: "bad payload", args: []string{"RESTORE", "dump_missing", "0", "garbage payload"}, wantErr: "ERR DUMP payload version or checksum are wrong"},
+		{name: "expired absttl", args: []string{"RESTORE", "dump_expired", "1", payload, "ABSTTL"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := call(tt.args...)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("%v error: %v", tt.args[:3], err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("%v error = %v, want %q", tt.args[:3], err, tt.wantErr)
+			}
+		})
+	}
+
+	dstKey := "dump_dst"
+	obj, exists := lookupKey(database(0), dstKey, time.Now())
+	if !exists {
+		t.Fatalf("restored key %q missing", dstKey)
+	}
+	if list, ok := obj.data.(*ListData); !ok || len(list.data) != 2 {
+		t.Errorf("restored value = %#v, want the dumped list", obj.data)
+	}
+	if remaining := time.Until(obj.expiry); remaining <= 0 || remaining > 100*time.Second {
+		t.Errorf("restored key expires in %v, want at most 100s", remaining)
+	}
+
+	if _, exists := lookupKey(database(0), "dump_expired", time.Now()); exists {
+		t.Errorf("key restored with an expiry in the past exists")
+	}
+}
+
+// Wraps an RDB encoded value in the DUMP footer, with a valid checksum
+func craftDumpPayload(body []byte) []byte {
+	payload := binary.LittleEndian.AppendUint16(append([]byte(nil), body...), RDB_VERSION)
+	return binary.LittleEndian.AppendUint64(payload, crc64Jones(0, payload))
+}
+
+func TestRestoreHugeLengths(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	conn, err := dialRESP(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer conn.Close()
+
+	huge := binary.BigEndian.AppendUint64([]byte{rdb64BitLen}, 1<<62)
+	payloads := map[string][]byte{
+		"string": craftDumpPayload(append([]byte{RDB_TYPE_STRING}, huge...)),
+		// 1 compressed byte announcing 2^62 bytes once uncompressed
+		"lzf string": craftDumpPayload(append(append([]byte{RDB_TYPE_STRING, rdbEncVal<<6 | rdbEncLZF, 1}, huge...), 0)),
+	}
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			_, err := conn.call([]byte("RESTORE"), []byte("dump_huge"), []byte("0"), payload)
+			if err == nil || err.Error() != "ERR Bad data format" {
+				t.Fatalf("RESTORE error = %v, want ERR Bad data format", err)
+			}
+			// The server is still serving the connection
+			if reply, err := conn.call([]byte("PING")); err != nil || reply.Dump() != "PONG" {
+				t.Fatalf("PING = %v, %v", reply, err)
+			}
+		})
+	}
+}
+
+// Accepts a single connection and answers every command it receives with +OK, or with an
+// error for a RESTORE of failKey. The commands received are sent on the returned channel
+func startMigrateTarget(t *testing.T, failKey string) (string, <-chan [][]byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen on random port: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan [][]byte, 16)
+	var once sync.Once
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer once.Do(func() { close(received) })
+
+		reader := bufio.NewReader(conn)
+		for {
+			args, _, err := readMultibulk(reader)
+			if err != nil {
+				return
+			}
+			received <- args
+
+			reply := "+OK\r\n"
+			if string(args[0]) == "RESTORE" && string(args[1]) == failKey {
+				reply = "-ERR injected failure\r\n"
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestMigrate(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	keys := []string{"migrate_1", "migrate_2", "migrate_3", "migrate_fail"}
+	for _, key := range keys {
+		key := key
+		defer database(0).Delete(&key)
+	}
+	setKeys := func() {
+		for _, key := range keys {
+			key := key
+			database(0).Set(&key, &MiniRedisObject{data: &StringData{data: []byte(key)}})
+		}
+	}
+
+	bulk := func(s string) string {
+		return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+	}
+	migrate := func(targetAddr string, args ...string) string {
+		host, port, _ := net.SplitHostPort(targetAddr)
+		all := append([]string{"MIGRATE", host, port}, args...)
+		command := "*" + strconv.Itoa(len(all)) + "\r\n"
+		for _, arg := range all {
+			command += bulk(arg)
+		}
+		replies := dialAndSend(t, addr, []string{command})
+		if len(replies) == 0 {
+			t.Fatalf("no reply to %v", all)
+		}
+		return replies[0]
+	}
+
+	t.Run("single key", func(t *testing.T) {
+		setKeys()
+		target, received := startMigrateTarget(t, "")
+		if reply := migrate(target, "migrate_1", "2", "1000"); reply != "+OK" {
+			t.Fatalf("MIGRATE reply = %q, want +OK", reply)
+		}
+
+		selectCommand := <-received
+		if string(selectCommand[0]) != "SELECT" || string(selectCommand[1]) != "2" {
+			t.Errorf("first command = %q, want SELECT 2", selectCommand)
+		}
+		restore := <-received
+		if string(restore[0]) != "RESTORE" || string(restore[1]) != "migrate_1" {
+			t.Fatalf("second command = %q, want RESTORE migrate_1", restore)
+		}
+		value, err := decodeDumpPayload(restore[3])
+		if data, ok := value.(*StringData); err != nil || !ok || string(data.data) != "migrate_1" {
+			t.Errorf("migrated value = %#v, %v", value, err)
+		}
+		if _, exists := lookupKey(database(0), "migrate_1", time.Now()); exists {
+			t.Errorf("migrated key still exists locally")
+		}
+	})
+
+	t.Run("keys with copy and replace", func(t *testing.T) {
+		setKeys()
+		target, received := startMigrateTarget(t, "")
+		reply := migrate(target, "", "0", "1000", "COPY", "REPLACE", "AUTH2", "user", "pass", "KEYS", "migrate_2", "migrate_3", "migrate_none")
+		if reply != "+OK" {
+			t.Fatalf("MIGRATE reply = %q, want +OK", reply)
+		}
+
+		auth := <-received
+		if len(auth) != 3 || string(auth[0]) != "AUTH" {
+			t.Errorf("first command = %q, want AUTH user pass", auth)
+		}
+		for _, key := range []string{"migrate_2", "migrate_3"} {
+			restore := <-received
+			if string(restore[1]) != key || string(restore[len(restore)-1]) != "REPLACE" {
+				t.Errorf("command = %q, want RESTORE %s ... REPLACE", restore[:2], key)
+			}
+			if _, exists := lookupKey(database(0), key, time.Now()); !exists {
+				t.Errorf("key %q copied with COPY was deleted", key)
+			}
+		}
+	})
+
+	t.Run("target error", func(t *testing.T) {
+		setKeys()
+		target, _ := startMigrateTarget(t, "migrate_fail")
+		reply := migrate(target, "", "0", "1000", "KEYS", "migrate_fail", "migrate_3")
+		if reply != "-ERR Target instance replied with error: ERR injected failure" {
+			t.Errorf("MIGRATE reply = %q", reply)
+		}
+		if _, exists := lookupKey(database(0), "migrate_fail", time.Now()); !exists {
+			t.Errorf("key rejected by the target was deleted")
+		}
+		if _, exists := lookupKey(database(0), "migrate_3", time.Now()); exists {
+			t.Errorf("key accepted by the target still exists locally")
+		}
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		target, _ := startMigrateTarget(t, "")
+		if reply := migrate(target, "migrate_none", "0", "1000"); reply != "+NOKEY" {
+			t.Errorf("MIGRATE reply = %q, want +NOKEY", reply)
+		}
+	})
+
+	t.Run("keys with a key argument", func(t *testing.T) {
+		target, _ := startMigrateTarget(t, "")
+		reply := migrate(target, "migrate_1", "0", "1000", "KEYS", "migrate_2")
+		if reply != "-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string" {
+			t.Errorf("MIGRATE reply = %q", reply)
+		}
+	})
+
+	t.Run("unreachable target", func(t *testing.T) {
+		setKeys()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen on random port: %v", err)
+		}
+		target := listener.Addr().String()
+		listener.Close()
+
+		if reply := migrate(target, "migrate_1", "0", "100"); reply != "-IOERR error or timeout connecting to the client" {
+			t.Errorf("MIGRATE reply = %q", reply)
+		}
+	})
+}
+
+func TestMigrateReleasesWritesDuringTransfer(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	for _, key := range []string{"migrate_slow", "migrate_other"} {
+		database(0).Set(&key, &MiniRedisObject{data: &StringData{data: []byte("old")}})
+		defer database(0).Delete(&key)
+	}
+
+	// The target only replies once released
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen on random port: %v", err)
+	}
+	defer listener.Close()
+	received, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := readMultibulk(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		close(received)
+		<-release
+		conn.Write([]byte("+OK\r\n"))
+	}()
+
+	conn, err := dialRESP(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer conn.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	migrated := make(chan error, 1)
+	go func() {
+		_, err := conn.call([]byte("MIGRATE"), []byte(host), []byte(port), []byte("migrate_slow"), []byte("0"), []byte("5000"))
+		migrated <- err
+	}()
+	<-received
+
+	// Writes go on while MIGRATE waits for the target, including to the key being moved
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$13\r\nmigrate_other\r\n$3\r\nnew\r\n",
+		"*3\r\n$3\r\nSET\r\n$12\r\nmigrate_slow\r\n$3\r\nnew\r\n",
+	})
+	if len(replies) != 4 {
+		t.Errorf("SET during MIGRATE replied %q", replies)
+	}
+	close(release)
+	if err := <-migrated; err != nil {
+		t.Fatalf("MIGRATE error: %v", err)
+	}
+
+	if obj, exists := lookupKey(database(0), "migrate_slow", time.Now()); !exists || string(obj.data.(*StringData).data) != "new" {
+		t.Errorf("key written during MIGRATE was deleted")
+	}
+}
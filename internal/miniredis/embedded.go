@@ -0,0 +1,296 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-memory server for the tests of Go programs, exposed by the miniredis package at the root of the module.
+// Each Server has databases of its own, which aren't persisted, replicated or clustered: the commands managing
+// these reply with an error. Unlike StartServer, Start returns as soon as the server accepts connections
+type Server struct {
+	databases *databaseSet
+	// Database the helpers (Set, Get, ...) work on
+	selected int
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	// Moved by FastForward and SetTime
+	clock *clock
+	// The accept loop and the goroutines serving conns
+	running sync.WaitGroup
+}
+
+// Returned by Get for keys that don't exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// Returned by Get for keys that don't hold a string
+var ErrWrongType = errWrongType
+
+// Failure reporting of testing.TB, used by the Check helpers
+type T interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// Creates a server with the configured number of databases, which accepts connections once started
+func NewServer() *Server {
+	return &Server{databases: newDatabaseSet(config().Databases), clock: &clock{}}
+}
+
+// Starts accepting connections on a port of the loopback interface picked by the system, see Addr
+func (s *Server) Start() error {
+	return s.StartAddr("127.0.0.1:0")
+}
+
+// Starts accepting connections on addr
+func (s *Server) StartAddr(addr string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listener != nil {
+		return fmt.Errorf("server already listening on %s", s.listener.Addr())
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	s.listener = listener
+	s.conns = map[net.Conn]struct{}{}
+
+	s.running.Add(1)
+	go s.serve(listener)
+	return nil
+}
+
+func (s *Server) serve(listener net.Listener) {
+	defer s.running.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("failed to accept connection: %v", err)
+			continue
+		}
+
+		s.mutex.Lock()
+		// Close ran between Accept and Lock
+		if s.listener != listener {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.running.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.running.Done()
+			// Connections closed by Close end with an error that isn't worth logging
+			if err := handleConnection(conn, s); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("error handling connection: %v", err)
+			}
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Address the server accepts connections on, as "host:port". Empty when the server isn't started
+func (s *Server) Addr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Stops accepting connections and closes the connected clients, returning once they are all served.
+// The data is kept, so the server can be started again
+func (s *Server) Close() {
+	s.mutex.Lock()
+	if s.listener == nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.listener.Close()
+	s.listener = nil
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.running.Wait()
+}
+
+// Changes the database the helpers work on. Clients still start in database 0
+func (s *Server) Select(id int) error {
+	if id < 0 || id >= s.databases.count() {
+		return errDBIndexOutOfRange
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.selected = id
+	return nil
+}
+
+// Current time of the server, see FastForward and SetTime
+func (s *Server) now() time.Time {
+	return s.clock.now()
+}
+
+// Moves the clock of the server forward by d and deletes the keys expiring in the meantime, so TTLs
+// can be tested without waiting for them
+func (s *Server) FastForward(d time.Duration) {
+	s.clock.fastForward(d)
+	s.deleteExpiredKeys()
+}
+
+// Stops the clock of the server at t, after which it only moves with FastForward, and deletes the
+// keys expired at t. The TTLs seen by clients are then the same on every run
+func (s *Server) SetTime(t time.Time) {
+	s.clock.setTime(t)
+	s.deleteExpiredKeys()
+}
+
+// Deletes the keys of every database expired at the current time of the server
+func (s *Server) deleteExpiredKeys() {
+	// Taken like a write sent by a client, so it doesn't run during MOVE or SWAPDB
+	propagationMutex.RLock()
+	defer propagationMutex.RUnlock()
+
+	now := s.now()
+	for i := 0; i < s.databases.count(); i++ {
+		db := s.databases.get(i)
+		var expired []string
+		db.Range(func(key string, obj MiniRedisObject) {
+			if obj.isExpired(now) {
+				expired = append(expired, key)
+			}
+		})
+		for _, key := range expired {
+			deleteIfExpired(db, key, now)
+		}
+	}
+}
+
+func (s *Server) keyspace() *ShardedMap[MiniRedisObject] {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.databases.get(s.selected)
+}
+
+// Sets key to the string value without an expiry, as SET does
+func (s *Server) Set(key, value string) {
+	// Taken like a write sent by a client, so it doesn't run during MOVE or SWAPDB
+	propagationMutex.RLock()
+	defer propagationMutex.RUnlock()
+	s.keyspace().Set(&key, &MiniRedisObject{data: &StringData{data: []byte(value)}})
+}
+
+// Value of the string stored at key, ErrKeyNotFound when it doesn't exist and ErrWrongType
+// when it holds another type
+func (s *Server) Get(key string) (string, error) {
+	obj, exists := lookupKey(s.keyspace(), key, s.now())
+	if !exists {
+		return "", ErrKeyNotFound
+	}
+	switch data := obj.data.(type) {
+	case *StringData:
+		return string(data.data), nil
+	case *IntegerData:
+		return strconv.FormatInt(data.data, 10), nil
+	}
+	return "", ErrWrongType
+}
+
+// Reports an error to t unless key holds the string expected
+func (s *Server) CheckGet(t T, key, expected string) {
+	t.Helper()
+	got, err := s.Get(key)
+	if err != nil {
+		t.Errorf("GET %s: %v", key, err)
+		return
+	}
+	if got != expected {
+		t.Errorf("GET %s = %q, want %q", key, got, expected)
+	}
+}
+
+// Sorted names of the keys that didn't expire
+func (s *Server) Keys() []string {
+	keys := []string{}
+	now := s.now()
+	s.keyspace().Range(func(key string, obj MiniRedisObject) {
+		if !obj.isExpired(now) {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Empties every database, as FLUSHALL does
+func (s *Server) FlushAll() {
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	s.databases.replace(nil)
+}
+
+// Lists the keys that didn't expire and their values, a line per key sorted by name, to print
+// the contents of the server when a test fails
+func (s *Server) Dump() string {
+	db := s.keyspace()
+	now := s.now()
+	var builder strings.Builder
+	for _, key := range s.Keys() {
+		obj, exists := db.Get(&key)
+		if !exists || obj.isExpired(now) {
+			continue
+		}
+		fmt.Fprintf(&builder, "- %s: %s\n", key, dumpValue(obj.data))
+	}
+	return builder.String()
+}
+
+// Formats data for Dump: strings are quoted, and the elements of the other types are listed between brackets
+func dumpValue(data MiniRedisData) string {
+	var elements []string
+	switch data := data.(type) {
+	case *StringData:
+		return strconv.Quote(string(data.data))
+	case *IntegerData:
+		return strconv.FormatInt(data.data, 10)
+	case *ListData:
+		for _, element := range data.data {
+			elements = append(elements, strconv.Quote(string(element)))
+		}
+	case *HashData:
+		for field, value := range data.data {
+			elements = append(elements, strconv.Quote(field)+"="+strconv.Quote(string(value)))
+		}
+		sort.Strings(elements)
+	case *SetData:
+		for member := range data.data {
+			elements = append(elements, strconv.Quote(member))
+		}
+		sort.Strings(elements)
+	case *SortedSetData:
+		for _, member := range data.sortedMembers() {
+			elements = append(elements, strconv.Quote(member)+"="+strconv.FormatFloat(data.data[member], 'g', -1, 64))
+		}
+	}
+	return "[" + strings.Join(elements, " ") + "]"
+}
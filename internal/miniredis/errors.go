@@ -0,0 +1,114 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The first word of a RESP error reply. Clients use it to tell error kinds apart
+type ErrorPrefix string
+
+const (
+	ErrPrefixGeneric   ErrorPrefix = "ERR"
+	ErrPrefixWrongType ErrorPrefix = "WRONGTYPE"
+	ErrPrefixNoScript  ErrorPrefix = "NOSCRIPT"
+	ErrPrefixBusy      ErrorPrefix = "BUSY"
+	ErrPrefixNoProto   ErrorPrefix = "NOPROTO"
+	ErrPrefixWrongPass ErrorPrefix = "WRONGPASS"
+	ErrPrefixMisconf   ErrorPrefix = "MISCONF"
+	ErrPrefixBusyKey   ErrorPrefix = "BUSYKEY"
+	ErrPrefixIOErr     ErrorPrefix = "IOERR"
+	ErrPrefixReadOnly  ErrorPrefix = "READONLY"
+	// Replica asked for a full sync while it isn't connected to its own master
+	ErrPrefixNoMasterLink ErrorPrefix = "NOMASTERLINK"
+	// Cluster redirections and errors: the slot is served by another node, the keys of a
+	// command are in different slots, or the cluster can't serve the request
+	ErrPrefixMoved       ErrorPrefix = "MOVED"
+	ErrPrefixCrossSlot   ErrorPrefix = "CROSSSLOT"
+	ErrPrefixClusterDown ErrorPrefix = "CLUSTERDOWN"
+	// The key is being migrated to the node named by ASK, or its slot is half-migrated (TRYAGAIN)
+	ErrPrefixAsk      ErrorPrefix = "ASK"
+	ErrPrefixTryAgain ErrorPrefix = "TRYAGAIN"
+)
+
+// An error sent back to the client with a specific prefix instead of the generic ERR
+type RedisError struct {
+	Prefix  ErrorPrefix
+	Message string
+}
+
+func (e *RedisError) Error() string {
+	return fmt.Sprintf("%s %s", e.Prefix, e.Message)
+}
+
+func newRedisError(prefix ErrorPrefix, format string, args ...any) error {
+	return &RedisError{Prefix: prefix, Message: fmt.Sprintf(format, args...)}
+}
+
+var errNotInteger = errors.New("value is not an integer or out of range")
+var errSyntax = errors.New("syntax error")
+var errWrongType = newRedisError(ErrPrefixWrongType, "Operation against a key holding the wrong kind of value")
+
+// A malformed request. The client gets "-ERR Protocol error: ..." and the connection is closed,
+// since there is no way to know where the next request starts
+type ProtocolError struct {
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("Protocol error: %s", e.Message)
+}
+
+func newProtocolError(format string, args ...any) error {
+	return &ProtocolError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Returned by ParseCommand for well-formed requests naming a command that doesn't exist
+type UnknownCommandError struct {
+	Name string
+}
+
+func (e *UnknownCommandError) Error() string {
+	return fmt.Sprintf("unknown command %s", e.Name)
+}
+
+// Builds Redis' reply for unknown commands: the name as sent, followed by the first arguments
+func unknownCommandReply(args []RESPData) error {
+	var name string
+	if len(args) > 0 {
+		name = args[0].Dump()
+	}
+
+	var argsBuilder strings.Builder
+	for _, arg := range args[min(1, len(args)):] {
+		if argsBuilder.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&argsBuilder, "'%s' ", truncateString(arg.Dump(), 128-argsBuilder.Len()))
+	}
+
+	return newRedisError(ErrPrefixGeneric, "unknown command '%s', with args beginning with: %s", truncateString(name, 128), argsBuilder.String())
+}
+
+func truncateString(s string, maxLen int) string {
+	if len(s) > maxLen {
+		return s[:maxLen]
+	}
+	return s
+}
+
+// Splits an error into the prefix and message written to the client.
+// Errors that aren't a RedisError get the generic ERR prefix
+func errorReply(err error) (ErrorPrefix, string) {
+	var redisErr *RedisError
+	if errors.As(err, &redisErr) {
+		return redisErr.Prefix, sanitizeErrorMessage(redisErr.Message)
+	}
+	return ErrPrefixGeneric, sanitizeErrorMessage(err.Error())
+}
+
+// Error replies are single line, so newlines can't be sent as-is
+func sanitizeErrorMessage(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
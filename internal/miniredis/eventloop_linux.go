@@ -0,0 +1,514 @@
+//go:build linux
+
+package miniredis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"syscall"
+)
+
+// Largest number of events handled per epoll_wait call
+const EVENT_LOOP_MAX_EVENTS = 256
+
+// Event loops serving connections without a goroutine each. Every loop is a thread with its own epoll
+// instance, listening socket and connections, all non-blocking: it accepts connections, reads their
+// requests, executes the commands itself and sends the replies, like the Redis main thread.
+// A single loop owns the databases like Redis does (see keyspaceOwner): it holds them from the end of
+// each wait until its replies are sent, and the shards aren't locked. The cron, replication, the admin
+// server and the clients moved to goroutines take the databases from the loop between two iterations.
+// Several loops share the databases, whose commands take the shard locks like the goroutine model does.
+// The listening sockets of the loops share the port with SO_REUSEPORT, the kernel spreading the
+// connections among them
+type eventLoopServer struct {
+	loops      []*eventLoop
+	listenPort int
+}
+
+type eventLoop struct {
+	epfd     int
+	listenFd int
+	// Pipe written to by close to wake the loop up and stop it
+	wakeFds [2]int
+	conns   map[int]*loopConn
+	// Connections that executed commands during the current iteration, whose replies are sent before the next wait
+	active  []*loopConn
+	stopped chan struct{}
+}
+
+// A connection served by an event loop. It is both the reader and the writer of its client: reads return
+// errWouldBlock when no data is available, and writes queue what the socket doesn't accept right away
+type loopConn struct {
+	fd     int
+	client *client
+	reader *RESPReader
+	// Replies waiting for the socket to be writable
+	pending []byte
+	// Whether the loop waits for the socket to be writable, because pending isn't empty
+	waitingWritable bool
+	// Set once the connection must be closed, which happens when pending is sent
+	closing bool
+}
+
+// Opens the listening sockets of threads event loops on addr
+func listenEventLoops(addr string, threads int) (*eventLoopServer, error) {
+	if threads < 1 {
+		return nil, fmt.Errorf("invalid number of event loop threads %d", threads)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &eventLoopServer{listenPort: tcpAddr.Port}
+	for i := 0; i < threads; i++ {
+		// Once the first socket was bound to a port picked by the system, the others use it as well
+		loop, port, err := newEventLoop(tcpAddr.IP, server.listenPort)
+		if err != nil {
+			for _, loop := range server.loops {
+				loop.release()
+			}
+			return nil, err
+		}
+		server.listenPort = port
+		server.loops = append(server.loops, loop)
+	}
+	return server, nil
+}
+
+func (s *eventLoopServer) port() int {
+	return s.listenPort
+}
+
+func (s *eventLoopServer) model() string {
+	return IO_MODEL_EPOLL
+}
+
+func (s *eventLoopServer) ownsKeyspace() bool {
+	return len(s.loops) == 1
+}
+
+// Runs the event loops until close is called
+func (s *eventLoopServer) serve() error {
+	for _, loop := range s.loops {
+		go loop.run()
+	}
+	for _, loop := range s.loops {
+		<-loop.stopped
+	}
+	return nil
+}
+
+// Stops the event loops, closing their connections
+func (s *eventLoopServer) close() {
+	for _, loop := range s.loops {
+		syscall.Write(loop.wakeFds[1], []byte{0})
+	}
+}
+
+func newEventLoop(ip net.IP, port int) (loop *eventLoop, boundPort int, err error) {
+	loop = &eventLoop{
+		epfd:     -1,
+		listenFd: -1,
+		wakeFds:  [2]int{-1, -1},
+		conns:    map[int]*loopConn{},
+		stopped:  make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			loop.release()
+		}
+	}()
+
+	if loop.listenFd, boundPort, err = listenSocket(ip, port); err != nil {
+		return nil, 0, err
+	}
+	if err = syscall.Pipe2(loop.wakeFds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return nil, 0, fmt.Errorf("creating the wake up pipe: %w", err)
+	}
+	if loop.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, 0, fmt.Errorf("creating the epoll instance: %w", err)
+	}
+	for _, fd := range []int{loop.listenFd, loop.wakeFds[0]} {
+		if err = loop.control(syscall.EPOLL_CTL_ADD, fd, syscall.EPOLLIN); err != nil {
+			return nil, 0, err
+		}
+	}
+	return loop, boundPort, nil
+}
+
+// Creates a non-blocking listening socket bound to ip and port, returning the port it got
+func listenSocket(ip net.IP, port int) (int, int, error) {
+	family := syscall.AF_INET
+	var sockaddr syscall.Sockaddr = &syscall.SockaddrInet4{Port: port}
+	if ip4 := ip.To4(); ip4 != nil {
+		sockaddr.(*syscall.SockaddrInet4).Addr = [4]byte(ip4)
+	} else if ip != nil {
+		family = syscall.AF_INET6
+		sockaddr = &syscall.SockaddrInet6{Port: port, Addr: [16]byte(ip.To16())}
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return -1, 0, fmt.Errorf("creating the listening socket: %w", err)
+	}
+	for _, option := range []int{syscall.SO_REUSEADDR, SO_REUSEPORT} {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, option, 1); err != nil {
+			syscall.Close(fd)
+			return -1, 0, fmt.Errorf("setting socket options: %w", err)
+		}
+	}
+	if err := syscall.Bind(fd, sockaddr); err != nil {
+		syscall.Close(fd)
+		return -1, 0, fmt.Errorf("binding to port %d: %w", port, err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return -1, 0, fmt.Errorf("listening: %w", err)
+	}
+
+	bound, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, 0, fmt.Errorf("getting the bound address: %w", err)
+	}
+	switch bound := bound.(type) {
+	case *syscall.SockaddrInet4:
+		port = bound.Port
+	case *syscall.SockaddrInet6:
+		port = bound.Port
+	}
+	return fd, port, nil
+}
+
+func (l *eventLoop) control(op int, fd int, events uint32) error {
+	if err := syscall.EpollCtl(l.epfd, op, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)}); err != nil {
+		return fmt.Errorf("epoll_ctl: %w", err)
+	}
+	return nil
+}
+
+func (l *eventLoop) run() {
+	// The loop is a thread of its own, like the main thread of Redis
+	runtime.LockOSThread()
+	defer close(l.stopped)
+	defer l.release()
+
+	events := make([]syscall.EpollEvent, EVENT_LOOP_MAX_EVENTS)
+	stopping := false
+	for !stopping {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Printf("Event loop stopped, epoll_wait failed: %v", err)
+			return
+		}
+
+		acquired := acquireKeyspace()
+		for _, event := range events[:n] {
+			switch fd := int(event.Fd); fd {
+			case l.wakeFds[0]:
+				// The other events of the iteration are still handled, so the commands received get their replies
+				stopping = true
+			case l.listenFd:
+				l.accept()
+			default:
+				conn := l.conns[fd]
+				if conn == nil {
+					continue
+				}
+				// A connection being closed only waits for its replies to be sent, or to fail
+				if event.Events&syscall.EPOLLOUT != 0 || conn.closing {
+					l.sendPending(conn)
+				}
+				if event.Events&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && !conn.closing && l.conns[fd] == conn {
+					l.handleReadable(conn)
+				}
+			}
+		}
+
+		l.sendReplies()
+		releaseKeyspace(acquired)
+	}
+}
+
+// Accepts the pending connections
+func (l *eventLoop) accept() {
+	for {
+		fd, _, err := syscall.Accept4(l.listenFd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err == syscall.EINTR || err == syscall.ECONNABORTED {
+			continue
+		}
+		if err != nil {
+			if err != syscall.EAGAIN {
+				log.Printf("failed to accept connection: %v", err)
+			}
+			return
+		}
+		// Like net.Conn, don't delay small replies
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+
+		conn := &loopConn{fd: fd}
+		conn.reader = NewRESPReader(conn, RESP_READER_INITIAL_BUF_SIZE)
+		conn.client = newClient(NewRESPWriter(conn, RESP_WRITER_INITIAL_BUF_SIZE))
+		conn.client.servedByLoop = true
+		stats.connectionsReceived.Add(1)
+		if err := l.control(syscall.EPOLL_CTL_ADD, fd, syscall.EPOLLIN); err != nil {
+			log.Printf("failed to accept connection: %v", err)
+			syscall.Close(fd)
+			continue
+		}
+		l.conns[fd] = conn
+		loopClients.Add(1)
+	}
+}
+
+// Reads from the connection once and executes the commands it completed. Their replies are buffered
+// until the end of the iteration, so that the writes of the whole iteration reach the AOF first
+func (l *eventLoop) handleReadable(conn *loopConn) {
+	c := conn.client
+	commands, readErr := conn.reader.ReadCommands()
+	if errors.Is(readErr, errWouldBlock) {
+		readErr = nil
+	}
+
+	// Blocking commands would stall every client of the loop, so the connection is moved to a goroutine first
+	if i := slices.IndexFunc(commands, func(cmd RESPCommand) bool { return cmd.Type.isBlocking() }); i >= 0 {
+		if done, err := executeCommands(c, commands[:i], nil); done {
+			l.closeWhenSent(conn, err)
+			return
+		}
+		l.handOff(conn, commands[i:], readErr)
+		return
+	}
+
+	if done, err := executeCommands(c, commands, readErr); done {
+		l.closeWhenSent(conn, err)
+		return
+	}
+	if len(commands) > 0 {
+		l.active = append(l.active, conn)
+	}
+}
+
+// Sends the replies buffered during the iteration, like the beforeSleep of Redis
+func (l *eventLoop) sendReplies() {
+	if len(l.active) == 0 {
+		return
+	}
+
+	// Write commands must reach the AOF before their replies are sent
+	if err := flushAppendOnlyFile(); err != nil {
+		log.Printf("Error writing to the AOF: %v", err)
+	}
+
+	for _, conn := range l.active {
+		if conn.closing || l.conns[conn.fd] != conn {
+			continue
+		}
+		if err := conn.client.writer.writer.Flush(); err != nil {
+			l.closeConn(conn, fmt.Errorf("flushing: %w", err))
+			continue
+		}
+		l.updateWritable(conn)
+	}
+	clear(l.active)
+	l.active = l.active[:0]
+}
+
+// Writes as much of the pending replies as the socket accepts
+func (l *eventLoop) sendPending(conn *loopConn) {
+	if err := conn.writePending(); err != nil {
+		l.closeConn(conn, fmt.Errorf("flushing: %w", err))
+		return
+	}
+	if conn.closing && len(conn.pending) == 0 {
+		l.closeConn(conn, nil)
+		return
+	}
+	l.updateWritable(conn)
+}
+
+// Waits for the socket to be writable exactly while replies are pending
+func (l *eventLoop) updateWritable(conn *loopConn) {
+	waiting := len(conn.pending) > 0
+	if waiting == conn.waitingWritable {
+		return
+	}
+	events := uint32(syscall.EPOLLIN)
+	if conn.closing {
+		events = 0
+	}
+	if waiting {
+		events |= syscall.EPOLLOUT
+	}
+	if err := l.control(syscall.EPOLL_CTL_MOD, conn.fd, events); err != nil {
+		l.closeConn(conn, err)
+		return
+	}
+	conn.waitingWritable = waiting
+}
+
+// Stops reading from the connection, and closes it once the replies already buffered are sent.
+// err is the reason the connection is closed, if it isn't a normal close
+func (l *eventLoop) closeWhenSent(conn *loopConn, err error) {
+	if err != nil {
+		log.Printf("error handling connection: %v", err)
+	}
+	conn.closing = true
+	if len(conn.pending) == 0 {
+		l.closeConn(conn, nil)
+		return
+	}
+	conn.waitingWritable = false
+	l.updateWritable(conn)
+}
+
+func (l *eventLoop) closeConn(conn *loopConn, err error) {
+	if err != nil {
+		log.Printf("error handling connection: %v", err)
+	}
+	l.removeConn(conn)
+	syscall.Close(conn.fd)
+}
+
+// Stops serving the connection from the loop
+func (l *eventLoop) removeConn(conn *loopConn) {
+	if l.conns[conn.fd] == conn {
+		delete(l.conns, conn.fd)
+		loopClients.Add(-1)
+	}
+}
+
+// Moves the connection out of the loop to a goroutine of its own. Used for the commands that may block their client
+func (l *eventLoop) handOff(conn *loopConn, commands []RESPCommand, readErr error) {
+	l.removeConn(conn)
+	l.control(syscall.EPOLL_CTL_DEL, conn.fd, 0)
+
+	flushAppendOnlyFile()
+	if err := conn.client.writer.writer.Flush(); err != nil {
+		syscall.Close(conn.fd)
+		log.Printf("error handling connection: %v", err)
+		return
+	}
+	serveFromGoroutine(conn.fd, conn.client, conn.reader, conn.pending, nil, commands, readErr)
+}
+
+// Serves a connection taken over from an event loop from a goroutine of its own, like HandleConnection
+// does, starting with commands (read along with readErr). The socket gets the unsent replies first,
+// and the data received but not read by reader yet is read before anything else
+func serveFromGoroutine(fd int, c *client, reader *RESPReader, unsent []byte, unread []byte, commands []RESPCommand, readErr error) {
+	err := syscall.SetNonblock(fd, false)
+	for err == nil && len(unsent) > 0 {
+		var n int
+		if n, err = syscall.Write(fd, unsent); err == syscall.EINTR {
+			err = nil
+		}
+		unsent = unsent[max(n, 0):]
+	}
+	var conn net.Conn
+	if err == nil {
+		file := os.NewFile(uintptr(fd), "")
+		conn, err = net.FileConn(file)
+		file.Close()
+	} else {
+		syscall.Close(fd)
+	}
+	if err != nil {
+		log.Printf("error handling connection: %v", err)
+		return
+	}
+
+	c.conn = conn
+	c.servedByLoop = false
+	reader.reader = conn
+	if len(unread) > 0 {
+		reader.reader = io.MultiReader(bytes.NewReader(unread), conn)
+	}
+	c.writer.writer.Reset(conn)
+	go func() {
+		defer conn.Close()
+		if err := serveClient(c, reader, commands, readErr); err != nil {
+			log.Printf("error handling connection: %v", err)
+		}
+	}()
+}
+
+// Releases the file descriptors of the loop and closes its connections
+func (l *eventLoop) release() {
+	for fd := range l.conns {
+		syscall.Close(fd)
+	}
+	loopClients.Add(-int64(len(l.conns)))
+	clear(l.conns)
+	for _, fd := range []int{l.epfd, l.listenFd, l.wakeFds[0], l.wakeFds[1]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+func (conn *loopConn) Read(p []byte) (int, error) {
+	for {
+		n, err := syscall.Read(conn.fd, p)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			return 0, errWouldBlock
+		case err != nil:
+			return 0, err
+		case n == 0 && len(p) > 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// Writes p, queueing what the socket doesn't accept right away. Only fails when the connection is broken
+func (conn *loopConn) Write(p []byte) (int, error) {
+	if len(conn.pending) == 0 {
+		n, err := conn.write(p)
+		if err != nil {
+			return n, err
+		}
+		conn.pending = append(conn.pending, p[n:]...)
+		return len(p), nil
+	}
+	conn.pending = append(conn.pending, p...)
+	return len(p), nil
+}
+
+func (conn *loopConn) writePending() error {
+	n, err := conn.write(conn.pending)
+	conn.pending = conn.pending[:copy(conn.pending, conn.pending[n:])]
+	return err
+}
+
+// Writes as much of p as the socket accepts without blocking
+func (conn *loopConn) write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := syscall.Write(conn.fd, p[written:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
@@ -0,0 +1,285 @@
+//go:build test && linux
+// +build test,linux
+
+package miniredis
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves connections with transport, returning its address. Like StartServer, a single loop owns the databases
+func startTransportTestServer(t *testing.T, transport transport) (string, func()) {
+	setKeyspaceOwned(transport.ownsKeyspace())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		transport.serve()
+	}()
+
+	cleanup := func() {
+		transport.close()
+		<-stopped
+		setKeyspaceOwned(false)
+	}
+	return fmt.Sprintf("127.0.0.1:%d", transport.port()), cleanup
+}
+
+// Runs fn holding the databases, which a loop may own
+func withKeyspace(fn func()) {
+	acquired := acquireKeyspace()
+	defer releaseKeyspace(acquired)
+	fn()
+}
+
+func TestEventLoop(t *testing.T) {
+	for _, threads := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d threads", threads), func(t *testing.T) {
+			loops, err := listenEventLoops("127.0.0.1:0", threads)
+			if err != nil {
+				t.Fatalf("listenEventLoops() error: %v", err)
+			}
+			if got := loops.ownsKeyspace(); got != (threads == 1) {
+				t.Errorf("ownsKeyspace() = %v with %d threads", got, threads)
+			}
+			addr, cleanup := startTransportTestServer(t, loops)
+			defer cleanup()
+			testTransport(t, addr)
+		})
+	}
+}
+
+func TestEventLoopOwnsKeyspace(t *testing.T) {
+	loops, err := listenEventLoops("127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatalf("listenEventLoops() error: %v", err)
+	}
+	addr, cleanup := startTransportTestServer(t, loops)
+	stop := sync.OnceFunc(cleanup)
+	defer stop()
+	goroutineAddr, stopGoroutines := startTestServer(t)
+	defer stopGoroutines()
+	if !database(0).lockFree.Load() {
+		t.Errorf("the databases are locked while a single loop owns them")
+	}
+
+	key := "eventloop:owned"
+	defer withKeyspace(func() { database(0).Delete(&key) })
+	loopClient, err := dialRESP(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer loopClient.Close()
+	goroutineClient, err := dialRESP(goroutineAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer goroutineClient.Close()
+
+	// Neither the loop nor the clients served from goroutines execute commands while something else holds the databases
+	acquired := acquireKeyspace()
+	if !acquired {
+		t.Fatal("acquireKeyspace() didn't take the databases from the loop")
+	}
+	replies := make(chan string, 2)
+	for _, client := range []*respClient{loopClient, goroutineClient} {
+		go func() {
+			reply, err := client.call([]byte("SET"), []byte(key), []byte("v"))
+			if err != nil {
+				replies <- err.Error()
+				return
+			}
+			replies <- fmt.Sprintf("%v", reply)
+		}()
+	}
+	select {
+	case reply := <-replies:
+		t.Errorf("got %s while the databases were held", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+	releaseKeyspace(acquired)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-replies:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply once the databases were released")
+		}
+	}
+
+	stop()
+	if database(0).lockFree.Load() {
+		t.Errorf("the databases are still accessed without locks once the loop stopped")
+	}
+}
+
+// Runs the same requests against every transport, which must behave like HandleConnection
+func testTransport(t *testing.T, addr string) {
+	t.Run("concurrent clients", func(t *testing.T) {
+		const clients = 20
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := fmt.Sprintf("eventloop:%d", i)
+				defer withKeyspace(func() { database(0).Delete(&key) })
+
+				replies := dialAndSend(t, addr, []string{
+					fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$1\r\n%d\r\n", len(key), key, i%10),
+					fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key),
+				})
+				want := []string{"$1", fmt.Sprint(i % 10), "$1", fmt.Sprint(i % 10)}
+				if !reflect.DeepEqual(replies, want) {
+					t.Errorf("client %d got %q, want %q", i, replies, want)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("protocol error replies then closes", func(t *testing.T) {
+		replies := dialAndSend(t, addr, []string{"*1\r\n$4\r\nPING\r\n*1\r\n$x\r\nPING\r\n*1\r\n$4\r\nPING\r\n"})
+		want := []string{"+PONG", "-ERR Protocol error: invalid bulk length"}
+		if !reflect.DeepEqual(replies, want) {
+			t.Errorf("got %q, want %q", replies, want)
+		}
+	})
+
+	t.Run("replies larger than the socket buffer", func(t *testing.T) {
+		key := "eventloop:big"
+		defer withKeyspace(func() { database(0).Delete(&key) })
+		value := bytes.Repeat([]byte("v"), 4*1024*1024)
+		withKeyspace(func() { database(0).Set(&key, &MiniRedisObject{data: &StringData{data: value}}) })
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial() error: %v", err)
+		}
+		defer conn.Close()
+
+		// The replies are only read once all the requests are sent, so the loop must queue them
+		const gets = 4
+		request := fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+		if _, err := conn.Write(bytes.Repeat([]byte(request), gets)); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		reply := []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, gets*len(reply))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("ReadFull() error: %v", err)
+		}
+		if !bytes.Equal(got, bytes.Repeat(reply, gets)) {
+			t.Error("replies don't match the stored value")
+		}
+	})
+
+	t.Run("blocking commands move the connection to a goroutine", func(t *testing.T) {
+		key := "eventloop:wait"
+		defer withKeyspace(func() { database(0).Delete(&key) })
+
+		client, err := dialRESP(addr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("dialRESP() error: %v", err)
+		}
+		defer client.Close()
+
+		callCommand(t, client, "SET", key, "before")
+		if got := callCommand(t, client, "WAIT", "0", "0"); !reflect.DeepEqual(got, &RESPInteger{data: 0}) {
+			t.Errorf("WAIT = %#v, want 0", got)
+		}
+		callCommand(t, client, "SET", key, "after")
+		if got := callCommand(t, client, "GET", key); !reflect.DeepEqual(got, &RESPBulkString{data: []byte("after")}) {
+			t.Errorf("GET = %#v, want after", got)
+		}
+	})
+
+	t.Run("clients served from goroutines share the keyspace", func(t *testing.T) {
+		goroutineAddr, cleanup := startTestServer(t)
+		defer cleanup()
+
+		// Every client tries to create the same keys, half of them served by the transport and the
+		// others by HandleConnection: each key must be created by exactly one of them
+		const clients, keys = 8, 50
+		defer withKeyspace(func() {
+			for j := 0; j < keys; j++ {
+				key := fmt.Sprintf("eventloop:shared:%d", j)
+				database(0).Delete(&key)
+			}
+		})
+		var created atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				target := addr
+				if i%2 == 1 {
+					target = goroutineAddr
+				}
+				client, err := dialRESP(target, 5*time.Second)
+				if err != nil {
+					t.Errorf("dialRESP() error: %v", err)
+					return
+				}
+				defer client.Close()
+				for j := 0; j < keys; j++ {
+					reply, err := client.call([]byte("SET"), []byte(fmt.Sprintf("eventloop:shared:%d", j)), []byte(fmt.Sprint(i)), []byte("NX"))
+					if err != nil {
+						t.Errorf("SET error: %v", err)
+						return
+					}
+					// SET replies with the value it stored, and a nil reply when the key existed
+					if bulk, ok := reply.(*RESPBulkString); ok && bulk.data != nil {
+						created.Add(1)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if got := created.Load(); got != keys {
+			t.Errorf("%d keys created, want %d", got, keys)
+		}
+	})
+}
+
+// The shutdown saves the databases owned by the loop, whose clients are served until then
+func TestEventLoopShutdownSave(t *testing.T) {
+	dir := useTempDataDir(t)
+	updateConfig(t, func(c *Config) {
+		c.IOModel = IO_MODEL_EPOLL
+		c.EventLoopThreads = 1
+		c.SaveRules = nil
+	})
+	addr, stopped := startShutdownTestServer(t)
+
+	key := "eventloop:shutdown"
+	defer database(0).Delete(&key)
+	replies := sendUntilClosed(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$18\r\neventloop:shutdown\r\n$5\r\nvalue\r\n",
+		"*2\r\n$8\r\nSHUTDOWN\r\n$4\r\nSAVE\r\n",
+	})
+	if len(replies) != 2 || replies[1] != "value" {
+		t.Fatalf("unexpected replies: %v", replies)
+	}
+	waitForStartServer(t, stopped)
+
+	if _, err := os.Stat(filepath.Join(dir, config().DBFilename)); err != nil {
+		t.Errorf("RDB file not saved on shutdown: %v", err)
+	}
+	if database(0).lockFree.Load() {
+		t.Errorf("the databases are still accessed without locks once the server stopped")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package miniredis
+
+import (
+	"fmt"
+)
+
+// Event loops are built on epoll, so they are only available on Linux
+type eventLoopServer struct{}
+
+func listenEventLoops(addr string, threads int) (*eventLoopServer, error) {
+	return nil, fmt.Errorf("the %s I/O model is only available on Linux", IO_MODEL_EPOLL)
+}
+
+func (s *eventLoopServer) port() int {
+	return 0
+}
+
+func (s *eventLoopServer) model() string {
+	return IO_MODEL_EPOLL
+}
+
+func (s *eventLoopServer) ownsKeyspace() bool {
+	return false
+}
+
+func (s *eventLoopServer) serve() error {
+	return nil
+}
+
+func (s *eventLoopServer) close() {}
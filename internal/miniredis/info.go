@@ -0,0 +1,156 @@
+package miniredis
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A "name:value" line of the INFO reply
+type infoField struct {
+	name  string
+	value string
+}
+
+type infoSection struct {
+	name string
+	// Lines of the section, as seen by client c
+	fields func(c *client) []infoField
+}
+
+// Sections in the order INFO prints them
+var infoSections = []infoSection{
+	{name: "Server", fields: serverInfo},
+	{name: "Clients", fields: clientsInfo},
+	{name: "Memory", fields: memoryInfo},
+	{name: "Persistence", fields: persistenceInfo},
+	{name: "Stats", fields: statsInfo},
+	{name: "Replication", fields: replicationInfo},
+	{name: "CPU", fields: cpuInfo},
+	{name: "Cluster", fields: clusterInfo},
+	{name: "Keyspace", fields: keyspaceInfo},
+}
+
+func handleInfo(c *client, args []RESPData) (MiniRedisData, error) {
+	// No argument, "default", "all" and "everything" all list every section
+	requested := map[string]bool{}
+	for i := range args {
+		section, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid section: %w", err)
+		}
+		requested[strings.ToLower(section)] = true
+	}
+	everything := len(requested) == 0 || requested["default"] || requested["all"] || requested["everything"]
+
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if !everything && !requested[strings.ToLower(section.name)] {
+			continue
+		}
+
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		fmt.Fprintf(&builder, "# %s\r\n", section.name)
+		for _, field := range section.fields(c) {
+			fmt.Fprintf(&builder, "%s:%s\r\n", field.name, field.value)
+		}
+	}
+
+	return &VerbatimStringReply{format: "txt", data: []byte(builder.String())}, nil
+}
+
+// Identifies this run of the server, like Redis' run_id
+var runID = newReplicationID()
+
+// Set by StartServer
+var serverStartTime = time.Now()
+
+// I/O model serving the clients of the server started with StartServer, after falling back
+// from the configured one if it isn't available
+var activeIOModel = IO_MODEL_GOROUTINES
+
+func serverInfo(*client) []infoField {
+	now := time.Now()
+	uptime := int64(now.Sub(serverStartTime).Seconds())
+	executable, _ := os.Executable()
+	return []infoField{
+		{"redis_version", redisVersion},
+		{"redis_mode", serverMode()},
+		{"os", runtime.GOOS + " " + runtime.GOARCH},
+		{"arch_bits", strconv.Itoa(strconv.IntSize)},
+		{"multiplexing_api", activeIOModel},
+		{"go_version", runtime.Version()},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"run_id", runID},
+		{"tcp_port", strconv.Itoa(listeningPort)},
+		{"server_time_usec", strconv.FormatInt(now.UnixMicro(), 10)},
+		{"uptime_in_seconds", strconv.FormatInt(uptime, 10)},
+		{"uptime_in_days", strconv.FormatInt(uptime/(24*3600), 10)},
+		{"hz", strconv.Itoa(SERVER_CRON_HZ)},
+		{"executable", executable},
+		{"config_file", config().ConfigFile},
+	}
+}
+
+// Largest used_memory seen by INFO or the server cron
+var usedMemoryPeak atomic.Uint64
+
+// Bytes of the heap objects allocated by the process, and bytes of memory obtained from the
+// operating system. Read through runtime/metrics, which doesn't stop the world like ReadMemStats
+func readMemoryUsage() (used uint64, total uint64) {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/memory/classes/total:bytes"},
+	}
+	metrics.Read(samples)
+	used, total = samples[0].Value.Uint64(), samples[1].Value.Uint64()
+
+	for peak := usedMemoryPeak.Load(); used > peak && !usedMemoryPeak.CompareAndSwap(peak, used); {
+		peak = usedMemoryPeak.Load()
+	}
+	return used, total
+}
+
+func memoryInfo(*client) []infoField {
+	used, total := readMemoryUsage()
+	peak := usedMemoryPeak.Load()
+	return []infoField{
+		{"used_memory", strconv.FormatUint(used, 10)},
+		{"used_memory_human", bytesToHuman(used)},
+		// Memory the Go runtime obtained from the operating system, which bounds the RSS
+		{"used_memory_rss", strconv.FormatUint(total, 10)},
+		{"used_memory_rss_human", bytesToHuman(total)},
+		{"used_memory_peak", strconv.FormatUint(peak, 10)},
+		{"used_memory_peak_human", bytesToHuman(peak)},
+		{"mem_allocator", "go"},
+	}
+}
+
+// Formats a size the way Redis' INFO does: 1.50K, 12.00M, ...
+func bytesToHuman(n uint64) string {
+	units := []string{"K", "M", "G", "T", "P"}
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	size := float64(n) / 1024
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%s", size, units[unit])
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
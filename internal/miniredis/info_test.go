@@ -0,0 +1,127 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fields of the INFO reply to the given command, by name
+func infoFields(t *testing.T, addr string, command string) map[string]string {
+	replies := dialAndSend(t, addr, []string{command})
+	fields := map[string]string{}
+	for _, line := range replies {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+func TestInfoSections(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	replies := dialAndSend(t, addr, []string{"*1\r\n$4\r\nINFO\r\n"})
+	info := strings.Join(replies, "\n")
+	for _, section := range []string{"# Server", "# Clients", "# Memory", "# Persistence", "# Stats", "# Replication", "# CPU", "# Keyspace"} {
+		if !strings.Contains(info, section) {
+			t.Errorf("INFO is missing section %q", section)
+		}
+	}
+
+	fields := infoFields(t, addr, "*2\r\n$4\r\nINFO\r\n$6\r\nMEMORY\r\n")
+	if _, ok := fields["used_memory"]; !ok {
+		t.Errorf("INFO memory is missing used_memory: %v", fields)
+	}
+	if _, ok := fields["uptime_in_seconds"]; ok {
+		t.Errorf("INFO memory includes the server section: %v", fields)
+	}
+	if used, err := strconv.ParseUint(fields["used_memory"], 10, 64); err != nil || used == 0 {
+		t.Errorf("used_memory = %q", fields["used_memory"])
+	}
+
+	fields = infoFields(t, addr, "*2\r\n$4\r\nINFO\r\n$6\r\nserver\r\n")
+	if fields["run_id"] != runID || fields["redis_version"] != redisVersion {
+		t.Errorf("INFO server: %v", fields)
+	}
+}
+
+func TestInfoStats(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	resetStats()
+
+	key := "info_stats_key"
+	defer database(0).Delete(&key)
+	dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$14\r\ninfo_stats_key\r\n$1\r\n1\r\n",
+		"*2\r\n$3\r\nGET\r\n$14\r\ninfo_stats_key\r\n",
+		"*2\r\n$3\r\nGET\r\n$14\r\ninfo_stats_key\r\n",
+		"*2\r\n$3\r\nGET\r\n$12\r\ninfo_missing\r\n",
+		"*5\r\n$3\r\nSET\r\n$14\r\ninfo_stats_key\r\n$1\r\n1\r\n$2\r\nPX\r\n$1\r\n1\r\n",
+	})
+	time.Sleep(5 * time.Millisecond)
+	dialAndSend(t, addr, []string{"*2\r\n$3\r\nGET\r\n$14\r\ninfo_stats_key\r\n"})
+
+	fields := infoFields(t, addr, "*2\r\n$4\r\nINFO\r\n$5\r\nstats\r\n")
+	want := map[string]string{
+		"keyspace_hits":   "2",
+		"keyspace_misses": "2",
+		"expired_keys":    "1",
+		// The INFO command itself is being processed
+		"total_commands_processed":   "7",
+		"total_connections_received": "3",
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("%s = %q, want %q", name, fields[name], value)
+		}
+	}
+
+	dialAndSend(t, addr, []string{"*2\r\n$6\r\nCONFIG\r\n$9\r\nRESETSTAT\r\n"})
+	fields = infoFields(t, addr, "*2\r\n$4\r\nINFO\r\n$5\r\nstats\r\n")
+	if fields["keyspace_hits"] != "0" || fields["expired_keys"] != "0" {
+		t.Errorf("CONFIG RESETSTAT didn't reset the counters: %v", fields)
+	}
+}
+
+func TestInstantaneousMetric(t *testing.T) {
+	var metric instantaneousMetric
+	start := time.Now()
+	step := time.Second / SERVER_CRON_HZ
+	for i := 0; i <= STATS_METRIC_SAMPLES; i++ {
+		// 10 more each step
+		metric.track(int64(i*10), start.Add(time.Duration(i)*step))
+	}
+	if rate, want := metric.rate(), 10*float64(SERVER_CRON_HZ); rate < want-0.01 || rate > want+0.01 {
+		t.Errorf("rate() = %v, want %v", rate, want)
+	}
+
+	metric.reset()
+	if rate := metric.rate(); rate != 0 {
+		t.Errorf("rate() = %v after reset", rate)
+	}
+}
+
+func TestBytesToHuman(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1536, "1.50K"},
+		{12 * 1024 * 1024, "12.00M"},
+		{3 * 1024 * 1024 * 1024, "3.00G"},
+	}
+	for _, tt := range tests {
+		if got := bytesToHuman(tt.n); got != tt.want {
+			t.Errorf("bytesToHuman(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
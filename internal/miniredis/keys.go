@@ -0,0 +1,263 @@
+package miniredis
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the object stored at key in db. Keys expired at now are deleted on access and reported as missing
+func lookupKey(db *ShardedMap[MiniRedisObject], key string, now time.Time) (MiniRedisObject, bool) {
+	obj, exists, _ := lookupKeyExpiring(db, key, now)
+	return obj, exists
+}
+
+// Like lookupKey, also reporting whether the lookup deleted the key because it expired
+func lookupKeyExpiring(db *ShardedMap[MiniRedisObject], key string, now time.Time) (MiniRedisObject, bool, bool) {
+	obj, exists := db.Get(&key)
+	if !exists {
+		return MiniRedisObject{}, false, false
+	}
+
+	if obj.isExpired(now) {
+		return MiniRedisObject{}, false, deleteIfExpired(db, key, now)
+	}
+
+	return obj, true, false
+}
+
+// Deletes key if it is expired at now, and reports whether it did. The check is repeated
+// under the lock, since another client may have replaced the key in the meantime
+func deleteIfExpired(db *ShardedMap[MiniRedisObject], key string, now time.Time) bool {
+	deleted := false
+	db.Compute(&key, func(obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		deleted = exists && obj.isExpired(now)
+		return obj, exists && !deleted
+	})
+	return deleted
+}
+
+func handleDel(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("DEL command requires at least 1 argument")
+	}
+
+	keys := make([]string, len(args))
+	for i := range args {
+		key, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		keys[i] = key
+	}
+
+	now := c.now()
+	var deleted int64
+	c.keyspace().ComputeAll(keys, func(key string, obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		if exists && !obj.isExpired(now) {
+			deleted++
+		} else if exists {
+			c.addExpired(key)
+		}
+		return obj, false
+	})
+
+	c.addDirty(deleted)
+	return &IntegerData{data: deleted}, nil
+}
+
+// Time unit and reference point of the EXPIRE family
+type expireVariant struct {
+	name     string
+	unit     time.Duration
+	absolute bool
+}
+
+var (
+	expireSeconds        = expireVariant{name: "expire", unit: time.Second}
+	expireMilliseconds   = expireVariant{name: "pexpire", unit: time.Millisecond}
+	expireAtSeconds      = expireVariant{name: "expireat", unit: time.Second, absolute: true}
+	expireAtMilliseconds = expireVariant{name: "pexpireat", unit: time.Millisecond, absolute: true}
+)
+
+// Converts an expire argument to an absolute unix time in milliseconds. Values that
+// would overflow are rejected like Redis does
+func absoluteExpireMillis(value int64, unit time.Duration, absolute bool, now time.Time, commandName string) (int64, error) {
+	invalid := fmt.Errorf("invalid expire time in '%s' command", commandName)
+
+	millis := value
+	if unit == time.Second {
+		if value > math.MaxInt64/1000 || value < math.MinInt64/1000 {
+			return 0, invalid
+		}
+		millis = value * 1000
+	}
+
+	if !absolute {
+		if millis > math.MaxInt64-now.UnixMilli() {
+			return 0, invalid
+		}
+		millis += now.UnixMilli()
+	}
+
+	return millis, nil
+}
+
+// EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT key time [NX | XX | GT | LT].
+// Always propagated as PEXPIREAT (or DEL when the time is already in the past), so
+// replaying the command later doesn't extend the TTL
+func handleExpire(c *client, args []RESPData, variant expireVariant) (MiniRedisData, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("%s command requires at least 2 arguments", strings.ToUpper(variant.name))
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	value, err := ExtractInt64(&args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var nx, xx, gt, lt bool
+	for i := 2; i < len(args); i++ {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, errSyntax
+		}
+		switch strings.ToUpper(option) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return nil, fmt.Errorf("Unsupported option %s", option)
+		}
+	}
+
+	if nx && (xx || gt || lt) {
+		return nil, fmt.Errorf("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if gt && lt {
+		return nil, fmt.Errorf("GT and LT options at the same time are not compatible")
+	}
+
+	now := c.now()
+	expireMillis, err := absoluteExpireMillis(value, variant.unit, variant.absolute, now, variant.name)
+	if err != nil {
+		return nil, err
+	}
+	expiry := time.UnixMilli(expireMillis)
+
+	updated := false
+	deleted := false
+	c.keyspace().Compute(&key, func(obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		if !exists || obj.isExpired(now) {
+			if exists {
+				c.addExpired(key)
+			}
+			return obj, false
+		}
+
+		// A key without expiry has an infinite TTL for GT and LT
+		hasExpiry := !obj.expiry.IsZero()
+		switch {
+		case nx && hasExpiry,
+			xx && !hasExpiry,
+			gt && (!hasExpiry || !expiry.After(obj.expiry)),
+			lt && hasExpiry && !expiry.Before(obj.expiry):
+			return obj, true
+		}
+
+		updated = true
+		if !expiry.After(now) {
+			deleted = true
+			return obj, false
+		}
+
+		obj.expiry = expiry
+		return obj, true
+	})
+
+	if !updated {
+		return &IntegerData{data: 0}, nil
+	}
+
+	c.addDirty(1)
+	if deleted {
+		c.rewritePropagated([]byte("DEL"), []byte(key))
+	} else {
+		c.rewritePropagated([]byte("PEXPIREAT"), []byte(key), []byte(strconv.FormatInt(expireMillis, 10)))
+	}
+	return &IntegerData{data: 1}, nil
+}
+
+// TTL and PTTL: remaining time to live in the given unit, -1 without expiry and -2 for missing keys
+func handleTTL(c *client, args []RESPData, unit time.Duration) (MiniRedisData, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("TTL command requires exactly 1 argument")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	now := c.now()
+	obj, exists := c.lookupKeyRead(key)
+	if !exists {
+		return &IntegerData{data: -2}, nil
+	}
+	if obj.expiry.IsZero() {
+		return &IntegerData{data: -1}, nil
+	}
+
+	remaining := obj.expiry.Sub(now).Milliseconds()
+	if unit == time.Second {
+		// Rounded like Redis does
+		return &IntegerData{data: (remaining + 500) / 1000}, nil
+	}
+	return &IntegerData{data: remaining}, nil
+}
+
+func handlePersist(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("PERSIST command requires exactly 1 argument")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	now := c.now()
+	persisted := false
+	c.keyspace().Compute(&key, func(obj MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		if !exists || obj.isExpired(now) {
+			if exists {
+				c.addExpired(key)
+			}
+			return obj, false
+		}
+		if !obj.expiry.IsZero() {
+			obj.expiry = time.Time{}
+			persisted = true
+		}
+		return obj, true
+	})
+
+	if !persisted {
+		return &IntegerData{data: 0}, nil
+	}
+
+	c.addDirty(1)
+	return &IntegerData{data: 1}, nil
+}
@@ -0,0 +1,174 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpireCommands(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		commands []string
+		want     []string
+	}{
+		{
+			name: "expire and ttl",
+			commands: []string{
+				"*3\r\n$3\r\nSET\r\n$5\r\nttl_1\r\n$1\r\nv\r\n",
+				"*2\r\n$3\r\nTTL\r\n$5\r\nttl_1\r\n",
+				"*3\r\n$6\r\nEXPIRE\r\n$5\r\nttl_1\r\n$3\r\n100\r\n",
+				"*2\r\n$3\r\nTTL\r\n$5\r\nttl_1\r\n",
+				"*2\r\n$7\r\nPERSIST\r\n$5\r\nttl_1\r\n",
+				"*2\r\n$3\r\nTTL\r\n$5\r\nttl_1\r\n",
+				"*2\r\n$3\r\nTTL\r\n$11\r\nttl_missing\r\n",
+			},
+			want: []string{"$1", "v", ":-1", ":1", ":100", ":1", ":-1", ":-2"},
+		},
+		{
+			name: "expire options",
+			commands: []string{
+				"*3\r\n$3\r\nSET\r\n$5\r\nttl_2\r\n$1\r\nv\r\n",
+				"*4\r\n$6\r\nEXPIRE\r\n$5\r\nttl_2\r\n$3\r\n100\r\n$2\r\nXX\r\n",
+				"*4\r\n$6\r\nEXPIRE\r\n$5\r\nttl_2\r\n$3\r\n100\r\n$2\r\nNX\r\n",
+				"*4\r\n$6\r\nEXPIRE\r\n$5\r\nttl_2\r\n$3\r\n200\r\n$2\r\nNX\r\n",
+				"*4\r\n$6\r\nEXPIRE\r\n$5\r\nttl_2\r\n$2\r\n50\r\n$2\r\nGT\r\n",
+				"*4\r\n$6\r\nEXPIRE\r\n$5\r\nttl_2\r\n$2\r\n50\r\n$2\r\nLT\r\n",
+				"*2\r\n$3\r\nTTL\r\n$5\r\nttl_2\r\n",
+			},
+			want: []string{"$1", "v", ":0", ":1", ":0", ":0", ":1", ":50"},
+		},
+		{
+			name: "expireat in the future and past",
+			commands: []string{
+				"*3\r\n$3\r\nSET\r\n$5\r\nttl_3\r\n$1\r\nv\r\n",
+				"*3\r\n$8\r\nEXPIREAT\r\n$5\r\nttl_3\r\n$" + strconv.Itoa(len(future)) + "\r\n" + future + "\r\n",
+				"*3\r\n$9\r\nPEXPIREAT\r\n$5\r\nttl_3\r\n$1\r\n1\r\n",
+				"*2\r\n$3\r\nGET\r\n$5\r\nttl_3\r\n",
+			},
+			want: []string{"$1", "v", ":1", ":1", "$-1"},
+		},
+		{
+			name: "set with expiry",
+			commands: []string{
+				"*5\r\n$3\r\nSET\r\n$5\r\nttl_4\r\n$1\r\nv\r\n$2\r\nPX\r\n$2\r\n50\r\n",
+				"*2\r\n$3\r\nGET\r\n$5\r\nttl_4\r\n",
+			},
+			want: []string{"$1", "v", "$1", "v"},
+		},
+		{
+			name: "set nx and xx",
+			commands: []string{
+				"*4\r\n$3\r\nSET\r\n$5\r\nttl_5\r\n$1\r\na\r\n$2\r\nXX\r\n",
+				"*4\r\n$3\r\nSET\r\n$5\r\nttl_5\r\n$1\r\nb\r\n$2\r\nNX\r\n",
+				"*4\r\n$3\r\nSET\r\n$5\r\nttl_5\r\n$1\r\nc\r\n$2\r\nNX\r\n",
+				"*2\r\n$3\r\nGET\r\n$5\r\nttl_5\r\n",
+			},
+			want: []string{"$-1", "$1", "b", "$-1", "$1", "b"},
+		},
+		{
+			name: "del",
+			commands: []string{
+				"*3\r\n$3\r\nSET\r\n$5\r\nttl_6\r\n$1\r\nv\r\n",
+				"*3\r\n$3\r\nDEL\r\n$5\r\nttl_6\r\n$11\r\nttl_missing\r\n",
+				"*2\r\n$3\r\nDEL\r\n$5\r\nttl_6\r\n",
+			},
+			want: []string{"$1", "v", ":1", ":0"},
+		},
+		{
+			name: "invalid arguments",
+			commands: []string{
+				"*3\r\n$6\r\nEXPIRE\r\n$5\r\nttl_7\r\n$3\r\nabc\r\n",
+				"*4\r\n$3\r\nSET\r\n$5\r\nttl_7\r\n$1\r\nv\r\n$2\r\nEX\r\n",
+				"*5\r\n$3\r\nSET\r\n$5\r\nttl_7\r\n$1\r\nv\r\n$2\r\nEX\r\n$1\r\n0\r\n",
+			},
+			want: []string{
+				"-ERR value is not an integer or out of range",
+				"-ERR syntax error",
+				"-ERR invalid expire time in 'set' command",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dialAndSend(t, addr, tt.commands)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d replies %q, want %q", len(got), got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("reply %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	// ttl_4 was set with a 50ms expiry
+	resetServerClock(t)
+	serverClock.fastForward(60 * time.Millisecond)
+	if got := dialAndSend(t, addr, []string{"*2\r\n$3\r\nGET\r\n$5\r\nttl_4\r\n"}); len(got) != 1 || got[0] != "$-1" {
+		t.Errorf("expected ttl_4 to be expired, got %q", got)
+	}
+}
+
+// Makes the clock of the server started with StartServer follow the system time again at the end of the test
+func resetServerClock(t *testing.T) {
+	t.Cleanup(func() { serverClock.setTime(time.Time{}) })
+}
+
+func TestServerClock(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	resetServerClock(t)
+
+	key := "clock_key"
+	defer database(0).Delete(&key)
+	serverClock.setTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	// The clock stands still, so the TTL is exact
+	replies := dialAndSend(t, addr, []string{
+		"*5\r\n$3\r\nSET\r\n$9\r\nclock_key\r\n$1\r\nv\r\n$2\r\nEX\r\n$3\r\n100\r\n",
+		"*2\r\n$4\r\nPTTL\r\n$9\r\nclock_key\r\n",
+	})
+	if want := []string{"$1", "v", ":100000"}; !slices.Equal(replies, want) {
+		t.Errorf("got %q, want %q", replies, want)
+	}
+
+	serverClock.fastForward(99 * time.Second)
+	if got := dialAndSend(t, addr, []string{"*2\r\n$4\r\nPTTL\r\n$9\r\nclock_key\r\n"}); !slices.Equal(got, []string{":1000"}) {
+		t.Errorf("PTTL after 99s = %q, want :1000", got)
+	}
+	serverClock.fastForward(time.Second)
+	if got := dialAndSend(t, addr, []string{"*2\r\n$3\r\nGET\r\n$9\r\nclock_key\r\n"}); !slices.Equal(got, []string{"$-1"}) {
+		t.Errorf("GET after 100s = %q, want a nil reply", got)
+	}
+
+	// The zero time goes back to the system time
+	serverClock.setTime(time.Time{})
+	if now := serverClock.now(); time.Since(now).Abs() > time.Minute {
+		t.Errorf("now() = %v after the clock was reset", now)
+	}
+}
+
+func TestGetWrongType(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	key := "wrongtype_hash"
+	database(0).Set(&key, &MiniRedisObject{data: &HashData{data: map[string][]byte{"f": []byte("v")}}})
+	defer database(0).Delete(&key)
+
+	replies := dialAndSend(t, addr, []string{"*2\r\n$3\r\nGET\r\n$14\r\nwrongtype_hash\r\n"})
+	if len(replies) != 1 || replies[0] != "-WRONGTYPE Operation against a key holding the wrong kind of value" {
+		t.Errorf("unexpected GET reply %q", replies)
+	}
+}
@@ -0,0 +1,66 @@
+package miniredis
+
+import (
+	"errors"
+)
+
+var errLZFCorrupt = errors.New("corrupt LZF data")
+
+// Most bytes a byte of LZF data expands to: a 3 byte back reference copies up to 264 bytes
+const lzfMaxExpansion = 88
+
+// Decompresses LZF data (as written by Redis for compressed RDB strings) into a buffer of
+// exactly outLen bytes. outLen comes from the input, so it is checked against what in can
+// expand to before the buffer is allocated
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	if outLen < 0 || outLen/lzfMaxExpansion > len(in) {
+		return nil, errLZFCorrupt
+	}
+	out := make([]byte, 0, outLen)
+
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		// Literal run of ctrl+1 bytes
+		if ctrl < 1<<5 {
+			length := ctrl + 1
+			if ip+length > len(in) || len(out)+length > outLen {
+				return nil, errLZFCorrupt
+			}
+			out = append(out, in[ip:ip+length]...)
+			ip += length
+			continue
+		}
+
+		// Back reference: the top 3 bits hold the length (7 meaning an extra length byte
+		// follows), the low 5 bits and the next byte the offset
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errLZFCorrupt
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLZFCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		length += 2
+
+		if ref < 0 || len(out)+length > outLen {
+			return nil, errLZFCorrupt
+		}
+		// Byte by byte, as the reference may overlap the bytes being written
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errLZFCorrupt
+	}
+	return out, nil
+}
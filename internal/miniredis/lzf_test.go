@@ -0,0 +1,73 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"testing"
+)
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		outLen  int
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "literal run",
+			input:  []byte{0x02, 'a', 'b', 'c'},
+			outLen: 3,
+			want:   "abc",
+		},
+		{
+			name:   "short back reference",
+			input:  []byte{0x02, 'a', 'b', 'c', 0x20, 0x02},
+			outLen: 6,
+			want:   "abcabc",
+		},
+		{
+			name:   "overlapping long back reference",
+			input:  []byte{0x00, 'a', 0xe0, 0x00, 0x00},
+			outLen: 10,
+			want:   "aaaaaaaaaa",
+		},
+		{
+			name:    "reference before the start",
+			input:   []byte{0x00, 'a', 0x20, 0x05},
+			outLen:  4,
+			wantErr: true,
+		},
+		{
+			name:    "truncated literal",
+			input:   []byte{0x05, 'a'},
+			outLen:  6,
+			wantErr: true,
+		},
+		{
+			name:    "uncompressed length beyond what the input expands to",
+			input:   []byte{0x02, 'a', 'b', 'c'},
+			outLen:  1 << 62,
+			wantErr: true,
+		},
+		{
+			name:    "wrong uncompressed length",
+			input:   []byte{0x02, 'a', 'b', 'c'},
+			outLen:  4,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lzfDecompress(tt.input, tt.outLen)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lzfDecompress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("lzfDecompress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
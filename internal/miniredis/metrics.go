@@ -0,0 +1,272 @@
+package miniredis
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets of the command latency histograms. Slower calls land in a last,
+// unbounded bucket
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Calls of a command by clients of the server started with StartServer
+type commandStat struct {
+	// Calls by latency bucket, not cumulative. Their sum is the number of calls
+	buckets [len(latencyBuckets) + 1]atomic.Int64
+	// Calls that replied with an error
+	failed atomic.Int64
+	// Total time spent executing the command
+	duration atomic.Int64
+}
+
+var commandStats [UNKNOWN]commandStat
+
+// Called by the dispatch path once a command returned
+func recordCommandCall(t RESPCommandType, elapsed time.Duration, err error) {
+	if t < 0 || t >= UNKNOWN {
+		return
+	}
+	stat := &commandStats[t]
+	bucket, _ := slices.BinarySearch(latencyBuckets[:], elapsed)
+	stat.buckets[bucket].Add(1)
+	stat.duration.Add(int64(elapsed))
+	if err != nil {
+		stat.failed.Add(1)
+	}
+}
+
+func resetCommandStats() {
+	for i := range commandStats {
+		stat := &commandStats[i]
+		for j := range stat.buckets {
+			stat.buckets[j].Store(0)
+		}
+		stat.failed.Store(0)
+		stat.duration.Store(0)
+	}
+}
+
+// Writes samples in the Prometheus text exposition format
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (w *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Labels alternate names and values
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, `%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatMetricValue(value))
+	w.buf.WriteByte('\n')
+}
+
+// A metric family made of a single sample
+func (w *metricsWriter) single(name, kind, help string, value float64) {
+	w.family(name, kind, help)
+	w.sample(name, value)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeCommandMetrics(w *metricsWriter) {
+	type commandSnapshot struct {
+		name     string
+		buckets  [len(latencyBuckets) + 1]int64
+		calls    int64
+		failed   int64
+		duration time.Duration
+	}
+	var called []commandSnapshot
+	for _, name := range slices.Sorted(maps.Keys(commandsByName)) {
+		t := commandsByName[name]
+		stat := &commandStats[t]
+		snapshot := commandSnapshot{name: commandTable[t].name}
+		for i := range stat.buckets {
+			snapshot.buckets[i] = stat.buckets[i].Load()
+			snapshot.calls += snapshot.buckets[i]
+		}
+		if snapshot.calls == 0 {
+			continue
+		}
+		snapshot.failed = stat.failed.Load()
+		snapshot.duration = time.Duration(stat.duration.Load())
+		called = append(called, snapshot)
+	}
+
+	w.family("miniredis_commands_total", "counter", "Calls of each command.")
+	for _, s := range called {
+		w.sample("miniredis_commands_total", float64(s.calls), "cmd", s.name)
+	}
+	w.family("miniredis_commands_failed_total", "counter", "Calls of each command that replied with an error.")
+	for _, s := range called {
+		w.sample("miniredis_commands_failed_total", float64(s.failed), "cmd", s.name)
+	}
+	w.family("miniredis_command_duration_seconds", "histogram", "Time spent executing each command.")
+	for _, s := range called {
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i]
+			w.sample("miniredis_command_duration_seconds_bucket", float64(cumulative), "cmd", s.name, "le", formatMetricValue(bound.Seconds()))
+		}
+		w.sample("miniredis_command_duration_seconds_bucket", float64(s.calls), "cmd", s.name, "le", "+Inf")
+		w.sample("miniredis_command_duration_seconds_sum", s.duration.Seconds(), "cmd", s.name)
+		w.sample("miniredis_command_duration_seconds_count", float64(s.calls), "cmd", s.name)
+	}
+}
+
+func writeKeyspaceMetrics(w *metricsWriter) {
+	type dbSize struct {
+		db            string
+		keys, expires int64
+	}
+	var sizes []dbSize
+	now := serverClock.now()
+	acquired := acquireKeyspace()
+	for i, db := range *databases.list.Load() {
+		if keys, expires, _ := countKeys(db, now); keys > 0 {
+			sizes = append(sizes, dbSize{strconv.Itoa(i), keys, expires})
+		}
+	}
+	releaseKeyspace(acquired)
+
+	w.family("miniredis_db_keys", "gauge", "Keys of each non-empty database.")
+	for _, size := range sizes {
+		w.sample("miniredis_db_keys", float64(size.keys), "db", size.db)
+	}
+	w.family("miniredis_db_keys_expiring", "gauge", "Keys with an expiry of each non-empty database.")
+	for _, size := range sizes {
+		w.sample("miniredis_db_keys_expiring", float64(size.expires), "db", size.db)
+	}
+}
+
+func writePersistenceMetrics(w *metricsWriter) {
+	persistence.mutex.Lock()
+	bgsaveInProgress := persistence.bgsaveInProgress
+	bgsaveOK := persistence.lastBgsaveErr == nil
+	lastSave := persistence.lastSave
+	persistence.mutex.Unlock()
+
+	aof.mutex.Lock()
+	aofEnabled := aof.file != nil
+	rewriteInProgress := aof.rewriteInProgress
+	rewriteOK := aof.lastRewriteErr == nil
+	aofSize := aof.currentSize
+	aof.mutex.Unlock()
+
+	w.single("miniredis_rdb_changes_since_last_save", "gauge", "Changes to the keyspace since the last snapshot.", float64(persistence.dirty.Load()))
+	w.single("miniredis_rdb_bgsave_in_progress", "gauge", "Whether a background save is running.", boolMetric(bgsaveInProgress))
+	w.single("miniredis_rdb_last_bgsave_success", "gauge", "Whether the last background save succeeded.", boolMetric(bgsaveOK))
+	w.single("miniredis_rdb_last_save_timestamp_seconds", "gauge", "Time of the last successful snapshot.", float64(lastSave.Unix()))
+	w.single("miniredis_aof_enabled", "gauge", "Whether write commands are logged to the append only file.", boolMetric(aofEnabled))
+	w.single("miniredis_aof_rewrite_in_progress", "gauge", "Whether an append only file rewrite is running.", boolMetric(rewriteInProgress))
+	w.single("miniredis_aof_last_rewrite_success", "gauge", "Whether the last append only file rewrite succeeded.", boolMetric(rewriteOK))
+	if aofEnabled {
+		w.single("miniredis_aof_current_size_bytes", "gauge", "Size of the append only file.", float64(aofSize))
+	}
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Metrics of the server started with StartServer, in the Prometheus text format
+func writeMetrics(w *metricsWriter) {
+	used, total := readMemoryUsage()
+
+	w.single("miniredis_uptime_seconds", "gauge", "Time since the server started.", time.Since(serverStartTime).Seconds())
+	w.single("miniredis_connected_clients", "gauge", "Client connections, replicas excluded.", float64(connectedClients()))
+	w.single("miniredis_connections_received_total", "counter", "Connections accepted.", float64(stats.connectionsReceived.Load()))
+	w.single("miniredis_commands_processed_total", "counter", "Commands processed.", float64(stats.commandsProcessed.Load()))
+	w.single("miniredis_expired_keys_total", "counter", "Keys deleted because commands found them expired.", float64(stats.expiredKeys.Load()))
+	w.single("miniredis_keyspace_hits_total", "counter", "Key lookups that found the key.", float64(stats.keyspaceHits.Load()))
+	w.single("miniredis_keyspace_misses_total", "counter", "Key lookups that didn't find the key.", float64(stats.keyspaceMisses.Load()))
+	w.single("miniredis_memory_used_bytes", "gauge", "Bytes of the heap objects allocated.", float64(used))
+	w.single("miniredis_memory_rss_bytes", "gauge", "Bytes of memory obtained from the operating system.", float64(total))
+	w.single("miniredis_memory_used_peak_bytes", "gauge", "Largest number of bytes of heap objects seen.", float64(usedMemoryPeak.Load()))
+	writeKeyspaceMetrics(w)
+	writePersistenceMetrics(w)
+	writeCommandMetrics(w)
+}
+
+func handleMetrics(rw http.ResponseWriter, _ *http.Request) {
+	var w metricsWriter
+	writeMetrics(&w)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.Write(w.buf.Bytes())
+}
+
+// Routes of the admin HTTP server: /metrics for Prometheus, and the pprof profiles under /debug/pprof/
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serves adminHandler on addr until the returned server is closed
+func startAdminServer(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on the admin port: %w", err)
+	}
+
+	server := &http.Server{Handler: adminHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin HTTP server error: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics and profiles on http://%s", listener.Addr())
+	return server, nil
+}
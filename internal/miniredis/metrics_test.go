@@ -0,0 +1,118 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fetches path from the admin HTTP server
+func adminGet(t *testing.T, server *httptest.Server, path string) (*http.Response, string) {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s error: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body of %s: %v", path, err)
+	}
+	return resp, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	resetStats()
+	defer resetStats()
+
+	key := "metrics_key"
+	defer database(0).Delete(&key)
+	dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$11\r\nmetrics_key\r\n$1\r\n1\r\n",
+		"*2\r\n$3\r\nGET\r\n$11\r\nmetrics_key\r\n",
+		"*2\r\n$3\r\nGET\r\n$11\r\nmetrics_key\r\n",
+		"*3\r\n$6\r\nEXPIRE\r\n$11\r\nmetrics_key\r\n$3\r\nbad\r\n",
+	})
+
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	resp, body := adminGet(t, admin, "/metrics")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("GET /metrics: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	for _, line := range []string{
+		"# TYPE miniredis_commands_total counter",
+		`miniredis_commands_total{cmd="get"} 2`,
+		`miniredis_commands_total{cmd="set"} 1`,
+		`miniredis_commands_failed_total{cmd="expire"} 1`,
+		`miniredis_commands_failed_total{cmd="get"} 0`,
+		"# TYPE miniredis_command_duration_seconds histogram",
+		`miniredis_command_duration_seconds_bucket{cmd="get",le="+Inf"} 2`,
+		`miniredis_command_duration_seconds_count{cmd="get"} 2`,
+		"miniredis_commands_processed_total 4",
+		"miniredis_keyspace_hits_total 2",
+		`miniredis_db_keys{db="0"} `,
+		"miniredis_rdb_last_bgsave_success 1",
+		"miniredis_aof_enabled 0",
+		"miniredis_memory_used_bytes ",
+		"miniredis_connected_clients ",
+	} {
+		if !strings.Contains(body, line+"\n") && !strings.Contains(body, "\n"+line) {
+			t.Errorf("metrics are missing %q:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `cmd="ping"`) {
+		t.Errorf("metrics include commands that were never called")
+	}
+
+	// The embedded servers' commands aren't counted
+	server := NewServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer server.Close()
+	dialAndSend(t, server.Addr(), []string{"*1\r\n$4\r\nPING\r\n"})
+	if _, body := adminGet(t, admin, "/metrics"); strings.Contains(body, `cmd="ping"`) {
+		t.Errorf("metrics count a command sent to an embedded server")
+	}
+
+	if resp, body := adminGet(t, admin, "/debug/pprof/"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("GET /debug/pprof/: status %d", resp.StatusCode)
+	}
+}
+
+func TestRecordCommandCall(t *testing.T) {
+	defer resetCommandStats()
+	resetCommandStats()
+
+	recordCommandCall(PING, 5*time.Microsecond, nil)
+	recordCommandCall(PING, time.Millisecond, nil)
+	recordCommandCall(PING, 2*time.Second, errSyntax)
+	recordCommandCall(UNKNOWN, time.Millisecond, nil)
+
+	stat := &commandStats[PING]
+	if got := stat.buckets[0].Load(); got != 1 {
+		t.Errorf("first bucket has %d calls, want 1", got)
+	}
+	// Bounds are inclusive
+	if got := stat.buckets[6].Load(); latencyBuckets[6] != time.Millisecond || got != 1 {
+		t.Errorf("1ms bucket has %d calls, want 1", got)
+	}
+	if got := stat.buckets[len(latencyBuckets)].Load(); got != 1 {
+		t.Errorf("unbounded bucket has %d calls, want 1", got)
+	}
+	if got := stat.failed.Load(); got != 1 {
+		t.Errorf("failed = %d, want 1", got)
+	}
+	if got := time.Duration(stat.duration.Load()); got != 2*time.Second+time.Millisecond+5*time.Microsecond {
+		t.Errorf("duration = %v", got)
+	}
+}
@@ -0,0 +1,284 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Delay before retrying a failed background save triggered by the save rules
+const BGSAVE_RETRY_DELAY = 5 * time.Second
+
+// State of RDB snapshotting, shared by SAVE, BGSAVE and LASTSAVE
+type rdbState struct {
+	mutex sync.Mutex
+	// Time of the last successful save
+	lastSave time.Time
+	// Whether a BGSAVE goroutine is currently writing a snapshot
+	bgsaveInProgress bool
+	lastBgsaveErr    error
+	lastBgsaveTry    time.Time
+	// Number of changes since the last successful save. Atomic, so writes don't take the mutex
+	dirty atomic.Int64
+	// Value of dirty when the running background save took its snapshot
+	dirtyBeforeBgsave int64
+	// Notified when a background save finishes
+	bgsaveFinished *notifier
+}
+
+var persistence = &rdbState{lastSave: time.Now(), bgsaveFinished: newNotifier()}
+
+// Records changes made to the keyspace. Mutating handlers call it with the number of keys they changed
+func addDirty(changes int64) {
+	persistence.dirty.Add(changes)
+}
+
+// Refuses writes with MISCONF while snapshots are configured but the last background save failed,
+// so clients notice that their data isn't being persisted
+func checkWritesAllowed() error {
+	if cfg := config(); !cfg.StopWritesOnBgsaveError || len(cfg.SaveRules) == 0 {
+		return nil
+	}
+
+	persistence.mutex.Lock()
+	defer persistence.mutex.Unlock()
+
+	if persistence.lastBgsaveErr != nil {
+		return newRedisError(ErrPrefixMisconf, "Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. "+
+			"Commands that may modify the data set are disabled, because this instance is configured to report errors during writes "+
+			"if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.")
+	}
+	return nil
+}
+
+// Starts a background save when one of the save rules is met. Called periodically by the server cron
+func checkSaveRules(now time.Time) {
+	persistence.mutex.Lock()
+	if persistence.bgsaveInProgress {
+		persistence.mutex.Unlock()
+		return
+	}
+
+	// After a failure, wait a bit before trying again instead of hammering the disk
+	canRetry := persistence.lastBgsaveErr == nil || now.Sub(persistence.lastBgsaveTry) > BGSAVE_RETRY_DELAY
+
+	var triggered *SaveRule
+	rules := config().SaveRules
+	for i, rule := range rules {
+		if persistence.dirty.Load() >= rule.Changes && now.Sub(persistence.lastSave) > rule.Seconds && canRetry {
+			triggered = &rules[i]
+			break
+		}
+	}
+	persistence.mutex.Unlock()
+
+	if triggered != nil {
+		log.Printf("%d changes in %d seconds. Saving...", triggered.Changes, int64(triggered.Seconds.Seconds()))
+		if err := startBgsave(); err != nil {
+			log.Printf("Can't start background save: %v", err)
+		}
+	}
+}
+
+func rdbPath() string {
+	cfg := config()
+	return filepath.Join(cfg.Dir, cfg.DBFilename)
+}
+
+// Writes a snapshot to the configured RDB file. The data goes to a temporary file in the same
+// directory first, which is then renamed over the old file, so a crash never leaves a partial dump behind
+func saveRDBFile(snapshot []map[string]MiniRedisObject) error {
+	tmp, err := os.CreateTemp(config().Dir, fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	// No-op once the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	if err := writeRDB(tmp, snapshot, serverClock.now()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing snapshot: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), rdbPath()); err != nil {
+		return fmt.Errorf("renaming snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// Loads the keyspace at startup: from the AOF when it is enabled and exists, as it is
+// the more up to date of the two, otherwise from the RDB file
+func loadData() error {
+	defer persistence.dirty.Store(0)
+
+	if config().AppendOnly {
+		if aofExists() {
+			return loadAppendOnlyFile()
+		}
+	}
+	return loadRDBFile()
+}
+
+// Loads the configured RDB file into the databases. A missing file is not an error
+func loadRDBFile() error {
+	file, err := os.Open(rdbPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	start := time.Now()
+	loaded := 0
+	err = readRDB(file, serverClock.now(), func(db int, key string, obj MiniRedisObject) {
+		database(db).Set(&key, &obj)
+		loaded++
+	})
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", rdbPath(), err)
+	}
+
+	log.Printf("DB loaded from disk: %d keys in %.3f seconds", loaded, time.Since(start).Seconds())
+	return nil
+}
+
+func handleSave(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("SAVE command takes no arguments")
+	}
+
+	if err := saveSnapshot(false); err != nil {
+		return nil, err
+	}
+	return okReply, nil
+}
+
+// Saves the databases to the RDB file from the calling goroutine. A background save in progress
+// makes it fail, unless waitBgsave is set, in which case it waits for the background save to finish
+func saveSnapshot(waitBgsave bool) error {
+	persistence.mutex.Lock()
+	defer persistence.mutex.Unlock()
+
+	for persistence.bgsaveInProgress {
+		if !waitBgsave {
+			return fmt.Errorf("Background save already in progress")
+		}
+		finished := persistence.bgsaveFinished.wait()
+		persistence.mutex.Unlock()
+		<-finished
+		persistence.mutex.Lock()
+	}
+
+	// Writes running in parallel would leave the databases copied at different points
+	propagationMutex.Lock()
+	snapshot := databases.snapshot()
+	propagationMutex.Unlock()
+
+	if err := saveRDBFile(snapshot); err != nil {
+		log.Printf("Error saving DB on disk: %v", err)
+		return fmt.Errorf("Error saving DB on disk: %w", err)
+	}
+
+	persistence.lastSave = time.Now()
+	persistence.lastBgsaveErr = nil
+	persistence.dirty.Store(0)
+	return nil
+}
+
+func handleBgsave(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("BGSAVE command takes no arguments")
+	}
+
+	if err := startBgsave(); err != nil {
+		return nil, err
+	}
+	return &SimpleStringReply{data: "Background saving started"}, nil
+}
+
+// Takes a point-in-time copy of the store and writes it from a separate goroutine.
+// Writers are only blocked while the copy is made, not while the file is written
+func startBgsave() error {
+	persistence.mutex.Lock()
+	defer persistence.mutex.Unlock()
+
+	if persistence.bgsaveInProgress {
+		return fmt.Errorf("Background save already in progress")
+	}
+
+	propagationMutex.Lock()
+	snapshot := databases.snapshot()
+	propagationMutex.Unlock()
+	persistence.bgsaveInProgress = true
+	persistence.lastBgsaveTry = time.Now()
+	persistence.dirtyBeforeBgsave = persistence.dirty.Load()
+
+	go func() {
+		err := saveRDBFile(snapshot)
+		if err != nil {
+			log.Printf("Background saving error: %v", err)
+		}
+
+		persistence.mutex.Lock()
+		defer persistence.mutex.Unlock()
+		defer persistence.bgsaveFinished.notify()
+
+		persistence.bgsaveInProgress = false
+		persistence.lastBgsaveErr = err
+		if err == nil {
+			persistence.lastSave = time.Now()
+			// Writes made while the snapshot was written still count as unsaved
+			persistence.dirty.Add(-persistence.dirtyBeforeBgsave)
+		}
+	}()
+
+	return nil
+}
+
+func handleLastsave(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("LASTSAVE command takes no arguments")
+	}
+
+	persistence.mutex.Lock()
+	defer persistence.mutex.Unlock()
+
+	return &IntegerData{data: persistence.lastSave.Unix()}, nil
+}
+
+func persistenceInfo(*client) []infoField {
+	persistence.mutex.Lock()
+	bgsaveStatus := "ok"
+	if persistence.lastBgsaveErr != nil {
+		bgsaveStatus = "err"
+	}
+
+	fields := []infoField{
+		{"loading", "0"},
+		{"rdb_changes_since_last_save", strconv.FormatInt(persistence.dirty.Load(), 10)},
+		{"rdb_bgsave_in_progress", formatBool(persistence.bgsaveInProgress)},
+		{"rdb_last_save_time", strconv.FormatInt(persistence.lastSave.Unix(), 10)},
+		{"rdb_last_bgsave_status", bgsaveStatus},
+	}
+	persistence.mutex.Unlock()
+
+	return append(fields, aofInfo()...)
+}
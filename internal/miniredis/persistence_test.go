@@ -0,0 +1,200 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Points the persistence files to a temporary directory for the duration of the test
+func useTempDataDir(t *testing.T) string {
+	dir := t.TempDir()
+	updateConfig(t, func(c *Config) { c.Dir = dir })
+	return dir
+}
+
+// Replaces the configuration with a copy changed by update, until the end of the test
+func updateConfig(tb testing.TB, update func(c *Config)) {
+	previous := config()
+	updated := *previous
+	update(&updated)
+	currentConfig.Store(&updated)
+	tb.Cleanup(func() { currentConfig.Store(previous) })
+}
+
+// Waits for the running background save to finish and returns its error
+func waitForBgsave(t *testing.T) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		persistence.mutex.Lock()
+		inProgress := persistence.bgsaveInProgress
+		lastErr := persistence.lastBgsaveErr
+		persistence.mutex.Unlock()
+
+		if !inProgress {
+			return lastErr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background save did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := useTempDataDir(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$10\r\nsave_key_1\r\n$6\r\nvalue1\r\n",
+		"*1\r\n$4\r\nSAVE\r\n",
+		"*1\r\n$8\r\nLASTSAVE\r\n",
+	})
+
+	if len(replies) != 4 || replies[2] != "+OK" {
+		t.Fatalf("unexpected SAVE replies: %v", replies)
+	}
+
+	lastSave, err := strconv.ParseInt(replies[3][1:], 10, 64)
+	if err != nil || time.Since(time.Unix(lastSave, 0)) > time.Minute {
+		t.Errorf("unexpected LASTSAVE reply %q", replies[3])
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "dump.rdb")); err != nil {
+		t.Fatalf("dump.rdb not written: %v", err)
+	}
+
+	// Nothing but the dump is left in the directory
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only dump.rdb in %s, got %d files", dir, len(files))
+	}
+
+	key := "save_key_1"
+	database(0).Delete(&key)
+
+	if err := loadRDBFile(); err != nil {
+		t.Fatalf("loadRDBFile() error: %v", err)
+	}
+
+	replies = dialAndSend(t, addr, []string{"*2\r\n$3\r\nGET\r\n$10\r\nsave_key_1\r\n"})
+	if len(replies) != 2 || replies[1] != "value1" {
+		t.Errorf("key not restored from dump, got: %v", replies)
+	}
+}
+
+func TestBgsave(t *testing.T) {
+	dir := useTempDataDir(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$10\r\nbgsave_key\r\n$5\r\nvalue\r\n",
+		"*1\r\n$6\r\nBGSAVE\r\n",
+	})
+
+	if len(replies) != 3 || replies[2] != "+Background saving started" {
+		t.Fatalf("unexpected BGSAVE replies: %v", replies)
+	}
+
+	if err := waitForBgsave(t); err != nil {
+		t.Fatalf("background save failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "dump.rdb"))
+	if err != nil {
+		t.Fatalf("dump.rdb not written: %v", err)
+	}
+	defer file.Close()
+
+	found := false
+	err = readRDB(file, time.Now(), func(_ int, key string, obj MiniRedisObject) {
+		if key == "bgsave_key" {
+			found = true
+		}
+	})
+	if err != nil {
+		t.Fatalf("readRDB() error: %v", err)
+	}
+	if !found {
+		t.Errorf("bgsave_key missing from background snapshot")
+	}
+}
+
+func TestSaveRules(t *testing.T) {
+	useTempDataDir(t)
+	updateConfig(t, func(c *Config) { c.SaveRules = []SaveRule{{Seconds: 0, Changes: 3}} })
+
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	// Start from a clean slate
+	dialAndSend(t, addr, []string{"*1\r\n$4\r\nSAVE\r\n"})
+
+	dialAndSend(t, addr, []string{"*3\r\n$3\r\nSET\r\n$5\r\nrule1\r\n$1\r\nx\r\n"})
+	checkSaveRules(time.Now())
+	if err := waitForBgsave(t); err != nil {
+		t.Fatalf("background save failed: %v", err)
+	}
+
+	replies := dialAndSend(t, addr, []string{"*2\r\n$4\r\nINFO\r\n$11\r\npersistence\r\n"})
+	if !strings.Contains(strings.Join(replies, "\n"), "rdb_changes_since_last_save:1") {
+		t.Fatalf("expected 1 unsaved change below the rule threshold, got: %v", replies)
+	}
+
+	dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$5\r\nrule2\r\n$1\r\nx\r\n",
+		"*3\r\n$3\r\nSET\r\n$5\r\nrule3\r\n$1\r\nx\r\n",
+	})
+	checkSaveRules(time.Now())
+	if err := waitForBgsave(t); err != nil {
+		t.Fatalf("background save failed: %v", err)
+	}
+
+	replies = dialAndSend(t, addr, []string{"*2\r\n$4\r\nINFO\r\n$11\r\npersistence\r\n"})
+	info := strings.Join(replies, "\n")
+	if !strings.Contains(info, "rdb_changes_since_last_save:0") || !strings.Contains(info, "rdb_last_bgsave_status:ok") {
+		t.Errorf("expected the save rule to trigger a successful background save, got: %v", replies)
+	}
+}
+
+func TestStopWritesOnBgsaveError(t *testing.T) {
+	useTempDataDir(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	// Saving into a directory that doesn't exist fails
+	dir := config().Dir
+	updateConfig(t, func(c *Config) { c.Dir = filepath.Join(dir, "missing") })
+	if err := startBgsave(); err != nil {
+		t.Fatalf("startBgsave() error: %v", err)
+	}
+	if err := waitForBgsave(t); err == nil {
+		t.Fatalf("expected background save to fail")
+	}
+
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$7\r\nmisconf\r\n$1\r\nx\r\n",
+		"*2\r\n$3\r\nGET\r\n$7\r\nmisconf\r\n",
+	})
+	if len(replies) != 2 || !strings.HasPrefix(replies[0], "-MISCONF") || replies[1] != "$-1" {
+		t.Errorf("expected writes to be refused and reads to work, got: %v", replies)
+	}
+
+	// A successful save lifts the restriction
+	updateConfig(t, func(c *Config) { c.Dir = dir })
+	replies = dialAndSend(t, addr, []string{
+		"*1\r\n$4\r\nSAVE\r\n",
+		"*3\r\n$3\r\nSET\r\n$7\r\nmisconf\r\n$1\r\nx\r\n",
+	})
+	if len(replies) != 3 || replies[0] != "+OK" || replies[1] != "$1" {
+		t.Errorf("expected writes to be accepted after SAVE, got: %v", replies)
+	}
+}
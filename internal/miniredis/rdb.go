@@ -0,0 +1,877 @@
+package miniredis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RDB format constants, see rdb.h in the Redis sources
+const RDB_VERSION = 11
+
+// Newest format version that can be loaded. Version 12 (Redis 7.4) only adds types and opcodes
+// that are either skipped or rejected when found
+const RDB_MAX_LOAD_VERSION = 12
+
+const (
+	RDB_TYPE_STRING             byte = 0
+	RDB_TYPE_LIST               byte = 1
+	RDB_TYPE_SET                byte = 2
+	RDB_TYPE_ZSET               byte = 3
+	RDB_TYPE_HASH               byte = 4
+	RDB_TYPE_ZSET_2             byte = 5
+	RDB_TYPE_MODULE_PRE_GA      byte = 6
+	RDB_TYPE_MODULE_2           byte = 7
+	RDB_TYPE_HASH_ZIPMAP        byte = 9
+	RDB_TYPE_LIST_ZIPLIST       byte = 10
+	RDB_TYPE_SET_INTSET         byte = 11
+	RDB_TYPE_ZSET_ZIPLIST       byte = 12
+	RDB_TYPE_HASH_ZIPLIST       byte = 13
+	RDB_TYPE_LIST_QUICKLIST     byte = 14
+	RDB_TYPE_STREAM_LISTPACKS   byte = 15
+	RDB_TYPE_HASH_LISTPACK      byte = 16
+	RDB_TYPE_ZSET_LISTPACK      byte = 17
+	RDB_TYPE_LIST_QUICKLIST_2   byte = 18
+	RDB_TYPE_STREAM_LISTPACKS_2 byte = 19
+	RDB_TYPE_SET_LISTPACK       byte = 20
+	RDB_TYPE_STREAM_LISTPACKS_3 byte = 21
+)
+
+// Container formats of RDB_TYPE_LIST_QUICKLIST_2 nodes
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+const (
+	RDB_OPCODE_SLOT_INFO     byte = 244
+	RDB_OPCODE_FUNCTION2     byte = 245
+	RDB_OPCODE_MODULE_AUX    byte = 247
+	RDB_OPCODE_IDLE          byte = 248
+	RDB_OPCODE_FREQ          byte = 249
+	RDB_OPCODE_AUX           byte = 250
+	RDB_OPCODE_RESIZEDB      byte = 251
+	RDB_OPCODE_EXPIRETIME_MS byte = 252
+	RDB_OPCODE_EXPIRETIME    byte = 253
+	RDB_OPCODE_SELECTDB      byte = 254
+	RDB_OPCODE_EOF           byte = 255
+)
+
+// Length encodings. The two most significant bits of the first byte select the format
+const (
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3
+)
+
+// Special string encodings, used when the length byte has the rdbEncVal format
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+var ErrRDBChecksum = errors.New("wrong RDB checksum")
+
+// Writer side of the RDB format. Every byte written is added to the checksum
+type rdbEncoder struct {
+	writer *bufio.Writer
+	crc    uint64
+}
+
+func newRDBEncoder(w io.Writer) *rdbEncoder {
+	return &rdbEncoder{writer: bufio.NewWriter(w)}
+}
+
+func (e *rdbEncoder) write(p []byte) error {
+	e.crc = crc64Jones(e.crc, p)
+	_, err := e.writer.Write(p)
+	return err
+}
+
+func (e *rdbEncoder) writeByte(b byte) error {
+	return e.write([]byte{b})
+}
+
+func (e *rdbEncoder) writeLength(length uint64) error {
+	switch {
+	case length < 1<<6:
+		return e.writeByte(byte(length) | rdb6BitLen<<6)
+	case length < 1<<14:
+		return e.write([]byte{byte(length>>8) | rdb14BitLen<<6, byte(length)})
+	case length <= 0xffffffff:
+		buf := make([]byte, 5)
+		buf[0] = rdb32BitLen
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		return e.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = rdb64BitLen
+		binary.BigEndian.PutUint64(buf[1:], length)
+		return e.write(buf)
+	}
+}
+
+// Writes a string, using the integer encoding when it holds a small integer in canonical form
+func (e *rdbEncoder) writeString(s []byte) error {
+	if len(s) <= 11 && len(s) > 0 {
+		if value, err := strconv.ParseInt(string(s), 10, 32); err == nil && strconv.FormatInt(value, 10) == string(s) {
+			return e.writeInteger(value)
+		}
+	}
+
+	if err := e.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return e.write(s)
+}
+
+// Writes an integer with the smallest integer string encoding. Values outside of
+// the 32 bit range are written as their decimal representation
+func (e *rdbEncoder) writeInteger(value int64) error {
+	switch {
+	case value >= -1<<7 && value < 1<<7:
+		return e.write([]byte{rdbEncVal<<6 | rdbEncInt8, byte(value)})
+	case value >= -1<<15 && value < 1<<15:
+		buf := []byte{rdbEncVal<<6 | rdbEncInt16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(value))
+		return e.write(buf)
+	case value >= -1<<31 && value < 1<<31:
+		buf := []byte{rdbEncVal<<6 | rdbEncInt32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(value))
+		return e.write(buf)
+	default:
+		decimal := strconv.FormatInt(value, 10)
+		if err := e.writeLength(uint64(len(decimal))); err != nil {
+			return err
+		}
+		return e.write([]byte(decimal))
+	}
+}
+
+func (e *rdbEncoder) writeAux(key string, value string) error {
+	if err := e.writeByte(RDB_OPCODE_AUX); err != nil {
+		return err
+	}
+	if err := e.writeString([]byte(key)); err != nil {
+		return err
+	}
+	return e.writeString([]byte(value))
+}
+
+func (e *rdbEncoder) writeHeader(now time.Time) error {
+	if err := e.write([]byte(fmt.Sprintf("REDIS%04d", RDB_VERSION))); err != nil {
+		return err
+	}
+
+	aux := [][2]string{
+		{"redis-ver", redisVersion},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(now.Unix(), 10)},
+		{"used-mem", "0"},
+		{"aof-base", "0"},
+	}
+	for _, field := range aux {
+		if err := e.writeAux(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Type byte used to store a value
+func rdbObjectType(data MiniRedisData) (byte, error) {
+	switch data.(type) {
+	case *StringData, *IntegerData:
+		return RDB_TYPE_STRING, nil
+	case *ListData:
+		return RDB_TYPE_LIST, nil
+	case *SetData:
+		return RDB_TYPE_SET, nil
+	case *HashData:
+		return RDB_TYPE_HASH, nil
+	case *SortedSetData:
+		return RDB_TYPE_ZSET_2, nil
+	default:
+		return 0, fmt.Errorf("can't save value of type %T", data)
+	}
+}
+
+// Writes a value in the encoding matching its rdbObjectType
+func (e *rdbEncoder) writeObject(data MiniRedisData) error {
+	switch v := data.(type) {
+	case *StringData:
+		return e.writeString(v.data)
+	case *IntegerData:
+		return e.writeInteger(v.data)
+	case *ListData:
+		if err := e.writeLength(uint64(len(v.data))); err != nil {
+			return err
+		}
+		for _, element := range v.data {
+			if err := e.writeString(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *SetData:
+		if err := e.writeLength(uint64(len(v.data))); err != nil {
+			return err
+		}
+		for member := range v.data {
+			if err := e.writeString([]byte(member)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *HashData:
+		if err := e.writeLength(uint64(len(v.data))); err != nil {
+			return err
+		}
+		for field, value := range v.data {
+			if err := e.writeString([]byte(field)); err != nil {
+				return err
+			}
+			if err := e.writeString(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *SortedSetData:
+		if err := e.writeLength(uint64(len(v.data))); err != nil {
+			return err
+		}
+		score := make([]byte, 8)
+		for member, value := range v.data {
+			if err := e.writeString([]byte(member)); err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint64(score, math.Float64bits(value))
+			if err := e.write(score); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("can't save value of type %T", data)
+	}
+}
+
+// Writes a key with its expiry, type and value
+func (e *rdbEncoder) writeEntry(key string, obj *MiniRedisObject) error {
+	if !obj.expiry.IsZero() {
+		buf := make([]byte, 9)
+		buf[0] = RDB_OPCODE_EXPIRETIME_MS
+		binary.LittleEndian.PutUint64(buf[1:], uint64(obj.expiry.UnixMilli()))
+		if err := e.write(buf); err != nil {
+			return err
+		}
+	}
+
+	objType, err := rdbObjectType(obj.data)
+	if err != nil {
+		return err
+	}
+	if err := e.writeByte(objType); err != nil {
+		return err
+	}
+	if err := e.writeString([]byte(key)); err != nil {
+		return err
+	}
+	return e.writeObject(obj.data)
+}
+
+// Writes the EOF opcode and checksum, then flushes
+func (e *rdbEncoder) writeFooter() error {
+	if err := e.writeByte(RDB_OPCODE_EOF); err != nil {
+		return err
+	}
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, e.crc)
+	if _, err := e.writer.Write(checksum); err != nil {
+		return err
+	}
+	return e.writer.Flush()
+}
+
+// Writes a complete RDB file with the keys of each database, indexed by number. Databases without
+// keys are left out, as are keys already expired at now
+func writeRDB(w io.Writer, dbs []map[string]MiniRedisObject, now time.Time) error {
+	e := newRDBEncoder(w)
+	if err := e.writeHeader(now); err != nil {
+		return err
+	}
+
+	for db, entries := range dbs {
+		var keys, expires uint64
+		for _, obj := range entries {
+			if obj.expiry.IsZero() {
+				keys++
+			} else if !now.After(obj.expiry) {
+				keys++
+				expires++
+			}
+		}
+		if keys == 0 {
+			continue
+		}
+
+		if err := e.writeByte(RDB_OPCODE_SELECTDB); err != nil {
+			return err
+		}
+		if err := e.writeLength(uint64(db)); err != nil {
+			return err
+		}
+		if err := e.writeByte(RDB_OPCODE_RESIZEDB); err != nil {
+			return err
+		}
+		if err := e.writeLength(keys); err != nil {
+			return err
+		}
+		if err := e.writeLength(expires); err != nil {
+			return err
+		}
+
+		for key, obj := range entries {
+			if !obj.expiry.IsZero() && now.After(obj.expiry) {
+				continue
+			}
+			if err := e.writeEntry(key, &obj); err != nil {
+				return fmt.Errorf("saving key %q: %w", key, err)
+			}
+		}
+	}
+
+	return e.writeFooter()
+}
+
+// Reader side of the RDB format. Every byte read is added to the checksum
+type rdbDecoder struct {
+	reader *bufio.Reader
+	crc    uint64
+	// Bytes left in the input, -1 when its size isn't known. Lengths read from the input are
+	// checked against it and proto-max-bulk-len before anything is allocated for them
+	remaining int64
+	maxLen    int64
+}
+
+func newRDBDecoder(r io.Reader) *rdbDecoder {
+	return &rdbDecoder{reader: bufio.NewReader(r), remaining: inputSize(r), maxLen: config().ProtoMaxBulkLen}
+}
+
+// Bytes left to read from r, or -1 when it can't be told
+func inputSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *io.LimitedReader:
+		return r.N
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
+
+// Checks a length read from the input before something of that size is allocated
+func (d *rdbDecoder) checkLength(n uint64) error {
+	if n > uint64(d.maxLen) || (d.remaining >= 0 && n > uint64(d.remaining)) {
+		return fmt.Errorf("length %d exceeds the input", n)
+	}
+	return nil
+}
+
+func (d *rdbDecoder) read(n uint64) ([]byte, error) {
+	if err := d.checkLength(n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.reader, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if d.remaining >= 0 {
+		d.remaining -= int64(n)
+	}
+	d.crc = crc64Jones(d.crc, buf)
+	return buf, nil
+}
+
+func (d *rdbDecoder) readByte() (byte, error) {
+	buf, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// Reads a length. isEncoded is set when the length byte announces a special string encoding,
+// in which case the returned value is the encoding type
+func (d *rdbDecoder) readLengthWithEncoding() (length uint64, isEncoded bool, err error) {
+	first, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case rdb6BitLen:
+		return uint64(first & 0x3f), false, nil
+	case rdb14BitLen:
+		second, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(second), false, nil
+	case rdbEncVal:
+		return uint64(first & 0x3f), true, nil
+	}
+
+	switch first {
+	case rdb32BitLen:
+		buf, err := d.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case rdb64BitLen:
+		buf, err := d.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	default:
+		return 0, false, fmt.Errorf("unknown length encoding %#x", first)
+	}
+}
+
+func (d *rdbDecoder) readLength() (uint64, error) {
+	length, isEncoded, err := d.readLengthWithEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if isEncoded {
+		return 0, fmt.Errorf("unexpected encoded value where a length was expected")
+	}
+	return length, nil
+}
+
+func (d *rdbDecoder) readString() ([]byte, error) {
+	length, isEncoded, err := d.readLengthWithEncoding()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isEncoded {
+		return d.read(length)
+	}
+
+	switch length {
+	case rdbEncInt8:
+		b, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int8(b)), 10)), nil
+	case rdbEncInt16:
+		buf, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10)), nil
+	case rdbEncInt32:
+		buf, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10)), nil
+	case rdbEncLZF:
+		compressedLen, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		uncompressedLen, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := d.read(compressedLen)
+		if err != nil {
+			return nil, err
+		}
+		if uncompressedLen > uint64(d.maxLen) {
+			return nil, fmt.Errorf("length %d exceeds the maximum bulk length", uncompressedLen)
+		}
+		return lzfDecompress(compressed, int(uncompressedLen))
+	default:
+		return nil, fmt.Errorf("unknown string encoding %d", length)
+	}
+}
+
+// Reads a value of the given type byte
+func (d *rdbDecoder) readObject(objType byte) (MiniRedisData, error) {
+	switch objType {
+	case RDB_TYPE_STRING:
+		data, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return &StringData{data: data}, nil
+	case RDB_TYPE_LIST:
+		elements, err := d.readStrings(1)
+		if err != nil {
+			return nil, err
+		}
+		return &ListData{data: elements}, nil
+	case RDB_TYPE_SET:
+		members, err := d.readStrings(1)
+		if err != nil {
+			return nil, err
+		}
+		return newSetData(members), nil
+	case RDB_TYPE_HASH:
+		entries, err := d.readStrings(2)
+		if err != nil {
+			return nil, err
+		}
+		return newHashData(entries)
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		return d.readSortedSet(objType == RDB_TYPE_ZSET_2)
+	case RDB_TYPE_LIST_QUICKLIST, RDB_TYPE_LIST_QUICKLIST_2:
+		return d.readQuicklist(objType == RDB_TYPE_LIST_QUICKLIST_2)
+	case RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_SET_INTSET, RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_HASH_ZIPLIST,
+		RDB_TYPE_HASH_LISTPACK, RDB_TYPE_ZSET_LISTPACK, RDB_TYPE_SET_LISTPACK:
+		return d.readCompactObject(objType)
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		return nil, fmt.Errorf("streams are not supported")
+	case RDB_TYPE_MODULE_PRE_GA, RDB_TYPE_MODULE_2:
+		return nil, fmt.Errorf("module values are not supported")
+	case RDB_TYPE_HASH_ZIPMAP:
+		return nil, fmt.Errorf("zipmap encoded hashes (RDB files from before Redis 2.6) are not supported")
+	default:
+		return nil, fmt.Errorf("unsupported RDB value type %d", objType)
+	}
+}
+
+// Reads a length followed by length*perEntry strings
+func (d *rdbDecoder) readStrings(perEntry uint64) ([][]byte, error) {
+	length, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	// Bounded preallocation, so a corrupt length doesn't exhaust memory before reading fails
+	values := make([][]byte, 0, min(length*perEntry, 1024))
+	for i := uint64(0); i < length*perEntry; i++ {
+		value, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Reads a sorted set stored as members followed by their scores, either binary
+// doubles (RDB_TYPE_ZSET_2) or strings prefixed by their length byte (RDB_TYPE_ZSET)
+func (d *rdbDecoder) readSortedSet(binaryScores bool) (MiniRedisData, error) {
+	length, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	zset := &SortedSetData{data: make(map[string]float64, min(length, 1024))}
+	for i := uint64(0); i < length; i++ {
+		member, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var score float64
+		if binaryScores {
+			buf, err := d.read(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else if score, err = d.readStringDouble(); err != nil {
+			return nil, err
+		}
+		zset.data[string(member)] = score
+	}
+	return zset, nil
+}
+
+// Reads a double written as a length byte and its decimal representation. Lengths 253, 254
+// and 255 stand for nan, +inf and -inf
+func (d *rdbDecoder) readStringDouble() (float64, error) {
+	length, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+
+	buf, err := d.read(uint64(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// Reads a list stored as a sequence of nodes: ziplists for RDB_TYPE_LIST_QUICKLIST, and
+// listpacks or single plain elements for RDB_TYPE_LIST_QUICKLIST_2
+func (d *rdbDecoder) readQuicklist(version2 bool) (MiniRedisData, error) {
+	nodes, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	list := &ListData{}
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistNodePacked)
+		if version2 {
+			if container, err = d.readLength(); err != nil {
+				return nil, err
+			}
+		}
+
+		node, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case container == quicklistNodePlain:
+			list.data = append(list.data, node)
+		case container != quicklistNodePacked:
+			return nil, fmt.Errorf("unknown quicklist node container %d", container)
+		case version2:
+			elements, err := decodeListpack(node)
+			if err != nil {
+				return nil, err
+			}
+			list.data = append(list.data, elements...)
+		default:
+			elements, err := decodeZiplist(node)
+			if err != nil {
+				return nil, err
+			}
+			list.data = append(list.data, elements...)
+		}
+	}
+	return list, nil
+}
+
+// Reads a small aggregate serialized in one of the compact encodings as a single string
+func (d *rdbDecoder) readCompactObject(objType byte) (MiniRedisData, error) {
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries [][]byte
+	switch objType {
+	case RDB_TYPE_SET_INTSET:
+		entries, err = decodeIntset(blob)
+	case RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_HASH_ZIPLIST:
+		entries, err = decodeZiplist(blob)
+	default:
+		entries, err = decodeListpack(blob)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch objType {
+	case RDB_TYPE_LIST_ZIPLIST:
+		return &ListData{data: entries}, nil
+	case RDB_TYPE_SET_INTSET, RDB_TYPE_SET_LISTPACK:
+		return newSetData(entries), nil
+	case RDB_TYPE_HASH_ZIPLIST, RDB_TYPE_HASH_LISTPACK:
+		return newHashData(entries)
+	default:
+		pairs, err := pairEntries(entries, "sorted set")
+		if err != nil {
+			return nil, err
+		}
+		zset := &SortedSetData{data: make(map[string]float64, len(pairs))}
+		for _, pair := range pairs {
+			score, err := strconv.ParseFloat(string(pair[1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sorted set score %q", pair[1])
+			}
+			zset.data[string(pair[0])] = score
+		}
+		return zset, nil
+	}
+}
+
+func newSetData(members [][]byte) *SetData {
+	set := &SetData{data: make(map[string]struct{}, len(members))}
+	for _, member := range members {
+		set.data[string(member)] = struct{}{}
+	}
+	return set
+}
+
+func newHashData(entries [][]byte) (*HashData, error) {
+	pairs, err := pairEntries(entries, "hash")
+	if err != nil {
+		return nil, err
+	}
+	hash := &HashData{data: make(map[string][]byte, len(pairs))}
+	for _, pair := range pairs {
+		hash.data[string(pair[0])] = pair[1]
+	}
+	return hash, nil
+}
+
+// Reads an RDB file, calling onKey for every key that isn't expired at now with the number of its database
+func readRDB(r io.Reader, now time.Time, onKey func(db int, key string, obj MiniRedisObject)) error {
+	d := newRDBDecoder(r)
+
+	magic, err := d.read(9)
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	if string(magic[:5]) != "REDIS" {
+		return fmt.Errorf("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(magic[5:]))
+	if err != nil || version < 1 || version > RDB_MAX_LOAD_VERSION {
+		return fmt.Errorf("can't handle RDB format version %s", magic[5:])
+	}
+
+	var expiry time.Time
+	db := 0
+	for {
+		opcode, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case RDB_OPCODE_EXPIRETIME_MS:
+			buf, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			expiry = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
+			continue
+		case RDB_OPCODE_EXPIRETIME:
+			buf, err := d.read(4)
+			if err != nil {
+				return err
+			}
+			expiry = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			continue
+		case RDB_OPCODE_FREQ:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_IDLE:
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_AUX:
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_SLOT_INFO:
+			// Slot id, slot size and expires slot size, only meaningful to Redis cluster
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLength(); err != nil {
+					return err
+				}
+			}
+			continue
+		case RDB_OPCODE_RESIZEDB:
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_SELECTDB:
+			id, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			if id >= uint64(databaseCount()) {
+				return fmt.Errorf("data file was created with a server configured to handle more than %d databases", databaseCount())
+			}
+			db = int(id)
+			continue
+		case RDB_OPCODE_MODULE_AUX, RDB_OPCODE_FUNCTION2:
+			return fmt.Errorf("RDB files with modules or functions are not supported")
+		case RDB_OPCODE_EOF:
+			return d.verifyChecksum(version)
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return fmt.Errorf("reading key: %w", err)
+		}
+
+		data, err := d.readObject(opcode)
+		if err != nil {
+			return fmt.Errorf("reading value of key %q: %w", key, err)
+		}
+
+		if expiry.IsZero() || !now.After(expiry) {
+			onKey(db, string(key), MiniRedisObject{data: data, expiry: expiry})
+		}
+		expiry = time.Time{}
+	}
+}
+
+// Checks the CRC64 footer present since RDB version 5. A zero checksum means checksums were disabled
+func (d *rdbDecoder) verifyChecksum(version int) error {
+	if version < 5 {
+		return nil
+	}
+
+	expected := d.crc
+	buf, err := d.read(8)
+	if err != nil {
+		return fmt.Errorf("reading checksum: %w", err)
+	}
+
+	checksum := binary.LittleEndian.Uint64(buf)
+	if checksum != 0 && checksum != expected {
+		return ErrRDBChecksum
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64Jones(t *testing.T) {
+	// Reference value from crc64.c in the Redis sources
+	if got := crc64Jones(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64Jones() = %#x, want %#x", got, uint64(0xe9c6d914c4b8d9ca))
+	}
+}
+
+func TestRDBLengthEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   uint64
+		expected []byte
+	}{
+		{name: "6 bit", length: 10, expected: []byte{0x0a}},
+		{name: "14 bit", length: 700, expected: []byte{0x42, 0xbc}},
+		{name: "32 bit", length: 70000, expected: []byte{0x80, 0x00, 0x01, 0x11, 0x70}},
+		{name: "64 bit", length: 1 << 33, expected: []byte{0x81, 0, 0, 0, 0x02, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			e := newRDBEncoder(&buffer)
+			if err := e.writeLength(tt.length); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			e.writer.Flush()
+
+			if !bytes.Equal(buffer.Bytes(), tt.expected) {
+				t.Errorf("got %x, want %x", buffer.Bytes(), tt.expected)
+			}
+
+			d := newRDBDecoder(&buffer)
+			got, err := d.readLength()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.length {
+				t.Errorf("decoded %d, want %d", got, tt.length)
+			}
+		})
+	}
+}
+
+func TestRDBStringEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []byte
+	}{
+		{name: "plain", value: "abc", expected: []byte{0x03, 'a', 'b', 'c'}},
+		{name: "int8", value: "-5", expected: []byte{0xc0, 0xfb}},
+		{name: "int16", value: "1000", expected: []byte{0xc1, 0xe8, 0x03}},
+		{name: "int32", value: "100000", expected: []byte{0xc2, 0xa0, 0x86, 0x01, 0x00}},
+		{name: "non canonical integer stays a string", value: "007", expected: []byte{0x03, '0', '0', '7'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			e := newRDBEncoder(&buffer)
+			if err := e.writeString([]byte(tt.value)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			e.writer.Flush()
+
+			if !bytes.Equal(buffer.Bytes(), tt.expected) {
+				t.Errorf("got %x, want %x", buffer.Bytes(), tt.expected)
+			}
+
+			d := newRDBDecoder(&buffer)
+			got, err := d.readString()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.value {
+				t.Errorf("decoded %q, want %q", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Hour).Truncate(time.Millisecond)
+
+	entries := map[string]MiniRedisObject{
+		"plain":    {data: &StringData{data: []byte("hello")}},
+		"empty":    {data: &StringData{data: []byte{}}},
+		"number":   {data: &IntegerData{data: 1 << 40}},
+		"big":      {data: &StringData{data: []byte(strings.Repeat("x", 20000))}},
+		"volatile": {data: &StringData{data: []byte("soon gone")}, expiry: future},
+		"expired":  {data: &StringData{data: []byte("gone")}, expiry: now.Add(-time.Second)},
+	}
+
+	var buffer bytes.Buffer
+	if err := writeRDB(&buffer, []map[string]MiniRedisObject{entries}, now); err != nil {
+		t.Fatalf("writeRDB() error: %v", err)
+	}
+
+	if !bytes.HasPrefix(buffer.Bytes(), []byte("REDIS0011")) {
+		t.Errorf("missing RDB header, got %q", buffer.Bytes()[:9])
+	}
+
+	loaded := map[string]MiniRedisObject{}
+	err := readRDB(bytes.NewReader(buffer.Bytes()), now, func(_ int, key string, obj MiniRedisObject) {
+		loaded[key] = obj
+	})
+	if err != nil {
+		t.Fatalf("readRDB() error: %v", err)
+	}
+
+	if len(loaded) != 5 {
+		t.Errorf("loaded %d keys, want 5", len(loaded))
+	}
+	if _, ok := loaded["expired"]; ok {
+		t.Errorf("expired key should not be saved")
+	}
+
+	expectedValues := map[string]string{
+		"plain":    "hello",
+		"empty":    "",
+		"number":   "1099511627776",
+		"big":      strings.Repeat("x", 20000),
+		"volatile": "soon gone",
+	}
+	for key, want := range expectedValues {
+		got, ok := loaded[key].data.(*StringData)
+		if !ok {
+			t.Errorf("key %q loaded as %T", key, loaded[key].data)
+			continue
+		}
+		if string(got.data) != want {
+			t.Errorf("key %q = %q, want %q", key, got.data, want)
+		}
+	}
+
+	if !loaded["volatile"].expiry.Equal(future) {
+		t.Errorf("expiry = %v, want %v", loaded["volatile"].expiry, future)
+	}
+	if !loaded["plain"].expiry.IsZero() {
+		t.Errorf("persistent key got expiry %v", loaded["plain"].expiry)
+	}
+}
+
+func TestRDBDatabases(t *testing.T) {
+	now := time.Now()
+	dbs := []map[string]MiniRedisObject{
+		0: {"key": {data: &StringData{data: []byte("in 0")}}},
+		3: {"key": {data: &StringData{data: []byte("in 3")}}},
+	}
+
+	var buffer bytes.Buffer
+	if err := writeRDB(&buffer, dbs, now); err != nil {
+		t.Fatalf("writeRDB() error: %v", err)
+	}
+
+	loaded := map[int]string{}
+	err := readRDB(bytes.NewReader(buffer.Bytes()), now, func(db int, key string, obj MiniRedisObject) {
+		loaded[db] = string(obj.data.(*StringData).data)
+	})
+	if err != nil {
+		t.Fatalf("readRDB() error: %v", err)
+	}
+	if want := map[int]string{0: "in 0", 3: "in 3"}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("loaded %v, want %v", loaded, want)
+	}
+
+	// Files written with more databases than configured can't be loaded
+	buffer.Reset()
+	dbs = make([]map[string]MiniRedisObject, databaseCount()+1)
+	dbs[databaseCount()] = map[string]MiniRedisObject{"key": {data: &StringData{data: []byte("v")}}}
+	if err := writeRDB(&buffer, dbs, now); err != nil {
+		t.Fatalf("writeRDB() error: %v", err)
+	}
+	if err := readRDB(bytes.NewReader(buffer.Bytes()), now, func(int, string, MiniRedisObject) {}); err == nil {
+		t.Errorf("readRDB() of a database out of range succeeded")
+	}
+}
+
+func TestRDBChecksumMismatch(t *testing.T) {
+	entries := map[string]MiniRedisObject{
+		"key": {data: &StringData{data: []byte("value")}},
+	}
+
+	var buffer bytes.Buffer
+	if err := writeRDB(&buffer, []map[string]MiniRedisObject{entries}, time.Now()); err != nil {
+		t.Fatalf("writeRDB() error: %v", err)
+	}
+
+	corrupted := buffer.Bytes()
+	corrupted[bytes.Index(corrupted, []byte("value"))] = 'V'
+
+	err := readRDB(bytes.NewReader(corrupted), time.Now(), func(int, string, MiniRedisObject) {})
+	if !errors.Is(err, ErrRDBChecksum) {
+		t.Errorf("got error %v, want %v", err, ErrRDBChecksum)
+	}
+}
+
+// Builds an RDB file the way Redis writes small aggregates, with compact encodings and LZF strings
+func redisEncodedRDB(t *testing.T) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	e := newRDBEncoder(&buffer)
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check(e.write([]byte("REDIS0012")))
+	check(e.write([]byte{RDB_OPCODE_SELECTDB, 0}))
+	// Redis 7.4 cluster nodes write slot information ahead of the keys
+	check(e.writeByte(RDB_OPCODE_SLOT_INFO))
+	check(e.writeLength(1))
+	check(e.writeLength(5))
+	check(e.writeLength(0))
+
+	compact := []struct {
+		key     string
+		objType byte
+		blob    []byte
+	}{
+		{"list_ziplist", RDB_TYPE_LIST_ZIPLIST, testZiplist},
+		{"set_intset", RDB_TYPE_SET_INTSET, testIntset},
+		{"set_listpack", RDB_TYPE_SET_LISTPACK, testListpack},
+		// ["f1", "v1"] as a listpack
+		{"hash_listpack", RDB_TYPE_HASH_LISTPACK, []byte{
+			0x0f, 0x00, 0x00, 0x00, 0x02, 0x00,
+			0x82, 'f', '1', 0x03,
+			0x82, 'v', '1', 0x03,
+			0xff,
+		}},
+		// ["m", 7] as a ziplist
+		{"zset_ziplist", RDB_TYPE_ZSET_ZIPLIST, []byte{
+			0x10, 0x00, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0x02, 0x00,
+			0x00, 0x01, 'm',
+			0x03, 0xf8,
+			0xff,
+		}},
+	}
+	for _, entry := range compact {
+		check(e.writeByte(entry.objType))
+		check(e.writeString([]byte(entry.key)))
+		check(e.writeString(entry.blob))
+	}
+
+	// Quicklist with a packed listpack node and a plain node
+	check(e.writeByte(RDB_TYPE_LIST_QUICKLIST_2))
+	check(e.writeString([]byte("list_quicklist")))
+	check(e.writeLength(2))
+	check(e.writeLength(quicklistNodePacked))
+	check(e.writeString(testListpack))
+	check(e.writeLength(quicklistNodePlain))
+	check(e.writeString([]byte("plain node")))
+
+	// Sorted set with scores as strings, +inf being encoded as length 254
+	check(e.writeByte(RDB_TYPE_ZSET))
+	check(e.writeString([]byte("zset_strings")))
+	check(e.writeLength(2))
+	check(e.writeString([]byte("a")))
+	check(e.write([]byte{3, '1', '.', '5'}))
+	check(e.writeString([]byte("b")))
+	check(e.writeByte(254))
+
+	// LZF compressed "aaaaaaaaaa"
+	check(e.writeByte(RDB_TYPE_STRING))
+	check(e.writeString([]byte("lzf_string")))
+	check(e.writeByte(rdbEncVal<<6 | rdbEncLZF))
+	check(e.writeLength(5))
+	check(e.writeLength(10))
+	check(e.write([]byte{0x00, 'a', 0xe0, 0x00, 0x00}))
+
+	check(e.writeFooter())
+	return buffer.Bytes()
+}
+
+func TestReadRedisEncodedRDB(t *testing.T) {
+	loaded := map[string]MiniRedisData{}
+	err := readRDB(bytes.NewReader(redisEncodedRDB(t)), time.Now(), func(_ int, key string, obj MiniRedisObject) {
+		loaded[key] = obj.data
+	})
+	if err != nil {
+		t.Fatalf("readRDB() error: %v", err)
+	}
+
+	checkList := func(key string, want ...string) {
+		t.Helper()
+		list, ok := loaded[key].(*ListData)
+		if !ok {
+			t.Fatalf("%s loaded as %T", key, loaded[key])
+		}
+		if len(list.data) != len(want) {
+			t.Fatalf("%s = %q, want %q", key, list.data, want)
+		}
+		for i := range want {
+			if string(list.data[i]) != want[i] {
+				t.Errorf("%s[%d] = %q, want %q", key, i, list.data[i], want[i])
+			}
+		}
+	}
+	checkSet := func(key string, want ...string) {
+		t.Helper()
+		set, ok := loaded[key].(*SetData)
+		if !ok {
+			t.Fatalf("%s loaded as %T", key, loaded[key])
+		}
+		if len(set.data) != len(want) {
+			t.Errorf("%s has %d members, want %d", key, len(set.data), len(want))
+		}
+		for _, member := range want {
+			if _, ok := set.data[member]; !ok {
+				t.Errorf("%s is missing %q", key, member)
+			}
+		}
+	}
+
+	checkList("list_ziplist", "ab", "7", "300")
+	checkList("list_quicklist", "a", "5", "-300", "1000000", "plain node")
+	checkSet("set_intset", "1", "2", "300")
+	checkSet("set_listpack", "a", "5", "-300", "1000000")
+
+	if hash, ok := loaded["hash_listpack"].(*HashData); !ok || len(hash.data) != 1 || string(hash.data["f1"]) != "v1" {
+		t.Errorf("hash_listpack = %#v", loaded["hash_listpack"])
+	}
+	if zset, ok := loaded["zset_ziplist"].(*SortedSetData); !ok || len(zset.data) != 1 || zset.data["m"] != 7 {
+		t.Errorf("zset_ziplist = %#v", loaded["zset_ziplist"])
+	}
+	if zset, ok := loaded["zset_strings"].(*SortedSetData); !ok || zset.data["a"] != 1.5 || !math.IsInf(zset.data["b"], 1) {
+		t.Errorf("zset_strings = %#v", loaded["zset_strings"])
+	}
+	if str, ok := loaded["lzf_string"].(*StringData); !ok || string(str.data) != "aaaaaaaaaa" {
+		t.Errorf("lzf_string = %#v", loaded["lzf_string"])
+	}
+}
+
+func TestRDBAggregateRoundTrip(t *testing.T) {
+	now := time.Now()
+	entries := map[string]MiniRedisObject{
+		"list": {data: &ListData{data: [][]byte{[]byte("a"), []byte("12"), {}}}},
+		"set":  {data: newSetData([][]byte{[]byte("x"), []byte("y")})},
+		"hash": {data: &HashData{data: map[string][]byte{"field": []byte("value"), "n": []byte("1")}}},
+		"zset": {data: &SortedSetData{data: map[string]float64{"low": -1.25, "high": math.Inf(1)}}},
+	}
+
+	var buffer bytes.Buffer
+	if err := writeRDB(&buffer, []map[string]MiniRedisObject{entries}, now); err != nil {
+		t.Fatalf("writeRDB() error: %v", err)
+	}
+
+	loaded := map[string]MiniRedisObject{}
+	err := readRDB(bytes.NewReader(buffer.Bytes()), now, func(_ int, key string, obj MiniRedisObject) {
+		loaded[key] = obj
+	})
+	if err != nil {
+		t.Fatalf("readRDB() error: %v", err)
+	}
+
+	for key, want := range entries {
+		wantBytes, _ := want.data.Serialize()
+		got, ok := loaded[key]
+		if !ok {
+			t.Errorf("key %q not loaded", key)
+			continue
+		}
+		if got.data.Type() != want.data.Type() {
+			t.Errorf("key %q loaded with type %v, want %v", key, got.data.Type(), want.data.Type())
+		}
+		// Maps serialize in random order, so only lists and sorted sets are compared byte for byte
+		if key == "list" || key == "zset" {
+			if gotBytes, _ := got.data.Serialize(); !bytes.Equal(gotBytes, wantBytes) {
+				t.Errorf("key %q = %q, want %q", key, gotBytes, wantBytes)
+			}
+		}
+	}
+
+	if hash := loaded["hash"].data.(*HashData); string(hash.data["field"]) != "value" || string(hash.data["n"]) != "1" {
+		t.Errorf("hash = %q", hash.data)
+	}
+	if set := loaded["set"].data.(*SetData); len(set.data) != 2 {
+		t.Errorf("set = %v", set.data)
+	}
+}
@@ -0,0 +1,307 @@
+package miniredis
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Decoders for the compact encodings Redis stores small aggregates with in RDB files.
+// Each of them is serialized as a single RDB string, see ziplist.c, listpack.c and intset.c in the Redis sources
+
+var (
+	errZiplistCorrupt  = errors.New("corrupt ziplist")
+	errListpackCorrupt = errors.New("corrupt listpack")
+	errIntsetCorrupt   = errors.New("corrupt intset")
+)
+
+const (
+	ziplistHeaderSize = 10
+	ziplistEnd        = 0xff
+	// First byte of a prevlen field followed by a 4 bytes length
+	ziplistBigPrevlen = 0xfe
+)
+
+// Ziplist entry encodings, stored in the first byte after the prevlen field
+const (
+	ziplistStr06b = 0x00
+	ziplistStr14b = 0x40
+	ziplistStr32b = 0x80
+	ziplistInt16  = 0xc0
+	ziplistInt32  = 0xd0
+	ziplistInt64  = 0xe0
+	ziplistInt24  = 0xf0
+	ziplistInt8   = 0xfe
+	// 1111xxxx: xxxx-1 is an immediate integer between 0 and 12
+	ziplistIntImmMin = 0xf1
+	ziplistIntImmMax = 0xfd
+)
+
+// Returns the entries of a ziplist, with integers formatted as decimal strings
+func decodeZiplist(zl []byte) ([][]byte, error) {
+	if len(zl) < ziplistHeaderSize+1 || int(binary.LittleEndian.Uint32(zl)) != len(zl) {
+		return nil, errZiplistCorrupt
+	}
+
+	count := int(binary.LittleEndian.Uint16(zl[8:]))
+	entries := make([][]byte, 0, count)
+
+	p := zl[ziplistHeaderSize:]
+	for {
+		if len(p) == 0 {
+			return nil, errZiplistCorrupt
+		}
+		if p[0] == ziplistEnd {
+			break
+		}
+
+		// prevlen is only needed to walk the list backwards
+		if p[0] == ziplistBigPrevlen {
+			if len(p) < 5 {
+				return nil, errZiplistCorrupt
+			}
+			p = p[5:]
+		} else {
+			p = p[1:]
+		}
+		if len(p) == 0 {
+			return nil, errZiplistCorrupt
+		}
+
+		entry, size, err := decodeZiplistEntry(p)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		p = p[size:]
+	}
+
+	// The count saturates at 65535 for long ziplists, in which case only the walk is authoritative
+	if count != 0xffff && count != len(entries) {
+		return nil, errZiplistCorrupt
+	}
+	return entries, nil
+}
+
+// Decodes the ziplist entry starting at the encoding byte, returning it and the number of bytes it uses
+func decodeZiplistEntry(p []byte) ([]byte, int, error) {
+	encoding := p[0]
+
+	var length, headerSize int
+	switch encoding >> 6 {
+	case ziplistStr06b >> 6:
+		length, headerSize = int(encoding&0x3f), 1
+	case ziplistStr14b >> 6:
+		if len(p) < 2 {
+			return nil, 0, errZiplistCorrupt
+		}
+		length, headerSize = int(encoding&0x3f)<<8|int(p[1]), 2
+	case ziplistStr32b >> 6:
+		if len(p) < 5 {
+			return nil, 0, errZiplistCorrupt
+		}
+		length, headerSize = int(binary.BigEndian.Uint32(p[1:])), 5
+	default:
+		value, size, err := decodeZiplistInt(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []byte(strconv.FormatInt(value, 10)), size, nil
+	}
+
+	if length < 0 || headerSize+length > len(p) {
+		return nil, 0, errZiplistCorrupt
+	}
+	return p[headerSize : headerSize+length], headerSize + length, nil
+}
+
+func decodeZiplistInt(p []byte) (int64, int, error) {
+	encoding := p[0]
+	data := p[1:]
+
+	switch {
+	case encoding == ziplistInt8 && len(data) >= 1:
+		return int64(int8(data[0])), 2, nil
+	case encoding == ziplistInt16 && len(data) >= 2:
+		return int64(int16(binary.LittleEndian.Uint16(data))), 3, nil
+	case encoding == ziplistInt24 && len(data) >= 3:
+		return signExtend(uint64(data[0])|uint64(data[1])<<8|uint64(data[2])<<16, 24), 4, nil
+	case encoding == ziplistInt32 && len(data) >= 4:
+		return int64(int32(binary.LittleEndian.Uint32(data))), 5, nil
+	case encoding == ziplistInt64 && len(data) >= 8:
+		return int64(binary.LittleEndian.Uint64(data)), 9, nil
+	case encoding >= ziplistIntImmMin && encoding <= ziplistIntImmMax:
+		return int64(encoding&0x0f) - 1, 1, nil
+	default:
+		return 0, 0, errZiplistCorrupt
+	}
+}
+
+const (
+	listpackHeaderSize = 6
+	listpackEnd        = 0xff
+)
+
+// Returns the entries of a listpack, with integers formatted as decimal strings
+func decodeListpack(lp []byte) ([][]byte, error) {
+	if len(lp) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(lp)) != len(lp) {
+		return nil, errListpackCorrupt
+	}
+
+	count := int(binary.LittleEndian.Uint16(lp[4:]))
+	entries := make([][]byte, 0, count)
+
+	p := lp[listpackHeaderSize:]
+	for {
+		if len(p) == 0 {
+			return nil, errListpackCorrupt
+		}
+		if p[0] == listpackEnd {
+			break
+		}
+
+		entry, size, err := decodeListpackEntry(p)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+
+		// Skip the backlen field, only needed to walk the listpack backwards
+		size += listpackBacklenSize(size)
+		if size > len(p) {
+			return nil, errListpackCorrupt
+		}
+		p = p[size:]
+	}
+
+	// The count saturates at 65535 for long listpacks, in which case only the walk is authoritative
+	if count != 0xffff && count != len(entries) {
+		return nil, errListpackCorrupt
+	}
+	return entries, nil
+}
+
+// Decodes the listpack entry starting at p, returning it and the size of its encoding and data
+func decodeListpackEntry(p []byte) ([]byte, int, error) {
+	encoding := p[0]
+
+	var length, headerSize int
+	switch {
+	// 0xxxxxxx: 7 bit unsigned integer
+	case encoding&0x80 == 0:
+		return []byte(strconv.FormatInt(int64(encoding&0x7f), 10)), 1, nil
+	// 10xxxxxx: string of up to 63 bytes
+	case encoding&0xc0 == 0x80:
+		length, headerSize = int(encoding&0x3f), 1
+	// 110xxxxx yyyyyyyy: 13 bit signed integer
+	case encoding&0xe0 == 0xc0:
+		if len(p) < 2 {
+			return nil, 0, errListpackCorrupt
+		}
+		value := signExtend(uint64(encoding&0x1f)<<8|uint64(p[1]), 13)
+		return []byte(strconv.FormatInt(value, 10)), 2, nil
+	// 1110xxxx yyyyyyyy: string of up to 4095 bytes
+	case encoding&0xf0 == 0xe0:
+		if len(p) < 2 {
+			return nil, 0, errListpackCorrupt
+		}
+		length, headerSize = int(encoding&0x0f)<<8|int(p[1]), 2
+	case encoding == 0xf0:
+		if len(p) < 5 {
+			return nil, 0, errListpackCorrupt
+		}
+		length, headerSize = int(binary.LittleEndian.Uint32(p[1:])), 5
+	default:
+		value, size, err := decodeListpackInt(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []byte(strconv.FormatInt(value, 10)), size, nil
+	}
+
+	if length < 0 || headerSize+length > len(p) {
+		return nil, 0, errListpackCorrupt
+	}
+	return p[headerSize : headerSize+length], headerSize + length, nil
+}
+
+func decodeListpackInt(p []byte) (int64, int, error) {
+	data := p[1:]
+
+	switch {
+	case p[0] == 0xf1 && len(data) >= 2:
+		return int64(int16(binary.LittleEndian.Uint16(data))), 3, nil
+	case p[0] == 0xf2 && len(data) >= 3:
+		return signExtend(uint64(data[0])|uint64(data[1])<<8|uint64(data[2])<<16, 24), 4, nil
+	case p[0] == 0xf3 && len(data) >= 4:
+		return int64(int32(binary.LittleEndian.Uint32(data))), 5, nil
+	case p[0] == 0xf4 && len(data) >= 8:
+		return int64(binary.LittleEndian.Uint64(data)), 9, nil
+	default:
+		return 0, 0, errListpackCorrupt
+	}
+}
+
+// Size of the backlen field following an entry whose encoding and data take size bytes
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// Returns the members of an intset, formatted as decimal strings
+func decodeIntset(is []byte) ([][]byte, error) {
+	if len(is) < 8 {
+		return nil, errIntsetCorrupt
+	}
+
+	width := int(binary.LittleEndian.Uint32(is))
+	count := int(binary.LittleEndian.Uint32(is[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(is) != 8+width*count {
+		return nil, errIntsetCorrupt
+	}
+
+	members := make([][]byte, count)
+	for i := range members {
+		p := is[8+i*width:]
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(p))
+		}
+		members[i] = []byte(strconv.FormatInt(value, 10))
+	}
+	return members, nil
+}
+
+// Interprets the low bits of value as a two's complement integer
+func signExtend(value uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(value<<shift) >> shift
+}
+
+// Splits the flat field, value, field, value... entries of a compact hash or sorted set
+func pairEntries(entries [][]byte, what string) ([][2][]byte, error) {
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("%s with an odd number of entries", what)
+	}
+	pairs := make([][2][]byte, len(entries)/2)
+	for i := range pairs {
+		pairs[i] = [2][]byte{entries[2*i], entries[2*i+1]}
+	}
+	return pairs, nil
+}
@@ -0,0 +1,92 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"testing"
+)
+
+// ["a", 5, -300, 1000000]: 6 bit string, 7 bit uint, 13 bit int and 24 bit int entries, each followed by its backlen
+var testListpack = []byte{
+	0x14, 0x00, 0x00, 0x00, 0x04, 0x00,
+	0x81, 'a', 0x02,
+	0x05, 0x01,
+	0xde, 0xd4, 0x02,
+	0xf2, 0x40, 0x42, 0x0f, 0x04,
+	0xff,
+}
+
+// ["ab", 7, 300]: string, immediate and 16 bit int entries, each preceded by the previous entry length
+var testZiplist = []byte{
+	0x15, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x03, 0x00,
+	0x00, 0x02, 'a', 'b',
+	0x04, 0xf8,
+	0x02, 0xc0, 0x2c, 0x01,
+	0xff,
+}
+
+// [1, 2, 300] with 16 bit members
+var testIntset = []byte{
+	0x02, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x02, 0x00, 0x2c, 0x01,
+}
+
+func TestDecodeCompactEncodings(t *testing.T) {
+	tests := []struct {
+		name    string
+		decode  func([]byte) ([][]byte, error)
+		input   []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "listpack", decode: decodeListpack, input: testListpack, want: []string{"a", "5", "-300", "1000000"}},
+		{name: "empty listpack", decode: decodeListpack, input: []byte{0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff}, want: []string{}},
+		{name: "listpack with wrong size", decode: decodeListpack, input: testListpack[:len(testListpack)-1], wantErr: true},
+		{name: "listpack with wrong count", decode: decodeListpack, input: append([]byte{0x14, 0x00, 0x00, 0x00, 0x05, 0x00}, testListpack[6:]...), wantErr: true},
+		{name: "ziplist", decode: decodeZiplist, input: testZiplist, want: []string{"ab", "7", "300"}},
+		{name: "ziplist without end marker", decode: decodeZiplist, input: append([]byte{0x14}, testZiplist[1:len(testZiplist)-1]...), wantErr: true},
+		{name: "intset", decode: decodeIntset, input: testIntset, want: []string{"1", "2", "300"}},
+		{name: "intset with wrong length", decode: decodeIntset, input: testIntset[:len(testIntset)-2], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decode(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("decoded %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if string(got[i]) != tt.want[i] {
+					t.Errorf("entry %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSignExtend(t *testing.T) {
+	tests := []struct {
+		value uint64
+		bits  uint
+		want  int64
+	}{
+		{value: 0x0fff, bits: 13, want: 4095},
+		{value: 0x1000, bits: 13, want: -4096},
+		{value: 0x1ed4, bits: 13, want: -300},
+		{value: 0xffffff, bits: 24, want: -1},
+		{value: 0x7fffff, bits: 24, want: 8388607},
+	}
+
+	for _, tt := range tests {
+		if got := signExtend(tt.value, tt.bits); got != tt.want {
+			t.Errorf("signExtend(%#x, %d) = %d, want %d", tt.value, tt.bits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package miniredis
+
+// Circular buffer holding the tail of the replication stream, so a replica that was briefly
+// disconnected can resume from its offset (partial resynchronization) instead of fetching a new snapshot
+type replBacklog struct {
+	buf []byte
+	// Position in buf where the next byte is written
+	idx int
+	// Number of valid bytes in buf
+	histlen int64
+	// Replication offset of the first byte in the backlog
+	offset int64
+}
+
+// Creates an empty backlog of size bytes whose next byte has replication offset start
+func newReplBacklog(size int64, start int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), offset: start}
+}
+
+func (b *replBacklog) write(p []byte) {
+	size := len(b.buf)
+	written := int64(len(p))
+	// Only the last size bytes can be kept
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % size
+		p = p[n:]
+	}
+
+	b.histlen += written
+	if b.histlen > int64(size) {
+		b.offset += b.histlen - int64(size)
+		b.histlen = int64(size)
+	}
+}
+
+// Returns a copy of the data from replication offset offset to the end of the stream,
+// or false when that data is no longer (or not yet) in the backlog
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < b.offset || offset > b.offset+b.histlen {
+		return nil, false
+	}
+
+	length := int(b.offset + b.histlen - offset)
+	// The oldest byte is at idx once the buffer wrapped, at 0 before
+	start := (b.idx - int(b.histlen) + len(b.buf)) % len(b.buf)
+	start = (start + int(offset-b.offset)) % len(b.buf)
+
+	data := make([]byte, 0, length)
+	for len(data) < length {
+		end := min(start+length-len(data), len(b.buf))
+		data = append(data, b.buf[start:end]...)
+		start = 0
+	}
+	return data, true
+}
@@ -0,0 +1,504 @@
+package miniredis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delay between attempts to connect to the master
+const REPL_RECONNECT_DELAY = time.Second
+
+// Port this instance accepts connections on, sent to the master with REPLCONF listening-port.
+// Set by StartServer before replication starts
+var listeningPort int
+
+var errReadOnlyReplica = newRedisError(ErrPrefixReadOnly, "You can't write against a read only replica.")
+
+// Serializes REPLICAOF commands, as switching masters waits for the previous link to stop
+var replicaofMutex sync.Mutex
+
+// Connection of a replica to its master. The link reconnects until it is stopped,
+// asking to continue from the offset it reached each time
+type masterLink struct {
+	host   string
+	port   int
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed once run returns
+	done chan struct{}
+
+	mutex sync.Mutex
+	// nil while disconnected
+	conn           net.Conn
+	up             bool
+	syncInProgress bool
+	lastIO         time.Time
+}
+
+// Parses the replicaof setting: "<host> <port>"
+func parseReplicaOf(s string) (string, int, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("invalid replicaof %q, expected \"<host> <port>\"", s)
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid replicaof port %q", fields[1])
+	}
+	return fields[0], port, nil
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE: starts replicating from another instance, or stops
+// replicating and becomes a master keeping the current dataset
+func handleReplicaof(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("REPLICAOF command requires exactly 2 arguments")
+	}
+
+	host, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %w", err)
+	}
+	portArg, err := ExtractString(&args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	if config().ClusterEnabled {
+		return nil, fmt.Errorf("REPLICAOF not allowed in cluster mode.")
+	}
+
+	replicaofMutex.Lock()
+	defer replicaofMutex.Unlock()
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(portArg, "one") {
+		if stopReplication() {
+			log.Printf("MASTER MODE enabled (user request)")
+		}
+		return okReply, nil
+	}
+
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid master port")
+	}
+
+	repl.mutex.Lock()
+	current := repl.link
+	repl.mutex.Unlock()
+	if current != nil && current.host == host && current.port == port {
+		return &SimpleStringReply{data: "OK Already connected to specified master"}, nil
+	}
+
+	if current != nil {
+		current.stop()
+	}
+	startReplication(host, port)
+	log.Printf("REPLICAOF %s:%d enabled (user request)", host, port)
+	return okReply, nil
+}
+
+// Makes this instance a replica of host:port. The current replication ID and offset are offered
+// to the new master, which continues from them when it shares our history
+func startReplication(host string, port int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	link := &masterLink{host: host, port: port, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+
+	repl.mutex.Lock()
+	repl.link = link
+	repl.mutex.Unlock()
+
+	go link.run()
+}
+
+// Stops replicating, returning whether this instance was a replica. A new replication ID is
+// generated, since writes accepted from now on diverge from the master's history
+func stopReplication() bool {
+	repl.mutex.Lock()
+	link := repl.link
+	repl.mutex.Unlock()
+	if link == nil {
+		return false
+	}
+
+	link.stop()
+
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+
+	repl.link = nil
+	shiftReplicationIDLocked()
+	// Our replicas reconnect and learn the new ID with a partial resync
+	disconnectReplicasLocked()
+	return true
+}
+
+func isReplica() bool {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	return repl.link != nil
+}
+
+func (l *masterLink) run() {
+	defer close(l.done)
+
+	for {
+		err := l.syncWithMaster()
+		if l.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Connection with master %s:%d lost: %v", l.host, l.port, err)
+
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-time.After(REPL_RECONNECT_DELAY):
+		}
+	}
+}
+
+// Closes the connection and waits for run to return
+func (l *masterLink) stop() {
+	l.cancel()
+	l.mutex.Lock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.mutex.Unlock()
+	<-l.done
+}
+
+// Connects to the master, synchronizes and applies the stream until the connection fails
+func (l *masterLink) syncWithMaster() error {
+	dialer := net.Dialer{Timeout: config().ReplTimeout}
+	conn, err := dialer.DialContext(l.ctx, "tcp", net.JoinHostPort(l.host, strconv.Itoa(l.port)))
+	if err != nil {
+		return err
+	}
+	if err := l.setConn(conn); err != nil {
+		return err
+	}
+	defer l.dropConn()
+
+	reader := bufio.NewReader(&masterConn{Conn: conn, link: l})
+
+	if _, err := l.request(reader, "PING"); err != nil {
+		return fmt.Errorf("PING: %w", err)
+	}
+	if listeningPort != 0 {
+		if _, err := l.request(reader, "REPLCONF", "listening-port", strconv.Itoa(listeningPort)); err != nil {
+			return fmt.Errorf("REPLCONF listening-port: %w", err)
+		}
+	}
+	if _, err := l.request(reader, "REPLCONF", "capa", "psync2"); err != nil {
+		return fmt.Errorf("REPLCONF capa: %w", err)
+	}
+
+	repl.mutex.Lock()
+	replid, offset := repl.replid, repl.offset
+	repl.mutex.Unlock()
+
+	reply, err := l.request(reader, "PSYNC", replid, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return fmt.Errorf("PSYNC: %w", err)
+	}
+
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC reply %q", reply)
+		}
+		if err := l.fullResync(reader, fields[1], masterOffset); err != nil {
+			return err
+		}
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		newReplid := ""
+		if len(fields) > 1 {
+			newReplid = fields[1]
+		}
+		l.continueResync(newReplid)
+		log.Printf("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization")
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", reply)
+	}
+
+	l.mutex.Lock()
+	l.up = true
+	l.mutex.Unlock()
+	return l.applyStream(reader)
+}
+
+// Loads the snapshot the master sends for a full resync, replacing the dataset
+func (l *masterLink) fullResync(reader *bufio.Reader, replid string, offset int64) error {
+	l.mutex.Lock()
+	l.syncInProgress = true
+	l.mutex.Unlock()
+
+	// The master may send newlines to keep the connection alive while it prepares the payload
+	var header string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading the snapshot: %w", err)
+		}
+		if header = strings.TrimRight(line, "\r\n"); header != "" {
+			break
+		}
+	}
+	if header[0] != '$' {
+		return fmt.Errorf("unexpected snapshot header %q", header)
+	}
+	size, err := strconv.ParseInt(header[1:], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid snapshot length %q", header)
+	}
+	log.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master", size)
+
+	payload := io.LimitReader(reader, size)
+	data := make([]map[string]MiniRedisObject, databaseCount())
+	loaded := 0
+	err = readRDB(payload, serverClock.now(), func(db int, key string, obj MiniRedisObject) {
+		if data[db] == nil {
+			data[db] = map[string]MiniRedisObject{}
+		}
+		data[db][key] = obj
+		loaded++
+	})
+	if err != nil {
+		return fmt.Errorf("loading the snapshot: %w", err)
+	}
+	// Skip whatever follows the end of the RDB, the stream starts after the payload
+	if _, err := io.Copy(io.Discard, payload); err != nil {
+		return fmt.Errorf("reading the snapshot: %w", err)
+	}
+
+	acquired := acquireKeyspace()
+	defer releaseKeyspace(acquired)
+	propagationMutex.Lock()
+	databases.replace(data)
+	repl.mutex.Lock()
+	repl.replid = replid
+	repl.replid2 = emptyReplicationID
+	repl.secondReplidOffset = -1
+	repl.offset = offset
+	repl.selectedDb = -1
+	createBacklogLocked(offset + 1)
+	// Our replicas followed the previous dataset, they need a full resync too
+	disconnectReplicasLocked()
+	repl.mutex.Unlock()
+	propagationMutex.Unlock()
+
+	log.Printf("MASTER <-> REPLICA sync: Finished with success, %d keys loaded", loaded)
+
+	// The AOF must describe the new dataset rather than the writes that led to the old one
+	if aofEnabled() {
+		if err := startAOFRewrite(); err != nil {
+			log.Printf("Can't rewrite the append only file after the sync: %v", err)
+		}
+	}
+	return nil
+}
+
+// Continues the stream after a partial resync. A new replication ID means the master was
+// promoted, its previous ID staying valid up to our offset
+func (l *masterLink) continueResync(replid string) {
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+
+	if replid != "" && replid != repl.replid {
+		repl.replid2 = repl.replid
+		repl.secondReplidOffset = repl.offset + 1
+		repl.replid = replid
+		disconnectReplicasLocked()
+	}
+	if repl.backlog == nil {
+		createBacklogLocked(repl.offset + 1)
+	}
+}
+
+// Executes the commands streamed by the master, forwarding them to our own replicas
+func (l *masterLink) applyStream(reader *bufio.Reader) error {
+	master := newClient(NewRESPWriter(io.Discard, RESP_WRITER_INITIAL_BUF_SIZE))
+	master.master = true
+	// After a partial resync, the stream goes on with the database it had selected
+	repl.mutex.Lock()
+	master.db = max(repl.selectedDb, 0)
+	repl.mutex.Unlock()
+
+	for {
+		args, _, err := readMultibulk(reader)
+		if err != nil {
+			return err
+		}
+
+		getack := len(args) >= 2 && strings.EqualFold(string(args[0]), "REPLCONF") && strings.EqualFold(string(args[1]), "GETACK")
+		if getack {
+			// The acknowledged offset doesn't include the GETACK itself
+			l.sendAck()
+		}
+
+		// The master writes canonical multibulk requests, so encoding args again gives the bytes it sent.
+		// The offset moves before the command runs, so the write offset it logs to the AOF includes it
+		propagationMutex.Lock()
+		feedReplicationStream(catCommand(nil, args))
+		propagationMutex.Unlock()
+
+		if !getack {
+			db := master.db
+			acquired := acquireKeyspace()
+			if err := replayCommand(master, args); err != nil {
+				log.Printf("Error executing a command from the master: %v", err)
+			}
+			releaseKeyspace(acquired)
+			if master.db != db {
+				repl.mutex.Lock()
+				repl.selectedDb = master.db
+				repl.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// Sends REPLCONF ACK with the offset processed so far, which the master uses to track replication lag,
+// followed by FACK and the offset fsynced to the AOF when it is enabled
+func (l *masterLink) sendAck() {
+	ack := [][]byte{[]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(replicationOffset(), 10))}
+	if aofOffset := aofFsyncedOffset(); aofOffset >= 0 {
+		ack = append(ack, []byte("FACK"), []byte(strconv.FormatInt(aofOffset, 10)))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conn == nil || !l.up {
+		return
+	}
+	l.conn.SetWriteDeadline(time.Now().Add(config().ReplTimeout))
+	if _, err := l.conn.Write(catCommand(nil, ack)); err != nil {
+		log.Printf("Error sending REPLCONF ACK to the master: %v", err)
+	}
+}
+
+// Sends a handshake command and reads its single line reply, returning it without the leading +
+func (l *masterLink) request(reader *bufio.Reader, args ...string) (string, error) {
+	command := make([][]byte, len(args))
+	for i, arg := range args {
+		command[i] = []byte(arg)
+	}
+
+	l.mutex.Lock()
+	conn := l.conn
+	l.mutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(config().ReplTimeout))
+	if _, err := conn.Write(catCommand(nil, command)); err != nil {
+		return "", err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("error reply from master: %s", line[1:])
+	}
+	return strings.TrimPrefix(line, "+"), nil
+}
+
+func (l *masterLink) setConn(conn net.Conn) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// stop may have run while dialing
+	if l.ctx.Err() != nil {
+		conn.Close()
+		return l.ctx.Err()
+	}
+	l.conn = conn
+	l.lastIO = time.Now()
+	return nil
+}
+
+func (l *masterLink) dropConn() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.conn.Close()
+	l.conn = nil
+	l.up = false
+	l.syncInProgress = false
+}
+
+func (l *masterLink) isUp() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.up
+}
+
+// State of the link as reported by ROLE
+func (l *masterLink) state() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case l.up:
+		return "connected"
+	case l.syncInProgress:
+		return "sync"
+	case l.conn != nil:
+		return "connecting"
+	default:
+		return "connect"
+	}
+}
+
+func (l *masterLink) info(offset int64) []infoField {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	status := "down"
+	if l.up {
+		status = "up"
+	}
+	return []infoField{
+		{"master_host", l.host},
+		{"master_port", strconv.Itoa(l.port)},
+		{"master_link_status", status},
+		{"master_last_io_seconds_ago", strconv.FormatInt(int64(time.Since(l.lastIO).Seconds()), 10)},
+		{"master_sync_in_progress", formatBool(l.syncInProgress)},
+		{"slave_repl_offset", strconv.FormatInt(offset, 10)},
+		{"slave_read_only", formatBool(config().ReplicaReadOnly)},
+	}
+}
+
+// Connection to the master, with every read bounded by the replication timeout. The master pings
+// periodically, so a silent connection means the master or the network went away
+type masterConn struct {
+	net.Conn
+	link *masterLink
+}
+
+func (c *masterConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(config().ReplTimeout))
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.link.mutex.Lock()
+		c.link.lastIO = time.Now()
+		c.link.mutex.Unlock()
+	}
+	return n, err
+}
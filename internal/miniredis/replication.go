@@ -0,0 +1,615 @@
+package miniredis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest amount of stream data buffered for a replica that doesn't keep up, beyond which it
+// is disconnected (client-output-buffer-limit replica)
+const REPL_OUTPUT_BUFFER_LIMIT = 256 * 1024 * 1024
+
+// Replication ID used when there is no previous history
+var emptyReplicationID = strings.Repeat("0", 40)
+
+// Replication state. The replication stream is the sequence of write commands applied to the dataset,
+// identified by a replication ID and the offset of each byte in it. Replicas ask for the stream from the
+// offset they reached, and are sent a snapshot first when that part is no longer in the backlog
+type replicationState struct {
+	mutex sync.Mutex
+	// ID of the current history of the dataset
+	replid string
+	// ID of the history this instance was following before a promotion, valid up to secondReplidOffset.
+	// Lets the other replicas of the old master continue with partial resyncs
+	replid2            string
+	secondReplidOffset int64
+	// Replication offset of the last byte of the stream
+	offset int64
+	// Database selected by the stream, -1 when the next command must select one. On a replica it follows
+	// the SELECTs of the master, so the stream carries on with the right database after a promotion
+	selectedDb int
+	// Created when the first replica connects, so a master without replicas doesn't keep a copy of its writes
+	backlog  *replBacklog
+	replicas map[*replica]struct{}
+	lastPing time.Time
+	lastCron time.Time
+
+	// Connection to the master when this instance is a replica, see replicaof.go
+	link *masterLink
+}
+
+var repl = &replicationState{
+	replid:             newReplicationID(),
+	replid2:            emptyReplicationID,
+	secondReplidOffset: -1,
+	selectedDb:         -1,
+	replicas:           map[*replica]struct{}{},
+}
+
+// Random 40 characters hexadecimal ID, like Redis replication IDs
+func newReplicationID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("generating replication ID: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// Starts a new history, remembering the current one so replicas following it can still partially resync
+func shiftReplicationIDLocked() {
+	repl.replid2 = repl.replid
+	repl.secondReplidOffset = repl.offset + 1
+	repl.replid = newReplicationID()
+}
+
+// A replica connected to this instance, as seen from the master side
+type replica struct {
+	conn net.Conn
+	// Address the replica accepts connections on, as reported with REPLCONF listening-port
+	ip            string
+	listeningPort int
+
+	mutex sync.Mutex
+	// Stream data waiting to be written to the replica
+	pending []byte
+	// Signals writeLoop that pending has data. Closed along with the connection
+	wake   chan struct{}
+	closed bool
+	// Offsets the replica acknowledged with REPLCONF ACK, as processed and as fsynced to its AOF
+	ackOffset    int64
+	aofAckOffset int64
+	lastAck      time.Time
+}
+
+func (r *replica) enqueue(data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+	if len(r.pending)+len(data) > REPL_OUTPUT_BUFFER_LIMIT {
+		log.Printf("Replica %s:%d exceeded the output buffer limit, disconnecting it", r.ip, r.listeningPort)
+		r.closeLocked()
+		return
+	}
+
+	r.pending = append(r.pending, data...)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replica) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closeLocked()
+}
+
+func (r *replica) closeLocked() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.wake)
+	r.conn.Close()
+}
+
+func (r *replica) isClosed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closed
+}
+
+func (r *replica) ack(offset int64, aofOffset int64) {
+	r.mutex.Lock()
+	r.ackOffset = max(r.ackOffset, offset)
+	r.aofAckOffset = max(r.aofAckOffset, aofOffset)
+	r.lastAck = time.Now()
+	r.mutex.Unlock()
+
+	ackNotifier.notify()
+}
+
+// Writes the stream to the replica as it is fed, until the replica is closed
+func (r *replica) writeLoop() {
+	for range r.wake {
+		r.mutex.Lock()
+		data := r.pending
+		r.pending = nil
+		r.mutex.Unlock()
+
+		if len(data) == 0 {
+			continue
+		}
+		r.conn.SetWriteDeadline(time.Now().Add(config().ReplTimeout))
+		if _, err := r.conn.Write(data); err != nil {
+			log.Printf("Error writing to replica %s:%d: %v", r.ip, r.listeningPort, err)
+			r.close()
+			return
+		}
+	}
+}
+
+// Sends a write command executed on this instance against database db to the replicas, preceded by a SELECT
+// when the stream was on another database. Commands that don't touch keys pass -1 for db. Called with propagationMutex held, so the stream has the same
+// order as the writes. A replica only forwards the stream of its master
+func feedReplication(db int, args [][]byte) {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+
+	if repl.link != nil {
+		return
+	}
+
+	var data []byte
+	if db >= 0 && db != repl.selectedDb {
+		data = catCommand(data, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(db))})
+		repl.selectedDb = db
+	}
+	data = catCommand(data, args)
+	if repl.backlog == nil {
+		// The offset still moves by the size of the stream without replicas, so WAITAOF can track fsyncs
+		repl.offset += int64(len(data))
+		return
+	}
+	feedReplicationLocked(data)
+}
+
+// Adds data received from the master to the stream, forwarding it to the replicas of this replica.
+// Called with propagationMutex held
+func feedReplicationStream(data []byte) {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+
+	if repl.backlog == nil {
+		createBacklogLocked(repl.offset + 1)
+	}
+	feedReplicationLocked(data)
+}
+
+func replicationOffset() int64 {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	return repl.offset
+}
+
+// Starts the backlog at offset start. Writes are streamed from now on, so it is
+// called with propagationMutex held for writing, as well as repl.mutex
+func createBacklogLocked(start int64) {
+	repl.backlog = newReplBacklog(config().ReplBacklogSize, start)
+	propagating.Store(true)
+}
+
+func replicationBacklogCreated() bool {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	return repl.backlog != nil
+}
+
+// Resizes the backlog to repl-backlog-size, keeping as much of its data as fits
+func resizeReplicationBacklog() {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+
+	size := config().ReplBacklogSize
+	if repl.backlog == nil || int64(len(repl.backlog.buf)) == size {
+		return
+	}
+	data, _ := repl.backlog.readFrom(repl.backlog.offset)
+	backlog := newReplBacklog(size, repl.backlog.offset)
+	backlog.write(data)
+	repl.backlog = backlog
+}
+
+func feedReplicationLocked(data []byte) {
+	repl.backlog.write(data)
+	repl.offset += int64(len(data))
+	for r := range repl.replicas {
+		r.enqueue(data)
+	}
+}
+
+// Closes the connections of all replicas, making them reconnect. Used when the history they follow changes
+func disconnectReplicasLocked() {
+	for r := range repl.replicas {
+		r.close()
+		delete(repl.replicas, r)
+	}
+}
+
+func unregisterReplica(r *replica) {
+	repl.mutex.Lock()
+	delete(repl.replicas, r)
+	repl.mutex.Unlock()
+	r.close()
+}
+
+// Registers c as a replica, its connection being handed to serveReplica once the reply is sent.
+// Called with repl.mutex held
+func registerReplicaLocked(c *client, pending []byte) {
+	ip, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	r := &replica{
+		conn:          c.conn,
+		ip:            ip,
+		listeningPort: c.replListeningPort,
+		pending:       pending,
+		wake:          make(chan struct{}, 1),
+	}
+	if len(pending) > 0 {
+		r.wake <- struct{}{}
+	}
+	repl.replicas[r] = struct{}{}
+	c.replica = r
+}
+
+// Takes the snapshot sent to a replica for a full resync, along with the replication ID and offset it
+// corresponds to. Writes made after it are buffered for the replica when register is set
+func startFullResync(c *client, register bool) (string, int64, []byte, error) {
+	// PSYNC and SYNC are blocking commands, which don't hold the databases
+	acquired := acquireKeyspace()
+	propagationMutex.Lock()
+	repl.mutex.Lock()
+
+	if repl.link != nil && !repl.link.isUp() {
+		repl.mutex.Unlock()
+		propagationMutex.Unlock()
+		releaseKeyspace(acquired)
+		return "", 0, nil, newRedisError(ErrPrefixNoMasterLink, "Can't SYNC while not connected with my master")
+	}
+
+	if repl.backlog == nil {
+		// No replica could follow the previous history without the backlog, so start a new one
+		if repl.link == nil {
+			repl.replid = newReplicationID()
+			repl.replid2 = emptyReplicationID
+			repl.secondReplidOffset = -1
+		}
+		createBacklogLocked(repl.offset + 1)
+	}
+
+	snapshot := databases.snapshot()
+	replid, offset := repl.replid, repl.offset
+	// The replica starts the stream on database 0, whatever the others are on
+	repl.selectedDb = -1
+	if register {
+		registerReplicaLocked(c, nil)
+	}
+	repl.mutex.Unlock()
+	propagationMutex.Unlock()
+	releaseKeyspace(acquired)
+
+	var payload bytes.Buffer
+	if err := writeRDB(&payload, snapshot, serverClock.now()); err != nil {
+		if c.replica != nil {
+			unregisterReplica(c.replica)
+			c.replica = nil
+		}
+		return "", 0, nil, fmt.Errorf("generating RDB payload: %w", err)
+	}
+	return replid, offset, payload.Bytes(), nil
+}
+
+// SYNC: full synchronization without replication ID or offset, as requested by replicas predating PSYNC.
+// The snapshot is followed by the stream of writes, unless REPLCONF rdb-only was sent (redis-cli --rdb)
+func handleSync(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("SYNC command takes no arguments")
+	}
+
+	_, _, payload, err := startFullResync(c, !c.rdbOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.rdbOnly {
+		c.closeAfterReply = true
+	}
+	return &RDBPayloadReply{data: payload}, nil
+}
+
+// PSYNC replid offset: continues the stream from offset when the backlog still holds it, replying
+// +CONTINUE followed by the missing data. Otherwise replies +FULLRESYNC followed by a snapshot
+func handlePsync(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("PSYNC command requires exactly 2 arguments")
+	}
+
+	replid, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid replication ID: %w", err)
+	}
+	offset, err := ExtractInt64(&args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// rdb-only requests are after the snapshot alone
+	if !c.rdbOnly {
+		propagationMutex.Lock()
+		repl.mutex.Lock()
+		if data, ok := tryPartialResyncLocked(replid, offset); ok {
+			registerReplicaLocked(c, data)
+			replid := repl.replid
+			repl.mutex.Unlock()
+			propagationMutex.Unlock()
+			log.Printf("Partial resynchronization request from %s accepted, sending %d bytes of backlog", c.conn.RemoteAddr(), len(data))
+			return &SimpleStringReply{data: "CONTINUE " + replid}, nil
+		}
+		repl.mutex.Unlock()
+		propagationMutex.Unlock()
+		log.Printf("Replica %s asks for synchronization, starting a full resync", c.conn.RemoteAddr())
+	}
+	replid, offset, payload, err := startFullResync(c, !c.rdbOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both replies go out together, the status line first
+	if err := c.writer.WriteValue(&SimpleStringReply{data: fmt.Sprintf("FULLRESYNC %s %d", replid, offset)}); err != nil {
+		return nil, err
+	}
+	if c.rdbOnly {
+		c.closeAfterReply = true
+	}
+	return &RDBPayloadReply{data: payload}, nil
+}
+
+// Returns the part of the stream starting at offset, when the replica follows our history (current or
+// previous one, up to where we diverged from it) and the backlog still holds that part
+func tryPartialResyncLocked(replid string, offset int64) ([]byte, bool) {
+	if repl.backlog == nil {
+		return nil, false
+	}
+	if replid != repl.replid && (replid != repl.replid2 || offset > repl.secondReplidOffset) {
+		return nil, false
+	}
+	return repl.backlog.readFrom(offset)
+}
+
+// Serves the connection of a replica once PSYNC or SYNC was answered: the stream is written by
+// writeLoop, while the replica only sends REPLCONF ACK <offset> [FACK <aof offset>] with the offsets it
+// processed and fsynced
+func serveReplica(c *client, reader *RESPReader) error {
+	r := c.replica
+	go r.writeLoop()
+
+	for {
+		commands, err := reader.ReadCommands()
+		for _, cmd := range commands {
+			if cmd.Type != REPLCONF || (len(cmd.Args) != 2 && len(cmd.Args) != 4) {
+				continue
+			}
+			option, _ := ExtractString(&cmd.Args[0])
+			offset, err := ExtractInt64(&cmd.Args[1])
+			if !strings.EqualFold(option, "ACK") || err != nil {
+				continue
+			}
+
+			aofOffset := int64(-1)
+			if len(cmd.Args) == 4 {
+				option, _ := ExtractString(&cmd.Args[2])
+				if value, err := ExtractInt64(&cmd.Args[3]); strings.EqualFold(option, "FACK") && err == nil {
+					aofOffset = value
+				}
+			}
+			r.ack(offset, aofOffset)
+		}
+
+		if err != nil {
+			if err == io.EOF || r.isClosed() {
+				return nil
+			}
+			return fmt.Errorf("reading from replica: %w", err)
+		}
+	}
+}
+
+// REPLCONF option value [option value ...]: settings sent by replicas and tools before PSYNC or SYNC
+func handleReplconf(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args)%2 != 0 {
+		return nil, errSyntax
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, errSyntax
+		}
+
+		switch strings.ToLower(option) {
+		case "listening-port":
+			port, err := ExtractInt64(&args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			c.replListeningPort = int(port)
+		case "rdb-only":
+			value, err := ExtractInt64(&args[i+1])
+			if err != nil || (value != 0 && value != 1) {
+				return nil, errSyntax
+			}
+			c.rdbOnly = value == 1
+		default:
+			// Capabilities, ip-address, and acknowledgements sent before the replica is
+			// registered, don't change anything
+		}
+	}
+	return okReply, nil
+}
+
+// Pings the replicas and disconnects the ones that stopped acknowledging, or acknowledges the
+// processed offset to the master. Called by the server cron, runs once per second
+func replicationCron(now time.Time) {
+	repl.mutex.Lock()
+	if now.Sub(repl.lastCron) < time.Second {
+		repl.mutex.Unlock()
+		return
+	}
+	repl.lastCron = now
+
+	link := repl.link
+	var timedOut []*replica
+	for r := range repl.replicas {
+		r.mutex.Lock()
+		// Replicas that never acknowledged (SYNC from old versions or tools) can't be checked
+		if !r.lastAck.IsZero() && now.Sub(r.lastAck) > config().ReplTimeout {
+			timedOut = append(timedOut, r)
+		}
+		r.mutex.Unlock()
+	}
+	ping := link == nil && len(repl.replicas) > 0 && now.Sub(repl.lastPing) >= config().ReplPingReplicaPeriod
+	repl.mutex.Unlock()
+
+	for _, r := range timedOut {
+		log.Printf("Disconnecting timedout replica %s:%d", r.ip, r.listeningPort)
+		unregisterReplica(r)
+	}
+
+	// The pings let replicas detect a master that went away, and keep their offsets moving
+	if ping {
+		propagationMutex.Lock()
+		feedReplication(-1, [][]byte{[]byte("PING")})
+		repl.mutex.Lock()
+		repl.lastPing = now
+		repl.mutex.Unlock()
+		propagationMutex.Unlock()
+	}
+
+	if link != nil {
+		link.sendAck()
+	}
+}
+
+// ROLE: the role of this instance, with the replicas and their offsets for a master, or the master
+// and the state of the link for a replica
+func handleRole(args []RESPData) (MiniRedisData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("ROLE command takes no arguments")
+	}
+
+	repl.mutex.Lock()
+	link := repl.link
+	offset := repl.offset
+	var replicas []MiniRedisData
+	for r := range repl.replicas {
+		r.mutex.Lock()
+		replicas = append(replicas, &ArrayReply{data: []MiniRedisData{
+			&StringData{data: []byte(r.ip)},
+			&StringData{data: []byte(strconv.Itoa(r.listeningPort))},
+			&StringData{data: []byte(strconv.FormatInt(r.ackOffset, 10))},
+		}})
+		r.mutex.Unlock()
+	}
+	repl.mutex.Unlock()
+
+	if link == nil {
+		return &ArrayReply{data: []MiniRedisData{
+			&StringData{data: []byte("master")},
+			&IntegerData{data: offset},
+			&ArrayReply{data: replicas},
+		}}, nil
+	}
+	return &ArrayReply{data: []MiniRedisData{
+		&StringData{data: []byte("slave")},
+		&StringData{data: []byte(link.host)},
+		&IntegerData{data: int64(link.port)},
+		&StringData{data: []byte(link.state())},
+		&IntegerData{data: offset},
+	}}, nil
+}
+
+// "master", or "slave" while replicating from another server, as ROLE and INFO report it
+func replicationRole() string {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if repl.link == nil {
+		return "master"
+	}
+	return "slave"
+}
+
+func replicationInfo(*client) []infoField {
+	repl.mutex.Lock()
+	link := repl.link
+	var fields []infoField
+	if link == nil {
+		fields = append(fields, infoField{"role", "master"})
+	} else {
+		fields = append(fields, infoField{"role", "slave"})
+	}
+
+	replicaFields := []infoField{{"connected_slaves", strconv.Itoa(len(repl.replicas))}}
+	i := 0
+	now := time.Now()
+	for r := range repl.replicas {
+		r.mutex.Lock()
+		var lag int64
+		if !r.lastAck.IsZero() {
+			lag = int64(now.Sub(r.lastAck).Seconds())
+		}
+		replicaFields = append(replicaFields, infoField{
+			"slave" + strconv.Itoa(i),
+			fmt.Sprintf("ip=%s,port=%d,state=online,offset=%d,lag=%d", r.ip, r.listeningPort, r.ackOffset, lag),
+		})
+		r.mutex.Unlock()
+		i++
+	}
+
+	replicaFields = append(replicaFields,
+		infoField{"master_replid", repl.replid},
+		infoField{"master_replid2", repl.replid2},
+		infoField{"master_repl_offset", strconv.FormatInt(repl.offset, 10)},
+		infoField{"second_repl_offset", strconv.FormatInt(repl.secondReplidOffset, 10)},
+		infoField{"repl_backlog_active", formatBool(repl.backlog != nil)},
+		infoField{"repl_backlog_size", strconv.FormatInt(config().ReplBacklogSize, 10)},
+	)
+	if repl.backlog != nil {
+		replicaFields = append(replicaFields,
+			infoField{"repl_backlog_first_byte_offset", strconv.FormatInt(repl.backlog.offset, 10)},
+			infoField{"repl_backlog_histlen", strconv.FormatInt(repl.backlog.histlen, 10)},
+		)
+	} else {
+		replicaFields = append(replicaFields,
+			infoField{"repl_backlog_first_byte_offset", "0"},
+			infoField{"repl_backlog_histlen", "0"},
+		)
+	}
+	offset := repl.offset
+	repl.mutex.Unlock()
+
+	if link != nil {
+		fields = append(fields, link.info(offset)...)
+	}
+	return append(fields, replicaFields...)
+}
@@ -0,0 +1,385 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncSendsRDBPayload(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	key := "sync_key"
+	database(0).Set(&key, &MiniRedisObject{data: &ListData{data: [][]byte{[]byte("a"), []byte("b")}}})
+	defer database(0).Delete(&key)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$8\r\nrdb-only\r\n$1\r\n1\r\n*1\r\n$4\r\nSYNC\r\n")); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	if line, _ := reader.ReadString('\n'); line != "+OK\r\n" {
+		t.Fatalf("unexpected REPLCONF reply %q", line)
+	}
+
+	header, err := reader.ReadString('\n')
+	if err != nil || header[0] != '$' {
+		t.Fatalf("unexpected SYNC reply %q, %v", header, err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil {
+		t.Fatalf("invalid payload length %q", header)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+
+	var found bool
+	err = readRDB(strings.NewReader(string(payload)), time.Now(), func(_ int, k string, obj MiniRedisObject) {
+		if k == key {
+			list, ok := obj.data.(*ListData)
+			found = ok && len(list.data) == 2
+		}
+	})
+	if err != nil {
+		t.Fatalf("readRDB() error: %v", err)
+	}
+	if !found {
+		t.Errorf("list %q missing from the SYNC payload", key)
+	}
+
+	// Nothing but EOF follows the payload
+	if extra, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %q, %v", extra, err)
+	}
+}
+
+func TestReplconfArguments(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$4\r\n6380\r\n",
+		"*2\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n",
+	})
+	want := []string{"+OK", "-ERR syntax error"}
+	if len(replies) != len(want) {
+		t.Fatalf("got replies %q, want %q", replies, want)
+	}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Errorf("reply %d = %q, want %q", i, replies[i], want[i])
+		}
+	}
+}
+
+func TestReplBacklog(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		writes []string
+		// Offset to read from, with the data expected or ok = false
+		from int64
+		want string
+		ok   bool
+	}{
+		{name: "empty", size: 8, from: 1, want: "", ok: true},
+		{name: "everything", size: 8, writes: []string{"abc", "de"}, from: 1, want: "abcde", ok: true},
+		{name: "middle", size: 8, writes: []string{"abc", "de"}, from: 3, want: "cde", ok: true},
+		{name: "end of the stream", size: 8, writes: []string{"abc"}, from: 4, want: "", ok: true},
+		{name: "ahead of the stream", size: 8, writes: []string{"abc"}, from: 5},
+		{name: "wrapped", size: 4, writes: []string{"abc", "def"}, from: 3, want: "cdef", ok: true},
+		{name: "overwritten", size: 4, writes: []string{"abc", "def"}, from: 2},
+		{name: "write larger than the backlog", size: 4, writes: []string{"a", "bcdefgh"}, from: 5, want: "efgh", ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplBacklog(tt.size, 1)
+			for _, w := range tt.writes {
+				b.write([]byte(w))
+			}
+
+			got, ok := b.readFrom(tt.from)
+			if ok != tt.ok || string(got) != tt.want {
+				t.Errorf("readFrom(%d) = %q, %v, want %q, %v", tt.from, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReplicationOffsetWithoutBacklog(t *testing.T) {
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+	repl.mutex.Lock()
+	backlog, offset, selectedDb := repl.backlog, repl.offset, repl.selectedDb
+	repl.backlog, repl.selectedDb = nil, -1
+	repl.mutex.Unlock()
+	defer func() {
+		repl.mutex.Lock()
+		repl.backlog, repl.offset, repl.selectedDb = backlog, offset, selectedDb
+		repl.mutex.Unlock()
+	}()
+
+	// The offset moves by the size of the stream the replicas would receive
+	set := [][]byte{[]byte("SET"), []byte("k"), []byte("v")}
+	feedReplication(3, set)
+	want := offset + int64(len(catCommand(catCommand(nil, [][]byte{[]byte("SELECT"), []byte("3")}), set)))
+	if got := replicationOffset(); got != want {
+		t.Errorf("offset after the first write = %d, want %d", got, want)
+	}
+	feedReplication(3, set)
+	want += int64(len(catCommand(nil, set)))
+	if got := replicationOffset(); got != want {
+		t.Errorf("offset after the second write = %d, want %d", got, want)
+	}
+}
+
+// Gives the test empty databases, so that full resynchronizations don't transfer the keys earlier
+// tests left behind. The previous databases are back at the end of the test
+func useEmptyDatabases(t *testing.T) {
+	previous := databases.list.Load()
+	databases.reset(len(*previous))
+	t.Cleanup(func() { databases.list.Store(previous) })
+}
+
+// Sends PSYNC on a new connection, returning the connection and the status line of the reply
+func sendPsync(t *testing.T, addr string, replid string, offset int64) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	// Only there so that a hung server fails the test instead of blocking it
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	psync := catCommand(nil, [][]byte{[]byte("PSYNC"), []byte(replid), []byte(strconv.FormatInt(offset, 10))})
+	if _, err := conn.Write(psync); err != nil {
+		t.Fatalf("failed to write PSYNC: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading PSYNC reply: %v", err)
+	}
+	return conn, reader, strings.TrimRight(line, "\r\n")
+}
+
+func TestPsyncFullAndPartialResync(t *testing.T) {
+	useEmptyDatabases(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	key := "psync_key"
+	defer database(0).Delete(&key)
+
+	conn, reader, line := sendPsync(t, addr, "?", -1)
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("PSYNC reply = %q, want +FULLRESYNC <replid> <offset>", line)
+	}
+	replid := fields[1]
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+
+	header, _ := reader.ReadString('\n')
+	size, err := strconv.Atoi(strings.TrimRight(header[1:], "\r\n"))
+	if header[0] != '$' || err != nil {
+		t.Fatalf("unexpected snapshot header %q", header)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, size)); err != nil {
+		t.Fatalf("reading snapshot: %v", err)
+	}
+
+	// Writes made after the snapshot follow it, the stream selecting their database first
+	dialAndSend(t, addr, []string{"*3\r\n$3\r\nSET\r\n$9\r\npsync_key\r\n$2\r\nv1\r\n"})
+	for _, want := range []string{"SELECT 0", "SET psync_key v1"} {
+		args, n, err := readMultibulk(reader)
+		if err != nil || string(bytes.Join(args, []byte(" "))) != want {
+			t.Fatalf("streamed command = %q, %v, want %s", args, err, want)
+		}
+		offset += n
+	}
+
+	ack := catCommand(nil, [][]byte{[]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(offset, 10))})
+	if _, err := conn.Write(ack); err != nil {
+		t.Fatalf("writing REPLCONF ACK: %v", err)
+	}
+	wantAck := "offset=" + strconv.FormatInt(offset, 10)
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(strings.Join(replicationInfoLines(), "\n"), wantAck) {
+		if time.Now().After(deadline) {
+			t.Fatalf("acknowledged offset missing from INFO: %q", replicationInfoLines())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+
+	// Writes made while disconnected are sent from the backlog
+	dialAndSend(t, addr, []string{"*3\r\n$3\r\nSET\r\n$9\r\npsync_key\r\n$2\r\nv2\r\n"})
+	conn, reader, line = sendPsync(t, addr, replid, offset+1)
+	defer conn.Close()
+	if line != "+CONTINUE "+replid {
+		t.Fatalf("PSYNC reply = %q, want +CONTINUE %s", line, replid)
+	}
+	args, _, err := readMultibulk(reader)
+	if err != nil || string(bytes.Join(args, []byte(" "))) != "SET psync_key v2" {
+		t.Fatalf("streamed command = %q, %v, want SET psync_key v2", args, err)
+	}
+
+	// Another history can't continue
+	other, _, line := sendPsync(t, addr, newReplicationID(), offset+1)
+	defer other.Close()
+	if !strings.HasPrefix(line, "+FULLRESYNC ") {
+		t.Errorf("PSYNC reply for an unknown history = %q, want +FULLRESYNC", line)
+	}
+}
+
+func replicationInfoLines() []string {
+	var lines []string
+	for _, field := range replicationInfo(nil) {
+		lines = append(lines, field.name+":"+field.value)
+	}
+	return lines
+}
+
+func TestReplicaFollowsMaster(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+	defer func() {
+		replicaofMutex.Lock()
+		stopReplication()
+		replicaofMutex.Unlock()
+	}()
+
+	keys := []string{"replica_snapshot", "replica_streamed", "replica_local"}
+	for _, key := range keys {
+		key := key
+		defer database(0).Delete(&key)
+		defer database(6).Delete(&key)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen on random port: %v", err)
+	}
+	defer listener.Close()
+
+	var snapshot bytes.Buffer
+	err = writeRDB(&snapshot, []map[string]MiniRedisObject{{
+		"replica_snapshot": {data: &StringData{data: []byte("from snapshot")}},
+	}}, time.Now())
+	if err != nil {
+		t.Fatalf("writeRDB() error: %v", err)
+	}
+
+	masterReplid := strings.Repeat("a", 40)
+	// The stream selects the database of the writes that follow
+	streamed := catCommand(nil, [][]byte{[]byte("SELECT"), []byte("6")})
+	streamed = catCommand(streamed, [][]byte{[]byte("SET"), []byte("replica_streamed"), []byte("from stream")})
+	getack := catCommand(nil, [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})
+
+	// Plays the master: answers the handshake, sends the snapshot and a write, then asks for an acknowledgement
+	acks := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for {
+			args, _, err := readMultibulk(reader)
+			if err != nil {
+				return
+			}
+
+			switch strings.ToUpper(string(args[0])) {
+			case "PING":
+				conn.Write([]byte("+PONG\r\n"))
+			case "PSYNC":
+				conn.Write([]byte("+FULLRESYNC " + masterReplid + " 100\r\n"))
+				conn.Write([]byte("$" + strconv.Itoa(snapshot.Len()) + "\r\n"))
+				conn.Write(snapshot.Bytes())
+				conn.Write(streamed)
+				conn.Write(getack)
+			case "REPLCONF":
+				if strings.EqualFold(string(args[1]), "ACK") {
+					acks <- string(args[2])
+					continue
+				}
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	replies := dialAndSend(t, addr, []string{
+		"*3\r\n$9\r\nREPLICAOF\r\n$9\r\n127.0.0.1\r\n$" + strconv.Itoa(len(port)) + "\r\n" + port + "\r\n",
+	})
+	if len(replies) != 1 || replies[0] != "+OK" {
+		t.Fatalf("REPLICAOF replies = %q, want +OK", replies)
+	}
+
+	select {
+	case ack := <-acks:
+		if want := strconv.Itoa(100 + len(streamed)); ack != want {
+			t.Errorf("REPLCONF ACK offset = %s, want %s", ack, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no REPLCONF ACK received")
+	}
+
+	for key, want := range map[string]string{"replica_snapshot": "from snapshot", "replica_streamed": "from stream"} {
+		db := 0
+		if key == "replica_streamed" {
+			db = 6
+		}
+		obj, exists := lookupKey(database(db), key, time.Now())
+		if data, ok := obj.data.(*StringData); !exists || !ok || string(data.data) != want {
+			t.Errorf("%s = %#v, want %q", key, obj.data, want)
+		}
+	}
+
+	replies = dialAndSend(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$13\r\nreplica_local\r\n$1\r\nv\r\n",
+		"*1\r\n$4\r\nROLE\r\n",
+	})
+	if len(replies) < 4 || replies[0] != "-READONLY You can't write against a read only replica." || replies[3] != "slave" {
+		t.Errorf("replies on the replica = %q, want a READONLY error and the slave role", replies)
+	}
+
+	// Once promoted, writes are accepted and the master's history is remembered
+	replies = dialAndSend(t, addr, []string{
+		"*3\r\n$9\r\nREPLICAOF\r\n$2\r\nNO\r\n$3\r\nONE\r\n",
+		"*3\r\n$3\r\nSET\r\n$13\r\nreplica_local\r\n$1\r\nv\r\n",
+	})
+	if len(replies) != 3 || replies[0] != "+OK" || replies[2] != "v" {
+		t.Errorf("replies after REPLICAOF NO ONE = %q, want +OK and the value set", replies)
+	}
+
+	repl.mutex.Lock()
+	replid2, secondOffset := repl.replid2, repl.secondReplidOffset
+	repl.mutex.Unlock()
+	if want := int64(100 + len(streamed) + len(getack) + 1); replid2 != masterReplid || secondOffset != want {
+		t.Errorf("previous history = %s up to %d, want %s up to %d", replid2, secondOffset, masterReplid, want)
+	}
+}
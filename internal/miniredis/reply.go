@@ -0,0 +1,81 @@
+package miniredis
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// Reply-only values returned by handlers. They let a handler describe the shape of its reply
+// (map, set, double, ...) once, while RESPWriter picks the RESP2 or RESP3 encoding depending
+// on what the connection negotiated through HELLO.
+
+type SimpleStringReply struct{ data string }
+type NullReply struct{}
+type BooleanReply struct{ data bool }
+type DoubleReply struct{ data float64 }
+type BigNumberReply struct{ data *big.Int }
+type VerbatimStringReply struct {
+	format string
+	data   []byte
+}
+type ArrayReply struct{ data []MiniRedisData }
+type SetReply struct{ data []MiniRedisData }
+type PushReply struct{ data []MiniRedisData }
+
+// Map entries are flattened as key, value, key, value, ...
+type MapReply struct{ data []MiniRedisData }
+
+// Attributes are sent ahead of value on RESP3 connections and dropped on RESP2 ones
+type AttributeReply struct {
+	attributes []MiniRedisData
+	value      MiniRedisData
+}
+
+// RDB file sent in reply to SYNC: a bulk string length followed by the raw payload, without trailing CRLF
+type RDBPayloadReply struct{ data []byte }
+
+// Nothing is sent, for commands that close the connection instead of replying
+type NoReply struct{}
+
+var okReply = &SimpleStringReply{data: "OK"}
+
+func (s *SimpleStringReply) Type() MiniRedisDataType   { return Reply }
+func (s *NullReply) Type() MiniRedisDataType           { return Reply }
+func (s *BooleanReply) Type() MiniRedisDataType        { return Reply }
+func (s *DoubleReply) Type() MiniRedisDataType         { return Reply }
+func (s *BigNumberReply) Type() MiniRedisDataType      { return Reply }
+func (s *VerbatimStringReply) Type() MiniRedisDataType { return Reply }
+func (s *ArrayReply) Type() MiniRedisDataType          { return Reply }
+func (s *SetReply) Type() MiniRedisDataType            { return Reply }
+func (s *PushReply) Type() MiniRedisDataType           { return Reply }
+func (s *MapReply) Type() MiniRedisDataType            { return Reply }
+func (s *AttributeReply) Type() MiniRedisDataType      { return Reply }
+func (s *RDBPayloadReply) Type() MiniRedisDataType     { return Reply }
+func (s *NoReply) Type() MiniRedisDataType             { return Reply }
+
+func (s *SimpleStringReply) Serialize() ([]byte, error)   { return serializeRESP2(s) }
+func (s *NullReply) Serialize() ([]byte, error)           { return serializeRESP2(s) }
+func (s *BooleanReply) Serialize() ([]byte, error)        { return serializeRESP2(s) }
+func (s *DoubleReply) Serialize() ([]byte, error)         { return serializeRESP2(s) }
+func (s *BigNumberReply) Serialize() ([]byte, error)      { return serializeRESP2(s) }
+func (s *VerbatimStringReply) Serialize() ([]byte, error) { return serializeRESP2(s) }
+func (s *ArrayReply) Serialize() ([]byte, error)          { return serializeRESP2(s) }
+func (s *SetReply) Serialize() ([]byte, error)            { return serializeRESP2(s) }
+func (s *PushReply) Serialize() ([]byte, error)           { return serializeRESP2(s) }
+func (s *MapReply) Serialize() ([]byte, error)            { return serializeRESP2(s) }
+func (s *AttributeReply) Serialize() ([]byte, error)      { return serializeRESP2(s) }
+func (s *RDBPayloadReply) Serialize() ([]byte, error)     { return serializeRESP2(s) }
+func (s *NoReply) Serialize() ([]byte, error)             { return serializeRESP2(s) }
+
+// Serializes a reply the way a RESP2 connection would receive it
+func serializeRESP2(v MiniRedisData) ([]byte, error) {
+	var buffer bytes.Buffer
+	w := NewRESPWriter(&buffer, RESP_WRITER_INITIAL_BUF_SIZE)
+	if err := w.WriteValue(v); err != nil {
+		return nil, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
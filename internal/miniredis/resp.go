@@ -2,9 +2,12 @@ package miniredis
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -13,12 +16,32 @@ type RESPDataType int16
 
 const RESP_READER_INITIAL_BUF_SIZE = 4 * 1024 // 4kb
 const RESP_WRITER_INITIAL_BUF_SIZE = 4 * 1024 // 4kb
+const RESP_INLINE_MAX_SIZE = 64 * 1024        // 64kb, same as Redis' PROTO_INLINE_MAX_SIZE
+const RESP_BIG_ARG_SIZE = 32 * 1024           // 32kb, same as Redis' PROTO_MBULK_BIG_ARG
 
 const (
 	SimpleString RESPDataType = iota
 	BulkString
 	Integer
 	Array
+	SimpleError
+	// RESP3 types
+	Null
+	Boolean
+	Double
+	BigNumber
+	BulkError
+	VerbatimString
+	Map
+	Set
+	Attribute
+	Push
+)
+
+// Protocol versions negotiated through HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 type RESPReader struct {
@@ -26,22 +49,56 @@ type RESPReader struct {
 	buffer     []byte
 	readIndex  int
 	writeIndex int
+	limits     RESPReaderLimits
+	// Multibulk request interrupted by a big argument, nil otherwise
+	partial *partialRequest
+}
+
+// A multibulk request containing a big argument. The arguments are owned by the request rather
+// than pointing into the reader buffer, so the buffer can be reused while the big argument is read
+type partialRequest struct {
+	args      []RESPData
+	remaining int64
+	// Destination of the big argument being read, including its trailing \r\n. Nil once read
+	bigArg       []byte
+	bigArgFilled int
+}
+
+// Limits enforced on client requests while parsing, so that a single header
+// can't make the server allocate unbounded memory
+type RESPReaderLimits struct {
+	MaxBulkLen        int64
+	MaxMultibulkLen   int64
+	MaxQueryBufferLen int64
+}
+
+func readerLimitsFromConfig() RESPReaderLimits {
+	cfg := config()
+	return RESPReaderLimits{
+		MaxBulkLen:        cfg.ProtoMaxBulkLen,
+		MaxMultibulkLen:   cfg.MaxMultibulkLen,
+		MaxQueryBufferLen: cfg.ClientQueryBufferLimit,
+	}
 }
 
 type RESPWriter struct {
 	writer bufio.Writer
+	// Protocol version replies are encoded with (RESP2 or RESP3)
+	protocol int
 }
 
 func NewRESPReader(conn io.Reader, initialBufferSize int) *RESPReader {
 	return &RESPReader{
 		reader: conn,
 		buffer: make([]byte, initialBufferSize),
+		limits: readerLimitsFromConfig(),
 	}
 }
 
 func NewRESPWriter(conn io.Writer, initialBufferSize int) *RESPWriter {
 	return &RESPWriter{
-		writer: *bufio.NewWriterSize(conn, initialBufferSize),
+		writer:   *bufio.NewWriterSize(conn, initialBufferSize),
+		protocol: RESP2,
 	}
 }
 
@@ -55,7 +112,12 @@ type RESPSimpleString struct{ data string }
 func (s *RESPSimpleString) DataType() RESPDataType { return SimpleString }
 func (s *RESPSimpleString) Dump() string           { return s.data }
 
-type RESPBulkString struct{ data []byte }
+type RESPBulkString struct {
+	data []byte
+	// Set when data has its own allocation instead of pointing into the reader buffer,
+	// meaning it can be kept after the request is processed without copying it
+	owned bool
+}
 
 func (s *RESPBulkString) DataType() RESPDataType { return BulkString }
 func (s *RESPBulkString) Dump() string           { return string(s.data) }
@@ -76,6 +138,77 @@ func (s *RESPArray) Dump() string {
 	return fmt.Sprintf("[%s]", strings.Join(stringsArr, ","))
 }
 
+type RESPSimpleError struct{ data string }
+
+func (s *RESPSimpleError) DataType() RESPDataType { return SimpleError }
+func (s *RESPSimpleError) Dump() string           { return s.data }
+
+type RESPNull struct{}
+
+func (s *RESPNull) DataType() RESPDataType { return Null }
+func (s *RESPNull) Dump() string           { return "(nil)" }
+
+type RESPBoolean struct{ data bool }
+
+func (s *RESPBoolean) DataType() RESPDataType { return Boolean }
+func (s *RESPBoolean) Dump() string           { return strconv.FormatBool(s.data) }
+
+type RESPDouble struct{ data float64 }
+
+func (s *RESPDouble) DataType() RESPDataType { return Double }
+func (s *RESPDouble) Dump() string           { return formatDouble(s.data) }
+
+type RESPBigNumber struct{ data *big.Int }
+
+func (s *RESPBigNumber) DataType() RESPDataType { return BigNumber }
+func (s *RESPBigNumber) Dump() string           { return s.data.String() }
+
+type RESPBulkError struct{ data []byte }
+
+func (s *RESPBulkError) DataType() RESPDataType { return BulkError }
+func (s *RESPBulkError) Dump() string           { return string(s.data) }
+
+// Verbatim strings carry a three character format ("txt", "mkd") alongside the text
+type RESPVerbatimString struct {
+	format string
+	data   []byte
+}
+
+func (s *RESPVerbatimString) DataType() RESPDataType { return VerbatimString }
+func (s *RESPVerbatimString) Dump() string           { return string(s.data) }
+
+// Maps keep their entries flattened as key, value, key, value, ... to preserve wire order
+type RESPMap struct{ data []RESPData }
+
+func (s *RESPMap) DataType() RESPDataType { return Map }
+func (s *RESPMap) Dump() string {
+	var stringsArr []string
+	for i := 0; i+1 < len(s.data); i += 2 {
+		stringsArr = append(stringsArr, s.data[i].Dump()+":"+s.data[i+1].Dump())
+	}
+	return fmt.Sprintf("{%s}", strings.Join(stringsArr, ","))
+}
+
+type RESPSet struct{ data []RESPData }
+
+func (s *RESPSet) DataType() RESPDataType { return Set }
+func (s *RESPSet) Dump() string           { return DumpRESPDataArray(s.data) }
+
+// Attributes are out-of-band metadata attached to the value that follows them on the wire,
+// so they are parsed together with that value
+type RESPAttribute struct {
+	attributes []RESPData
+	value      RESPData
+}
+
+func (s *RESPAttribute) DataType() RESPDataType { return Attribute }
+func (s *RESPAttribute) Dump() string           { return s.value.Dump() }
+
+type RESPPush struct{ data []RESPData }
+
+func (s *RESPPush) DataType() RESPDataType { return Push }
+func (s *RESPPush) Dump() string           { return DumpRESPDataArray(s.data) }
+
 func DumpRESPDataArray(lst []RESPData) string {
 	var stringsArr []string
 	for _, elem := range lst {
@@ -90,6 +223,45 @@ const (
 	SET RESPCommandType = iota
 	GET
 	ECHO
+	HELLO
+	PING
+	SAVE
+	BGSAVE
+	LASTSAVE
+	INFO
+	DEL
+	EXPIRE
+	PEXPIRE
+	EXPIREAT
+	PEXPIREAT
+	TTL
+	PTTL
+	PERSIST
+	BGREWRITEAOF
+	SYNC
+	REPLCONF
+	DUMP
+	RESTORE
+	MIGRATE
+	PSYNC
+	REPLICAOF
+	SLAVEOF
+	ROLE
+	WAIT
+	WAITAOF
+	CLUSTER
+	ASKING
+	RESTORE_ASKING
+	SELECT
+	MOVE
+	SWAPDB
+	DBSIZE
+	SHUTDOWN
+	CONFIG
+	HGETALL
+	ZSCORE
+	// Well-formed request for a command that doesn't exist, answered with an error reply
+	UNKNOWN
 )
 
 type RESPCommand struct {
@@ -98,9 +270,16 @@ type RESPCommand struct {
 }
 
 var ErrIncompleteRESPValue = errors.New("incomplete RESP value")
+var ErrQueryBufferLimit = errors.New("client reached max query buffer length")
+var errBigArgPending = errors.New("big argument pending")
 
 // Reads commands in from r.reader, handles buffering. Meant to be called in a loop
 func (r *RESPReader) ReadCommands() ([]RESPCommand, error) {
+	// A big argument is read straight into its own allocation, bypassing the buffer
+	if r.partial != nil && r.partial.bigArg != nil {
+		return r.readBigArg()
+	}
+
 	r.shiftBuffer()
 
 	r.growBuffer()
@@ -124,7 +303,44 @@ func (r *RESPReader) ReadCommands() ([]RESPCommand, error) {
 
 	r.writeIndex += numReadBytes
 
-	return r.parseBufferCommands()
+	commands, parseErr := r.parseBufferCommands()
+	if parseErr != nil {
+		return commands, parseErr
+	}
+
+	// Whatever is left is an incomplete request. Don't let it grow forever
+	if int64(r.writeIndex-r.readIndex) > r.limits.MaxQueryBufferLen {
+		return commands, fmt.Errorf("%w (%d bytes buffered, limit is %d)", ErrQueryBufferLimit, r.writeIndex-r.readIndex, r.limits.MaxQueryBufferLen)
+	}
+
+	return commands, nil
+}
+
+// Reads the pending big argument directly into its destination. Once it is complete,
+// the rest of its request is parsed from the buffer as usual
+func (r *RESPReader) readBigArg() ([]RESPCommand, error) {
+	partial := r.partial
+
+	numReadBytes, err := r.reader.Read(partial.bigArg[partial.bigArgFilled:])
+	partial.bigArgFilled += numReadBytes
+
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading from reader: %w", err)
+	}
+
+	if partial.bigArgFilled < len(partial.bigArg) {
+		return nil, err
+	}
+
+	if err := r.finishBigArg(); err != nil {
+		return nil, err
+	}
+
+	commands, parseErr := r.parseBufferCommands()
+	if parseErr != nil {
+		return commands, parseErr
+	}
+	return commands, err
 }
 
 // Shifts buffer to start at 0
@@ -166,32 +382,64 @@ func (r *RESPReader) parseBufferCommands() ([]RESPCommand, error) {
 	var commands []RESPCommand
 
 	for {
-		// Read everything in the buffer, so just exit loop
-		if r.readIndex >= r.writeIndex {
+		// Read everything in the buffer, so just exit loop. A partial request whose
+		// last argument was big can be complete without anything left in the buffer
+		if r.readIndex >= r.writeIndex && (r.partial == nil || r.partial.remaining > 0) {
 			break
 		}
 
 		subBuffer := r.buffer[r.readIndex:r.writeIndex]
-		value, consumed, err := parseSingleValue(subBuffer)
+
+		// Like Redis, anything that doesn't start as a multibulk request is an inline command
+		var value RESPData
+		var consumed int
+		var err error
+		if r.partial != nil {
+			value, consumed, err = r.parseBulkArgs(subBuffer, 0, r.partial.args, r.partial.remaining)
+		} else if subBuffer[0] == '*' {
+			value, consumed, err = r.parseMultibulkRequest(subBuffer)
+		} else {
+			value, consumed, err = parseInlineCommand(subBuffer)
+		}
+
 		if err != nil {
 			// Ran out of commands in the buffer, just exit loop
 			if err == ErrIncompleteRESPValue {
 				break
 			}
 
-			return commands, fmt.Errorf("parsing buffer command: %w", err)
+			// The rest of the buffer went into a big argument, which is read on the next call
+			if err == errBigArgPending {
+				r.readIndex += consumed
+				break
+			}
+
+			return commands, &ProtocolError{Message: err.Error()}
 		}
 
 		r.readIndex += consumed
+		r.partial = nil
 
 		val, ok := value.(*RESPArray)
 		if !ok {
-			return commands, fmt.Errorf("error casting value to RESPArray - value datatype is %#v", value.DataType())
+			return commands, newProtocolError("expected array, got %#v", value.DataType())
+		}
+
+		// Empty requests (blank inline lines, *0, *-1) are skipped like Redis does
+		if len(val.data) == 0 {
+			continue
 		}
 
 		cmd, err := ParseCommand(val)
 		if err != nil {
-			return commands, fmt.Errorf("error parsing command: %w", err)
+			// Unknown commands get an error reply, everything else after them in the pipeline still runs
+			var unknownErr *UnknownCommandError
+			if errors.As(err, &unknownErr) {
+				commands = append(commands, RESPCommand{Type: UNKNOWN, Args: val.data})
+				continue
+			}
+
+			return commands, newProtocolError("%v", err)
 		}
 		commands = append(commands, cmd)
 	}
@@ -199,6 +447,122 @@ func (r *RESPReader) parseBufferCommands() ([]RESPCommand, error) {
 	return commands, nil
 }
 
+// Parses a multibulk request (*N followed by N bulk strings) the way Redis does, enforcing the
+// reader limits on every header before waiting for the data it announces
+func (r *RESPReader) parseMultibulkRequest(buf []byte) (*RESPArray, int, error) {
+	end := CLRFIndex(buf)
+	if end == -1 {
+		if len(buf) > RESP_INLINE_MAX_SIZE {
+			return &RESPArray{data: nil}, 0, fmt.Errorf("too big mbulk count string")
+		}
+		return &RESPArray{data: nil}, 0, ErrIncompleteRESPValue
+	}
+
+	count, err := strconv.ParseInt(string(buf[1:end]), 10, 64)
+	if err != nil || count > r.limits.MaxMultibulkLen {
+		return &RESPArray{data: nil}, 0, fmt.Errorf("invalid multibulk length")
+	}
+
+	// Null (*-1) and empty (*0) requests carry no command, and are skipped like Redis does
+	if count <= 0 {
+		return &RESPArray{data: []RESPData{}}, end + 2, nil
+	}
+
+	// The count comes from the client, so it isn't trusted for preallocation
+	args := make([]RESPData, 0, min(count, 1024))
+
+	return r.parseBulkArgs(buf, end+2, args, count)
+}
+
+// Parses count bulk string arguments starting at buf[offset:], appending them to args.
+// When it reaches a big argument whose data isn't buffered yet, the arguments parsed so far
+// are copied out of the buffer into r.partial along with a destination sized for the big
+// argument, and errBigArgPending is returned with everything in buf consumed
+func (r *RESPReader) parseBulkArgs(buf []byte, offset int, args []RESPData, count int64) (*RESPArray, int, error) {
+	consumed := offset
+	parsedBefore := len(args)
+
+	for i := int64(0); i < count; i++ {
+		rest := buf[consumed:]
+		if len(rest) == 0 {
+			return &RESPArray{data: nil}, 0, ErrIncompleteRESPValue
+		}
+
+		if rest[0] != '$' {
+			return &RESPArray{data: nil}, 0, fmt.Errorf("expected '$', got '%c'", rest[0])
+		}
+
+		end := CLRFIndex(rest)
+		if end == -1 {
+			if len(rest) > RESP_INLINE_MAX_SIZE {
+				return &RESPArray{data: nil}, 0, fmt.Errorf("too big bulk count string")
+			}
+			return &RESPArray{data: nil}, 0, ErrIncompleteRESPValue
+		}
+
+		length, err := strconv.ParseInt(string(rest[1:end]), 10, 64)
+		if err != nil || length < 0 || length > r.limits.MaxBulkLen {
+			return &RESPArray{data: nil}, 0, fmt.Errorf("invalid bulk length")
+		}
+
+		dataStart := end + 2
+		if int64(len(rest)) < int64(dataStart)+length+2 {
+			if length >= RESP_BIG_ARG_SIZE {
+				r.startBigArg(args, parsedBefore, count-i, rest[dataStart:], length)
+				return &RESPArray{data: nil}, len(buf), errBigArgPending
+			}
+			return &RESPArray{data: nil}, 0, ErrIncompleteRESPValue
+		}
+
+		dataEnd := dataStart + int(length)
+		if rest[dataEnd] != '\r' || rest[dataEnd+1] != '\n' {
+			return &RESPArray{data: nil}, 0, fmt.Errorf("expected CRLF after bulk string")
+		}
+		args = append(args, &RESPBulkString{data: rest[dataStart:dataEnd]})
+		consumed += dataEnd + 2
+	}
+
+	return &RESPArray{data: args}, consumed, nil
+}
+
+// Moves the request into big argument mode: the arguments after args[ownedBefore:] still point
+// into the reader buffer so they get copied, and the buffered part of the big argument is
+// copied into a destination of exactly its size (plus the trailing \r\n)
+func (r *RESPReader) startBigArg(args []RESPData, ownedBefore int, remaining int64, buffered []byte, length int64) {
+	for i := ownedBefore; i < len(args); i++ {
+		bulk := args[i].(*RESPBulkString)
+		owned := make([]byte, len(bulk.data))
+		copy(owned, bulk.data)
+		args[i] = &RESPBulkString{data: owned, owned: true}
+	}
+
+	bigArg := make([]byte, length+2)
+	filled := copy(bigArg, buffered)
+
+	r.partial = &partialRequest{
+		args:         args,
+		remaining:    remaining,
+		bigArg:       bigArg,
+		bigArgFilled: filled,
+	}
+}
+
+// Appends the fully read big argument to its request
+func (r *RESPReader) finishBigArg() error {
+	partial := r.partial
+	length := len(partial.bigArg) - 2
+
+	if partial.bigArg[length] != '\r' || partial.bigArg[length+1] != '\n' {
+		return newProtocolError("expected CRLF after bulk string")
+	}
+
+	partial.args = append(partial.args, &RESPBulkString{data: partial.bigArg[:length], owned: true})
+	partial.remaining--
+	partial.bigArg = nil
+	partial.bigArgFilled = 0
+	return nil
+}
+
 // Parses single RESP value from buffer
 func parseSingleValue(buf []byte) (RESPData, int, error) {
 	if len(buf) == 0 {
@@ -215,6 +579,28 @@ func parseSingleValue(buf []byte) (RESPData, int, error) {
 		return parseSimpleString(buf)
 	case '*':
 		return parseArray(buf)
+	case '-':
+		return parseSimpleError(buf)
+	case '_':
+		return parseNull(buf)
+	case '#':
+		return parseBoolean(buf)
+	case ',':
+		return parseDouble(buf)
+	case '(':
+		return parseBigNumber(buf)
+	case '!':
+		return parseBulkError(buf)
+	case '=':
+		return parseVerbatimString(buf)
+	case '%':
+		return parseMap(buf)
+	case '~':
+		return parseSet(buf)
+	case '|':
+		return parseAttribute(buf)
+	case '>':
+		return parsePush(buf)
 	default:
 		return nil, 0, fmt.Errorf("unknown RESP type byte: %q", buf[0])
 	}
@@ -252,6 +638,9 @@ func parseBulkString(buf []byte) (*RESPBulkString, int, error) {
 
 	length, consumed, err := parseInteger(buf)
 	if err != nil {
+		if err != ErrIncompleteRESPValue {
+			err = fmt.Errorf("invalid bulk length")
+		}
 		return &RESPBulkString{data: nil}, 0, err
 	}
 
@@ -290,34 +679,340 @@ func parseSimpleString(buf []byte) (*RESPSimpleString, int, error) {
 // Parses array into RESPArray
 // Expects *len\r\nELEM1\r\nELEM2\r\n...\r\nELEMN\r\n
 func parseArray(buf []byte) (*RESPArray, int, error) {
+	data, consumed, err := parseAggregate(buf, 1)
+	if err != nil {
+		return &RESPArray{data: nil}, 0, err
+	}
+	return &RESPArray{data: data}, consumed, nil
+}
+
+// Parses simple error into RESPSimpleError
+// Expects -ERR message\r\n
+func parseSimpleError(buf []byte) (*RESPSimpleError, int, error) {
+	str, consumed, err := parseSimpleString(buf)
+	if err != nil {
+		return &RESPSimpleError{data: ""}, 0, err
+	}
+	return &RESPSimpleError{data: str.data}, consumed, nil
+}
+
+// Parses RESP3 null
+// Expects _\r\n
+func parseNull(buf []byte) (*RESPNull, int, error) {
+	end := CLRFIndex(buf)
+	if end == -1 {
+		return &RESPNull{}, 0, ErrIncompleteRESPValue
+	}
+	if end != 1 {
+		return &RESPNull{}, 0, fmt.Errorf("invalid null: %q", buf[:end])
+	}
+	return &RESPNull{}, end + 2, nil
+}
+
+// Parses RESP3 boolean
+// Expects #t\r\n or #f\r\n
+func parseBoolean(buf []byte) (*RESPBoolean, int, error) {
+	end := CLRFIndex(buf)
+	if end == -1 {
+		return &RESPBoolean{}, 0, ErrIncompleteRESPValue
+	}
+
+	switch string(buf[1:end]) {
+	case "t":
+		return &RESPBoolean{data: true}, end + 2, nil
+	case "f":
+		return &RESPBoolean{data: false}, end + 2, nil
+	default:
+		return &RESPBoolean{}, 0, fmt.Errorf("invalid boolean: %q", buf[1:end])
+	}
+}
+
+// Parses RESP3 double
+// Expects ,1.23\r\n (also accepts inf, -inf and nan)
+func parseDouble(buf []byte) (*RESPDouble, int, error) {
+	end := CLRFIndex(buf)
+	if end == -1 {
+		return &RESPDouble{}, 0, ErrIncompleteRESPValue
+	}
+
+	var data float64
+	switch part := string(buf[1:end]); part {
+	case "inf":
+		data = math.Inf(1)
+	case "-inf":
+		data = math.Inf(-1)
+	case "nan":
+		data = math.NaN()
+	default:
+		parsed, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return &RESPDouble{}, 0, err
+		}
+		data = parsed
+	}
+
+	return &RESPDouble{data: data}, end + 2, nil
+}
+
+// Parses RESP3 big number
+// Expects (3492890328409238509324850943850943825024385\r\n
+func parseBigNumber(buf []byte) (*RESPBigNumber, int, error) {
+	end := CLRFIndex(buf)
+	if end == -1 {
+		return &RESPBigNumber{}, 0, ErrIncompleteRESPValue
+	}
+
+	data, ok := new(big.Int).SetString(string(buf[1:end]), 10)
+	if !ok {
+		return &RESPBigNumber{}, 0, fmt.Errorf("invalid big number: %q", buf[1:end])
+	}
+
+	return &RESPBigNumber{data: data}, end + 2, nil
+}
+
+// Parses RESP3 bulk error. Same framing as a bulk string
+// Expects !len\r\nERR message\r\n
+func parseBulkError(buf []byte) (*RESPBulkError, int, error) {
+	str, consumed, err := parseBulkString(buf)
+	if err != nil {
+		return &RESPBulkError{data: nil}, 0, err
+	}
+	return &RESPBulkError{data: str.data}, consumed, nil
+}
+
+// Parses RESP3 verbatim string. Same framing as a bulk string, with the payload prefixed by its format
+// Expects =len\r\ntxt:Some string\r\n
+func parseVerbatimString(buf []byte) (*RESPVerbatimString, int, error) {
+	str, consumed, err := parseBulkString(buf)
+	if err != nil {
+		return &RESPVerbatimString{}, 0, err
+	}
+
+	if len(str.data) < 4 || str.data[3] != ':' {
+		return &RESPVerbatimString{}, 0, fmt.Errorf("invalid verbatim string: %q", str.data)
+	}
+
+	return &RESPVerbatimString{format: string(str.data[:3]), data: str.data[4:]}, consumed, nil
+}
+
+// Parses the header and elements of an aggregate type (array, map, set, push, attribute).
+// Each of the n elements declared in the header is made of elementsPerEntry RESP values.
+// Returns nil data for a negative length (RESP2 null array)
+func parseAggregate(buf []byte, elementsPerEntry int) ([]RESPData, int, error) {
 	totalConsumed := 0
 
 	length, consumed, err := parseInteger(buf)
 	if err != nil {
-		return &RESPArray{data: nil}, 0, err
+		if err != ErrIncompleteRESPValue {
+			err = fmt.Errorf("invalid multibulk length")
+		}
+		return nil, 0, err
 	}
 
 	totalConsumed += consumed
 	parsedLength := length.data
 
 	if parsedLength < 0 {
-		return &RESPArray{data: nil}, totalConsumed, nil
+		return nil, totalConsumed, nil
 	}
 
-	arr := make([]RESPData, parsedLength)
+	arr := make([]RESPData, parsedLength*int64(elementsPerEntry))
 
-	for i := 0; i < int(parsedLength); i++ {
+	for i := 0; i < len(arr); i++ {
 		elem, consumed, err := parseSingleValue(buf[totalConsumed:])
 
 		if err != nil {
-			return &RESPArray{data: nil}, 0, err
+			return nil, 0, err
 		}
 
 		totalConsumed += consumed
 		arr[i] = elem
 	}
 
-	return &RESPArray{data: arr}, totalConsumed, nil
+	return arr, totalConsumed, nil
+}
+
+// Parses RESP3 map into RESPMap
+// Expects %len\r\nKEY1VALUE1...KEYNVALUEN
+func parseMap(buf []byte) (*RESPMap, int, error) {
+	data, consumed, err := parseAggregate(buf, 2)
+	if err != nil {
+		return &RESPMap{data: nil}, 0, err
+	}
+	return &RESPMap{data: data}, consumed, nil
+}
+
+// Parses RESP3 set into RESPSet
+// Expects ~len\r\nELEM1...ELEMN
+func parseSet(buf []byte) (*RESPSet, int, error) {
+	data, consumed, err := parseAggregate(buf, 1)
+	if err != nil {
+		return &RESPSet{data: nil}, 0, err
+	}
+	return &RESPSet{data: data}, consumed, nil
+}
+
+// Parses RESP3 push into RESPPush
+// Expects >len\r\nELEM1...ELEMN
+func parsePush(buf []byte) (*RESPPush, int, error) {
+	data, consumed, err := parseAggregate(buf, 1)
+	if err != nil {
+		return &RESPPush{data: nil}, 0, err
+	}
+	return &RESPPush{data: data}, consumed, nil
+}
+
+// Parses RESP3 attribute along with the value it is attached to
+// Expects |len\r\nKEY1VALUE1...KEYNVALUEN followed by any RESP value
+func parseAttribute(buf []byte) (*RESPAttribute, int, error) {
+	attributes, consumed, err := parseAggregate(buf, 2)
+	if err != nil {
+		return &RESPAttribute{}, 0, err
+	}
+
+	value, valueConsumed, err := parseSingleValue(buf[consumed:])
+	if err != nil {
+		return &RESPAttribute{}, 0, err
+	}
+
+	return &RESPAttribute{attributes: attributes, value: value}, consumed + valueConsumed, nil
+}
+
+// Parses an inline command (space separated arguments terminated by \n or \r\n), as typed in telnet or netcat.
+// Returns the arguments as a RESPArray of bulk strings, so it can go through ParseCommand like any multibulk request
+func parseInlineCommand(buf []byte) (*RESPArray, int, error) {
+	end := bytes.IndexByte(buf, '\n')
+	if end == -1 {
+		if len(buf) > RESP_INLINE_MAX_SIZE {
+			return &RESPArray{data: nil}, 0, fmt.Errorf("too big inline request")
+		}
+		return &RESPArray{data: nil}, 0, ErrIncompleteRESPValue
+	}
+
+	line := buf[:end]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	args, err := splitInlineArgs(line)
+	if err != nil {
+		return &RESPArray{data: nil}, 0, err
+	}
+
+	return &RESPArray{data: args}, end + 1, nil
+}
+
+// Splits an inline command line into arguments, following Redis' sdssplitargs rules:
+// double quoted arguments support \n, \r, \t, \b, \a, \\, \" and \xHH escapes,
+// single quoted arguments only support \', and a closing quote must be followed by a space
+func splitInlineArgs(line []byte) ([]RESPData, error) {
+	args := []RESPData{}
+	i := 0
+
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var current []byte
+		inDoubleQuotes := false
+		inSingleQuotes := false
+		done := false
+
+		for !done {
+			if i >= len(line) {
+				if inDoubleQuotes || inSingleQuotes {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				break
+			}
+
+			ch := line[i]
+			switch {
+			case inDoubleQuotes:
+				if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					current = append(current, hexDigitValue(line[i+2])<<4|hexDigitValue(line[i+3]))
+					i += 3
+				} else if ch == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if ch == '"' {
+					// Closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			case inSingleQuotes:
+				if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if ch == '\'' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			default:
+				switch ch {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, ch)
+				}
+			}
+
+			i++
+		}
+
+		if current == nil {
+			current = []byte{}
+		}
+		args = append(args, &RESPBulkString{data: current})
+	}
+}
+
+func isInlineSpace(ch byte) bool {
+	return ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t' || ch == 0
+}
+
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func hexDigitValue(ch byte) byte {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0'
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10
+	default:
+		return ch - 'A' + 10
+	}
 }
 
 // Returns first index where \r\n is inside the string
@@ -332,11 +1027,10 @@ func CLRFIndex(buf []byte) int {
 }
 
 func ParseCommand(commandArray *RESPArray) (RESPCommand, error) {
-	var commandType RESPCommandType
 	var commandName string
 
 	if len(commandArray.data) == 0 {
-		return RESPCommand{}, fmt.Errorf("command array length 0")
+		return RESPCommand{}, fmt.Errorf("invalid multibulk length")
 	}
 
 	firstArg := commandArray.data[0]
@@ -349,17 +1043,9 @@ func ParseCommand(commandArray *RESPArray) (RESPCommand, error) {
 		return RESPCommand{}, fmt.Errorf("unknown command type %T", firstArg)
 	}
 
-	commandName = strings.ToUpper(commandName)
-
-	switch commandName {
-	case "SET":
-		commandType = SET
-	case "GET":
-		commandType = GET
-	case "ECHO":
-		commandType = ECHO
-	default:
-		return RESPCommand{}, fmt.Errorf("unknown command %s", commandName)
+	commandType, ok := commandsByName[strings.ToUpper(commandName)]
+	if !ok {
+		return RESPCommand{}, &UnknownCommandError{Name: commandName}
 	}
 
 	return RESPCommand{Type: commandType, Args: commandArray.data[1:]}, nil
@@ -387,10 +1073,22 @@ func ExtractByteSlice(data *RESPData) ([]byte, error) {
 	}
 }
 
+func ExtractInt64(data *RESPData) (int64, error) {
+	str, err := ExtractString(data)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return value, nil
+}
+
 func (w *RESPWriter) WriteBulkString(b []byte) error {
 	if b == nil {
-		_, err := w.writer.Write([]byte("$-1\r\n"))
-		return err
+		return w.WriteNull()
 	}
 	w.writer.WriteString("$")
 	w.writer.WriteString(strconv.Itoa(len(b)))
@@ -400,6 +1098,13 @@ func (w *RESPWriter) WriteBulkString(b []byte) error {
 	return nil
 }
 
+func (w *RESPWriter) WriteSimpleString(s string) error {
+	w.writer.WriteString("+")
+	w.writer.WriteString(s)
+	w.writer.WriteString("\r\n")
+	return nil
+}
+
 func (w *RESPWriter) WriteInteger(i int64) error {
 	w.writer.WriteString(":")
 	w.writer.WriteString(strconv.FormatInt(i, 10))
@@ -407,11 +1112,127 @@ func (w *RESPWriter) WriteInteger(i int64) error {
 	return nil
 }
 
+// Writes an error reply. RedisErrors keep their own prefix (WRONGTYPE, NOPROTO, ...), anything else is sent as ERR
 func (w *RESPWriter) WriteError(err error) error {
-	_, err = fmt.Fprintf(&w.writer, "-ERR %s\r\n", err.Error())
+	prefix, message := errorReply(err)
+	w.writer.WriteString("-")
+	w.writer.WriteString(string(prefix))
+	w.writer.WriteString(" ")
+	w.writer.WriteString(message)
+	_, err = w.writer.WriteString("\r\n")
 	return err
 }
 
+// Writes a null reply. RESP2 has no dedicated null, so the null bulk string is used
+func (w *RESPWriter) WriteNull() error {
+	if w.protocol == RESP2 {
+		_, err := w.writer.WriteString("$-1\r\n")
+		return err
+	}
+	_, err := w.writer.WriteString("_\r\n")
+	return err
+}
+
+// Writes a boolean reply. RESP2 represents booleans as the integers 1 and 0
+func (w *RESPWriter) WriteBoolean(b bool) error {
+	if w.protocol == RESP2 {
+		if b {
+			return w.WriteInteger(1)
+		}
+		return w.WriteInteger(0)
+	}
+
+	if b {
+		w.writer.WriteString("#t\r\n")
+	} else {
+		w.writer.WriteString("#f\r\n")
+	}
+	return nil
+}
+
+// Writes a double reply. RESP2 represents doubles as bulk strings
+func (w *RESPWriter) WriteDouble(f float64) error {
+	if w.protocol == RESP2 {
+		return w.WriteBulkString([]byte(formatDouble(f)))
+	}
+	w.writer.WriteString(",")
+	w.writer.WriteString(formatDouble(f))
+	w.writer.WriteString("\r\n")
+	return nil
+}
+
+// Writes a big number reply. RESP2 represents big numbers as bulk strings
+func (w *RESPWriter) WriteBigNumber(n *big.Int) error {
+	if w.protocol == RESP2 {
+		return w.WriteBulkString([]byte(n.String()))
+	}
+	w.writer.WriteString("(")
+	w.writer.WriteString(n.String())
+	w.writer.WriteString("\r\n")
+	return nil
+}
+
+// Writes a verbatim string reply. RESP2 drops the format and sends a plain bulk string
+func (w *RESPWriter) WriteVerbatimString(format string, b []byte) error {
+	if w.protocol == RESP2 {
+		return w.WriteBulkString(b)
+	}
+	w.writer.WriteString("=")
+	w.writer.WriteString(strconv.Itoa(len(b) + 4))
+	w.writer.WriteString("\r\n")
+	w.writer.WriteString(format)
+	w.writer.WriteString(":")
+	w.writer.Write(b)
+	w.writer.WriteString("\r\n")
+	return nil
+}
+
+func (w *RESPWriter) writeAggregateHeader(prefix byte, length int) error {
+	w.writer.WriteByte(prefix)
+	w.writer.WriteString(strconv.Itoa(length))
+	w.writer.WriteString("\r\n")
+	return nil
+}
+
+// Writes the header of an array with the given number of elements
+func (w *RESPWriter) WriteArrayHeader(length int) error {
+	return w.writeAggregateHeader('*', length)
+}
+
+// Writes the header of a map with the given number of key/value pairs.
+// RESP2 represents maps as flat arrays of twice the length
+func (w *RESPWriter) WriteMapHeader(length int) error {
+	if w.protocol == RESP2 {
+		return w.writeAggregateHeader('*', length*2)
+	}
+	return w.writeAggregateHeader('%', length)
+}
+
+// Writes the header of a set with the given number of elements. RESP2 represents sets as arrays
+func (w *RESPWriter) WriteSetHeader(length int) error {
+	if w.protocol == RESP2 {
+		return w.writeAggregateHeader('*', length)
+	}
+	return w.writeAggregateHeader('~', length)
+}
+
+// Writes the header of a push message with the given number of elements. RESP2 represents pushes as arrays
+func (w *RESPWriter) WritePushHeader(length int) error {
+	if w.protocol == RESP2 {
+		return w.writeAggregateHeader('*', length)
+	}
+	return w.writeAggregateHeader('>', length)
+}
+
+// Writes the header of an attribute with the given number of key/value pairs.
+// RESP2 has no way to represent attributes, so callers must not write the pairs either
+func (w *RESPWriter) WriteAttributeHeader(length int) error {
+	if w.protocol == RESP2 {
+		return fmt.Errorf("attributes are not supported by RESP2")
+	}
+	return w.writeAggregateHeader('|', length)
+}
+
 // WriteValue determines the type of MiniRedisData and writes appropriate RESP format
 func (w *RESPWriter) WriteValue(v MiniRedisData) error {
 	switch data := v.(type) {
@@ -419,7 +1240,72 @@ func (w *RESPWriter) WriteValue(v MiniRedisData) error {
 		return w.WriteBulkString(data.data)
 	case *IntegerData:
 		return w.WriteInteger(data.data)
+	case aggregateData:
+		return w.WriteValue(data.reply())
+	case *SimpleStringReply:
+		return w.WriteSimpleString(data.data)
+	case *NullReply:
+		return w.WriteNull()
+	case *BooleanReply:
+		return w.WriteBoolean(data.data)
+	case *DoubleReply:
+		return w.WriteDouble(data.data)
+	case *BigNumberReply:
+		return w.WriteBigNumber(data.data)
+	case *VerbatimStringReply:
+		return w.WriteVerbatimString(data.format, data.data)
+	case *ArrayReply:
+		w.WriteArrayHeader(len(data.data))
+		return w.writeValues(data.data)
+	case *SetReply:
+		w.WriteSetHeader(len(data.data))
+		return w.writeValues(data.data)
+	case *PushReply:
+		w.WritePushHeader(len(data.data))
+		return w.writeValues(data.data)
+	case *MapReply:
+		w.WriteMapHeader(len(data.data) / 2)
+		return w.writeValues(data.data)
+	case *AttributeReply:
+		if w.protocol != RESP2 {
+			w.WriteAttributeHeader(len(data.attributes) / 2)
+			if err := w.writeValues(data.attributes); err != nil {
+				return err
+			}
+		}
+		return w.WriteValue(data.value)
+	case *RDBPayloadReply:
+		w.writer.WriteString("$")
+		w.writer.WriteString(strconv.Itoa(len(data.data)))
+		w.writer.WriteString("\r\n")
+		_, err := w.writer.Write(data.data)
+		return err
+	case *NoReply:
+		return nil
 	default:
 		return fmt.Errorf("unknown data type: %T", v)
 	}
 }
+
+func (w *RESPWriter) writeValues(values []MiniRedisData) error {
+	for _, value := range values {
+		if err := w.WriteValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Formats a double the way Redis does: shortest representation, with inf/-inf/nan spelled out
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
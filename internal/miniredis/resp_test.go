@@ -5,8 +5,11 @@ package miniredis
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -424,9 +427,52 @@ func TestReadCommands(t *testing.T) {
 			expectError: false, // Should return no commands but no error
 		},
 		{
-			name:        "invalid command format",
-			input:       "*-1\r\n",
-			expectError: true,
+			name:  "null and empty multibulk requests are skipped",
+			input: "*-1\r\n*0\r\n*1\r\n$4\r\nPING\r\n",
+			expected: []RESPCommand{
+				{
+					Type: PING,
+					Args: []RESPData{},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name:  "unknown command is kept for an error reply",
+			input: "*2\r\n$3\r\nFOO\r\n$3\r\nbar\r\n*1\r\n$4\r\nPING\r\n",
+			expected: []RESPCommand{
+				{
+					Type: UNKNOWN,
+					Args: []RESPData{
+						&RESPBulkString{data: []byte("FOO")},
+						&RESPBulkString{data: []byte("bar")},
+					},
+				},
+				{
+					Type: PING,
+					Args: []RESPData{},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name:  "inline commands mixed with multibulk",
+			input: "GET key\r\n\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n",
+			expected: []RESPCommand{
+				{
+					Type: GET,
+					Args: []RESPData{
+						&RESPBulkString{data: []byte("key")},
+					},
+				},
+				{
+					Type: ECHO,
+					Args: []RESPData{
+						&RESPBulkString{data: []byte("hi")},
+					},
+				},
+			},
+			expectError: false,
 		},
 	}
 
@@ -516,3 +562,511 @@ func (r *partialReader) Read(p []byte) (n int, err error) {
 	r.currPart++
 	return n, nil
 }
+
+func TestParseRESP3Types(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         []byte
+		expectedType  RESPDataType
+		expectedBytes int
+		expectedDump  string
+		expectError   bool
+	}{
+		{
+			name:          "simple error",
+			input:         []byte("-ERR oops\r\n"),
+			expectedType:  SimpleError,
+			expectedBytes: 11,
+			expectedDump:  "ERR oops",
+		},
+		{
+			name:          "null",
+			input:         []byte("_\r\n"),
+			expectedType:  Null,
+			expectedBytes: 3,
+			expectedDump:  "(nil)",
+		},
+		{
+			name:          "boolean true",
+			input:         []byte("#t\r\n"),
+			expectedType:  Boolean,
+			expectedBytes: 4,
+			expectedDump:  "true",
+		},
+		{
+			name:        "invalid boolean",
+			input:       []byte("#x\r\n"),
+			expectError: true,
+		},
+		{
+			name:          "double",
+			input:         []byte(",1.5\r\n"),
+			expectedType:  Double,
+			expectedBytes: 6,
+			expectedDump:  "1.5",
+		},
+		{
+			name:          "negative infinity",
+			input:         []byte(",-inf\r\n"),
+			expectedType:  Double,
+			expectedBytes: 7,
+			expectedDump:  "-inf",
+		},
+		{
+			name:          "big number",
+			input:         []byte("(3492890328409238509324850943850943825024385\r\n"),
+			expectedType:  BigNumber,
+			expectedBytes: 46,
+			expectedDump:  "3492890328409238509324850943850943825024385",
+		},
+		{
+			name:          "bulk error",
+			input:         []byte("!10\r\nERR failed\r\n"),
+			expectedType:  BulkError,
+			expectedBytes: 17,
+			expectedDump:  "ERR failed",
+		},
+		{
+			name:          "verbatim string",
+			input:         []byte("=9\r\ntxt:hello\r\n"),
+			expectedType:  VerbatimString,
+			expectedBytes: 15,
+			expectedDump:  "hello",
+		},
+		{
+			name:        "verbatim string without format",
+			input:       []byte("=5\r\nhello\r\n"),
+			expectError: true,
+		},
+		{
+			name:          "map",
+			input:         []byte("%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n"),
+			expectedType:  Map,
+			expectedBytes: 20,
+			expectedDump:  "{a:1,b:2}",
+		},
+		{
+			name:          "set",
+			input:         []byte("~2\r\n+a\r\n#f\r\n"),
+			expectedType:  Set,
+			expectedBytes: 12,
+			expectedDump:  "[a,false]",
+		},
+		{
+			name:          "push",
+			input:         []byte(">2\r\n+message\r\n$2\r\nhi\r\n"),
+			expectedType:  Push,
+			expectedBytes: 22,
+			expectedDump:  "[message,hi]",
+		},
+		{
+			name:          "attribute attached to value",
+			input:         []byte("|1\r\n+ttl\r\n:3\r\n:42\r\n"),
+			expectedType:  Attribute,
+			expectedBytes: 19,
+			expectedDump:  "42",
+		},
+		{
+			name:        "incomplete map",
+			input:       []byte("%1\r\n+a\r\n"),
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, bytesConsumed, err := parseSingleValue(tt.input)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if result.DataType() != tt.expectedType {
+				t.Errorf("got type %v, want %v", result.DataType(), tt.expectedType)
+			}
+
+			if result.Dump() != tt.expectedDump {
+				t.Errorf("got dump %q, want %q", result.Dump(), tt.expectedDump)
+			}
+
+			if bytesConsumed != tt.expectedBytes {
+				t.Errorf("got %d bytes consumed, want %d", bytesConsumed, tt.expectedBytes)
+			}
+		})
+	}
+}
+
+func TestWriteValueProtocols(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    MiniRedisData
+		expected map[int]string
+	}{
+		{
+			name:  "null bulk string",
+			value: &StringData{data: nil},
+			expected: map[int]string{
+				RESP2: "$-1\r\n",
+				RESP3: "_\r\n",
+			},
+		},
+		{
+			name:  "boolean",
+			value: &BooleanReply{data: true},
+			expected: map[int]string{
+				RESP2: ":1\r\n",
+				RESP3: "#t\r\n",
+			},
+		},
+		{
+			name:  "double",
+			value: &DoubleReply{data: 3.25},
+			expected: map[int]string{
+				RESP2: "$4\r\n3.25\r\n",
+				RESP3: ",3.25\r\n",
+			},
+		},
+		{
+			name: "map",
+			value: &MapReply{data: []MiniRedisData{
+				&StringData{data: []byte("a")}, &IntegerData{data: 1},
+			}},
+			expected: map[int]string{
+				RESP2: "*2\r\n$1\r\na\r\n:1\r\n",
+				RESP3: "%1\r\n$1\r\na\r\n:1\r\n",
+			},
+		},
+		{
+			name:  "set",
+			value: &SetReply{data: []MiniRedisData{&StringData{data: []byte("x")}}},
+			expected: map[int]string{
+				RESP2: "*1\r\n$1\r\nx\r\n",
+				RESP3: "~1\r\n$1\r\nx\r\n",
+			},
+		},
+		{
+			name:  "verbatim string",
+			value: &VerbatimStringReply{format: "txt", data: []byte("hi")},
+			expected: map[int]string{
+				RESP2: "$2\r\nhi\r\n",
+				RESP3: "=6\r\ntxt:hi\r\n",
+			},
+		},
+		{
+			name: "attribute",
+			value: &AttributeReply{
+				attributes: []MiniRedisData{&StringData{data: []byte("k")}, &IntegerData{data: 1}},
+				value:      &IntegerData{data: 2},
+			},
+			expected: map[int]string{
+				RESP2: ":2\r\n",
+				RESP3: "|1\r\n$1\r\nk\r\n:1\r\n:2\r\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for protocol, expected := range tt.expected {
+			t.Run(fmt.Sprintf("%s RESP%d", tt.name, protocol), func(t *testing.T) {
+				var buffer bytes.Buffer
+				writer := NewRESPWriter(&buffer, RESP_WRITER_INITIAL_BUF_SIZE)
+				writer.protocol = protocol
+
+				if err := writer.WriteValue(tt.value); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				writer.writer.Flush()
+
+				if buffer.String() != expected {
+					t.Errorf("got %q, want %q", buffer.String(), expected)
+				}
+			})
+		}
+	}
+}
+
+func TestParseInlineCommand(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         []byte
+		expectedDump  string
+		expectedBytes int
+		expectError   bool
+		expectPartial bool
+	}{
+		{
+			name:          "newline terminated",
+			input:         []byte("PING\n"),
+			expectedDump:  "[PING]",
+			expectedBytes: 5,
+		},
+		{
+			name:          "crlf terminated with extra spaces",
+			input:         []byte("SET  foo   bar\r\n"),
+			expectedDump:  "[SET,foo,bar]",
+			expectedBytes: 16,
+		},
+		{
+			name:          "double quotes with escapes",
+			input:         []byte("SET k \"a b\\n\\x41\"\r\n"),
+			expectedDump:  "[SET,k,a b\nA]",
+			expectedBytes: 19,
+		},
+		{
+			name:          "single quotes",
+			input:         []byte("ECHO 'it\\'s \"raw\"'\n"),
+			expectedDump:  "[ECHO,it's \"raw\"]",
+			expectedBytes: 19,
+		},
+		{
+			name:          "empty quoted argument",
+			input:         []byte("ECHO \"\"\n"),
+			expectedDump:  "[ECHO,]",
+			expectedBytes: 8,
+		},
+		{
+			name:          "empty line",
+			input:         []byte("\r\n"),
+			expectedDump:  "[]",
+			expectedBytes: 2,
+		},
+		{
+			name:        "unbalanced quotes",
+			input:       []byte("ECHO \"abc\n"),
+			expectError: true,
+		},
+		{
+			name:        "closing quote followed by text",
+			input:       []byte("ECHO \"abc\"def\n"),
+			expectError: true,
+		},
+		{
+			name:          "no newline yet",
+			input:         []byte("PIN"),
+			expectError:   true,
+			expectPartial: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, bytesConsumed, err := parseInlineCommand(tt.input)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				}
+				if tt.expectPartial != (err == ErrIncompleteRESPValue) {
+					t.Errorf("got error %v, want incomplete value: %v", err, tt.expectPartial)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if result.Dump() != tt.expectedDump {
+				t.Errorf("got dump %q, want %q", result.Dump(), tt.expectedDump)
+			}
+
+			if bytesConsumed != tt.expectedBytes {
+				t.Errorf("got %d bytes consumed, want %d", bytesConsumed, tt.expectedBytes)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "plain error gets ERR prefix",
+			err:      fmt.Errorf("something failed"),
+			expected: "-ERR something failed\r\n",
+		},
+		{
+			name:     "typed prefix",
+			err:      newRedisError(ErrPrefixWrongType, "Operation against a key holding the wrong kind of value"),
+			expected: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		},
+		{
+			name:     "wrapped typed error keeps prefix",
+			err:      fmt.Errorf("context: %w", newRedisError(ErrPrefixBusy, "script running")),
+			expected: "-BUSY script running\r\n",
+		},
+		{
+			name:     "protocol error",
+			err:      newProtocolError("invalid bulk length"),
+			expected: "-ERR Protocol error: invalid bulk length\r\n",
+		},
+		{
+			name:     "newlines are stripped",
+			err:      fmt.Errorf("line1\r\nline2"),
+			expected: "-ERR line1  line2\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := NewRESPWriter(&buffer, RESP_WRITER_INITIAL_BUF_SIZE)
+
+			if err := writer.WriteError(tt.err); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			writer.writer.Flush()
+
+			if buffer.String() != tt.expected {
+				t.Errorf("got %q, want %q", buffer.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	limits := RESPReaderLimits{
+		MaxBulkLen:        16,
+		MaxMultibulkLen:   4,
+		MaxQueryBufferLen: 64,
+	}
+
+	tests := []struct {
+		name        string
+		input       string
+		expectProto bool
+		expectLimit bool
+	}{
+		{
+			name:  "within limits",
+			input: "*2\r\n$4\r\nECHO\r\n$16\r\n0123456789abcdef\r\n",
+		},
+		{
+			name:        "multibulk count over the limit",
+			input:       "*2147483647\r\n",
+			expectProto: true,
+		},
+		{
+			name:        "bulk length over the limit is rejected before its data arrives",
+			input:       "*2\r\n$3\r\nSET\r\n$9999999999\r\n",
+			expectProto: true,
+		},
+		{
+			name:        "bulk data not followed by CRLF",
+			input:       "*2\r\n$4\r\nECHO\r\n$2\r\nhixx*1\r\n$4\r\nPING\r\n",
+			expectProto: true,
+		},
+		{
+			name:        "non bulk argument",
+			input:       "*1\r\n:1\r\n",
+			expectProto: true,
+		},
+		{
+			name:        "incomplete multibulk request larger than the query buffer limit",
+			input:       "*4\r\n" + strings.Repeat("$16\r\n0123456789abcdef\r\n", 3),
+			expectLimit: true,
+		},
+		{
+			name:        "pending inline request larger than the query buffer limit",
+			input:       "ECHO " + strings.Repeat("x", 100),
+			expectLimit: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewRESPReader(bytes.NewReader([]byte(tt.input)), 1024)
+			reader.limits = limits
+
+			_, err := reader.ReadCommands()
+
+			var protoErr *ProtocolError
+			if gotProto := errors.As(err, &protoErr); gotProto != tt.expectProto {
+				t.Errorf("got error %v, want protocol error: %v", err, tt.expectProto)
+			}
+			if gotLimit := errors.Is(err, ErrQueryBufferLimit); gotLimit != tt.expectLimit {
+				t.Errorf("got error %v, want query buffer limit error: %v", err, tt.expectLimit)
+			}
+		})
+	}
+}
+
+func TestBigArgumentStreaming(t *testing.T) {
+	bigValue := strings.Repeat("v", 3*RESP_BIG_ARG_SIZE)
+	otherBigValue := strings.Repeat("w", RESP_BIG_ARG_SIZE)
+	request := fmt.Sprintf("*4\r\n$3\r\nSET\r\n$3\r\nkey\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n*1\r\n$4\r\nPING\r\n",
+		len(bigValue), bigValue, len(otherBigValue), otherBigValue)
+
+	// Feed the request in small chunks so every argument arrives over several reads
+	reader := NewRESPReader(&chunkedReader{reader: strings.NewReader(request), chunkSize: 1000}, 1024)
+
+	var commands []RESPCommand
+	for {
+		cmds, err := reader.ReadCommands()
+		commands = append(commands, cmds...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(commands) != 2 {
+		t.Fatalf("expected 2 commands, got %d", len(commands))
+	}
+
+	args := commands[0].Args
+	if commands[0].Type != SET || len(args) != 3 {
+		t.Fatalf("unexpected first command: %v with %d args", commands[0].Type, len(args))
+	}
+	if args[0].Dump() != "key" {
+		t.Errorf("got key %q, want %q", args[0].Dump(), "key")
+	}
+	for i, want := range []string{bigValue, otherBigValue} {
+		bulk := args[i+1].(*RESPBulkString)
+		if string(bulk.data) != want {
+			t.Errorf("big argument %d mismatch, got %d bytes, want %d", i, len(bulk.data), len(want))
+		}
+		if !bulk.owned {
+			t.Errorf("big argument %d should own its data", i)
+		}
+		if cap(bulk.data) != len(want)+2 {
+			t.Errorf("big argument %d should be allocated at its exact size, got capacity %d", i, cap(bulk.data))
+		}
+	}
+
+	if commands[1].Type != PING {
+		t.Errorf("expected PING after the big request, got %v", commands[1].Type)
+	}
+
+	// The big arguments never went through the reader buffer
+	if len(reader.buffer) > 4*1024 {
+		t.Errorf("reader buffer grew to %d bytes", len(reader.buffer))
+	}
+}
+
+// Helper type for testing reads that return at most chunkSize bytes at a time
+type chunkedReader struct {
+	reader    io.Reader
+	chunkSize int
+}
+
+func (r *chunkedReader) Read(p []byte) (n int, err error) {
+	if len(p) > r.chunkSize {
+		p = p[:r.chunkSize]
+	}
+	return r.reader.Read(p)
+}
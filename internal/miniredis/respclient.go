@@ -0,0 +1,82 @@
+package miniredis
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Client side of the protocol, used to talk to other instances (MIGRATE, replication)
+type respClient struct {
+	conn net.Conn
+	// Every read or write must complete within timeout
+	timeout time.Duration
+	// Data read from conn but not parsed yet
+	pending []byte
+}
+
+// Error reply sent by the other instance
+type remoteError struct{ message string }
+
+func (e *remoteError) Error() string { return e.message }
+
+func dialRESP(addr string, timeout time.Duration) (*respClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &respClient{conn: conn, timeout: timeout}, nil
+}
+
+func (c *respClient) Close() error {
+	return c.conn.Close()
+}
+
+// Sends a command without waiting for its reply, so several can be pipelined
+func (c *respClient) send(args ...[]byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(catCommand(nil, args))
+	return err
+}
+
+// Reads the next reply. Error replies are returned as a *remoteError
+func (c *respClient) readReply() (RESPData, error) {
+	for {
+		value, consumed, err := parseSingleValue(c.pending)
+		if err == nil {
+			// The rest moves to a new buffer, leaving the data referenced by value untouched
+			c.pending = append([]byte(nil), c.pending[consumed:]...)
+			if replyErr, ok := value.(*RESPSimpleError); ok {
+				return nil, &remoteError{message: replyErr.data}
+			}
+			return value, nil
+		}
+		if err != ErrIncompleteRESPValue {
+			return nil, fmt.Errorf("invalid reply: %w", err)
+		}
+
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads more data from the connection into pending
+func (c *respClient) fill() error {
+	buf := make([]byte, 16*1024)
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	n, err := c.conn.Read(buf)
+	c.pending = append(c.pending, buf[:n]...)
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// Sends a command and waits for its reply
+func (c *respClient) call(args ...[]byte) (RESPData, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
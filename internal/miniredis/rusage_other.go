@@ -0,0 +1,8 @@
+//go:build !unix
+
+package miniredis
+
+// getrusage is only available on Unix systems
+func cpuInfo(*client) []infoField {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package miniredis
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// CPU time used by the process and by its children, from getrusage
+func cpuInfo(*client) []infoField {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+	return []infoField{
+		{"used_cpu_sys", formatTimeval(self.Stime)},
+		{"used_cpu_user", formatTimeval(self.Utime)},
+		{"used_cpu_sys_children", formatTimeval(children.Stime)},
+		{"used_cpu_user_children", formatTimeval(children.Utime)},
+	}
+}
+
+func formatTimeval(tv syscall.Timeval) string {
+	return fmt.Sprintf("%d.%06d", tv.Sec, tv.Usec)
+}
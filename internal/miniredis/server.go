@@ -1,16 +1,22 @@
 package miniredis
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var store = NewConcurrentMap[string, MiniRedisObject]()
-
-func handleSet(args []RESPData) (MiniRedisData, error) {
+// SET key value [NX | XX] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL].
+// Replies with the value that was set, or nil when NX/XX prevented the write
+func handleSet(c *client, args []RESPData) (MiniRedisData, error) {
 	if len(args) < 2 {
 		return nil, fmt.Errorf("SET command requires at least 2 arguments")
 	}
@@ -25,19 +31,112 @@ func handleSet(args []RESPData) (MiniRedisData, error) {
 		return nil, fmt.Errorf("invalid value: %w", err)
 	}
 
-	byteSliceCopy := make([]byte, len(value))
-	copy(byteSliceCopy, []byte(value))
-	stringData := &StringData{data: byteSliceCopy}
-	obj := MiniRedisObject{
-		data:   stringData,
-		expiry: time.Time{},
+	var nx, xx, keepTTL bool
+	var expireOption *expireVariant
+	var expireValue int64
+	for i := 2; i < len(args); i++ {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, errSyntax
+		}
+
+		switch option = strings.ToUpper(option); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireOption != nil || i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			switch option {
+			case "EX":
+				expireOption = &expireSeconds
+			case "PX":
+				expireOption = &expireMilliseconds
+			case "EXAT":
+				expireOption = &expireAtSeconds
+			case "PXAT":
+				expireOption = &expireAtMilliseconds
+			}
+
+			i++
+			expireValue, err = ExtractInt64(&args[i])
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if (nx && xx) || (keepTTL && expireOption != nil) {
+		return nil, errSyntax
 	}
 
-	store.Set(&key, &obj)
+	now := c.now()
+	var expiry time.Time
+	var expireMillis int64
+	if expireOption != nil {
+		if expireValue <= 0 {
+			return nil, fmt.Errorf("invalid expire time in 'set' command")
+		}
+		expireMillis, err = absoluteExpireMillis(expireValue, expireOption.unit, expireOption.absolute, now, "set")
+		if err != nil {
+			return nil, err
+		}
+		expiry = time.UnixMilli(expireMillis)
+	}
+
+	// Small values point into the reader buffer, which is reused for the next requests.
+	// Big values are read into their own allocation, so they can be stored as-is
+	if bulk, ok := args[1].(*RESPBulkString); !ok || !bulk.owned {
+		byteSliceCopy := make([]byte, len(value))
+		copy(byteSliceCopy, value)
+		value = byteSliceCopy
+	}
+	stringData := &StringData{data: value}
+
+	written := false
+	c.keyspace().Compute(&key, func(old MiniRedisObject, exists bool) (MiniRedisObject, bool) {
+		live := exists && !old.isExpired(now)
+		if exists && !live {
+			c.addExpired(key)
+		}
+		if (nx && live) || (xx && !live) {
+			return old, live
+		}
+
+		obj := MiniRedisObject{
+			data:   stringData,
+			expiry: expiry,
+		}
+		if keepTTL && live {
+			obj.expiry = old.expiry
+		}
+
+		written = true
+		return obj, true
+	})
+
+	if !written {
+		return &StringData{data: nil}, nil
+	}
+
+	c.addDirty(1)
+	if expireOption != nil {
+		c.rewritePropagated([]byte("SET"), []byte(key), value, []byte("PXAT"), []byte(strconv.FormatInt(expireMillis, 10)))
+	} else if keepTTL {
+		c.rewritePropagated([]byte("SET"), []byte(key), value, []byte("KEEPTTL"))
+	} else {
+		c.rewritePropagated([]byte("SET"), []byte(key), value)
+	}
 	return stringData, nil
 }
 
-func handleGet(args []RESPData) (MiniRedisData, error) {
+func handleGet(c *client, args []RESPData) (MiniRedisData, error) {
 	if len(args) != 1 {
 		return nil, fmt.Errorf("GET command requires exactly 1 argument")
 	}
@@ -47,18 +146,70 @@ func handleGet(args []RESPData) (MiniRedisData, error) {
 		return nil, fmt.Errorf("invalid key: %w", err)
 	}
 
-	value, exists := store.Get(&key)
+	value, exists := c.lookupKeyRead(key)
 
 	if !exists {
 		return &StringData{data: nil}, nil
 	}
+	if value.data.Type() != Scalar {
+		return nil, errWrongType
+	}
+
+	return value.data, nil
+}
+
+// Fields and values of a hash, as a map in RESP3 and a flat array in RESP2
+func handleHgetall(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("HGETALL command requires exactly 1 argument")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	value, exists := c.lookupKeyRead(key)
+	if !exists {
+		return &MapReply{data: []MiniRedisData{}}, nil
+	}
+	hash, ok := value.data.(*HashData)
+	if !ok {
+		return nil, errWrongType
+	}
+
+	return hash.reply(), nil
+}
 
-	if !value.expiry.IsZero() && time.Now().After(value.expiry) {
-		store.Delete(&key)
+// Score of a sorted set member, as a double in RESP3 and a bulk string in RESP2
+func handleZscore(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("ZSCORE command requires exactly 2 arguments")
+	}
+
+	key, err := ExtractString(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	member, err := ExtractString(&args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid member: %w", err)
+	}
+
+	value, exists := c.lookupKeyRead(key)
+	if !exists {
 		return &StringData{data: nil}, nil
 	}
+	zset, ok := value.data.(*SortedSetData)
+	if !ok {
+		return nil, errWrongType
+	}
 
-	return value.data, nil
+	score, ok := zset.data[member]
+	if !ok {
+		return &StringData{data: nil}, nil
+	}
+	return &DoubleReply{data: score}, nil
 }
 
 func handleEcho(args []RESPData) (MiniRedisData, error) {
@@ -73,81 +224,600 @@ func handleEcho(args []RESPData) (MiniRedisData, error) {
 
 	return &StringData{data: arg}, nil
 }
+
+func handlePing(args []RESPData) (MiniRedisData, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("PING command accepts at most 1 argument")
+	}
+
+	if len(args) == 0 {
+		return &SimpleStringReply{data: "PONG"}, nil
+	}
+
+	arg, err := ExtractByteSlice(&args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ping message: %w", err)
+	}
+
+	return &StringData{data: arg}, nil
+}
+
+// Redis version reported to clients. Some client libraries gate features on it, so it
+// tracks the Redis release whose behavior miniredis follows
+const redisVersion = "7.2.4"
+
+func handleHello(c *client, args []RESPData) (MiniRedisData, error) {
+	protocol := c.protocol()
+
+	if len(args) > 0 {
+		protoArg, err := ExtractString(&args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol version: %w", err)
+		}
+
+		requested, err := strconv.ParseInt(protoArg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Protocol version is not an integer or out of range")
+		}
+
+		if requested != RESP2 && requested != RESP3 {
+			return nil, newRedisError(ErrPrefixNoProto, "unsupported protocol version")
+		}
+		protocol = int(requested)
+	}
+
+	name := c.name
+	for i := 1; i < len(args); i++ {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid HELLO option: %w", err)
+		}
+
+		switch remaining := len(args) - i - 1; {
+		case strings.EqualFold(option, "AUTH") && remaining >= 2:
+			username, err := ExtractString(&args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid username: %w", err)
+			}
+			// There are no ACLs, so only the passwordless default user exists
+			if username != "default" {
+				return nil, newRedisError(ErrPrefixWrongPass, "invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case strings.EqualFold(option, "SETNAME") && remaining >= 1:
+			clientName, err := ExtractString(&args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid client name: %w", err)
+			}
+			if strings.ContainsAny(clientName, " \n") {
+				return nil, fmt.Errorf("Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = clientName
+			i++
+		default:
+			return nil, fmt.Errorf("Syntax error in HELLO option '%s'", option)
+		}
+	}
+
+	// Options are only applied once all of them validated
+	c.name = name
+	c.writer.protocol = protocol
+
+	return &MapReply{data: []MiniRedisData{
+		&StringData{data: []byte("server")}, &StringData{data: []byte("redis")},
+		&StringData{data: []byte("version")}, &StringData{data: []byte(redisVersion)},
+		&StringData{data: []byte("proto")}, &IntegerData{data: int64(protocol)},
+		&StringData{data: []byte("id")}, &IntegerData{data: c.id},
+		&StringData{data: []byte("mode")}, &StringData{data: []byte(serverMode())},
+		&StringData{data: []byte("role")}, &StringData{data: []byte(replicationRole())},
+		&StringData{data: []byte("modules")}, &ArrayReply{data: []MiniRedisData{}},
+	}}, nil
+}
+
 func HandleConnection(conn net.Conn) error {
+	return handleConnection(conn, nil)
+}
+
+// Serves conn for server, nil for the server started with StartServer
+func handleConnection(conn net.Conn, server *Server) error {
 	defer conn.Close()
 
 	// Initialize RESPReader with 4kb buffer
 	respReader := NewRESPReader(conn, RESP_READER_INITIAL_BUF_SIZE)
 	respWriter := NewRESPWriter(conn, RESP_WRITER_INITIAL_BUF_SIZE)
+	c := newClient(respWriter)
+	c.conn = conn
+	c.server = server
+	if server != nil {
+		c.clock = server.clock
+	} else {
+		stats.connectionsReceived.Add(1)
+	}
+
+	return serveClient(c, respReader, nil, nil)
+}
+
+// Serves c from the calling goroutine until its connection is closed: executes its commands, starting
+// with commands (read along with readErr), and sends the replies of each batch together
+func serveClient(c *client, respReader *RESPReader, commands []RESPCommand, readErr error) error {
+	defer func() {
+		if c.replica != nil {
+			unregisterReplica(c.replica)
+		}
+	}()
+	if c.server == nil {
+		registerServedClient(c)
+		defer unregisterServedClient(c)
+	}
 
 	for {
-		commands, err := respReader.ReadCommands()
-		if err != nil {
-			// For a net.Conn, io.EOF is only returned if there's no data that was read
-			// so it's safe to just exit
-			if err == io.EOF {
+		if done, err := executeCommands(c, commands, readErr); done {
+			// Clients closed by a shutdown end with a read error
+			if closingClients.Load() {
 				return nil
 			}
+			return err
+		}
 
-			return fmt.Errorf("reading commands: %w", err)
+		// Write commands must reach the AOF before their replies are sent
+		if err := flushAppendOnlyFile(); err != nil {
+			log.Printf("Error writing to the AOF: %v", err)
 		}
 
-		// Process all commands we read
-		for _, cmd := range commands {
-			result, handlerErr := dispatchCommand(&cmd)
+		// Flush all responses together
+		if err := c.writer.writer.Flush(); err != nil {
+			return fmt.Errorf("flushing: %w", err)
+		}
 
-			if handlerErr != nil {
-				if err := respWriter.WriteError(handlerErr); err != nil {
-					return fmt.Errorf("writing error: %w", err)
-				}
-				continue
+		if c.replica != nil {
+			return serveReplica(c, respReader)
+		}
+		if closingClients.Load() {
+			return nil
+		}
+
+		commands, readErr = respReader.ReadCommands()
+	}
+}
+
+// Executes the commands read from the connection of c, buffering their replies, then handles the error
+// the reader returned along with them. When the connection must be closed, it flushes the replies
+// and returns done, along with the reason for an abnormal close
+func executeCommands(c *client, commands []RESPCommand, readErr error) (done bool, err error) {
+	respWriter := c.writer
+
+	// Process all commands we read. Commands parsed before a read or protocol error still get their replies
+	for _, cmd := range commands {
+		// Anything pipelined after PSYNC or SYNC is ignored, the connection now carries the stream
+		if c.replica != nil {
+			break
+		}
+		// Nor does anything pipelined after a command closing the connection run
+		if c.closeAfterReply {
+			break
+		}
+		var start time.Time
+		if c.server == nil {
+			stats.commandsProcessed.Add(1)
+			start = time.Now()
+		}
+		// Blocking commands would hold up the event loop owning the databases, they take them when needed
+		acquired := false
+		if c.server == nil && !c.servedByLoop && !cmd.Type.isBlocking() {
+			acquired = acquireKeyspace()
+		}
+		var result MiniRedisData
+		var handlerErr error
+		if config().ClusterEnabled && c.server == nil {
+			handlerErr = clusterRedirect(c, &cmd)
+		}
+		if handlerErr == nil {
+			result, handlerErr = dispatchCommand(c, &cmd)
+			if c.server == nil {
+				recordCommandCall(cmd.Type, time.Since(start), handlerErr)
 			}
+		}
+		releaseKeyspace(acquired)
 
-			if err := respWriter.WriteValue(result); err != nil {
-				return fmt.Errorf("writing response: %w", err)
+		if handlerErr != nil {
+			if err := respWriter.WriteError(handlerErr); err != nil {
+				return true, fmt.Errorf("writing error: %w", err)
 			}
+			continue
 		}
 
-		// Flush all responses together
-		if err := respWriter.writer.Flush(); err != nil {
-			return fmt.Errorf("flushing: %w", err)
+		if err := respWriter.WriteValue(result); err != nil {
+			return true, fmt.Errorf("writing response: %w", err)
+		}
+	}
+
+	if readErr != nil {
+		// For a net.Conn, io.EOF is only returned if there's no data that was read
+		// so it's safe to just exit
+		if readErr == io.EOF {
+			flushAppendOnlyFile()
+			respWriter.writer.Flush()
+			return true, nil
+		}
+
+		// Malformed input: tell the client why before dropping it
+		var protoErr *ProtocolError
+		if errors.As(readErr, &protoErr) {
+			respWriter.WriteError(protoErr)
+			flushAppendOnlyFile()
+			respWriter.writer.Flush()
+			return true, fmt.Errorf("closing connection after protocol error: %w", readErr)
+		}
+
+		return true, fmt.Errorf("reading commands: %w", readErr)
+	}
+
+	if c.closeAfterReply {
+		flushAppendOnlyFile()
+		return true, respWriter.writer.Flush()
+	}
+	return false, nil
+}
+
+func dispatchCommand(c *client, cmd *RESPCommand) (MiniRedisData, error) {
+	// Persistence, replication and the cluster belong to the server started with StartServer,
+	// so embedded servers don't run the commands managing them
+	if c.server != nil && commandTable[cmd.Type].flags&(cmdAdmin|cmdBlocking) != 0 {
+		return nil, fmt.Errorf("%s is not supported by embedded servers", strings.ToUpper(commandTable[cmd.Type].name))
+	}
+
+	if !cmd.Type.isWrite() {
+		return call(c, cmd)
+	}
+
+	// Writes coming from our master are applied whatever the local state
+	if !c.master && c.server == nil {
+		if config().ReplicaReadOnly && isReplica() {
+			return nil, errReadOnlyReplica
+		}
+		if err := checkWritesAllowed(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Writes only need to be serialized when something receives them in order
+	shared, err := lockForWrite(c, cmd.Type.isExclusive())
+	if err != nil {
+		return nil, err
+	}
+	c.dirty = 0
+	c.propagateArgs = nil
+	c.expiredKeys = c.expiredKeys[:0]
+	if shared {
+		defer propagationMutex.RUnlock()
+		return call(c, cmd)
+	}
+
+	// Hold the propagation lock so writes reach the AOF in the order they were applied
+	defer propagationMutex.Unlock()
+	result, err := call(c, cmd)
+	// Writes to embedded servers aren't logged or replicated
+	if c.server != nil {
+		return result, err
+	}
+	// Keys are found expired before the command changes them
+	propagateExpired(c, c.expiredKeys)
+	if err == nil && c.dirty > 0 {
+		propagateCommand(c, cmd)
+	}
+	return result, err
+}
+
+// Takes propagationMutex for a write, for reading when the write can run in parallel with others, and
+// reports which one was taken. Writes wait while a shutdown is in progress, and fail once it succeeded
+func lockForWrite(c *client, exclusive bool) (shared bool, err error) {
+	for {
+		shared, resume, stopping := lockPropagation(exclusive)
+		if resume == nil && !stopping {
+			return shared, nil
+		}
+
+		unlockPropagation(shared)
+		if stopping {
+			return false, errShuttingDown
+		}
+		// The shutdown needs the databases to save them
+		held := c.holdsKeyspace()
+		releaseKeyspace(held)
+		<-resume
+		reacquireKeyspace(held)
+	}
+}
+
+// Releases propagationMutex, held for writing by the command being executed, and the databases when an
+// event loop owns them, while fn does network I/O. They are held again when it returns, along with
+// errShuttingDown if the server stopped meanwhile
+func unlockedDuring(c *client, fn func()) error {
+	propagationMutex.Unlock()
+	held := c.holdsKeyspace()
+	releaseKeyspace(held)
+	fn()
+	reacquireKeyspace(held)
+	if _, err := lockForWrite(c, true); err != nil {
+		propagationMutex.Lock()
+		return err
+	}
+	return nil
+}
+
+// Takes propagationMutex like lockForWrite, without waiting for a shutdown: the channel closed when the
+// shutdown in progress ends, and whether the server is stopping, are returned along with the lock
+func lockPropagation(exclusive bool) (shared bool, resume chan struct{}, stopping bool) {
+	shared = !exclusive && !propagating.Load()
+	if shared {
+		propagationMutex.RLock()
+		// The flag can't change while the lock is shared, so it is checked again once the lock is taken
+		if propagating.Load() {
+			propagationMutex.RUnlock()
+			shared = false
+		}
+	}
+	if !shared {
+		propagationMutex.Lock()
+	}
+
+	// Shutdowns pause writes holding propagationMutex for writing, so none is running once they are paused
+	shutdownState.mutex.Lock()
+	resume, stopping = shutdownState.resume, shutdownState.stopping
+	shutdownState.mutex.Unlock()
+	return shared, resume, stopping
+}
+
+func unlockPropagation(shared bool) {
+	if shared {
+		propagationMutex.RUnlock()
+	} else {
+		propagationMutex.Unlock()
+	}
+}
+
+// Logs a write command that changed the keyspace to the AOF and sends it to the replicas
+func propagateCommand(c *client, cmd *RESPCommand) {
+	args := c.propagateArgs
+	if args == nil {
+		args = make([][]byte, 0, len(cmd.Args)+1)
+		args = append(args, []byte(strings.ToUpper(commandTable[cmd.Type].name)))
+		for i := range cmd.Args {
+			arg, err := ExtractByteSlice(&cmd.Args[i])
+			if err != nil {
+				return
+			}
+			args = append(args, arg)
 		}
 	}
+	propagate(c, args)
 }
 
-func dispatchCommand(cmd *RESPCommand) (MiniRedisData, error) {
+// Propagates the deletion of keys the command being executed found expired as DELs, like Redis does,
+// so the AOF and the replicas drop them too. Replicas leave that to their master
+func propagateExpired(c *client, keys []string) {
+	if c.master {
+		return
+	}
+	for _, key := range keys {
+		propagate(c, [][]byte{[]byte("DEL"), []byte(key)})
+	}
+}
+
+// Logs args to the AOF and sends them to the replicas, with propagationMutex held for writing
+func propagate(c *client, args [][]byte) {
+	if !c.master {
+		feedReplication(c.db, args)
+	}
+	// The stream from our master is added to the replication offset before the command is executed
+	c.woff = replicationOffset()
+	feedAppendOnlyFile(c.db, args, c.woff)
+}
+
+// Executes a command
+func call(c *client, cmd *RESPCommand) (MiniRedisData, error) {
 	switch cmd.Type {
 	case SET:
-		return handleSet(cmd.Args)
+		return handleSet(c, cmd.Args)
 	case GET:
-		return handleGet(cmd.Args)
+		return handleGet(c, cmd.Args)
 	case ECHO:
 		return handleEcho(cmd.Args)
+	case HELLO:
+		return handleHello(c, cmd.Args)
+	case PING:
+		return handlePing(cmd.Args)
+	case SAVE:
+		return handleSave(cmd.Args)
+	case BGSAVE:
+		return handleBgsave(cmd.Args)
+	case LASTSAVE:
+		return handleLastsave(cmd.Args)
+	case INFO:
+		return handleInfo(c, cmd.Args)
+	case DEL:
+		return handleDel(c, cmd.Args)
+	case EXPIRE:
+		return handleExpire(c, cmd.Args, expireSeconds)
+	case PEXPIRE:
+		return handleExpire(c, cmd.Args, expireMilliseconds)
+	case EXPIREAT:
+		return handleExpire(c, cmd.Args, expireAtSeconds)
+	case PEXPIREAT:
+		return handleExpire(c, cmd.Args, expireAtMilliseconds)
+	case TTL:
+		return handleTTL(c, cmd.Args, time.Second)
+	case PTTL:
+		return handleTTL(c, cmd.Args, time.Millisecond)
+	case PERSIST:
+		return handlePersist(c, cmd.Args)
+	case BGREWRITEAOF:
+		return handleBgrewriteaof(cmd.Args)
+	case SYNC:
+		return handleSync(c, cmd.Args)
+	case REPLCONF:
+		return handleReplconf(c, cmd.Args)
+	case DUMP:
+		return handleDump(c, cmd.Args)
+	case RESTORE, RESTORE_ASKING:
+		return handleRestore(c, cmd.Args)
+	case MIGRATE:
+		return handleMigrate(c, cmd.Args)
+	case PSYNC:
+		return handlePsync(c, cmd.Args)
+	case REPLICAOF, SLAVEOF:
+		return handleReplicaof(cmd.Args)
+	case ROLE:
+		return handleRole(cmd.Args)
+	case WAIT:
+		return handleWait(c, cmd.Args)
+	case WAITAOF:
+		return handleWaitaof(c, cmd.Args)
+	case CLUSTER:
+		return handleCluster(cmd.Args)
+	case ASKING:
+		return handleAsking(c, cmd.Args)
+	case SELECT:
+		return handleSelect(c, cmd.Args)
+	case MOVE:
+		return handleMove(c, cmd.Args)
+	case SWAPDB:
+		return handleSwapdb(c, cmd.Args)
+	case DBSIZE:
+		return handleDbsize(c, cmd.Args)
+	case SHUTDOWN:
+		return handleShutdown(c, cmd.Args)
+	case CONFIG:
+		return handleConfig(cmd.Args)
+	case HGETALL:
+		return handleHgetall(c, cmd.Args)
+	case ZSCORE:
+		return handleZscore(c, cmd.Args)
+	case UNKNOWN:
+		return nil, unknownCommandReply(cmd.Args)
 	default:
 		return nil, fmt.Errorf("unsupported command: %v", cmd.Type)
 	}
 }
 
+// Serves clients on addr until the server is shut down with SHUTDOWN, SIGINT or SIGTERM (see shutdown),
+// then returns nil
 func StartServer(addr string) error {
-	listener, err := net.Listen("tcp", addr)
+	cfg := config()
+	if err := loadData(); err != nil {
+		return fmt.Errorf("loading data: %w", err)
+	}
+	if cfg.AppendOnly {
+		if err := openAppendOnlyFile(); err != nil {
+			return err
+		}
+	}
+
+	// Handled from the start, so signals received while starting up don't kill the process
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	transport, err := listenTransport(addr)
 	if err != nil {
-		log.Fatalf("Failed to bind to port 9092: %v", err)
+		return err
+	}
+	listeningPort = transport.port()
+	activeIOModel = transport.model()
+	// Before anything accessing the databases starts, and once everything stopped
+	setKeyspaceOwned(transport.ownsKeyspace())
+	defer setKeyspaceOwned(false)
+	serverStartTime = time.Now()
+	if cfg.AdminPort != 0 {
+		admin, err := startAdminServer(cfg.adminAddr())
+		if err != nil {
+			transport.close()
+			return err
+		}
+		defer admin.Close()
+	}
+
+	if cfg.ClusterEnabled {
+		if err := initCluster(listeningPort); err != nil {
+			transport.close()
+			return err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if err := startClusterBus(net.JoinHostPort(host, strconv.Itoa(cluster.myself.busPort))); err != nil {
+			transport.close()
+			return err
+		}
+	}
+	if cfg.ReplicaOf != "" {
+		host, port, err := parseReplicaOf(cfg.ReplicaOf)
+		if err != nil {
+			transport.close()
+			return err
+		}
+		startReplication(host, port)
 	}
 
-	defer listener.Close()
+	stop := make(chan struct{})
+	shutdownState.mutex.Lock()
+	shutdownState.stop = stop
+	shutdownState.mutex.Unlock()
+	defer resetShutdownState()
+
+	stopCron := make(chan struct{})
+	defer close(stopCron)
+	go serverCron(stopCron)
 
+	served := make(chan error, 1)
+	go func() {
+		served <- transport.serve()
+	}()
 	for {
-		conn, err := listener.Accept()
+		select {
+		case err := <-served:
+			return err
+		case sig := <-signals:
+			log.Printf("Received %s, scheduling shutdown...", sig)
+			go func() {
+				if err := shutdown(0); err != nil {
+					log.Printf("Shutdown failed: %v", err)
+				}
+			}()
+		case <-stop:
+			transport.close()
+			<-served
+			stopServer()
+			return nil
+		}
+	}
+}
 
-		if err != nil {
-			log.Printf("failed to accept connection: %v", err)
-			continue
+// Periodic background work, run SERVER_CRON_HZ times per second
+const SERVER_CRON_HZ = 10
+
+func serverCron(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second / SERVER_CRON_HZ)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-stop:
+			return
 		}
 
-		go func() {
-			if err := HandleConnection(conn); err != nil {
-				log.Printf("error handling connection: %v", err)
-			}
-		}()
+		trackInstantaneousMetrics(now)
+		readMemoryUsage()
+		acquired := acquireKeyspace()
+		checkSaveRules(now)
+		releaseKeyspace(acquired)
+		fsyncAppendOnlyFileEverysec(now)
+		acquired = acquireKeyspace()
+		checkAOFRewrite(now)
+		releaseKeyspace(acquired)
+		replicationCron(now)
+		if config().ClusterEnabled {
+			clusterCron(now)
+		}
 	}
 }
@@ -370,3 +370,155 @@ func TestLongBulkStrings(t *testing.T) {
 		t.Errorf("GET response value mismatch, expected length %d, got different value", len(longValue))
 	}
 }
+
+func TestHelloProtocolSwitch(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	hello3 := "*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"
+	getMissing := "*2\r\n$3\r\nGET\r\n$12\r\nhello_absent\r\n"
+
+	replies := dialAndSend(t, addr, []string{hello3, getMissing})
+
+	if len(replies) == 0 || replies[0] != "%7" {
+		t.Fatalf("expected RESP3 map header %%7, got: %v", replies)
+	}
+	if !strings.Contains(strings.Join(replies, " "), "proto :3") {
+		t.Errorf("expected proto 3 in HELLO reply, got: %v", replies)
+	}
+	if replies[len(replies)-1] != "_" {
+		t.Errorf("expected RESP3 null for missing key, got: %v", replies[len(replies)-1])
+	}
+
+	// Without HELLO, the same connection-level reply is a RESP2 null bulk string
+	replies = dialAndSend(t, addr, []string{getMissing})
+	if len(replies) != 1 || replies[0] != "$-1" {
+		t.Errorf("expected RESP2 null bulk string, got: %v", replies)
+	}
+
+	// Unsupported versions are rejected and leave the protocol untouched
+	hello4 := "*2\r\n$5\r\nHELLO\r\n$1\r\n4\r\n"
+	replies = dialAndSend(t, addr, []string{hello4, getMissing})
+	if len(replies) != 2 || !strings.Contains(replies[0], "NOPROTO") || replies[1] != "$-1" {
+		t.Errorf("expected NOPROTO error followed by RESP2 null, got: %v", replies)
+	}
+}
+
+func TestAggregateRepliesByProtocol(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	hashKey, zsetKey := "resp3_hash", "resp3_zset"
+	database(0).Set(&hashKey, &MiniRedisObject{data: &HashData{data: map[string][]byte{"f": []byte("v")}}})
+	database(0).Set(&zsetKey, &MiniRedisObject{data: &SortedSetData{data: map[string]float64{"m": 1.5}}})
+	defer database(0).Delete(&hashKey)
+	defer database(0).Delete(&zsetKey)
+
+	hgetall := "*2\r\n$7\r\nHGETALL\r\n$10\r\nresp3_hash\r\n"
+	zscore := "*3\r\n$6\r\nZSCORE\r\n$10\r\nresp3_zset\r\n$1\r\nm\r\n"
+	zscoreMissing := "*3\r\n$6\r\nZSCORE\r\n$10\r\nresp3_zset\r\n$1\r\nx\r\n"
+
+	replies := dialAndSend(t, addr, []string{hgetall, zscore, zscoreMissing})
+	expected := []string{"*2", "$1", "f", "$1", "v", "$3", "1.5", "$-1"}
+	if strings.Join(replies, " ") != strings.Join(expected, " ") {
+		t.Errorf("RESP2 replies = %v, want %v", replies, expected)
+	}
+
+	replies = dialAndSend(t, addr, []string{"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n", hgetall, zscore, zscoreMissing})
+	if len(replies) < 7 {
+		t.Fatalf("RESP3 replies = %v", replies)
+	}
+	expected = []string{"%1", "$1", "f", "$1", "v", ",1.5", "_"}
+	if got := replies[len(replies)-7:]; strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("RESP3 replies = %v, want %v", got, expected)
+	}
+
+	replies = dialAndSend(t, addr, []string{"*2\r\n$7\r\nHGETALL\r\n$10\r\nresp3_zset\r\n"})
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], "-WRONGTYPE") {
+		t.Errorf("HGETALL of a sorted set replied %v", replies)
+	}
+}
+
+func TestHelloReportsReplicaRole(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	repl.mutex.Lock()
+	repl.link = &masterLink{host: "127.0.0.1", port: 1}
+	repl.mutex.Unlock()
+	defer func() {
+		repl.mutex.Lock()
+		repl.link = nil
+		repl.mutex.Unlock()
+	}()
+
+	replies := dialAndSend(t, addr, []string{"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"})
+	if !strings.Contains(strings.Join(replies, " "), "role $5 slave") {
+		t.Errorf("HELLO reply doesn't report the replica role: %v", replies)
+	}
+}
+
+func TestInlineCommands(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	replies := dialAndSend(t, addr, []string{
+		"PING\r\n",
+		"SET inline_key \"hello world\"\n",
+		"GET inline_key\n",
+	})
+
+	expected := []string{"+PONG", "$11", "hello world", "$11", "hello world"}
+	if len(replies) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %v", len(expected), len(replies), replies)
+	}
+	for i := range expected {
+		if replies[i] != expected[i] {
+			t.Errorf("line %d: got %q, want %q", i, replies[i], expected[i])
+		}
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	t.Run("unknown command keeps the connection", func(t *testing.T) {
+		replies := dialAndSend(t, addr, []string{
+			"*3\r\n$3\r\nFOO\r\n$1\r\na\r\n$1\r\nb\r\n",
+			"*2\r\n$4\r\nECHO\r\n$5\r\nstill\r\n",
+		})
+
+		expected := []string{
+			"-ERR unknown command 'FOO', with args beginning with: 'a' 'b' ",
+			"$5",
+			"still",
+		}
+		if len(replies) != len(expected) {
+			t.Fatalf("expected %d lines, got %d: %v", len(expected), len(replies), replies)
+		}
+		for i := range expected {
+			if replies[i] != expected[i] {
+				t.Errorf("line %d: got %q, want %q", i, replies[i], expected[i])
+			}
+		}
+	})
+
+	t.Run("protocol error replies then closes", func(t *testing.T) {
+		replies := dialAndSend(t, addr, []string{
+			"*1\r\n$4\r\nPING\r\n",
+			"*1\r\n$x\r\nPING\r\n",
+			"*1\r\n$4\r\nPING\r\n",
+		})
+
+		expected := []string{"+PONG", "-ERR Protocol error: invalid bulk length"}
+		if len(replies) != len(expected) {
+			t.Fatalf("expected %d lines, got %d: %v", len(expected), len(replies), replies)
+		}
+		for i := range expected {
+			if replies[i] != expected[i] {
+				t.Errorf("line %d: got %q, want %q", i, replies[i], expected[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package miniredis
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of shards of the keyspace
+const KEYSPACE_SHARDS = 256
+
+// One independently locked part of a ShardedMap, padded to a cache line so that
+// goroutines locking neighbouring shards don't slow each other down
+type mapShard[T any] struct {
+	mutex sync.RWMutex
+	m     map[string]T
+	_     [64 - 32]byte
+}
+
+// A concurrent map split into shards with their own RWMutex, picked by a hash of the key, so
+// writes to keys of different shards don't contend. Operations on several keys lock their
+// shards in ascending order, and operations on the whole map lock all of them in that order,
+// so they never deadlock each other
+type ShardedMap[T any] struct {
+	shards []mapShard[T]
+	seed   maphash.Seed
+	// Called under the write lock of the key's shard for each key added to or removed from the map, see Watch
+	watcher func(key string, added bool)
+	// Set when a single goroutine at a time accesses the map, see SetLockFree
+	lockFree atomic.Bool
+}
+
+// NewShardedMap creates a ShardedMap with at least the given number of shards, rounded up to a power of two
+func NewShardedMap[T any](shards int) *ShardedMap[T] {
+	n := 1
+	if shards > 1 {
+		n = 1 << bits.Len(uint(shards-1))
+	}
+	m := &ShardedMap[T]{shards: make([]mapShard[T], n), seed: maphash.MakeSeed()}
+	for i := range m.shards {
+		m.shards[i].m = make(map[string]T)
+	}
+	return m
+}
+
+func (m *ShardedMap[T]) shardIndex(key string) int {
+	return int(maphash.String(m.seed, key) & uint64(len(m.shards)-1))
+}
+
+func (m *ShardedMap[T]) shard(key string) *mapShard[T] {
+	return &m.shards[m.shardIndex(key)]
+}
+
+// Get retrieves a value from the map
+func (m *ShardedMap[T]) Get(key *string) (T, bool) {
+	s := m.shard(*key)
+	m.rlock(s)
+	defer m.runlock(s)
+
+	val, exists := s.m[*key]
+	return val, exists
+}
+
+// Set adds or updates a value in the map
+func (m *ShardedMap[T]) Set(key *string, value *T) {
+	s := m.shard(*key)
+	m.lock(s)
+	defer m.unlock(s)
+
+	if _, exists := s.m[*key]; !exists && m.watcher != nil {
+		m.watcher(*key, true)
+	}
+	s.m[*key] = *value
+}
+
+// Delete removes a key-value pair from the map
+func (m *ShardedMap[T]) Delete(key *string) {
+	s := m.shard(*key)
+	m.lock(s)
+	defer m.unlock(s)
+
+	if _, exists := s.m[*key]; exists && m.watcher != nil {
+		m.watcher(*key, false)
+	}
+	delete(s.m, *key)
+}
+
+// Update modifies an existing value using a function for atomicity
+// Return value indicates success
+func (m *ShardedMap[T]) Update(key *string, fn func(T) T) bool {
+	s := m.shard(*key)
+	m.lock(s)
+	defer m.unlock(s)
+
+	if val, ok := s.m[*key]; ok {
+		s.m[*key] = fn(val)
+		return true
+	}
+	return false
+}
+
+// Compute atomically replaces the value for key with the result of fn, which receives the
+// current value and whether it exists. When fn returns keep = false the key is deleted instead
+func (m *ShardedMap[T]) Compute(key *string, fn func(val T, exists bool) (newVal T, keep bool)) {
+	s := m.shard(*key)
+	m.lock(s)
+	defer m.unlock(s)
+
+	m.computeLocked(s, *key, fn)
+}
+
+// ComputeAll is Compute for several keys at once: fn is called for each key in turn, with the
+// shards of all of them locked, so other clients see either none or all of the changes
+func (m *ShardedMap[T]) ComputeAll(keys []string, fn func(key string, val T, exists bool) (newVal T, keep bool)) {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = m.shardIndex(key)
+	}
+	locked := slices.Clone(indexes)
+	slices.Sort(locked)
+	locked = slices.Compact(locked)
+
+	for _, i := range locked {
+		m.lock(&m.shards[i])
+	}
+	defer func() {
+		for _, i := range slices.Backward(locked) {
+			m.unlock(&m.shards[i])
+		}
+	}()
+
+	for i, key := range keys {
+		m.computeLocked(&m.shards[indexes[i]], key, func(val T, exists bool) (T, bool) {
+			return fn(key, val, exists)
+		})
+	}
+}
+
+func (m *ShardedMap[T]) computeLocked(s *mapShard[T], key string, fn func(val T, exists bool) (newVal T, keep bool)) {
+	val, exists := s.m[key]
+	newVal, keep := fn(val, exists)
+	if keep {
+		s.m[key] = newVal
+	} else if exists {
+		delete(s.m, key)
+	}
+	if keep != exists && m.watcher != nil {
+		m.watcher(key, keep)
+	}
+}
+
+// Snapshot returns a copy of the map. All the shards are read locked while it is taken,
+// so it holds the contents of the map at a single point in time
+func (m *ShardedMap[T]) Snapshot() map[string]T {
+	for i := range m.shards {
+		m.rlock(&m.shards[i])
+	}
+	defer func() {
+		for i := range slices.Backward(m.shards) {
+			m.runlock(&m.shards[i])
+		}
+	}()
+
+	size := 0
+	for i := range m.shards {
+		size += len(m.shards[i].m)
+	}
+	snapshot := make(map[string]T, size)
+	for i := range m.shards {
+		for k, v := range m.shards[i].m {
+			snapshot[k] = v
+		}
+	}
+	return snapshot
+}
+
+// Len returns the number of keys in the map
+func (m *ShardedMap[T]) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		m.rlock(s)
+		n += len(s.m)
+		m.runlock(s)
+	}
+	return n
+}
+
+// Range calls fn for every key of the map, read locking one shard at a time. Unlike Snapshot,
+// it doesn't see the whole map at a single point in time
+func (m *ShardedMap[T]) Range(fn func(key string, val T)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		m.rlock(s)
+		for k, v := range s.m {
+			fn(k, v)
+		}
+		m.runlock(s)
+	}
+}
+
+// Replace swaps the contents of the map for those of contents
+func (m *ShardedMap[T]) Replace(contents map[string]T) {
+	m.lockAll()
+	defer m.unlockAll()
+
+	if m.watcher != nil {
+		for i := range m.shards {
+			for k := range m.shards[i].m {
+				m.watcher(k, false)
+			}
+		}
+	}
+	for i := range m.shards {
+		m.shards[i].m = make(map[string]T, len(contents)/len(m.shards))
+	}
+	for k, v := range contents {
+		m.shard(k).m[k] = v
+		if m.watcher != nil {
+			m.watcher(k, true)
+		}
+	}
+}
+
+// Watch makes fn track the keys of the map: it is called under the write lock of the key's shard for
+// every key added or removed, starting with the keys already in the map. A nil fn stops the tracking
+func (m *ShardedMap[T]) Watch(fn func(key string, added bool)) {
+	m.lockAll()
+	defer m.unlockAll()
+
+	m.watcher = fn
+	if fn != nil {
+		for i := range m.shards {
+			for k := range m.shards[i].m {
+				fn(k, true)
+			}
+		}
+	}
+}
+
+func (m *ShardedMap[T]) lockAll() {
+	for i := range m.shards {
+		m.lock(&m.shards[i])
+	}
+}
+
+func (m *ShardedMap[T]) unlockAll() {
+	for i := range slices.Backward(m.shards) {
+		m.unlock(&m.shards[i])
+	}
+}
+
+// SetLockFree makes the map skip the locks of its shards, when whoever accesses it makes sure a single
+// goroutine at a time does. It must not be called while other goroutines access the map
+func (m *ShardedMap[T]) SetLockFree(lockFree bool) {
+	m.lockFree.Store(lockFree)
+}
+
+func (m *ShardedMap[T]) lock(s *mapShard[T]) {
+	if !m.lockFree.Load() {
+		s.mutex.Lock()
+	}
+}
+
+func (m *ShardedMap[T]) unlock(s *mapShard[T]) {
+	if !m.lockFree.Load() {
+		s.mutex.Unlock()
+	}
+}
+
+func (m *ShardedMap[T]) rlock(s *mapShard[T]) {
+	if !m.lockFree.Load() {
+		s.mutex.RLock()
+	}
+}
+
+func (m *ShardedMap[T]) runlock(s *mapShard[T]) {
+	if !m.lockFree.Load() {
+		s.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,245 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedMap_ShardCount(t *testing.T) {
+	tests := []struct {
+		shards int
+		want   int
+	}{
+		{shards: 0, want: 1},
+		{shards: 1, want: 1},
+		{shards: 2, want: 2},
+		{shards: 3, want: 4},
+		{shards: 256, want: 256},
+		{shards: 257, want: 512},
+	}
+
+	for _, tt := range tests {
+		if got := len(NewShardedMap[int](tt.shards).shards); got != tt.want {
+			t.Errorf("NewShardedMap(%d) has %d shards, want %d", tt.shards, got, tt.want)
+		}
+	}
+}
+
+func TestShardedMap_BasicOperations(t *testing.T) {
+	m := NewShardedMap[int](16)
+
+	for i := 0; i < 100; i++ {
+		key, value := strconv.Itoa(i), i
+		m.Set(&key, &value)
+	}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if got, exists := m.Get(&key); !exists || got != i {
+			t.Errorf("Get(%q) = %v, %v; want %v, true", key, got, exists, i)
+		}
+	}
+
+	key := "7"
+	if !m.Update(&key, func(v int) int { return v * 2 }) {
+		t.Error("Update() returned false for existing key")
+	}
+	if got, _ := m.Get(&key); got != 14 {
+		t.Errorf("Update() failed to modify value: got %v, want 14", got)
+	}
+
+	m.Delete(&key)
+	if _, exists := m.Get(&key); exists {
+		t.Error("Delete() failed, key still exists")
+	}
+	missing := "missing"
+	if m.Update(&missing, func(v int) int { return v }) {
+		t.Error("Update() returned true for non-existent key")
+	}
+
+	snapshot := m.Snapshot()
+	if len(snapshot) != 99 || snapshot["42"] != 42 {
+		t.Errorf("Snapshot() has %d keys and 42 = %v, want 99 keys and 42", len(snapshot), snapshot["42"])
+	}
+
+	m.Replace(map[string]int{"a": 1, "b": 2})
+	if got := m.Snapshot(); len(got) != 2 || got["a"] != 1 || got["b"] != 2 {
+		t.Errorf("Snapshot() after Replace() = %v, want map[a:1 b:2]", got)
+	}
+}
+
+func TestShardedMap_ComputeAll(t *testing.T) {
+	// A single shard makes every key share it, and duplicates must not lock it twice
+	for _, shards := range []int{1, 4, 256} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			m := NewShardedMap[int](shards)
+			a, b, one := "a", "b", 1
+			m.Set(&a, &one)
+			m.Set(&b, &one)
+
+			var seen []string
+			m.ComputeAll([]string{"a", "c", "a", "b"}, func(key string, v int, exists bool) (int, bool) {
+				seen = append(seen, key)
+				if key == "b" {
+					return 0, false
+				}
+				return v + 1, true
+			})
+
+			if want := []string{"a", "c", "a", "b"}; !slices.Equal(seen, want) {
+				t.Errorf("ComputeAll() visited %v, want %v", seen, want)
+			}
+			want := map[string]int{"a": 3, "c": 1}
+			if got := m.Snapshot(); len(got) != len(want) || got["a"] != want["a"] || got["c"] != want["c"] {
+				t.Errorf("Snapshot() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestShardedMap_Concurrency(t *testing.T) {
+	m := NewShardedMap[int](8)
+	keys := make([]string, 32)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("counter:%d", i)
+	}
+
+	const numGoroutines = 50
+	const incrementsPerGoroutine = 100
+	var wg sync.WaitGroup
+
+	// Goroutines lock the same shards through keys given in different orders
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			order := slices.Clone(keys)
+			if i%2 == 1 {
+				slices.Reverse(order)
+			}
+			for j := 0; j < incrementsPerGoroutine; j++ {
+				m.ComputeAll(order, func(key string, v int, exists bool) (int, bool) {
+					return v + 1, true
+				})
+				if j%10 == 0 {
+					m.Snapshot()
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for key, got := range m.Snapshot() {
+		if got != numGoroutines*incrementsPerGoroutine {
+			t.Errorf("%s = %v, want %v", key, got, numGoroutines*incrementsPerGoroutine)
+		}
+	}
+}
+
+func TestShardedMap_Watch(t *testing.T) {
+	m := NewShardedMap[int](4)
+	existing, value := "existing", 1
+	m.Set(&existing, &value)
+
+	tracked := map[string]bool{}
+	m.Watch(func(key string, added bool) {
+		if added == tracked[key] {
+			t.Errorf("watcher called with %q, %v while the key is already in that state", key, added)
+		}
+		tracked[key] = added
+	})
+
+	a, b := "a", "b"
+	m.Set(&a, &value)
+	m.Set(&a, &value)
+	m.Compute(&b, func(v int, exists bool) (int, bool) { return 2, true })
+	m.Compute(&b, func(v int, exists bool) (int, bool) { return 3, true })
+	m.Delete(&a)
+	m.Delete(&a)
+	m.ComputeAll([]string{"c", "d"}, func(key string, v int, exists bool) (int, bool) { return 1, key == "c" })
+	want := map[string]bool{"existing": true, "a": false, "b": true, "c": true, "d": false}
+	for key, present := range want {
+		if tracked[key] != present {
+			t.Errorf("tracked[%q] = %v, want %v", key, tracked[key], present)
+		}
+	}
+
+	m.Replace(map[string]int{"e": 1})
+	if tracked["existing"] || tracked["b"] || tracked["c"] || !tracked["e"] {
+		t.Errorf("tracked keys after Replace() = %v, want only e", tracked)
+	}
+}
+
+// The keyspace interface shared by the maps compared in the benchmarks
+type benchmarkKeyspace interface {
+	Set(key *string, value *MiniRedisObject)
+}
+
+// Keys written by the SET benchmarks, numerous enough that goroutines rarely write the same one
+var benchmarkKeys = func() []string {
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+// SET throughput of the keyspace implementations, with a goroutine per core. Run with
+// -cpu 1,2,4,8 to see how each scales:
+//
+//	go test -tags test -run '^$' -bench KeyspaceSet -cpu 1,2,4,8 ./internal/miniredis
+func BenchmarkKeyspaceSet(b *testing.B) {
+	keyspaces := []struct {
+		name     string
+		keyspace func() benchmarkKeyspace
+	}{
+		{name: "ConcurrentMap", keyspace: func() benchmarkKeyspace { return NewConcurrentMap[string, MiniRedisObject]() }},
+		{name: "ShardedMap", keyspace: func() benchmarkKeyspace { return NewShardedMap[MiniRedisObject](KEYSPACE_SHARDS) }},
+	}
+
+	for _, ks := range keyspaces {
+		b.Run(ks.name, func(b *testing.B) {
+			keyspace := ks.keyspace()
+			obj := MiniRedisObject{data: &StringData{data: []byte("value")}}
+			var goroutines atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(goroutines.Add(1)) * 7919
+				for pb.Next() {
+					keyspace.Set(&benchmarkKeys[i%len(benchmarkKeys)], &obj)
+					i++
+				}
+			})
+		})
+	}
+}
+
+// SET throughput through the command dispatcher, with a client per core and no AOF or replicas
+func BenchmarkSetCommand(b *testing.B) {
+	updateConfig(b, func(c *Config) { c.SaveRules = nil })
+	b.Cleanup(func() { database(0).Replace(map[string]MiniRedisObject{}) })
+
+	var goroutines atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := newClient(NewRESPWriter(io.Discard, RESP_WRITER_INITIAL_BUF_SIZE))
+		value := &RESPBulkString{data: []byte("value")}
+		i := int(goroutines.Add(1)) * 7919
+		for pb.Next() {
+			cmd := RESPCommand{Type: SET, Args: []RESPData{&RESPBulkString{data: []byte(benchmarkKeys[i%len(benchmarkKeys)])}, value}}
+			if _, err := dispatchCommand(c, &cmd); err != nil {
+				b.Fatalf("SET error: %v", err)
+			}
+			i++
+		}
+	})
+}
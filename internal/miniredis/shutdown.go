@@ -0,0 +1,300 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options of SHUTDOWN
+type shutdownFlags int
+
+const (
+	// Don't save the RDB file, even with save rules configured
+	shutdownNoSave shutdownFlags = 1 << iota
+	// Save the RDB file, even without save rules configured
+	shutdownSave
+	// Don't wait for lagging replicas, nor for clients to finish the commands they sent
+	shutdownNow
+	// Shut down even when the data couldn't be persisted
+	shutdownForce
+)
+
+var errShutdownFailed = errors.New("Errors trying to SHUTDOWN. Check logs.")
+var errShuttingDown = errors.New("Server is shutting down")
+
+// State of the shutdown of the server started with StartServer
+var shutdownState struct {
+	mutex sync.Mutex
+	// Closed by shutdown to make StartServer return, nil while no server is running
+	stop chan struct{}
+	// Closed when the shutdown in progress completes or is aborted, nil while none is in progress.
+	// Writes wait for it, so the data saved by the shutdown is the final one
+	resume chan struct{}
+	// Closed by SHUTDOWN ABORT while the shutdown in progress waits for lagging replicas
+	abort chan struct{}
+	// Set once the data was persisted: the server is stopping and writes are refused
+	stopping bool
+	// Set by SHUTDOWN NOW: clients aren't given time to finish the commands they sent
+	now bool
+}
+
+// SHUTDOWN [NOSAVE | SAVE] [NOW] [FORCE] [ABORT]: persists the data and stops the server, see shutdown.
+// Only failures get a reply. ABORT cancels a shutdown waiting for lagging replicas
+func handleShutdown(c *client, args []RESPData) (MiniRedisData, error) {
+	var flags shutdownFlags
+	abort := false
+	for i := range args {
+		option, err := ExtractString(&args[i])
+		if err != nil {
+			return nil, errSyntax
+		}
+		switch strings.ToUpper(option) {
+		case "NOSAVE":
+			flags |= shutdownNoSave
+		case "SAVE":
+			flags |= shutdownSave
+		case "NOW":
+			flags |= shutdownNow
+		case "FORCE":
+			flags |= shutdownForce
+		case "ABORT":
+			abort = true
+		default:
+			return nil, errSyntax
+		}
+	}
+	if (flags&shutdownNoSave != 0 && flags&shutdownSave != 0) || (abort && flags != 0) {
+		return nil, errSyntax
+	}
+
+	if abort {
+		if err := abortShutdown(); err != nil {
+			return nil, err
+		}
+		return okReply, nil
+	}
+	if err := shutdown(flags); err != nil {
+		return nil, err
+	}
+	// Like Redis, which exits without replying, the connection is closed without a reply
+	c.closeAfterReply = true
+	return &NoReply{}, nil
+}
+
+// Stops the server started with StartServer:
+//  1. Writes are paused once those in progress are done.
+//  2. Unless NOW is set, the lagging replicas get up to shutdown-timeout to acknowledge every write.
+//     SHUTDOWN ABORT can cancel the shutdown meanwhile.
+//  3. The AOF is fsynced, and the RDB file is saved when save rules are configured or SAVE is set (never with NOSAVE).
+//     If that fails, the server keeps running unless FORCE is set.
+//  4. StartServer stops accepting connections, gives the clients up to shutdown-timeout to finish
+//     the commands they sent (unless NOW is set), closes their connections and returns.
+func shutdown(flags shutdownFlags) error {
+	propagationMutex.Lock()
+	shutdownState.mutex.Lock()
+	if shutdownState.stop == nil {
+		shutdownState.mutex.Unlock()
+		propagationMutex.Unlock()
+		return fmt.Errorf("The server isn't running")
+	}
+	if shutdownState.resume != nil || shutdownState.stopping {
+		shutdownState.mutex.Unlock()
+		propagationMutex.Unlock()
+		return fmt.Errorf("A shutdown is already in progress")
+	}
+	resume, abort := make(chan struct{}), make(chan struct{})
+	shutdownState.resume, shutdownState.abort = resume, abort
+	shutdownState.mutex.Unlock()
+
+	offset := replicationOffset()
+	repl.mutex.Lock()
+	hasReplicas := len(repl.replicas) > 0
+	repl.mutex.Unlock()
+	if hasReplicas && flags&shutdownNow == 0 {
+		feedReplication(-1, [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})
+	}
+	propagationMutex.Unlock()
+	log.Printf("User requested shutdown...")
+
+	err := func() error {
+		if timeout := config().ShutdownTimeout; hasReplicas && flags&shutdownNow == 0 && timeout > 0 {
+			aborted := false
+			waitForAcks(timeout, func() bool {
+				select {
+				case <-abort:
+					aborted = true
+					return true
+				default:
+				}
+				repl.mutex.Lock()
+				replicas := int64(len(repl.replicas))
+				repl.mutex.Unlock()
+				return countReplicasAcked(offset, false) >= replicas
+			})
+			if aborted {
+				log.Printf("Shutdown manually aborted")
+				return errShutdownFailed
+			}
+		}
+
+		// Too late to abort from now on
+		shutdownState.mutex.Lock()
+		shutdownState.abort = nil
+		shutdownState.mutex.Unlock()
+		acquired := acquireKeyspace()
+		defer releaseKeyspace(acquired)
+		return persistOnShutdown(flags)
+	}()
+
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+	if err == nil {
+		shutdownState.stopping = true
+		shutdownState.now = flags&shutdownNow != 0
+		close(shutdownState.stop)
+	}
+	shutdownState.resume, shutdownState.abort = nil, nil
+	close(resume)
+	return err
+}
+
+// Called by StartServer once shut down and no longer accepting connections: closes the clients
+// and stops replication, the cluster bus and the AOF
+func stopServer() {
+	// Replicas had their chance to acknowledge the last writes
+	propagationMutex.Lock()
+	repl.mutex.Lock()
+	disconnectReplicasLocked()
+	repl.mutex.Unlock()
+	propagationMutex.Unlock()
+
+	shutdownState.mutex.Lock()
+	timeout := config().ShutdownTimeout
+	if shutdownState.now {
+		timeout = 0
+	}
+	shutdownState.mutex.Unlock()
+	closeServedClients(timeout)
+
+	stopReplication()
+	stopCluster()
+	if err := closeAppendOnlyFile(); err != nil {
+		log.Printf("Error closing the append only file: %v", err)
+	}
+	log.Printf("Server is now ready to exit, bye bye...")
+}
+
+// Lets the next StartServer run, and be shut down
+func resetShutdownState() {
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+	shutdownState.stop = nil
+	shutdownState.stopping = false
+	shutdownState.now = false
+}
+
+// Fsyncs the AOF and saves the RDB file if needed. Failures are ignored with FORCE
+func persistOnShutdown(flags shutdownFlags) error {
+	failed := false
+	if err := fsyncAppendOnlyFile(); err != nil {
+		log.Printf("Error trying to fsync the append only file on shutdown: %v", err)
+		failed = true
+	}
+	if flags&shutdownSave != 0 || (len(config().SaveRules) > 0 && flags&shutdownNoSave == 0) {
+		log.Printf("Saving the final RDB snapshot before exiting.")
+		if err := saveSnapshot(true); err != nil {
+			failed = true
+		}
+	}
+
+	if failed && flags&shutdownForce == 0 {
+		log.Printf("Errors trying to shut down the server. Check the logs for more information.")
+		return errShutdownFailed
+	}
+	return nil
+}
+
+// Cancels the shutdown waiting for lagging replicas
+func abortShutdown() error {
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+
+	if shutdownState.abort == nil {
+		return fmt.Errorf("No shutdown in progress.")
+	}
+	close(shutdownState.abort)
+	shutdownState.abort = nil
+	// Wake up the shutdown, which waits for the acknowledgements of the replicas
+	ackNotifier.notify()
+	return nil
+}
+
+// Clients of the server started with StartServer served from goroutines by serveClient, which
+// StartServer closes once shut down. Event loops close their own clients
+var servedClients = struct {
+	mutex   sync.Mutex
+	clients map[*client]struct{}
+	// Notified when a client stops being served
+	left *notifier
+}{clients: map[*client]struct{}{}, left: newNotifier()}
+
+// Set while StartServer closes the served clients: they stop once the commands they sent are executed
+var closingClients atomic.Bool
+
+func registerServedClient(c *client) {
+	servedClients.mutex.Lock()
+	servedClients.clients[c] = struct{}{}
+	servedClients.mutex.Unlock()
+}
+
+func unregisterServedClient(c *client) {
+	servedClients.mutex.Lock()
+	delete(servedClients.clients, c)
+	servedClients.mutex.Unlock()
+	servedClients.left.notify()
+}
+
+// Closes the clients served from goroutines: the idle ones right away, and the others once the commands
+// they sent are executed and replied to. Connections still open after timeout are closed
+func closeServedClients(timeout time.Duration) {
+	closingClients.Store(true)
+	defer closingClients.Store(false)
+
+	// Idle clients are waiting for data, which a past deadline interrupts
+	servedClients.mutex.Lock()
+	for c := range servedClients.clients {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	servedClients.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	expired := timer.C
+	for {
+		left := servedClients.left.wait()
+		servedClients.mutex.Lock()
+		remaining := len(servedClients.clients)
+		servedClients.mutex.Unlock()
+		if remaining == 0 {
+			return
+		}
+
+		select {
+		case <-left:
+		case <-expired:
+			log.Printf("Closing %d clients still busy after the shutdown timeout", remaining)
+			servedClients.mutex.Lock()
+			for c := range servedClients.clients {
+				c.conn.Close()
+			}
+			servedClients.mutex.Unlock()
+			// They leave as soon as their connection fails
+			expired = nil
+		}
+	}
+}
@@ -0,0 +1,162 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs StartServer on a free port until it returns, which the returned channel reports.
+// The server is shut down at the end of the test if it is still running
+func startShutdownTestServer(t *testing.T) (string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen on random port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	stopped := make(chan error, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		stopped <- StartServer(addr)
+	}()
+	t.Cleanup(func() {
+		shutdown(shutdownNoSave | shutdownNow)
+		<-returned
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr, stopped
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Sends the commands on a new connection and returns the reply lines read until the server closes it
+func sendUntilClosed(t *testing.T, addr string, commands []string) []string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(strings.Join(commands, "")))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	replies := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf("connection not closed by the shutdown: %v", err)
+			}
+			return replies
+		}
+		replies = append(replies, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func waitForStartServer(t *testing.T, stopped <-chan error) {
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("StartServer() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("StartServer() did not return after the shutdown")
+	}
+}
+
+func TestShutdownSave(t *testing.T) {
+	dir := useTempDataDir(t)
+	updateConfig(t, func(c *Config) { c.SaveRules = nil })
+	addr, stopped := startShutdownTestServer(t)
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer idle.Close()
+
+	key := "shutdown_key"
+	defer database(0).Delete(&key)
+	replies := sendUntilClosed(t, addr, []string{
+		"*3\r\n$3\r\nSET\r\n$12\r\nshutdown_key\r\n$5\r\nvalue\r\n",
+		"*2\r\n$8\r\nSHUTDOWN\r\n$4\r\nSAVE\r\n",
+	})
+	// The connection is closed without a reply to SHUTDOWN
+	if len(replies) != 2 || replies[1] != "value" {
+		t.Fatalf("unexpected replies: %v", replies)
+	}
+	waitForStartServer(t, stopped)
+
+	if _, err := os.Stat(filepath.Join(dir, config().DBFilename)); err != nil {
+		t.Errorf("RDB file not saved on shutdown: %v", err)
+	}
+
+	// Idle clients are disconnected
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bufio.NewReader(idle).ReadByte(); err == nil {
+		t.Errorf("idle client still connected after the shutdown")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("server still accepting connections after the shutdown")
+	}
+}
+
+func TestShutdownNoSave(t *testing.T) {
+	dir := useTempDataDir(t)
+	updateConfig(t, func(c *Config) { c.SaveRules = []SaveRule{{Seconds: time.Hour, Changes: 1}} })
+	addr, stopped := startShutdownTestServer(t)
+
+	replies := sendUntilClosed(t, addr, []string{"*2\r\n$8\r\nSHUTDOWN\r\n$6\r\nNOSAVE\r\n", "*1\r\n$4\r\nPING\r\n"})
+	if len(replies) != 0 {
+		t.Fatalf("unexpected replies: %v", replies)
+	}
+	waitForStartServer(t, stopped)
+
+	if _, err := os.Stat(filepath.Join(dir, config().DBFilename)); !os.IsNotExist(err) {
+		t.Errorf("RDB file saved despite NOSAVE: %v", err)
+	}
+}
+
+func TestShutdownErrors(t *testing.T) {
+	useTempDataDir(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		command string
+		prefix  string
+	}{
+		{"*3\r\n$8\r\nSHUTDOWN\r\n$4\r\nSAVE\r\n$6\r\nNOSAVE\r\n", "-ERR syntax error"},
+		{"*2\r\n$8\r\nSHUTDOWN\r\n$5\r\nLATER\r\n", "-ERR syntax error"},
+		{"*3\r\n$8\r\nSHUTDOWN\r\n$5\r\nABORT\r\n$3\r\nNOW\r\n", "-ERR syntax error"},
+		{"*2\r\n$8\r\nSHUTDOWN\r\n$5\r\nABORT\r\n", "-ERR No shutdown in progress"},
+		// Connections served outside of StartServer
+		{"*1\r\n$8\r\nSHUTDOWN\r\n", "-ERR The server isn't running"},
+	}
+	for _, tt := range tests {
+		replies := dialAndSend(t, addr, []string{tt.command})
+		if len(replies) != 1 || !strings.HasPrefix(replies[0], tt.prefix) {
+			t.Errorf("%q: expected %q, got %v", tt.command, tt.prefix, replies)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package miniredis
+
+// SO_REUSEPORT, which the syscall package doesn't define
+const SO_REUSEPORT = 0x200
@@ -0,0 +1,114 @@
+package miniredis
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters of the server started with StartServer, reported by INFO and reset by CONFIG RESETSTAT.
+// Embedded servers don't count
+var stats struct {
+	connectionsReceived atomic.Int64
+	commandsProcessed   atomic.Int64
+	// Keys deleted because commands found them expired
+	expiredKeys atomic.Int64
+	// Lookups of commands reading keys that found the key, or didn't
+	keyspaceHits   atomic.Int64
+	keyspaceMisses atomic.Int64
+
+	// Commands processed per second, sampled by the server cron
+	opsPerSec instantaneousMetric
+}
+
+func resetStats() {
+	stats.connectionsReceived.Store(0)
+	stats.commandsProcessed.Store(0)
+	stats.expiredKeys.Store(0)
+	stats.keyspaceHits.Store(0)
+	stats.keyspaceMisses.Store(0)
+	stats.opsPerSec.reset()
+	resetCommandStats()
+}
+
+// Number of samples averaged by an instantaneous metric, taken SERVER_CRON_HZ times per second
+const STATS_METRIC_SAMPLES = 16
+
+// Rate at which a counter increased over the last samples, like Redis' instantaneous_ops_per_sec
+type instantaneousMetric struct {
+	mutex      sync.Mutex
+	lastSample time.Time
+	lastValue  int64
+	// Rates per second measured between consecutive samples
+	samples [STATS_METRIC_SAMPLES]float64
+	idx     int
+}
+
+// Samples the counter, whose value is value at now
+func (m *instantaneousMetric) track(value int64, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if elapsed := now.Sub(m.lastSample); !m.lastSample.IsZero() && elapsed > 0 {
+		m.samples[m.idx] = float64(value-m.lastValue) / elapsed.Seconds()
+		m.idx = (m.idx + 1) % STATS_METRIC_SAMPLES
+	}
+	m.lastSample = now
+	m.lastValue = value
+}
+
+// Average rate per second over the last samples
+func (m *instantaneousMetric) rate() float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var sum float64
+	for _, sample := range m.samples {
+		sum += sample
+	}
+	return sum / STATS_METRIC_SAMPLES
+}
+
+func (m *instantaneousMetric) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.samples = [STATS_METRIC_SAMPLES]float64{}
+	// The counter was reset too, so the next sample starts over
+	m.lastSample = time.Time{}
+}
+
+// Called by the server cron
+func trackInstantaneousMetrics(now time.Time) {
+	stats.opsPerSec.track(stats.commandsProcessed.Load(), now)
+}
+
+func statsInfo(*client) []infoField {
+	return []infoField{
+		{"total_connections_received", strconv.FormatInt(stats.connectionsReceived.Load(), 10)},
+		{"total_commands_processed", strconv.FormatInt(stats.commandsProcessed.Load(), 10)},
+		{"instantaneous_ops_per_sec", strconv.FormatInt(int64(stats.opsPerSec.rate()), 10)},
+		{"expired_keys", strconv.FormatInt(stats.expiredKeys.Load(), 10)},
+		{"keyspace_hits", strconv.FormatInt(stats.keyspaceHits.Load(), 10)},
+		{"keyspace_misses", strconv.FormatInt(stats.keyspaceMisses.Load(), 10)},
+	}
+}
+
+// Clients currently served by the event loops of the epoll and io_uring I/O models. The others
+// are served from goroutines, see servedClients
+var loopClients atomic.Int64
+
+// Number of client connections of the server started with StartServer, replicas excluded
+func connectedClients() int64 {
+	servedClients.mutex.Lock()
+	served := int64(len(servedClients.clients))
+	servedClients.mutex.Unlock()
+	repl.mutex.Lock()
+	replicas := int64(len(repl.replicas))
+	repl.mutex.Unlock()
+	return loopClients.Load() + served - replicas
+}
+
+func clientsInfo(*client) []infoField {
+	return []infoField{{"connected_clients", strconv.FormatInt(connectedClients(), 10)}}
+}
@@ -0,0 +1,110 @@
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// I/O models, see Config.IOModel
+const (
+	// A goroutine per connection, see HandleConnection
+	IO_MODEL_GOROUTINES = "goroutines"
+	// Non-blocking sockets served by epoll event loops, see eventloop_linux.go
+	IO_MODEL_EPOLL = "epoll"
+	// Event loops submitting their socket operations to io_uring, see uringserver_linux.go
+	IO_MODEL_IO_URING = "io_uring"
+)
+
+// Returned by the reads of a non-blocking socket with no data available
+var errWouldBlock = errors.New("operation would block")
+
+// Accepts the client connections and moves their data. Whatever the transport, requests are parsed by
+// a RESPReader reading from the connection and executed by executeCommands, which buffers the replies
+// in the RESPWriter of the client, so clients see the same behavior with every I/O model
+type transport interface {
+	// Port the transport accepts connections on
+	port() int
+	// I/O model of the transport, one of the IO_MODEL_* constants
+	model() string
+	// Whether a single thread executes the commands, owning the databases (see setKeyspaceOwned)
+	ownsKeyspace() bool
+	// Serves connections until close is called
+	serve() error
+	close()
+}
+
+// Listens on addr with the configured I/O model. When io_uring isn't available, the server falls back
+// to epoll, or to goroutines where epoll isn't available either
+func listenTransport(addr string) (transport, error) {
+	cfg := config()
+	switch cfg.IOModel {
+	case IO_MODEL_IO_URING:
+		t, err := listenUring(addr, cfg.EventLoopThreads)
+		if err == nil {
+			return t, nil
+		}
+		log.Printf("io_uring is not available (%v), falling back to the %s I/O model", err, IO_MODEL_EPOLL)
+		if t, err := listenEventLoops(addr, cfg.EventLoopThreads); err == nil {
+			return t, nil
+		} else {
+			log.Printf("epoll is not available (%v), falling back to the %s I/O model", err, IO_MODEL_GOROUTINES)
+		}
+	case IO_MODEL_EPOLL:
+		return listenEventLoops(addr, cfg.EventLoopThreads)
+	}
+	return listenGoroutines(addr)
+}
+
+// Serves each connection from a goroutine of its own with HandleConnection
+type goroutineTransport struct {
+	listener net.Listener
+}
+
+func listenGoroutines(addr string) (*goroutineTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	return &goroutineTransport{listener: listener}, nil
+}
+
+func (t *goroutineTransport) port() int {
+	if tcpAddr, ok := t.listener.Addr().(*net.TCPAddr); ok {
+		return tcpAddr.Port
+	}
+	return 0
+}
+
+func (t *goroutineTransport) model() string {
+	return IO_MODEL_GOROUTINES
+}
+
+func (t *goroutineTransport) ownsKeyspace() bool {
+	return false
+}
+
+func (t *goroutineTransport) serve() error {
+	for {
+		conn, err := t.listener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("failed to accept connection: %v", err)
+			continue
+		}
+
+		go func() {
+			if err := HandleConnection(conn); err != nil {
+				log.Printf("error handling connection: %v", err)
+			}
+		}()
+	}
+}
+
+func (t *goroutineTransport) close() {
+	t.listener.Close()
+}
@@ -0,0 +1,349 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package miniredis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// The io_uring kernel ABI, from include/uapi/linux/io_uring.h. The rings are shared with the kernel
+// through mmap, so they are used without cgo or liburing
+
+// System call numbers, the same on every architecture using the generic table
+const (
+	SYS_IO_URING_SETUP    = 425
+	SYS_IO_URING_ENTER    = 426
+	SYS_IO_URING_REGISTER = 427
+)
+
+const (
+	IORING_OFF_SQ_RING = 0
+	IORING_OFF_CQ_RING = 0x8000000
+	IORING_OFF_SQES    = 0x10000000
+
+	IORING_SETUP_CQSIZE       = 1 << 3
+	IORING_FEAT_SINGLE_MMAP   = 1 << 0
+	IORING_ENTER_GETEVENTS    = 1 << 0
+	IORING_REGISTER_PBUF_RING = 22
+
+	IORING_OP_POLL_ADD     = 6
+	IORING_OP_ACCEPT       = 13
+	IORING_OP_ASYNC_CANCEL = 14
+	IORING_OP_SEND         = 26
+	IORING_OP_RECV         = 27
+
+	// sqe.flags
+	IOSQE_BUFFER_SELECT = 1 << 5
+	// sqe.ioprio of accept and recv
+	IORING_ACCEPT_MULTISHOT = 1 << 0
+	IORING_RECV_MULTISHOT   = 1 << 1
+
+	// cqe.flags
+	IORING_CQE_F_BUFFER     = 1 << 0
+	IORING_CQE_F_MORE       = 1 << 1
+	IORING_CQE_BUFFER_SHIFT = 16
+)
+
+// Oldest kernel with everything used here: multishot accept and provided buffer rings came in 5.19,
+// multishot recv in 6.0
+const uringMinKernel = "6.0"
+
+// Submission queue entry (struct io_uring_sqe)
+type ioUringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+// Completion queue entry (struct io_uring_cqe)
+type ioUringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type ioSqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// struct io_uring_params
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSqringOffsets
+	cqOff                                                                  ioCqringOffsets
+}
+
+// struct io_uring_buf_reg, registering a provided buffer ring
+type ioUringBufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	resv        [3]uint64
+}
+
+// struct io_uring_buf, an entry of a provided buffer ring
+type ioUringBuf struct {
+	addr uint64
+	len  uint32
+	bid  uint16
+	// The tail of the ring overlaps this field of its first entry
+	resv uint16
+}
+
+// An io_uring instance, used by a single goroutine
+type ioUring struct {
+	fd     int
+	rings  [][]byte
+	sqHead *uint32
+	sqTail *uint32
+	sqMask uint32
+	sqes   []ioUringSQE
+	// Entries prepared since the last submission, published to the kernel by submit
+	sqLocalTail uint32
+	sqArray     []uint32
+	cqHead      *uint32
+	cqTail      *uint32
+	cqMask      uint32
+	cqes        []ioUringCQE
+}
+
+// Whether the running kernel is recent enough, io_uring being often built in but too old
+func uringKernelSupported() error {
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err != nil {
+		return err
+	}
+	release := make([]byte, 0, len(uname.Release))
+	for _, c := range uname.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	if compareKernelVersions(string(release), uringMinKernel) < 0 {
+		return fmt.Errorf("kernel %s is older than %s", release, uringMinKernel)
+	}
+	return nil
+}
+
+// Compares the major and minor numbers of kernel releases like "6.1.0-13-amd64"
+func compareKernelVersions(a, b string) int {
+	parse := func(release string) (int, int) {
+		fields := strings.FieldsFunc(release, func(r rune) bool { return r < '0' || r > '9' })
+		var numbers [2]int
+		for i := 0; i < len(numbers) && i < len(fields); i++ {
+			numbers[i], _ = strconv.Atoi(fields[i])
+		}
+		return numbers[0], numbers[1]
+	}
+	aMajor, aMinor := parse(a)
+	bMajor, bMinor := parse(b)
+	if aMajor != bMajor {
+		return aMajor - bMajor
+	}
+	return aMinor - bMinor
+}
+
+// Creates an io_uring with entries submission queue entries and four times as many completion queue entries
+func newIOUring(entries uint32) (*ioUring, error) {
+	params := ioUringParams{flags: IORING_SETUP_CQSIZE, cqEntries: 4 * entries}
+	fd, _, errno := syscall.Syscall(SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	ring := &ioUring{fd: int(fd)}
+
+	sqSize := int(params.sqOff.array) + int(params.sqEntries)*4
+	cqSize := int(params.cqOff.cqes) + int(params.cqEntries)*int(unsafe.Sizeof(ioUringCQE{}))
+	if params.features&IORING_FEAT_SINGLE_MMAP != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+	sq, err := syscall.Mmap(ring.fd, IORING_OFF_SQ_RING, sqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		ring.close()
+		return nil, fmt.Errorf("mapping the submission queue: %w", err)
+	}
+	ring.rings = append(ring.rings, sq)
+	cq := sq
+	if params.features&IORING_FEAT_SINGLE_MMAP == 0 {
+		if cq, err = syscall.Mmap(ring.fd, IORING_OFF_CQ_RING, cqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+			ring.close()
+			return nil, fmt.Errorf("mapping the completion queue: %w", err)
+		}
+		ring.rings = append(ring.rings, cq)
+	}
+	sqes, err := syscall.Mmap(ring.fd, IORING_OFF_SQES, int(params.sqEntries)*int(unsafe.Sizeof(ioUringSQE{})), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		ring.close()
+		return nil, fmt.Errorf("mapping the submission queue entries: %w", err)
+	}
+	ring.rings = append(ring.rings, sqes)
+
+	ring.sqHead = (*uint32)(unsafe.Pointer(&sq[params.sqOff.head]))
+	ring.sqTail = (*uint32)(unsafe.Pointer(&sq[params.sqOff.tail]))
+	ring.sqMask = *(*uint32)(unsafe.Pointer(&sq[params.sqOff.ringMask]))
+	ring.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&sq[params.sqOff.array])), params.sqEntries)
+	ring.sqes = unsafe.Slice((*ioUringSQE)(unsafe.Pointer(&sqes[0])), params.sqEntries)
+	ring.sqLocalTail = *ring.sqTail
+	ring.cqHead = (*uint32)(unsafe.Pointer(&cq[params.cqOff.head]))
+	ring.cqTail = (*uint32)(unsafe.Pointer(&cq[params.cqOff.tail]))
+	ring.cqMask = *(*uint32)(unsafe.Pointer(&cq[params.cqOff.ringMask]))
+	ring.cqes = unsafe.Slice((*ioUringCQE)(unsafe.Pointer(&cq[params.cqOff.cqes])), params.cqEntries)
+	return ring, nil
+}
+
+// Closes the ring, which cancels its pending requests, then unmaps its memory
+func (ring *ioUring) close() {
+	syscall.Close(ring.fd)
+	for _, mapping := range ring.rings {
+		syscall.Munmap(mapping)
+	}
+	ring.rings = nil
+}
+
+// Returns a cleared submission queue entry, submitting the prepared ones first when the queue is full
+func (ring *ioUring) getSQE() (*ioUringSQE, error) {
+	if ring.sqLocalTail-atomic.LoadUint32(ring.sqHead) == uint32(len(ring.sqes)) {
+		if err := ring.submit(0); err != nil {
+			return nil, err
+		}
+	}
+	index := ring.sqLocalTail & ring.sqMask
+	ring.sqArray[index] = index
+	ring.sqLocalTail++
+	sqe := &ring.sqes[index]
+	*sqe = ioUringSQE{}
+	return sqe, nil
+}
+
+// Submits the prepared entries in a single system call, waiting for at least waitFor completions
+func (ring *ioUring) submit(waitFor uint32) error {
+	atomic.StoreUint32(ring.sqTail, ring.sqLocalTail)
+	toSubmit := ring.sqLocalTail - atomic.LoadUint32(ring.sqHead)
+	var flags uintptr
+	if waitFor > 0 {
+		flags = IORING_ENTER_GETEVENTS
+	}
+	for {
+		_, _, errno := syscall.Syscall6(SYS_IO_URING_ENTER, uintptr(ring.fd), uintptr(toSubmit), uintptr(waitFor), flags, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return fmt.Errorf("io_uring_enter: %w", errno)
+		}
+		return nil
+	}
+}
+
+// Calls fn for every available completion, then hands their slots back to the kernel
+func (ring *ioUring) forEachCompletion(fn func(cqe *ioUringCQE)) {
+	head := *ring.cqHead
+	tail := atomic.LoadUint32(ring.cqTail)
+	for ; head != tail; head++ {
+		cqe := ring.cqes[head&ring.cqMask]
+		fn(&cqe)
+	}
+	atomic.StoreUint32(ring.cqHead, head)
+}
+
+// A ring of buffers the kernel picks from for the receives of a buffer group, so that memory is only
+// used by connections that have data, rather than by a buffer per connection
+type providedBuffers struct {
+	ring    []byte
+	entries []ioUringBuf
+	tail    *uint16
+	buffers []byte
+	size    int
+	group   uint16
+}
+
+// Registers count buffers of size bytes as group. count must be a power of two
+func (ring *ioUring) registerBuffers(group uint16, count int, size int) (*providedBuffers, error) {
+	mapping, err := syscall.Mmap(-1, 0, count*int(unsafe.Sizeof(ioUringBuf{})), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("allocating the buffer ring: %w", err)
+	}
+	buffers, err := syscall.Mmap(-1, 0, count*size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		syscall.Munmap(mapping)
+		return nil, fmt.Errorf("allocating the buffers: %w", err)
+	}
+	ring.rings = append(ring.rings, mapping, buffers)
+
+	reg := ioUringBufReg{ringAddr: uint64(uintptr(unsafe.Pointer(&mapping[0]))), ringEntries: uint32(count), bgid: group}
+	if _, _, errno := syscall.Syscall6(SYS_IO_URING_REGISTER, uintptr(ring.fd), IORING_REGISTER_PBUF_RING, uintptr(unsafe.Pointer(&reg)), 1, 0, 0); errno != 0 {
+		return nil, fmt.Errorf("registering the buffer ring: %w", errno)
+	}
+
+	entries := unsafe.Slice((*ioUringBuf)(unsafe.Pointer(&mapping[0])), count)
+	pb := &providedBuffers{
+		ring:    mapping,
+		entries: entries,
+		tail:    &entries[0].resv,
+		buffers: buffers,
+		size:    size,
+		group:   group,
+	}
+	for id := 0; id < count; id++ {
+		pb.recycle(uint16(id))
+	}
+	return pb, nil
+}
+
+// The data of buffer id
+func (pb *providedBuffers) buffer(id uint16) []byte {
+	return pb.buffers[int(id)*pb.size : (int(id)+1)*pb.size]
+}
+
+// Gives buffer id back to the kernel
+func (pb *providedBuffers) recycle(id uint16) {
+	tail := *pb.tail
+	entry := &pb.entries[int(tail)&(len(pb.entries)-1)]
+	entry.addr = uint64(uintptr(unsafe.Pointer(&pb.buffer(id)[0])))
+	entry.len = uint32(pb.size)
+	entry.bid = id
+	// The tail shares its memory with entry 0, which is why it is read before filling the entry
+	atomicStoreUint16(pb.tail, tail+1)
+}
+
+// sync/atomic has no 16 bits operations: store the 32 bits word holding the value, whose
+// other half is the bid of the first entry, which only this goroutine writes
+func atomicStoreUint16(p *uint16, v uint16) {
+	word := (*uint32)(unsafe.Add(unsafe.Pointer(p), -2))
+	old := atomic.LoadUint32(word)
+	if littleEndian {
+		atomic.StoreUint32(word, old&0xffff|uint32(v)<<16)
+	} else {
+		atomic.StoreUint32(word, old&0xffff0000|uint32(v))
+	}
+}
+
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
@@ -0,0 +1,32 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package miniredis
+
+import (
+	"fmt"
+)
+
+// The io_uring structures are only laid out for the Linux architectures it is tested on
+type uringServer struct{}
+
+func listenUring(addr string, threads int) (*uringServer, error) {
+	return nil, fmt.Errorf("the %s I/O model is not available on this platform", IO_MODEL_IO_URING)
+}
+
+func (s *uringServer) port() int {
+	return 0
+}
+
+func (s *uringServer) model() string {
+	return IO_MODEL_IO_URING
+}
+
+func (s *uringServer) ownsKeyspace() bool {
+	return false
+}
+
+func (s *uringServer) serve() error {
+	return nil
+}
+
+func (s *uringServer) close() {}
@@ -0,0 +1,555 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package miniredis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"slices"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Submission queue entries of each ring
+	URING_ENTRIES = 256
+	// Number and size of the buffers the kernel receives data into, shared by the connections of a ring
+	URING_BUFFERS     = 1024
+	URING_BUFFER_SIZE = 16 * 1024
+)
+
+// Kinds of requests, stored in the top byte of their user_data, the rest holding the connection ID
+const (
+	uringAccept = iota + 1
+	uringRecv
+	uringSend
+	uringCancel
+	uringWake
+)
+
+// Event loops like those of the epoll I/O model (see eventloop_linux.go), whose socket operations are
+// io_uring requests instead of system calls. A multishot accept gets all the connections, a multishot
+// recv per connection gets their data in buffers picked by the kernel from a provided buffer ring, and
+// the replies of all the connections are submitted as sends with a single io_uring_enter per iteration.
+// A single loop owns the databases the same way
+type uringServer struct {
+	loops      []*uringLoop
+	listenPort int
+}
+
+type uringLoop struct {
+	ring     *ioUring
+	buffers  *providedBuffers
+	listenFd int
+	// Pipe written to by close to stop the loop
+	wakeFds [2]int
+	conns   map[uint64]*uringConn
+	nextID  uint64
+	// Connections that executed commands during the current iteration, whose replies are sent before the next wait
+	active   []*uringConn
+	stopping bool
+	stopped  chan struct{}
+}
+
+// A connection served by a ring. Like loopConn, it is the reader and the writer of its client, reads
+// returning the data received so far and writes queueing the replies for the next sends
+type uringConn struct {
+	id     uint64
+	fd     int
+	client *client
+	reader *RESPReader
+	// Received data not read by reader yet, pointing into a provided buffer
+	input []byte
+	eof   bool
+	// Replies not submitted yet, and replies being sent by the kernel, which must stay untouched until then
+	output  []byte
+	sending []byte
+	// Whether the multishot recv of the connection is armed
+	receiving bool
+	active    bool
+	// Set once the connection must be closed, which happens when its replies are sent
+	closing  bool
+	shutdown bool
+	// Set when the connection moves to a goroutine, which happens once its recv is cancelled and its sends completed
+	handOff *uringHandOff
+}
+
+type uringHandOff struct {
+	commands []RESPCommand
+	readErr  error
+	// Data received after the commands, which the goroutine reads first
+	unread []byte
+}
+
+// Sets up threads rings, each with its own socket listening on addr. Fails when io_uring or the
+// features used here aren't available
+func listenUring(addr string, threads int) (*uringServer, error) {
+	if threads < 1 {
+		return nil, fmt.Errorf("invalid number of event loop threads %d", threads)
+	}
+	if err := uringKernelSupported(); err != nil {
+		return nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &uringServer{listenPort: tcpAddr.Port}
+	for i := 0; i < threads; i++ {
+		loop, port, err := newUringLoop(tcpAddr.IP, server.listenPort)
+		if err != nil {
+			for _, loop := range server.loops {
+				loop.release()
+			}
+			return nil, err
+		}
+		server.listenPort = port
+		server.loops = append(server.loops, loop)
+	}
+	return server, nil
+}
+
+func (s *uringServer) port() int {
+	return s.listenPort
+}
+
+func (s *uringServer) model() string {
+	return IO_MODEL_IO_URING
+}
+
+func (s *uringServer) ownsKeyspace() bool {
+	return len(s.loops) == 1
+}
+
+// Runs the loops until close is called
+func (s *uringServer) serve() error {
+	for _, loop := range s.loops {
+		go loop.run()
+	}
+	for _, loop := range s.loops {
+		<-loop.stopped
+	}
+	return nil
+}
+
+// Stops the loops, closing their connections
+func (s *uringServer) close() {
+	for _, loop := range s.loops {
+		syscall.Write(loop.wakeFds[1], []byte{0})
+	}
+}
+
+func newUringLoop(ip net.IP, port int) (loop *uringLoop, boundPort int, err error) {
+	loop = &uringLoop{
+		listenFd: -1,
+		wakeFds:  [2]int{-1, -1},
+		conns:    map[uint64]*uringConn{},
+		stopped:  make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			loop.release()
+		}
+	}()
+
+	if loop.ring, err = newIOUring(URING_ENTRIES); err != nil {
+		return nil, 0, err
+	}
+	if loop.buffers, err = loop.ring.registerBuffers(0, URING_BUFFERS, URING_BUFFER_SIZE); err != nil {
+		return nil, 0, err
+	}
+	if loop.listenFd, boundPort, err = listenSocket(ip, port); err != nil {
+		return nil, 0, err
+	}
+	if err = syscall.Pipe2(loop.wakeFds[:], syscall.O_CLOEXEC); err != nil {
+		return nil, 0, fmt.Errorf("creating the wake up pipe: %w", err)
+	}
+	return loop, boundPort, nil
+}
+
+func (l *uringLoop) run() {
+	// The loop is a thread of its own, like the main thread of Redis
+	runtime.LockOSThread()
+	defer close(l.stopped)
+	defer l.release()
+
+	if err := l.armAccept(); err != nil {
+		log.Printf("Event loop stopped: %v", err)
+		return
+	}
+	if err := l.prepare(uringWake, 0, func(sqe *ioUringSQE) {
+		sqe.opcode = IORING_OP_POLL_ADD
+		sqe.fd = int32(l.wakeFds[0])
+		sqe.opFlags = 1 // POLLIN
+	}); err != nil {
+		log.Printf("Event loop stopped: %v", err)
+		return
+	}
+
+	for {
+		// Submits everything prepared during the previous iteration, replies included
+		if err := l.ring.submit(1); err != nil {
+			log.Printf("Event loop stopped: %v", err)
+			return
+		}
+		acquired := acquireKeyspace()
+		l.ring.forEachCompletion(l.handleCompletion)
+		l.sendReplies()
+		releaseKeyspace(acquired)
+		if l.stopping {
+			// The replies of the commands executed last are submitted once more, at best
+			l.ring.submit(0)
+			return
+		}
+	}
+}
+
+// Prepares a request of kind for connection id, filled by fill. It is submitted at the next iteration
+func (l *uringLoop) prepare(kind uint64, id uint64, fill func(sqe *ioUringSQE)) error {
+	sqe, err := l.ring.getSQE()
+	if err != nil {
+		return err
+	}
+	fill(sqe)
+	sqe.userData = kind<<56 | id
+	return nil
+}
+
+func (l *uringLoop) armAccept() error {
+	return l.prepare(uringAccept, 0, func(sqe *ioUringSQE) {
+		sqe.opcode = IORING_OP_ACCEPT
+		sqe.fd = int32(l.listenFd)
+		sqe.ioprio = IORING_ACCEPT_MULTISHOT
+		sqe.opFlags = syscall.SOCK_CLOEXEC
+	})
+}
+
+func (l *uringLoop) armRecv(conn *uringConn) {
+	err := l.prepare(uringRecv, conn.id, func(sqe *ioUringSQE) {
+		sqe.opcode = IORING_OP_RECV
+		sqe.fd = int32(conn.fd)
+		sqe.flags = IOSQE_BUFFER_SELECT
+		sqe.ioprio = IORING_RECV_MULTISHOT
+		sqe.bufIndex = l.buffers.group
+	})
+	if err != nil {
+		l.closeConn(conn, err)
+		return
+	}
+	conn.receiving = true
+}
+
+// Submits a send of the queued replies, unless a send is in flight already
+func (l *uringLoop) queueSend(conn *uringConn) {
+	if len(conn.sending) > 0 || len(conn.output) == 0 {
+		return
+	}
+	// The buffer of the previous send is free again, it takes the next replies
+	conn.sending, conn.output = conn.output, conn.sending[:0]
+	l.submitSend(conn)
+}
+
+func (l *uringLoop) submitSend(conn *uringConn) {
+	err := l.prepare(uringSend, conn.id, func(sqe *ioUringSQE) {
+		sqe.opcode = IORING_OP_SEND
+		sqe.fd = int32(conn.fd)
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&conn.sending[0])))
+		sqe.len = uint32(len(conn.sending))
+		sqe.opFlags = syscall.MSG_NOSIGNAL
+	})
+	if err != nil {
+		l.closeConn(conn, err)
+	}
+}
+
+func (l *uringLoop) handleCompletion(cqe *ioUringCQE) {
+	kind, id := cqe.userData>>56, cqe.userData&(1<<56-1)
+	switch kind {
+	case uringWake:
+		l.stopping = true
+	case uringAccept:
+		if cqe.res >= 0 {
+			l.addConn(int(cqe.res))
+		} else if errno := syscall.Errno(-cqe.res); errno != syscall.ECANCELED {
+			log.Printf("failed to accept connection: %v", errno)
+		}
+		if cqe.flags&IORING_CQE_F_MORE == 0 && !l.stopping {
+			if err := l.armAccept(); err != nil {
+				log.Printf("failed to accept connection: %v", err)
+			}
+		}
+	case uringRecv:
+		conn := l.conns[id]
+		if conn == nil {
+			if cqe.flags&IORING_CQE_F_BUFFER != 0 {
+				l.buffers.recycle(uint16(cqe.flags >> IORING_CQE_BUFFER_SHIFT))
+			}
+			return
+		}
+		l.handleRecv(conn, cqe)
+	case uringSend:
+		if conn := l.conns[id]; conn != nil {
+			l.handleSent(conn, cqe.res)
+		}
+	}
+}
+
+func (l *uringLoop) addConn(fd int) {
+	// Like net.Conn, don't delay small replies
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+
+	l.nextID++
+	conn := &uringConn{id: l.nextID, fd: fd}
+	conn.reader = NewRESPReader(conn, RESP_READER_INITIAL_BUF_SIZE)
+	conn.client = newClient(NewRESPWriter(conn, RESP_WRITER_INITIAL_BUF_SIZE))
+	conn.client.servedByLoop = true
+	stats.connectionsReceived.Add(1)
+	l.conns[conn.id] = conn
+	loopClients.Add(1)
+	l.armRecv(conn)
+}
+
+func (l *uringLoop) handleRecv(conn *uringConn, cqe *ioUringCQE) {
+	if cqe.flags&IORING_CQE_F_MORE == 0 {
+		conn.receiving = false
+	}
+
+	switch {
+	case cqe.res > 0:
+		bid := uint16(cqe.flags >> IORING_CQE_BUFFER_SHIFT)
+		data := l.buffers.buffer(bid)[:cqe.res]
+		if conn.handOff != nil {
+			conn.handOff.unread = append(conn.handOff.unread, data...)
+		} else if !conn.closing {
+			conn.input = data
+			l.readCommands(conn)
+		}
+		conn.input = nil
+		l.buffers.recycle(bid)
+	case cqe.res == 0:
+		conn.eof = true
+		if conn.handOff == nil && !conn.closing {
+			l.readCommands(conn)
+		}
+	case syscall.Errno(-cqe.res) == syscall.ENOBUFS || syscall.Errno(-cqe.res) == syscall.ECANCELED:
+		// Out of buffers the recv is armed again below, once they were recycled
+	default:
+		if conn.handOff == nil && !conn.closing {
+			conn.output = nil
+			l.closeWhenSent(conn, fmt.Errorf("reading commands: %w", syscall.Errno(-cqe.res)))
+		}
+	}
+
+	if conn.receiving || l.conns[conn.id] != conn {
+		return
+	}
+	switch {
+	case conn.handOff != nil:
+		l.tryHandOff(conn)
+	case conn.closing:
+		l.tryClose(conn)
+	case !conn.eof:
+		l.armRecv(conn)
+	}
+}
+
+// Executes the commands completed by the received data. Their replies are buffered until the end
+// of the iteration, so that the writes of the whole iteration reach the AOF first
+func (l *uringLoop) readCommands(conn *uringConn) {
+	c := conn.client
+	for {
+		commands, readErr := conn.reader.ReadCommands()
+		wouldBlock := errors.Is(readErr, errWouldBlock)
+		if wouldBlock {
+			readErr = nil
+		}
+
+		// Blocking commands would stall every client of the loop, so the connection is moved to a goroutine first
+		if i := slices.IndexFunc(commands, func(cmd RESPCommand) bool { return cmd.Type.isBlocking() }); i >= 0 {
+			if done, err := executeCommands(c, commands[:i], nil); done {
+				l.closeWhenSent(conn, err)
+				return
+			}
+			l.startHandOff(conn, commands[i:], readErr)
+			return
+		}
+
+		if done, err := executeCommands(c, commands, readErr); done {
+			l.closeWhenSent(conn, err)
+			return
+		}
+		if len(commands) > 0 && !conn.active {
+			conn.active = true
+			l.active = append(l.active, conn)
+		}
+		if wouldBlock {
+			return
+		}
+	}
+}
+
+// Sends the replies buffered during the iteration, like the beforeSleep of Redis
+func (l *uringLoop) sendReplies() {
+	if len(l.active) == 0 {
+		return
+	}
+
+	// Write commands must reach the AOF before their replies are sent
+	if err := flushAppendOnlyFile(); err != nil {
+		log.Printf("Error writing to the AOF: %v", err)
+	}
+
+	for _, conn := range l.active {
+		conn.active = false
+		if l.conns[conn.id] != conn || conn.closing || conn.handOff != nil {
+			continue
+		}
+		conn.client.writer.writer.Flush()
+		l.queueSend(conn)
+	}
+	clear(l.active)
+	l.active = l.active[:0]
+}
+
+func (l *uringLoop) handleSent(conn *uringConn, res int32) {
+	if res < 0 {
+		conn.sending = nil
+		conn.output = nil
+		if !conn.closing {
+			l.closeWhenSent(conn, fmt.Errorf("flushing: %w", syscall.Errno(-res)))
+		} else {
+			l.tryClose(conn)
+		}
+		return
+	}
+
+	if conn.sending = conn.sending[res:]; len(conn.sending) > 0 {
+		l.submitSend(conn)
+		return
+	}
+	switch {
+	case conn.handOff != nil:
+		l.tryHandOff(conn)
+	case conn.closing:
+		l.tryClose(conn)
+	default:
+		l.queueSend(conn)
+	}
+}
+
+// Stops executing the commands of the connection, and closes it once the replies already buffered are sent.
+// err is the reason the connection is closed, if it isn't a normal close
+func (l *uringLoop) closeWhenSent(conn *uringConn, err error) {
+	if err != nil {
+		log.Printf("error handling connection: %v", err)
+	}
+	conn.closing = true
+	l.tryClose(conn)
+}
+
+// Closes a closing connection once its replies are sent and its recv completed. Shutting the socket
+// down ends the recv
+func (l *uringLoop) tryClose(conn *uringConn) {
+	if len(conn.sending) > 0 {
+		return
+	}
+	if len(conn.output) > 0 {
+		l.queueSend(conn)
+		return
+	}
+	if conn.receiving {
+		if !conn.shutdown {
+			conn.shutdown = true
+			syscall.Shutdown(conn.fd, syscall.SHUT_RDWR)
+		}
+		return
+	}
+	l.closeConn(conn, nil)
+}
+
+func (l *uringLoop) closeConn(conn *uringConn, err error) {
+	if err != nil {
+		log.Printf("error handling connection: %v", err)
+	}
+	l.removeConn(conn)
+	syscall.Close(conn.fd)
+}
+
+// Stops serving the connection from the loop
+func (l *uringLoop) removeConn(conn *uringConn) {
+	if l.conns[conn.id] == conn {
+		delete(l.conns, conn.id)
+		loopClients.Add(-1)
+	}
+}
+
+// Starts moving the connection to a goroutine, for commands that may block their client: its recv is
+// cancelled, and once it completed along with the sends in flight, the goroutine takes the socket over
+func (l *uringLoop) startHandOff(conn *uringConn, commands []RESPCommand, readErr error) {
+	// The commands point into the buffer of the reader, which isn't used again until the goroutine takes it
+	conn.handOff = &uringHandOff{commands: commands, readErr: readErr, unread: slices.Clone(conn.input)}
+	conn.input = nil
+	if conn.receiving {
+		err := l.prepare(uringCancel, conn.id, func(sqe *ioUringSQE) {
+			sqe.opcode = IORING_OP_ASYNC_CANCEL
+			sqe.addr = uringRecv<<56 | conn.id
+		})
+		if err != nil {
+			l.closeConn(conn, err)
+		}
+		return
+	}
+	l.tryHandOff(conn)
+}
+
+func (l *uringLoop) tryHandOff(conn *uringConn) {
+	if conn.receiving || len(conn.sending) > 0 {
+		return
+	}
+	l.removeConn(conn)
+
+	flushAppendOnlyFile()
+	conn.client.writer.writer.Flush()
+	handOff := conn.handOff
+	serveFromGoroutine(conn.fd, conn.client, conn.reader, conn.output, handOff.unread, handOff.commands, handOff.readErr)
+}
+
+// Releases the ring, the file descriptors of the loop and closes its connections
+func (l *uringLoop) release() {
+	for _, conn := range l.conns {
+		syscall.Close(conn.fd)
+	}
+	loopClients.Add(-int64(len(l.conns)))
+	clear(l.conns)
+	if l.ring != nil {
+		l.ring.close()
+	}
+	for _, fd := range []int{l.listenFd, l.wakeFds[0], l.wakeFds[1]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+func (conn *uringConn) Read(p []byte) (int, error) {
+	if len(conn.input) > 0 {
+		n := copy(p, conn.input)
+		conn.input = conn.input[n:]
+		return n, nil
+	}
+	if conn.eof {
+		return 0, io.EOF
+	}
+	return 0, errWouldBlock
+}
+
+// Queues p, which is sent at the end of the iteration
+func (conn *uringConn) Write(p []byte) (int, error) {
+	conn.output = append(conn.output, p...)
+	return len(p), nil
+}
@@ -0,0 +1,48 @@
+//go:build test && linux && !mips && !mipsle && !mips64 && !mips64le
+// +build test,linux,!mips,!mipsle,!mips64,!mips64le
+
+package miniredis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompareKernelVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"6.0", "6.0", 0},
+		{"6.18.44-fc-v139", "6.0", 1},
+		{"5.15.0-91-generic", "6.0", -1},
+		{"6.0.0", "6.0", 0},
+		{"10.1", "9.12", 1},
+	}
+
+	for _, tt := range tests {
+		got := compareKernelVersions(tt.a, tt.b)
+		if got > 0 {
+			got = 1
+		} else if got < 0 {
+			got = -1
+		}
+		if got != tt.want {
+			t.Errorf("compareKernelVersions(%q, %q) sign = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestUring(t *testing.T) {
+	for _, threads := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d threads", threads), func(t *testing.T) {
+			rings, err := listenUring("127.0.0.1:0", threads)
+			if err != nil {
+				t.Skipf("io_uring is not available: %v", err)
+			}
+			addr, cleanup := startTransportTestServer(t, rings)
+			defer cleanup()
+			testTransport(t, addr)
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package miniredis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Wakes up every goroutine waiting on it at once. Waiters take the channel before checking
+// their condition, so a notification sent in between isn't missed
+type notifier struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{ch: make(chan struct{})}
+}
+
+// Channel closed at the next notify
+func (n *notifier) wait() <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// Notified when a replica acknowledges an offset or the local AOF is fsynced
+var ackNotifier = newNotifier()
+
+// Blocks until done returns true or the timeout expires. A zero timeout waits forever
+func waitForAcks(timeout time.Duration, done func() bool) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		wake := ackNotifier.wait()
+		if done() {
+			return
+		}
+		select {
+		case <-wake:
+		case <-expired:
+			return
+		}
+	}
+}
+
+// Number of replicas that acknowledged offset, as processed or as fsynced to their AOF
+func countReplicasAcked(offset int64, aof bool) int64 {
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+
+	var count int64
+	for r := range repl.replicas {
+		r.mutex.Lock()
+		acked := r.ackOffset
+		if aof {
+			acked = r.aofAckOffset
+		}
+		r.mutex.Unlock()
+		if acked >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// Asks the replicas to acknowledge their offset now rather than at the next replicationCron
+func requestAcks() {
+	propagationMutex.Lock()
+	defer propagationMutex.Unlock()
+
+	repl.mutex.Lock()
+	hasReplicas := len(repl.replicas) > 0
+	repl.mutex.Unlock()
+	if hasReplicas {
+		feedReplication(-1, [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})
+	}
+}
+
+func parseWaitTimeout(arg *RESPData) (time.Duration, error) {
+	timeout, err := ExtractInt64(arg)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("timeout is negative")
+	}
+	return time.Duration(timeout) * time.Millisecond, nil
+}
+
+// WAIT numreplicas timeout: blocks until numreplicas replicas acknowledged the last write of the
+// connection, or timeout milliseconds passed (0 waits forever). Replies with the number of replicas
+// that acknowledged it
+func handleWait(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("WAIT command requires exactly 2 arguments")
+	}
+	if isReplica() {
+		return nil, fmt.Errorf("WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+
+	numReplicas, err := ExtractInt64(&args[0])
+	if err != nil {
+		return nil, errNotInteger
+	}
+	timeout, err := parseWaitTimeout(&args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if acked := countReplicasAcked(c.woff, false); acked >= numReplicas {
+		return &IntegerData{data: acked}, nil
+	}
+
+	requestAcks()
+	var acked int64
+	waitForAcks(timeout, func() bool {
+		acked = countReplicasAcked(c.woff, false)
+		return acked >= numReplicas
+	})
+	return &IntegerData{data: acked}, nil
+}
+
+// WAITAOF numlocal numreplicas timeout: blocks until the last write of the connection was fsynced to
+// the local AOF (when numlocal is 1) and to the AOF of numreplicas replicas, or timeout milliseconds
+// passed (0 waits forever). Replies with whether the local AOF has it and the number of replicas that do
+func handleWaitaof(c *client, args []RESPData) (MiniRedisData, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("WAITAOF command requires exactly 3 arguments")
+	}
+	if isReplica() {
+		return nil, fmt.Errorf("WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+
+	numLocal, err := ExtractInt64(&args[0])
+	if err != nil {
+		return nil, errNotInteger
+	}
+	numReplicas, err := ExtractInt64(&args[1])
+	if err != nil {
+		return nil, errNotInteger
+	}
+	timeout, err := parseWaitTimeout(&args[2])
+	if err != nil {
+		return nil, err
+	}
+	if numLocal > 0 && !aofEnabled() {
+		return nil, fmt.Errorf("WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+
+	// Writes of this connection are still in the AOF buffer, as replies are flushed after the batch
+	if err := flushAppendOnlyFile(); err != nil {
+		return nil, fmt.Errorf("writing to the AOF: %w", err)
+	}
+
+	var local, acked int64
+	done := func() bool {
+		local = 0
+		if aofFsyncedOffset() >= c.woff {
+			local = 1
+		}
+		acked = countReplicasAcked(c.woff, true)
+		return local >= numLocal && acked >= numReplicas
+	}
+	if !done() {
+		requestAcks()
+		waitForAcks(timeout, done)
+	}
+	return &ArrayReply{data: []MiniRedisData{&IntegerData{data: local}, &IntegerData{data: acked}}}, nil
+}
@@ -0,0 +1,131 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a command with respClient and returns its reply
+func callCommand(t *testing.T, client *respClient, args ...string) RESPData {
+	t.Helper()
+	request := make([][]byte, len(args))
+	for i, arg := range args {
+		request[i] = []byte(arg)
+	}
+	reply, err := client.call(request...)
+	if err != nil {
+		t.Fatalf("%s error: %v", strings.Join(args, " "), err)
+	}
+	return reply
+}
+
+func TestWait(t *testing.T) {
+	useEmptyDatabases(t)
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	key := "wait_key"
+	defer database(0).Delete(&key)
+
+	client, err := dialRESP(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		want int64
+	}{
+		{name: "no replicas needed", args: []string{"WAIT", "0", "0"}, want: 0},
+		{name: "times out without replicas", args: []string{"WAIT", "1", "50"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := callCommand(t, client, tt.args...)
+			if got, ok := reply.(*RESPInteger); !ok || got.data != tt.want {
+				t.Errorf("%s = %#v, want %d", strings.Join(tt.args, " "), reply, tt.want)
+			}
+		})
+	}
+
+	if _, err := client.call([]byte("WAIT"), []byte("1"), []byte("-1")); err == nil || !strings.Contains(err.Error(), "timeout is negative") {
+		t.Errorf("WAIT with a negative timeout error = %v, want timeout is negative", err)
+	}
+
+	// A replica that only acknowledges when asked with GETACK
+	conn, reader, line := sendPsync(t, addr, "?", -1)
+	defer conn.Close()
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("PSYNC reply = %q, want +FULLRESYNC <replid> <offset>", line)
+	}
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+	header, _ := reader.ReadString('\n')
+	size, _ := strconv.Atoi(strings.TrimRight(header[1:], "\r\n"))
+	if _, err := io.ReadFull(reader, make([]byte, size)); err != nil {
+		t.Fatalf("reading snapshot: %v", err)
+	}
+	go func() {
+		for {
+			args, n, err := readMultibulk(reader)
+			if err != nil {
+				return
+			}
+			if len(args) >= 2 && string(args[0]) == "REPLCONF" && string(args[1]) == "GETACK" {
+				conn.Write(catCommand(nil, [][]byte{[]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(offset, 10))}))
+			}
+			offset += n
+		}
+	}()
+
+	callCommand(t, client, "SET", key, "v")
+	start := time.Now()
+	reply := callCommand(t, client, "WAIT", "1", "2000")
+	if got, ok := reply.(*RESPInteger); !ok || got.data != 1 {
+		t.Errorf("WAIT 1 2000 after a write = %#v, want 1", reply)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("WAIT returned after %v, want as soon as the replica acknowledged", elapsed)
+	}
+}
+
+func TestWaitaof(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	key := "waitaof_key"
+	defer database(0).Delete(&key)
+
+	client, err := dialRESP(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialRESP() error: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.call([]byte("WAITAOF"), []byte("1"), []byte("0"), []byte("0")); err == nil || !strings.Contains(err.Error(), "appendonly is disabled") {
+		t.Errorf("WAITAOF 1 without an AOF error = %v, want appendonly is disabled", err)
+	}
+
+	useTempAppendOnlyFile(t)
+	updateConfig(t, func(c *Config) { c.AppendFsync = AOF_FSYNC_ALWAYS })
+
+	callCommand(t, client, "SET", key, "v")
+	reply := callCommand(t, client, "WAITAOF", "1", "0", "0")
+	array, ok := reply.(*RESPArray)
+	if !ok || len(array.data) != 2 {
+		t.Fatalf("WAITAOF 1 0 0 = %#v, want a 2 elements array", reply)
+	}
+	want := []RESPData{&RESPInteger{data: 1}, &RESPInteger{data: 0}}
+	if !reflect.DeepEqual(array.data, want) {
+		t.Errorf("WAITAOF 1 0 0 = %#v, want [1 0]", array.data)
+	}
+}
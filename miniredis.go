@@ -0,0 +1,127 @@
+// Package miniredis runs in-memory Redis servers inside Go programs, to test code talking to Redis
+// without a redis-server process:
+//
+//	s, err := miniredis.Run()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer s.Close()
+//
+//	// Point the code under test at s.Addr(), then check what it stored
+//	s.CheckGet(t, "user:1", "alice")
+//
+// Expiries are checked against a clock of the server, which FastForward and SetTime move, so TTLs are
+// tested without sleeping.
+//
+// Every Server has databases of its own. They aren't persisted or replicated, and the commands
+// managing persistence, replication or the cluster reply with an error.
+package miniredis
+
+import (
+	"time"
+
+	server "github.com/mrtonbrian/miniredis/internal/miniredis"
+)
+
+// An in-memory Redis server
+type Server struct {
+	s *server.Server
+}
+
+var (
+	// Returned by Get for keys that don't exist
+	ErrKeyNotFound = server.ErrKeyNotFound
+	// Returned by Get for keys that don't hold a string
+	ErrWrongType = server.ErrWrongType
+)
+
+// The part of testing.TB used by the Check helpers
+type T interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// Creates a server that isn't accepting connections yet, see Start
+func NewServer() *Server {
+	return &Server{s: server.NewServer()}
+}
+
+// Creates a server and starts it
+func Run() (*Server, error) {
+	s := NewServer()
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Starts accepting connections on a port of 127.0.0.1 picked by the system, see Addr
+func (s *Server) Start() error {
+	return s.s.Start()
+}
+
+// Starts accepting connections on addr, as "host:port"
+func (s *Server) StartAddr(addr string) error {
+	return s.s.StartAddr(addr)
+}
+
+// Address the server accepts connections on, as "host:port". Empty when the server isn't started
+func (s *Server) Addr() string {
+	return s.s.Addr()
+}
+
+// Stops accepting connections and closes the connected clients. The data is kept, so the server
+// can be started again
+func (s *Server) Close() {
+	s.s.Close()
+}
+
+// Changes the database the helpers work on (0 by default). Clients still start in database 0
+func (s *Server) Select(db int) error {
+	return s.s.Select(db)
+}
+
+// Moves the clock of the server forward by d and deletes the keys expiring in the meantime, so
+// expiries can be tested without sleeping
+func (s *Server) FastForward(d time.Duration) {
+	s.s.FastForward(d)
+}
+
+// Stops the clock of the server at t and deletes the keys expired at t. The clock then only moves
+// with FastForward, so TTLs and expiries are the same on every run
+func (s *Server) SetTime(t time.Time) {
+	s.s.SetTime(t)
+}
+
+// Sets key to the string value without an expiry, as SET does
+func (s *Server) Set(key, value string) {
+	s.s.Set(key, value)
+}
+
+// Value of the string stored at key, ErrKeyNotFound when it doesn't exist and ErrWrongType
+// when it holds another type
+func (s *Server) Get(key string) (string, error) {
+	return s.s.Get(key)
+}
+
+// Reports an error to t unless key holds the string expected
+func (s *Server) CheckGet(t T, key, expected string) {
+	t.Helper()
+	s.s.CheckGet(t, key, expected)
+}
+
+// Sorted names of the keys that didn't expire
+func (s *Server) Keys() []string {
+	return s.s.Keys()
+}
+
+// Empties every database, as FLUSHALL does
+func (s *Server) FlushAll() {
+	s.s.FlushAll()
+}
+
+// Lists the keys and their values, a line per key sorted by name, e.g. to log the contents
+// of the server when a test fails
+func (s *Server) Dump() string {
+	return s.s.Dump()
+}
@@ -0,0 +1,209 @@
+//go:build test
+// +build test
+
+package miniredis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a command to addr and returns the first line of the reply
+func sendCommand(t *testing.T, addr string, args ...string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	// Bulk strings: return the value instead of its length
+	if strings.HasPrefix(line, "$") && line != "$-1\r\n" {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatalf("ReadString() error: %v", err)
+		}
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestServer(t *testing.T) {
+	s, err := Run()
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	defer s.Close()
+	if !strings.HasPrefix(s.Addr(), "127.0.0.1:") {
+		t.Errorf("Addr() = %q, want 127.0.0.1:<port>", s.Addr())
+	}
+
+	// Writes of clients are seen by the helpers and the other way around
+	sendCommand(t, s.Addr(), "SET", "from_client", "1")
+	s.CheckGet(t, "from_client", "1")
+	s.Set("from_helper", "2")
+	if got := sendCommand(t, s.Addr(), "GET", "from_helper"); got != "2" {
+		t.Errorf("GET from_helper = %q, want 2", got)
+	}
+
+	if got := s.Keys(); !reflect.DeepEqual(got, []string{"from_client", "from_helper"}) {
+		t.Errorf("Keys() = %q", got)
+	}
+	if got, want := s.Dump(), "- from_client: \"1\"\n- from_helper: \"2\"\n"; got != want {
+		t.Errorf("Dump() = %q, want %q", got, want)
+	}
+	if _, err := s.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("Get(missing) error = %v, want ErrKeyNotFound", err)
+	}
+
+	// Persistence and replication belong to the standalone server
+	if got := sendCommand(t, s.Addr(), "SAVE"); got != "-ERR SAVE is not supported by embedded servers" {
+		t.Errorf("SAVE = %q", got)
+	}
+
+	if err := s.Select(1); err != nil {
+		t.Fatalf("Select() error: %v", err)
+	}
+	if got := s.Keys(); len(got) != 0 {
+		t.Errorf("Keys() in database 1 = %q, want none", got)
+	}
+	if err := s.Select(16); err == nil {
+		t.Errorf("Select(16) succeeded")
+	}
+	if err := s.Select(0); err != nil {
+		t.Fatalf("Select() error: %v", err)
+	}
+
+	s.FlushAll()
+	if got := s.Keys(); len(got) != 0 {
+		t.Errorf("Keys() after FlushAll() = %q, want none", got)
+	}
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	first, err := Run()
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	defer first.Close()
+	second, err := Run()
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	defer second.Close()
+
+	first.Set("key", "first")
+	if _, err := second.Get("key"); err != ErrKeyNotFound {
+		t.Errorf("Get() on the second server error = %v, want ErrKeyNotFound", err)
+	}
+	if got := sendCommand(t, second.Addr(), "GET", "key"); got != "$-1" {
+		t.Errorf("GET on the second server = %q, want nil", got)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s, err := Run()
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	s.Set("key", "kept")
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+	addr := s.Addr()
+
+	s.Close()
+	if s.Addr() != "" {
+		t.Errorf("Addr() after Close() = %q, want empty", s.Addr())
+	}
+	// The connected client is closed, and no new client is accepted
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection still open after Close()")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("connection accepted after Close()")
+	}
+
+	// Restarting keeps the data
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer s.Close()
+	if got := sendCommand(t, s.Addr(), "GET", "key"); got != "kept" {
+		t.Errorf("GET after restart = %q, want kept", got)
+	}
+}
+
+func TestServerClock(t *testing.T) {
+	s, err := Run()
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	defer s.Close()
+
+	// A stopped clock gives the same TTLs on every run
+	s.SetTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	sendCommand(t, s.Addr(), "SET", "session", "v", "EX", "10")
+	sendCommand(t, s.Addr(), "SET", "deadline", "v", "EXAT", strconv.FormatInt(time.Date(2030, 1, 1, 0, 1, 0, 0, time.UTC).Unix(), 10))
+
+	tests := []struct {
+		forward  time.Duration
+		wantPTTL string
+		wantKeys []string
+	}{
+		{0, ":10000", []string{"deadline", "session"}},
+		{4 * time.Second, ":6000", []string{"deadline", "session"}},
+		// Expired keys are deleted right away, without being accessed
+		{6 * time.Second, ":-2", []string{"deadline"}},
+		{time.Minute, ":-2", []string{}},
+	}
+	for _, tt := range tests {
+		s.FastForward(tt.forward)
+		if got := sendCommand(t, s.Addr(), "PTTL", "session"); got != tt.wantPTTL {
+			t.Errorf("PTTL after %v = %q, want %q", tt.forward, got, tt.wantPTTL)
+		}
+		if got := s.Keys(); !reflect.DeepEqual(got, tt.wantKeys) {
+			t.Errorf("Keys() after %v = %q, want %q", tt.forward, got, tt.wantKeys)
+		}
+	}
+}
+
+func TestServerFastForward(t *testing.T) {
+	s, err := Run()
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	defer s.Close()
+
+	// Without SetTime, the clock follows the system time moved by FastForward
+	sendCommand(t, s.Addr(), "SET", "key", "v", "PX", "60000")
+	s.FastForward(59 * time.Second)
+	s.CheckGet(t, "key", "v")
+	s.FastForward(time.Second)
+	if got := sendCommand(t, s.Addr(), "GET", "key"); got != "$-1" {
+		t.Errorf("GET after the TTL = %q, want nil", got)
+	}
+}